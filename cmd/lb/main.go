@@ -0,0 +1,43 @@
+// Command lb runs the load balancer. "lb lint [flags]" checks the
+// configuration instead, and "lb tunnel [flags]" runs the reverse tunnel
+// agent next to a backend.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/iamyusuf/own_lb/pkg/loadbalancer"
+)
+
+func main() {
+	args := os.Args[1:]
+
+	// "lb tunnel [flags]" runs the reverse tunnel agent next to a backend
+	if len(args) > 0 && args[0] == "tunnel" {
+		if err := loadbalancer.RunTunnelAgent(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// "lb lint [flags]" checks the configuration instead of running
+	lintMode := len(args) > 0 && args[0] == "lint"
+	if lintMode {
+		args = args[1:]
+	}
+
+	// Parse command line flags
+	cfg, err := loadbalancer.ParseConfig(flag.CommandLine, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if lintMode {
+		os.Exit(loadbalancer.Lint(cfg, os.Stdout))
+	}
+	if err := loadbalancer.Run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,386 @@
+//go:build integration
+
+// The integration suite runs the load balancer binary in front of real
+// backends started in Docker containers:
+//
+//	cd integration && go test -tags integration -run Integration -v ./...
+//
+// Tests are skipped when no Docker daemon is reachable. The suite is a
+// module of its own so that the library does not depend on dockertest.
+package integration
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+var (
+	// dockerPool is nil when Docker is not available
+	dockerPool *dockertest.Pool
+
+	// lbBinary is the load balancer built for the suite
+	lbBinary string
+)
+
+func TestMain(m *testing.M) {
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err == nil {
+		pool.MaxWait = 2 * time.Minute
+		dockerPool = pool
+	} else {
+		fmt.Fprintf(os.Stderr, "Docker is not available, skipping integration tests: %s\n", err)
+	}
+
+	dir, err := os.MkdirTemp("", "lb-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	lbBinary = filepath.Join(dir, "lb")
+	build := exec.Command("go", "build", "-o", lbBinary, "./cmd/lb")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build the load balancer: %s\n%s", err, out)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startContainer runs an image and returns the host address of its port
+// once it accepts connections
+func startContainer(t *testing.T, repository, tag, port string, cmd ...string) (*dockertest.Resource, string) {
+	t.Helper()
+	if dockerPool == nil {
+		t.Skip("Docker is not available")
+	}
+	resource, err := dockerPool.RunWithOptions(&dockertest.RunOptions{
+		Repository:   repository,
+		Tag:          tag,
+		Cmd:          cmd,
+		ExposedPorts: []string{port},
+	}, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		t.Fatalf("Failed to start %s:%s: %s", repository, tag, err)
+	}
+	resource.Expire(300)
+	t.Cleanup(func() { dockerPool.Purge(resource) })
+
+	addr := resource.GetHostPort(port)
+	if err := dockerPool.Retry(func() error { return dialOnce(addr) }); err != nil {
+		t.Fatalf("%s:%s did not start listening: %s", repository, tag, err)
+	}
+	return resource, addr
+}
+
+// startLB runs the load balancer on a free port with the arguments and
+// returns its address once it accepts connections
+func startLB(t *testing.T, args ...string) string {
+	t.Helper()
+	addr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(addr)
+	cmd := exec.Command(lbBinary, append([]string{"-port", port}, args...)...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = io.Discard
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the load balancer: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	waitFor(t, 10*time.Second, "the load balancer to listen", func() bool { return dialOnce(addr) == nil })
+	return addr
+}
+
+// freeAddr returns a local address with a currently free port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialOnce checks that the address accepts a connection
+func dialOnce(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// waitFor polls the condition until it holds or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// backendsAlive returns the alive state of every backend from the admin API
+func backendsAlive(t *testing.T, lbAddr string) map[string]bool {
+	t.Helper()
+	resp, err := http.Get("http://" + lbAddr + "/lb-admin/backends")
+	if err != nil {
+		t.Fatalf("Failed to query backends: %s", err)
+	}
+	defer resp.Body.Close()
+	var backends []struct {
+		URL   string `json:"url"`
+		Alive bool   `json:"alive"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&backends); err != nil {
+		t.Fatalf("Failed to decode backends: %s", err)
+	}
+	alive := make(map[string]bool)
+	for _, backend := range backends {
+		alive[strings.TrimPrefix(strings.TrimPrefix(backend.URL, "http://"), "tcp://")] = backend.Alive
+	}
+	return alive
+}
+
+func TestIntegrationHTTPProxy(t *testing.T) {
+	_, first := startContainer(t, "nginx", "1.27-alpine", "80/tcp")
+	_, second := startContainer(t, "nginx", "1.27-alpine", "80/tcp")
+	lb := startLB(t, "-server", "http://"+first, "-server", "http://"+second)
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get("http://" + lb + "/")
+		if err != nil {
+			t.Fatalf("Request %d failed: %s", i+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Welcome to nginx") {
+			t.Fatalf("Expected the nginx welcome page, got %d %q", resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get("http://" + lb + "/lb-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, backend := range []string{first, second} {
+		if !strings.Contains(string(stats), backend+": 2 requests") {
+			t.Errorf("Expected 2 requests to %s, got:\n%s", backend, stats)
+		}
+	}
+}
+
+func TestIntegrationHealthChecks(t *testing.T) {
+	_, healthy := startContainer(t, "nginx", "1.27-alpine", "80/tcp")
+	failing, stopped := startContainer(t, "nginx", "1.27-alpine", "80/tcp")
+	lb := startLB(t, "-server", "http://"+healthy, "-server", "http://"+stopped,
+		"-interval", "1", "-health-jitter", "0", "-health-fall", "1", "-health-rise", "1")
+
+	if err := dockerPool.Client.StopContainer(failing.Container.ID, 5); err != nil {
+		t.Fatalf("Failed to stop the backend: %s", err)
+	}
+	waitFor(t, 15*time.Second, "the stopped backend to be marked down", func() bool {
+		alive := backendsAlive(t, lb)
+		return alive[healthy] && !alive[stopped]
+	})
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get("http://" + lb + "/")
+		if err != nil {
+			t.Fatalf("Request %d failed: %s", i+1, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected requests to go to the healthy backend, got %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestIntegrationGRPCHealthCheck(t *testing.T) {
+	// The grpc-java hostname example serves grpc.health.v1.Health
+	_, backend := startContainer(t, "grpc/java-example-hostname", "latest", "50051/tcp")
+
+	lb := startLB(t, "-server", "http://"+backend, "-health-type", "grpc",
+		"-interval", "1", "-health-jitter", "0", "-health-fall", "1", "-health-rise", "1")
+	time.Sleep(3 * time.Second)
+	if !backendsAlive(t, lb)[backend] {
+		t.Errorf("Expected the gRPC backend to pass its health check")
+	}
+
+	// An unknown service is reported as NOT_FOUND
+	lb = startLB(t, "-server", "http://"+backend, "-health-type", "grpc", "-health-grpc-service", "no.such.Service",
+		"-interval", "1", "-health-jitter", "0", "-health-fall", "1", "-health-rise", "1")
+	waitFor(t, 15*time.Second, "the backend to fail the health check of an unknown service", func() bool {
+		return !backendsAlive(t, lb)[backend]
+	})
+}
+
+func TestIntegrationTCPMode(t *testing.T) {
+	_, redis := startContainer(t, "redis", "7-alpine", "6379/tcp")
+	lb := startLB(t, "-mode", "tcp", "-server", "tcp://"+redis)
+
+	conn, err := net.DialTimeout("tcp", lb, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, exchange := range [][2]string{
+		{"PING\r\n", "+PONG\r\n"},
+		{"SET lb integration\r\n", "+OK\r\n"},
+		{"GET lb\r\n", "$11\r\n"},
+	} {
+		fmt.Fprint(conn, exchange[0])
+		reply, err := reader.ReadString('\n')
+		if err != nil || reply != exchange[1] {
+			t.Fatalf("Expected %q in reply to %q, got %q, %v", exchange[1], exchange[0], reply, err)
+		}
+	}
+}
+
+func TestIntegrationSharedRateLimit(t *testing.T) {
+	_, redis := startContainer(t, "redis", "7-alpine", "6379/tcp")
+	_, backend := startContainer(t, "nginx", "1.27-alpine", "80/tcp")
+	// A burst of 3 at 0.1 per second keeps the window open for 30 seconds
+	args := []string{"-server", "http://" + backend, "-store", "redis://" + redis, "-rate-limit", "0.1", "-rate-burst", "3"}
+	instances := []string{startLB(t, args...), startLB(t, args...)}
+
+	status := func(lb string) int {
+		resp, err := http.Get("http://" + lb + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 3; i++ {
+		if code := status(instances[i%2]); code != http.StatusOK {
+			t.Fatalf("Expected request %d of the burst to be allowed, got %d", i+1, code)
+		}
+	}
+	for _, lb := range instances {
+		if code := status(lb); code != http.StatusTooManyRequests {
+			t.Errorf("Expected the burst used up across both instances, got %d from %s", code, lb)
+		}
+	}
+}
+
+func TestIntegrationWebSocket(t *testing.T) {
+	_, echo := startContainer(t, "jmalloc/echo-server", "latest", "8080/tcp")
+
+	t.Run("http", func(t *testing.T) {
+		// The HTTP proxy relays the connection once the backend accepts
+		// the upgrade
+		lb := startLB(t, "-server", "http://"+echo)
+		checkWebSocketEcho(t, lb, echo)
+	})
+	t.Run("tcp", func(t *testing.T) {
+		// The TCP proxy carries the handshake like any other bytes
+		lb := startLB(t, "-mode", "tcp", "-server", "tcp://"+echo)
+		checkWebSocketEcho(t, lb, echo)
+	})
+}
+
+// checkWebSocketEcho opens a WebSocket through the load balancer and
+// expects a message to come back from the echo server
+func checkWebSocketEcho(t *testing.T, lb, echo string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", lb, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	fmt.Fprintf(conn, "GET /.ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		echo, base64.StdEncoding.EncodeToString(key))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %v, %v", resp, err)
+	}
+
+	writeWebSocketText(t, conn, "hello through the balancer")
+	// The echo server greets new connections before echoing
+	for i := 0; i < 3; i++ {
+		if message := readWebSocketText(t, reader); message == "hello through the balancer" {
+			return
+		}
+	}
+	t.Errorf("Expected the message to be echoed back")
+}
+
+// writeWebSocketText sends a masked text frame as a client must
+func writeWebSocketText(t *testing.T, w io.Writer, message string) {
+	t.Helper()
+	if len(message) > 125 {
+		t.Fatalf("Message too long for a single short frame")
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame := []byte{0x81, 0x80 | byte(len(message))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(message); i++ {
+		frame = append(frame, message[i]^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatalf("Failed to send frame: %s", err)
+	}
+}
+
+// readWebSocketText reads an unmasked frame sent by the server
+func readWebSocketText(t *testing.T, r io.Reader) string {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("Failed to read frame: %s", err)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext uint16
+		binary.Read(r, binary.BigEndian, &ext)
+		length = uint64(ext)
+	case 127:
+		binary.Read(r, binary.BigEndian, &length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Failed to read frame payload: %s", err)
+	}
+	return string(payload)
+}
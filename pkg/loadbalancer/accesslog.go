@@ -0,0 +1,229 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogSyslog as -access-log sends the access log to the -syslog endpoint
+const accessLogSyslog = "syslog"
+
+// accessLogBackupFormat timestamps the rotated files, access.log.20060102-150405.000
+const accessLogBackupFormat = "20060102-150405.000"
+
+// accessLogSettings configure the access log file and its rotation
+type accessLogSettings struct {
+	path       string
+	maxSize    int64         // Size in bytes at which the file is rotated, 0 for no limit
+	maxAge     time.Duration // Age at which the file is rotated, 0 for no limit
+	maxBackups int           // Rotated files kept, 0 keeps all
+}
+
+// accessLog writes one line per request to a file, rotating it by size and
+// age. Reopen switches to a new file after an external tool such as
+// logrotate moved the current one away.
+type accessLog struct {
+	settings accessLogSettings
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+// openAccessLog opens the access log, appending to an existing file
+func openAccessLog(settings accessLogSettings) (*accessLog, error) {
+	l := &accessLog{settings: settings, now: time.Now}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at the configured path. Must hold l.mu.
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.settings.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening access log: %w", err)
+	}
+	l.file, l.size, l.opened = file, info.Size(), l.now()
+	return nil
+}
+
+// Write appends a line, rotating the file first when the line would take
+// it past the size limit or it has reached the age limit
+func (l *accessLog) Write(line []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tooBig := l.settings.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.settings.maxSize
+	tooOld := l.settings.maxAge > 0 && l.now().Sub(l.opened) >= l.settings.maxAge
+	if tooBig || tooOld {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file after the time and opens a new one.
+// Must hold l.mu.
+func (l *accessLog) rotate() error {
+	l.file.Close()
+	backup := l.settings.path + "." + l.now().Format(accessLogBackupFormat)
+	if err := os.Rename(l.settings.path, backup); err != nil && !os.IsNotExist(err) {
+		// Keep writing to the current file rather than losing lines
+		if reopenErr := l.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return fmt.Errorf("rotating access log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the number kept
+func (l *accessLog) prune() {
+	if l.settings.maxBackups <= 0 {
+		return
+	}
+	backups := l.backups()
+	for len(backups) > l.settings.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups lists the rotated files, oldest first
+func (l *accessLog) backups() []string {
+	matches, _ := filepath.Glob(l.settings.path + ".*")
+	var backups []string
+	for _, match := range matches {
+		stamp := strings.TrimPrefix(match, l.settings.path+".")
+		if _, err := time.Parse(accessLogBackupFormat, stamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// The timestamps sort chronologically
+	sort.Strings(backups)
+	return backups
+}
+
+// Reopen closes the file and opens the configured path again
+func (l *accessLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	return l.open()
+}
+
+// Close closes the file
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// reopenOnSignal reopens the file whenever the process receives the reopen
+// signal, logging failures through logf
+func (l *accessLog) reopenOnSignal(logf func(format string, v ...any)) {
+	signals := make(chan os.Signal, 1)
+	if !notifyReopen(signals) {
+		return
+	}
+	go func() {
+		for range signals {
+			if err := l.Reopen(); err != nil {
+				logf("Error reopening access log: %s", err)
+				continue
+			}
+			logf("Reopened access log %s", l.settings.path)
+		}
+	}()
+}
+
+// accessLogWriter records the status and size of a response for the
+// access log
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	// Informational responses other than a protocol switch precede the
+	// final one
+	if w.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack records a protocol switch, whose 101 response is written to the
+// taken over connection rather than through WriteHeader
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// accessLogLine formats a request in the combined log format followed by
+// the time taken in milliseconds
+func accessLogLine(clientIP string, r *http.Request, status int, bytes int64, start time.Time, took time.Duration) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %.3f\n",
+		clientIP,
+		accessLogUser(r),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto,
+		status,
+		bytes,
+		r.Referer(),
+		r.UserAgent(),
+		durationMs(took),
+	)
+}
+
+// accessLogUser returns the basic auth user of the request, or "-"
+func accessLogUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "-"
+}
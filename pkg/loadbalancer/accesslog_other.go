@@ -0,0 +1,11 @@
+//go:build !unix
+
+package loadbalancer
+
+import "os"
+
+// notifyReopen reports that the access log cannot be reopened on a signal,
+// having none to ask for it
+func notifyReopen(signals chan<- os.Signal) bool {
+	return false
+}
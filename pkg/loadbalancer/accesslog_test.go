@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path, maxSize: 20, maxAge: time.Hour, maxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	l.opened = now
+
+	// Each line fills more than half the file, so the next one starts a new
+	// file
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		fmt.Fprintf(l, "line %d 0123456\n", i)
+	}
+	if backups := l.backups(); len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %q", backups)
+	}
+	current, _ := os.ReadFile(path)
+	if string(current) != "line 3 0123456\n" {
+		t.Errorf("Expected the last line in the current file, got %q", current)
+	}
+
+	// The oldest backups are removed beyond the number kept
+	for i := 4; i < 6; i++ {
+		now = now.Add(time.Second)
+		fmt.Fprintf(l, "line %d 0123456\n", i)
+	}
+	backups := l.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated files to be kept, got %q", backups)
+	}
+	oldest, _ := os.ReadFile(backups[0])
+	if string(oldest) != "line 3 0123456\n" {
+		t.Errorf("Expected the oldest backups to be removed, the oldest left holds %q", oldest)
+	}
+
+	// A file reaching the age limit is rotated whatever its size
+	now = now.Add(time.Hour)
+	fmt.Fprint(l, "old\n")
+	current, _ = os.ReadFile(path)
+	if string(current) != "old\n" {
+		t.Errorf("Expected the file to be rotated after an hour, got %q", current)
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fmt.Fprint(l, "before\n")
+
+	// An external tool moves the file away, then asks for a new one
+	if err := os.Rename(path, filepath.Join(dir, "access.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(l, "moved\n")
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(l, "after\n")
+
+	moved, _ := os.ReadFile(filepath.Join(dir, "access.log.1"))
+	current, _ := os.ReadFile(path)
+	if string(moved) != "before\nmoved\n" || string(current) != "after\n" {
+		t.Errorf("Expected lines before the reopen in the moved file, got %q and %q", moved, current)
+	}
+}
+
+func TestAccessLogRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, accessLog: l}
+
+	req := httptest.NewRequest("POST", "/items?id=1", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("User-Agent", "test-client")
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+
+	line, _ := os.ReadFile(path)
+	for _, want := range []string{`192.0.2.1 - alice [`, `] "POST /items?id=1 HTTP/1.1" 201 5 "" "test-client" `} {
+		if !strings.Contains(string(line), want) {
+			t.Errorf("Expected %q in the access log line, got %q", want, line)
+		}
+	}
+
+	// Requests the load balancer answers itself are logged too
+	lb.kills = newKillSwitches()
+	lb.kills.set(routeKill{Route: "/gone", Status: http.StatusNotFound})
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/gone", nil))
+	line, _ = os.ReadFile(path)
+	if !strings.Contains(string(line), `"GET /gone HTTP/1.1" 404 `) {
+		t.Errorf("Expected the killed request in the access log, got %q", line)
+	}
+}
+
+func TestLintAccessLog(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing", "access.log")
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-access-log", missing), lintError, "does not exist") {
+		t.Error("Expected an error for an access log in a missing directory")
+	}
+	path := filepath.Join(t.TempDir(), "access.log")
+	findings := lintArgs(t, "-server", "http://a", "-access-log", path, "-access-log-max-size", "0")
+	if !hasFinding(findings, lintWarning, "never rotated") {
+		t.Error("Expected a warning for an access log that is never rotated")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen relays SIGUSR1, which asks to reopen the access log, to the
+// channel
+func notifyReopen(signals chan<- os.Signal) bool {
+	signal.Notify(signals, syscall.SIGUSR1)
+	return true
+}
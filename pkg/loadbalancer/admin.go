@@ -0,0 +1,81 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+// adminPrefix is the path prefix of the admin API
+const adminPrefix = "/lb-admin/"
+
+// adminHandler returns the admin API handler, building it on first use
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	lb.adminOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /lb-admin/backends", lb.handleBackends)
+		mux.HandleFunc("GET /lb-admin/pools", lb.handlePools)
+		mux.HandleFunc("POST /lb-admin/backends/{host}/weight", lb.handleSetWeight)
+		mux.HandleFunc("GET /lb-admin/quarantine", lb.handleQuarantine)
+		mux.HandleFunc("POST /lb-admin/backends/{host}/quarantine", lb.handleSetQuarantine)
+		mux.HandleFunc("DELETE /lb-admin/backends/{host}/quarantine", lb.handleReinstate)
+		mux.HandleFunc("GET /lb-admin/cutover", lb.handleCutover)
+		mux.HandleFunc("POST /lb-admin/cutover", lb.handleStartCutover)
+		mux.HandleFunc("DELETE /lb-admin/cutover", lb.handleAbortCutover)
+		if lb.canary != nil {
+			mux.HandleFunc("GET /lb-admin/canary", lb.handleCanary)
+			mux.HandleFunc("POST /lb-admin/canary", lb.handleSetCanary)
+		}
+		if lb.blueGreen != nil {
+			mux.HandleFunc("GET /lb-admin/blue-green", lb.handleBlueGreen)
+			mux.HandleFunc("POST /lb-admin/blue-green/switch", lb.handleBlueGreenSwitch)
+			mux.HandleFunc("POST /lb-admin/blue-green/rollback", lb.handleBlueGreenRollback)
+		}
+		if lb.flags != nil {
+			mux.HandleFunc("GET /lb-admin/flags", lb.handleFlags)
+			mux.HandleFunc("POST /lb-admin/flags/{name}", lb.handleSetFlag)
+			mux.HandleFunc("DELETE /lb-admin/flags/{name}", lb.handleClearFlag)
+		}
+		if lb.kills != nil {
+			mux.HandleFunc("GET /lb-admin/kill", lb.handleKills)
+			mux.HandleFunc("POST /lb-admin/kill", lb.handleSetKill)
+			mux.HandleFunc("DELETE /lb-admin/kill", lb.handleClearKill)
+		}
+		if lb.mirrorDiff != nil {
+			mux.HandleFunc("GET /lb-admin/mirror-diff", lb.handleMirrorDiff)
+		}
+		if lb.connStats != nil {
+			mux.HandleFunc("GET /lb-admin/upstream-latency", lb.handleUpstreamLatency)
+			mux.HandleFunc("GET /lb-admin/conn-pool", lb.handleConnPool)
+		}
+		if lb.synthetics != nil {
+			mux.HandleFunc("GET /lb-admin/synthetic", lb.handleSynthetics)
+		}
+		if lb.usage != nil {
+			mux.HandleFunc("GET /lb-admin/usage", lb.handleUsage)
+		}
+		if lb.diagnostics != nil {
+			mux.HandleFunc("GET /lb-admin/diagnostics", lb.handleDiagnostics)
+			mux.HandleFunc("POST /lb-admin/diagnostics/requests/{id}/abort", lb.handleAbortRequest)
+		}
+		if lb.cacheStats != nil {
+			mux.HandleFunc("GET /lb-admin/cache-stats", lb.handleCacheStats)
+		}
+		if len(lb.hedges) > 0 {
+			mux.HandleFunc("GET /lb-admin/hedging", lb.handleHedging)
+		}
+		if lb.retryBudget != nil {
+			mux.HandleFunc("GET /lb-admin/retry-budget", lb.handleRetryBudget)
+		}
+		if lb.advisor != nil {
+			mux.HandleFunc("GET /lb-admin/advisor", lb.handleAdvisor)
+		}
+		if lb.cache != nil {
+			mux.HandleFunc("GET /lb-admin/cache", lb.handleCache)
+			mux.HandleFunc("DELETE /lb-admin/cache", lb.handlePurgeCache)
+		}
+		if lb.compat != nil {
+			mux.HandleFunc("GET /lb-admin/compat", lb.handleCompat)
+		}
+		lb.admin = mux
+	})
+	return lb.admin
+}
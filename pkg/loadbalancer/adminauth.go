@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminAuth holds the credentials the stats page and admin API accept
+type adminAuth struct {
+	token    string // Bearer token, empty when not accepted
+	user     string // Basic auth user, empty when not accepted
+	password string
+}
+
+// newAdminAuth builds the admin credentials from a bearer token and a
+// user:password pair, returning nil when neither is set
+func newAdminAuth(token, basic string) (*adminAuth, error) {
+	if token == "" && basic == "" {
+		return nil, nil
+	}
+	auth := &adminAuth{token: token}
+	if basic != "" {
+		user, password, ok := strings.Cut(basic, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("invalid admin basic auth, expected user:password")
+		}
+		auth.user, auth.password = user, password
+	}
+	return auth, nil
+}
+
+// authorized reports whether the request carries valid admin credentials.
+// Credentials are compared in constant time.
+func (a *adminAuth) authorized(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+	}
+	if user, password, ok := r.BasicAuth(); ok && a.user != "" {
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+		return userOK && passwordOK
+	}
+	return false
+}
+
+// serveAdmin answers requests for the stats page and the admin API,
+// reporting whether the request was one of them
+func (lb *LoadBalancer) serveAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != "/lb-stats" && !strings.HasPrefix(r.URL.Path, adminPrefix) {
+		return false
+	}
+	if lb.adminAuth != nil && !lb.adminAuth.authorized(r) {
+		lb.metrics().IncCounter("lb_admin_auth_failures_total", nil)
+		if lb.adminAuth.user != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lb-admin"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lb-admin"`)
+		}
+		lb.writeError(w, errUnauthorized, "Admin credentials required")
+		return true
+	}
+
+	// Without credentials anyone who reaches the admin API could change
+	// weights, kill routes or purge the cache, so only a listener bound to
+	// loopback accepts changes
+	if lb.adminAuth == nil && !lb.adminLocal && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		lb.metrics().IncCounter("lb_admin_auth_failures_total", nil)
+		lb.writeError(w, errUnauthorized, "Admin credentials required to change settings, or -admin-port with -admin-host 127.0.0.1")
+		return true
+	}
+
+	// Special endpoint for stats
+	if r.URL.Path == "/lb-stats" {
+		lb.handleStats(w, r)
+		return true
+	}
+	lb.adminHandler().ServeHTTP(w, r)
+	return true
+}
+
+// loopbackHost reports whether a listen address only accepts connections
+// from the same machine
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminListenerHandler serves only the stats page and the admin API, for
+// the separate admin listener
+func (lb *LoadBalancer) adminListenerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lb.serveAdmin(w, r) && !lb.serveSelfHealth(w, r) {
+			lb.writeError(w, errRouteNotFound, "404 page not found")
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	auth, err := newAdminAuth("s3cret", "ops:hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{adminAuth: auth}
+
+	for _, tc := range []struct {
+		name      string
+		authorize func(r *http.Request)
+		status    int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("ops", "hunter3") }, http.StatusUnauthorized},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("ops", "hunter2") }, http.StatusOK},
+	} {
+		for _, path := range []string{"/lb-stats", "/lb-admin/backends"} {
+			r := httptest.NewRequest("GET", path, nil)
+			tc.authorize(r)
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("Expected %d for %s with %s, got %d", tc.status, path, tc.name, w.Code)
+			}
+			if tc.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="lb-admin"` {
+				t.Errorf("Expected a basic auth challenge, got %q", w.Header().Get("WWW-Authenticate"))
+			}
+		}
+	}
+}
+
+func TestAdminTokenOnly(t *testing.T) {
+	auth, _ := newAdminAuth("s3cret", "")
+	r := httptest.NewRequest("GET", "/lb-stats", nil)
+	r.SetBasicAuth("", "s3cret")
+	if auth.authorized(r) {
+		t.Error("Expected basic auth to be refused when only a token is configured")
+	}
+	if auth, err := newAdminAuth("", ""); auth != nil || err != nil {
+		t.Errorf("Expected no admin auth without credentials, got %v, %v", auth, err)
+	}
+	for _, basic := range []string{"ops", "ops:", ":hunter2"} {
+		if _, err := newAdminAuth("", basic); err == nil {
+			t.Errorf("Expected %q to be rejected", basic)
+		}
+	}
+}
+
+func TestAdminSeparateListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{
+		servers:       []*Server{{URL: backendURL, Alive: true}},
+		current:       -1,
+		adminSeparate: true,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/lb-stats", nil))
+	if w.Body.String() != "backend /lb-stats" {
+		t.Errorf("Expected the main listener to forward /lb-stats, got %q", w.Body.String())
+	}
+
+	admin := lb.adminListenerHandler()
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/lb-stats", nil))
+	if w.Code != http.StatusOK || w.Body.String() == "backend /lb-stats" {
+		t.Errorf("Expected the admin listener to serve stats, got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the admin listener not to proxy, got %d", w.Code)
+	}
+}
+
+func TestAdminChangesNeedCredentials(t *testing.T) {
+	lb := &LoadBalancer{kills: newKillSwitches()}
+	serve := func(lb *LoadBalancer, r *http.Request) int {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Without credentials the admin API can be read but not changed
+	if code := serve(lb, httptest.NewRequest("GET", "/lb-admin/kill", nil)); code != http.StatusOK {
+		t.Errorf("Expected the open admin API to be readable, got %d", code)
+	}
+	if code := serve(lb, httptest.NewRequest("POST", "/lb-admin/kill?route=/api", nil)); code != http.StatusUnauthorized {
+		t.Errorf("Expected a change without credentials to be refused, got %d", code)
+	}
+	if _, ok := lb.kills.match("/api"); ok {
+		t.Error("Expected the refused change not to apply")
+	}
+
+	// A loopback admin listener or credentials allow changes
+	local := &LoadBalancer{kills: newKillSwitches(), adminSeparate: true, adminLocal: true}
+	w := httptest.NewRecorder()
+	local.adminListenerHandler().ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/kill?route=/api", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the loopback admin listener to accept changes, got %d", w.Code)
+	}
+	auth, _ := newAdminAuth("s3cret", "")
+	lb.adminAuth = auth
+	r := httptest.NewRequest("POST", "/lb-admin/kill?route=/api", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if code := serve(lb, r); code != http.StatusOK {
+		t.Errorf("Expected an authorized change to be accepted, got %d", code)
+	}
+
+	for host, want := range map[string]bool{"127.0.0.1": true, "::1": true, "localhost": true, "": false, "0.0.0.0": false, "10.0.0.5": false} {
+		if got := loopbackHost(host); got != want {
+			t.Errorf("loopbackHost(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
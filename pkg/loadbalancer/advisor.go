@@ -0,0 +1,422 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// advisorMinSamples is the number of requests needed before latency based
+// suggestions are made
+const advisorMinSamples = 100
+
+// advisorSettings are the current values the advisor's suggestions are
+// compared against
+type advisorSettings struct {
+	responseHeaderTimeout time.Duration
+	requestTimeout        time.Duration
+	maxConcurrent         int
+	maxIdlePerHost        int
+	maxHeaderBytes        int
+	retryMaxBody          int64
+}
+
+// advisor observes traffic for a period and suggests configuration changes
+// from what it saw
+type advisor struct {
+	settings advisorSettings
+	started  time.Time
+	until    time.Time
+
+	mu       sync.Mutex
+	headers  *histogram // Time until response headers arrived
+	duration *histogram
+	backends map[*Server]*advisorBackend
+
+	// Sizes of request headers, and of the bodies of repeatable requests
+	headerBytes sizeHistogram
+	bodyBytes   sizeHistogram
+}
+
+// advisorBackend holds what the advisor saw of one backend
+type advisorBackend struct {
+	headers *histogram
+	peak    int64 // Most requests in flight at once
+}
+
+// newAdvisor creates an advisor observing traffic for the period from now
+func newAdvisor(settings advisorSettings, period time.Duration, now time.Time) *advisor {
+	return &advisor{
+		settings: settings,
+		started:  now,
+		until:    now.Add(period),
+		headers:  newHistogram(),
+		duration: newHistogram(),
+		backends: make(map[*Server]*advisorBackend),
+	}
+}
+
+// observe records a completed request. Requests after the observation
+// period are ignored so the report stays stable.
+func (a *advisor) observe(server *Server, headers, duration time.Duration, now time.Time) {
+	if a == nil || now.After(a.until) {
+		return
+	}
+	a.headers.observe(headers)
+	a.duration.observe(duration)
+	inFlight := server.inflight.Load()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.backends[server]
+	if !ok {
+		b = &advisorBackend{headers: newHistogram()}
+		a.backends[server] = b
+	}
+	b.headers.observe(headers)
+	b.peak = max(b.peak, inFlight)
+}
+
+// observeRequest records the size of a request's headers, and of its body
+// when it is repeatable and so a candidate for retries
+func (a *advisor) observeRequest(r *http.Request, repeatable bool, now time.Time) {
+	if a == nil || now.After(a.until) {
+		return
+	}
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + len(r.Host) + 10
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.headerBytes.observe(int64(size))
+	if repeatable && r.ContentLength > 0 {
+		a.bodyBytes.observe(r.ContentLength)
+	}
+}
+
+// sizeHistogram counts sizes in power of two buckets
+type sizeHistogram struct {
+	counts [65]int64 // By bit length
+	total  int64
+}
+
+func (h *sizeHistogram) observe(size int64) {
+	h.counts[bits.Len64(uint64(size))]++
+	h.total++
+}
+
+// quantile returns a power of two at least the q quantile of the sizes
+func (h *sizeHistogram) quantile(q float64) int64 {
+	rank := int64(math.Ceil(q * float64(h.total)))
+	var seen int64
+	for length, count := range h.counts {
+		seen += count
+		if seen >= rank && count > 0 {
+			return 1 << min(length, 62)
+		}
+	}
+	return 0
+}
+
+// above returns the share of sizes above limit, counting the bucket
+// holding the limit as below it
+func (h *sizeHistogram) above(limit int64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	var count int64
+	for length := bits.Len64(uint64(limit)) + 1; length < len(h.counts); length++ {
+		count += h.counts[length]
+	}
+	return float64(count) / float64(h.total)
+}
+
+// suggestion is one configuration change proposed by the advisor
+type suggestion struct {
+	Flag      string `json:"flag" yaml:"flag"`
+	Current   string `json:"current" yaml:"current"`
+	Suggested string `json:"suggested" yaml:"suggested"`
+	Reason    string `json:"reason" yaml:"reason"`
+}
+
+// advisorReport is what the advisor observed and suggests
+type advisorReport struct {
+	Observed    string       `json:"observed" yaml:"observed"`
+	Complete    bool         `json:"complete" yaml:"complete"`
+	Requests    int64        `json:"requests" yaml:"requests"`
+	Suggestions []suggestion `json:"suggestions" yaml:"suggestions"`
+}
+
+// report builds the suggestions from the traffic observed so far
+func (a *advisor) report(pools map[string]*Pool, now time.Time) advisorReport {
+	end := now
+	if end.After(a.until) {
+		end = a.until
+	}
+	report := advisorReport{
+		Observed:    end.Sub(a.started).Round(time.Second).String(),
+		Complete:    !now.Before(a.until),
+		Requests:    a.duration.summary().Count,
+		Suggestions: []suggestion{},
+	}
+	if report.Requests >= advisorMinSamples {
+		report.Suggestions = append(report.Suggestions, a.timeoutSuggestions()...)
+	}
+	report.Suggestions = append(report.Suggestions, a.concurrencySuggestions()...)
+	report.Suggestions = append(report.Suggestions, a.bufferSuggestions()...)
+	report.Suggestions = append(report.Suggestions, a.strategySuggestions(pools)...)
+	return report
+}
+
+// timeoutSuggestions proposes timeouts at twice the observed p99, flagging
+// timeouts that are disabled, far looser than needed or tighter than p99
+func (a *advisor) timeoutSuggestions() []suggestion {
+	var suggestions []suggestion
+	for _, t := range []struct {
+		flag    string
+		current time.Duration
+		p99     time.Duration
+		what    string
+	}{
+		{"response-header-timeout", a.settings.responseHeaderTimeout, a.headers.quantile(0.99), "time to response headers"},
+		{"request-timeout", a.settings.requestTimeout, a.duration.quantile(0.99), "request duration"},
+	} {
+		suggested := roundUpDuration(max(2*t.p99, time.Second))
+		reason := fmt.Sprintf("p99 %s is %s", t.what, t.p99)
+		switch {
+		case t.current == 0:
+			reason += "; the timeout is disabled"
+		case t.current < t.p99:
+			reason += "; the timeout cuts off more than 1% of requests"
+		case t.current > 4*suggested:
+			reason += "; a stuck backend holds requests far longer than needed"
+		default:
+			continue
+		}
+		suggestions = append(suggestions, suggestion{Flag: t.flag, Current: t.current.String(), Suggested: suggested.String(), Reason: reason})
+	}
+	return suggestions
+}
+
+// concurrencySuggestions proposes a per-backend concurrency cap with
+// headroom over the observed peak, and an idle pool large enough to keep
+// a connection for every concurrent request
+func (a *advisor) concurrencySuggestions() []suggestion {
+	a.mu.Lock()
+	var peak int64
+	var busiest string
+	for server, b := range a.backends {
+		if b.peak > peak || (b.peak == peak && server.URL.Host < busiest) {
+			peak, busiest = b.peak, server.URL.Host
+		}
+	}
+	a.mu.Unlock()
+	if peak == 0 {
+		return nil
+	}
+
+	var suggestions []suggestion
+	settings := a.settings
+	switch {
+	case settings.maxConcurrent == 0:
+		suggestions = append(suggestions, suggestion{
+			Flag:      "max-concurrent",
+			Current:   "0",
+			Suggested: strconv.FormatInt(int64(math.Ceil(float64(peak)*1.5)), 10),
+			Reason:    fmt.Sprintf("backends are uncapped; %s peaked at %d requests in flight", busiest, peak),
+		})
+	case peak >= int64(settings.maxConcurrent):
+		suggestions = append(suggestions, suggestion{
+			Flag:      "max-concurrent",
+			Current:   strconv.Itoa(settings.maxConcurrent),
+			Suggested: strconv.Itoa(int(math.Ceil(float64(settings.maxConcurrent) * 1.5))),
+			Reason:    fmt.Sprintf("%s reached the cap of %d requests in flight", busiest, settings.maxConcurrent),
+		})
+	}
+	if settings.maxIdlePerHost > 0 && peak > int64(settings.maxIdlePerHost) {
+		suggestions = append(suggestions, suggestion{
+			Flag:      "max-idle-conns-per-host",
+			Current:   strconv.Itoa(settings.maxIdlePerHost),
+			Suggested: strconv.FormatInt(peak, 10),
+			Reason:    fmt.Sprintf("%s peaked at %d requests in flight, so connections beyond the idle pool are closed and reopened", busiest, peak),
+		})
+	}
+	return suggestions
+}
+
+// bufferSuggestions proposes a request header limit with room over the
+// largest headers seen, and a retry body buffer large enough for nearly
+// every repeatable request with a body
+func (a *advisor) bufferSuggestions() []suggestion {
+	a.mu.Lock()
+	headers, bodies := a.headerBytes, a.bodyBytes
+	a.mu.Unlock()
+
+	var suggestions []suggestion
+	settings := a.settings
+	if headers.total >= advisorMinSamples && settings.maxHeaderBytes > 0 {
+		largest := headers.quantile(1)
+		suggested := max(4*largest, 32<<10)
+		reason := fmt.Sprintf("the largest request headers were under %d bytes", largest)
+		switch {
+		case int64(settings.maxHeaderBytes) < 2*largest:
+			reason += "; requests come close to the limit"
+		case int64(settings.maxHeaderBytes) > 16*suggested:
+			reason += "; clients may hold far more memory per request than needed"
+		default:
+			suggested = 0
+		}
+		if suggested > 0 {
+			suggestions = append(suggestions, suggestion{
+				Flag:      "max-header-bytes",
+				Current:   strconv.Itoa(settings.maxHeaderBytes),
+				Suggested: strconv.FormatInt(suggested, 10),
+				Reason:    reason,
+			})
+		}
+	}
+	if bodies.total >= advisorMinSamples/10 && settings.retryMaxBody > 0 {
+		if share := bodies.above(settings.retryMaxBody); share > 0.01 {
+			suggestions = append(suggestions, suggestion{
+				Flag:      "retry-max-body",
+				Current:   strconv.FormatInt(settings.retryMaxBody, 10),
+				Suggested: strconv.FormatInt(bodies.quantile(0.99), 10),
+				Reason:    fmt.Sprintf("%.0f%% of repeatable requests with a body are larger, so they are not retried", share*100),
+			})
+		}
+	}
+	return suggestions
+}
+
+// strategySuggestions proposes least-conn for round-robin pools whose
+// backends respond at very different speeds
+func (a *advisor) strategySuggestions(pools map[string]*Pool) []suggestion {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var suggestions []suggestion
+	for _, name := range names {
+		pool := pools[name]
+		if pool.strategy == StrategyLeastConn || len(pool.servers()) < 2 {
+			continue
+		}
+		var fastest, slowest time.Duration
+		observed := 0
+		for _, server := range pool.servers() {
+			a.mu.Lock()
+			b := a.backends[server]
+			a.mu.Unlock()
+			if b == nil || b.headers.summary().Count < advisorMinSamples/10 {
+				continue
+			}
+			p50 := b.headers.quantile(0.5)
+			if observed == 0 || p50 < fastest {
+				fastest = p50
+			}
+			slowest = max(slowest, p50)
+			observed++
+		}
+		if observed < 2 || slowest < 2*max(fastest, time.Millisecond) {
+			continue
+		}
+		suggestions = append(suggestions, suggestion{
+			Flag:      "pool-config",
+			Current:   name + "?strategy=" + pool.strategy,
+			Suggested: name + "?strategy=" + StrategyLeastConn,
+			Reason:    fmt.Sprintf("median time to response headers ranges from %s to %s across the pool's backends", fastest, slowest),
+		})
+	}
+	return suggestions
+}
+
+// roundUpDuration rounds up to 1, 2 or 5 times a power of ten milliseconds
+func roundUpDuration(d time.Duration) time.Duration {
+	for step := time.Millisecond; ; step *= 10 {
+		for _, m := range []time.Duration{1, 2, 5} {
+			if d <= m*step {
+				return m * step
+			}
+		}
+	}
+}
+
+// yaml formats the report as YAML
+func (r advisorReport) yaml() ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(r); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeAdvisorReport writes the report as YAML when the path ends in .yaml
+// or .yml and as JSON otherwise
+func writeAdvisorReport(path string, report advisorReport) error {
+	var data []byte
+	var err error
+	if ext := strings.ToLower(path); strings.HasSuffix(ext, ".yaml") || strings.HasSuffix(ext, ".yml") {
+		data, err = report.yaml()
+	} else if data, err = json.MarshalIndent(report, "", "  "); err == nil {
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// finishAdvisor logs the suggestions at the end of the observation period
+// and writes them to the output file when one is configured
+func (lb *LoadBalancer) finishAdvisor(output string) {
+	report := lb.advisor.report(lb.pools, time.Now())
+	lb.logf("Advisor observed %d requests over %s and has %d suggestions", report.Requests, report.Observed, len(report.Suggestions))
+	for _, s := range report.Suggestions {
+		lb.logf("Advisor: -%s %s (currently %s): %s", s.Flag, s.Suggested, s.Current, s.Reason)
+	}
+	if output == "" {
+		return
+	}
+	if err := writeAdvisorReport(output, report); err != nil {
+		lb.errorf("Writing advisor report: %s", err)
+	}
+}
+
+// handleAdvisor reports the advisor's suggestions so far, as YAML with
+// ?format=yaml
+func (lb *LoadBalancer) handleAdvisor(w http.ResponseWriter, r *http.Request) {
+	report := lb.advisor.report(lb.pools, time.Now())
+	if r.URL.Query().Get("format") == "yaml" {
+		data, err := report.yaml()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestAdvisorSuggestions(t *testing.T) {
+	now := time.Now()
+	servers := testServers("fast:80", "slow:80")
+	pools := map[string]*Pool{"api": newPool("api", servers)}
+	a := newAdvisor(advisorSettings{responseHeaderTimeout: 30 * time.Second, maxIdlePerHost: 2}, time.Minute, now)
+
+	servers[0].inflight.Store(4)
+	for range 100 {
+		a.observe(servers[0], 20*time.Millisecond, 30*time.Millisecond, now)
+		a.observe(servers[1], 400*time.Millisecond, 450*time.Millisecond, now)
+	}
+	// Requests after the period are ignored
+	a.observe(servers[1], time.Hour, time.Hour, now.Add(2*time.Minute))
+
+	report := a.report(pools, now.Add(2*time.Minute))
+	if !report.Complete || report.Requests != 200 || report.Observed != "1m0s" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	suggested := make(map[string]suggestion)
+	for _, s := range report.Suggestions {
+		suggested[s.Flag] = s
+	}
+	if s := suggested["response-header-timeout"]; s.Current != "30s" || s.Suggested != "1s" {
+		t.Errorf("Expected a tighter response header timeout, got %+v", s)
+	}
+	if s := suggested["request-timeout"]; s.Current != "0s" || s.Suggested != "1s" {
+		t.Errorf("Expected a request timeout, got %+v", s)
+	}
+	if s := suggested["max-concurrent"]; s.Suggested != "6" || !strings.Contains(s.Reason, "fast:80") {
+		t.Errorf("Expected a concurrency cap above the peak of 4, got %+v", s)
+	}
+	if s := suggested["max-idle-conns-per-host"]; s.Current != "2" || s.Suggested != "4" {
+		t.Errorf("Expected a larger idle pool, got %+v", s)
+	}
+	if s := suggested["pool-config"]; s.Suggested != "api?strategy=least-conn" {
+		t.Errorf("Expected least-conn for a pool with uneven backends, got %+v", s)
+	}
+
+	// Well tuned settings are left alone
+	pools["api"].strategy = StrategyLeastConn
+	a.settings = advisorSettings{responseHeaderTimeout: 2 * time.Second, requestTimeout: 2 * time.Second, maxConcurrent: 10, maxIdlePerHost: 10}
+	if report := a.report(pools, now); len(report.Suggestions) != 0 || report.Complete {
+		t.Errorf("Expected no suggestions for a tuned configuration, got %+v", report)
+	}
+}
+
+func TestAdvisorBufferSuggestions(t *testing.T) {
+	now := time.Now()
+	a := newAdvisor(advisorSettings{maxHeaderBytes: 1 << 20, retryMaxBody: 64 << 10}, time.Minute, now)
+	for i := range 100 {
+		r := httptest.NewRequest("PUT", "/items", nil)
+		r.Header.Set("Cookie", strings.Repeat("x", 3000))
+		r.ContentLength = 10 << 10
+		if i%10 == 0 {
+			r.ContentLength = 200 << 10
+		}
+		a.observeRequest(r, true, now)
+	}
+	// Bodies of requests that are never retried do not count
+	r := httptest.NewRequest("POST", "/items", nil)
+	r.ContentLength = 100 << 20
+	a.observeRequest(r, false, now)
+
+	suggested := make(map[string]suggestion)
+	for _, s := range a.report(nil, now).Suggestions {
+		suggested[s.Flag] = s
+	}
+	if s := suggested["max-header-bytes"]; s.Current != "1048576" || s.Suggested != "32768" || !strings.Contains(s.Reason, "under 4096 bytes") {
+		t.Errorf("Expected a tighter header limit, got %+v", s)
+	}
+	if s := suggested["retry-max-body"]; s.Current != "65536" || s.Suggested != "262144" || !strings.Contains(s.Reason, "10%") {
+		t.Errorf("Expected a larger retry body buffer, got %+v", s)
+	}
+
+	// Limits close to the traffic are raised, and ample ones left alone
+	a.settings = advisorSettings{maxHeaderBytes: 4096, retryMaxBody: 256 << 10}
+	suggested = make(map[string]suggestion)
+	for _, s := range a.report(nil, now).Suggestions {
+		suggested[s.Flag] = s
+	}
+	if s := suggested["max-header-bytes"]; s.Suggested != "32768" || !strings.Contains(s.Reason, "close to the limit") {
+		t.Errorf("Expected a larger header limit, got %+v", s)
+	}
+	if s, ok := suggested["retry-max-body"]; ok {
+		t.Errorf("Expected no retry body suggestion when every body fits, got %+v", s)
+	}
+}
+
+func TestAdvisorFewSamples(t *testing.T) {
+	now := time.Now()
+	a := newAdvisor(advisorSettings{}, time.Minute, now)
+	a.observe(testServers("a:80")[0], time.Second, time.Second, now)
+	for _, s := range a.report(nil, now).Suggestions {
+		if strings.HasSuffix(s.Flag, "timeout") {
+			t.Errorf("Expected no timeout suggestion from one request, got %+v", s)
+		}
+	}
+}
+
+func TestWriteAdvisorReport(t *testing.T) {
+	report := advisorReport{Observed: "1m0s", Requests: 3, Suggestions: []suggestion{{Flag: "max-concurrent", Current: "0", Suggested: "6", Reason: `peaked at "4": see #12`}}}
+	dir := t.TempDir()
+
+	if err := writeAdvisorReport(filepath.Join(dir, "advice.yaml"), report); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "advice.yaml"))
+	if !strings.Contains(string(data), "suggestions:\n  - flag: max-concurrent\n    current: \"0\"\n") {
+		t.Errorf("Unexpected YAML report:\n%s", data)
+	}
+	var parsed advisorReport
+	if err := yaml.Unmarshal(data, &parsed); err != nil || !reflect.DeepEqual(parsed, report) {
+		t.Errorf("Expected the YAML report to read back unchanged, got %+v: %v", parsed, err)
+	}
+
+	if err := writeAdvisorReport(filepath.Join(dir, "advice.json"), report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded advisorReport
+	data, _ = os.ReadFile(filepath.Join(dir, "advice.json"))
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Suggestions[0].Suggested != "6" {
+		t.Errorf("Unexpected JSON report %s: %v", data, err)
+	}
+}
+
+func TestHandleAdvisor(t *testing.T) {
+	lb := &LoadBalancer{advisor: newAdvisor(advisorSettings{}, time.Minute, time.Now())}
+	w := httptest.NewRecorder()
+	lb.handleAdvisor(w, httptest.NewRequest("GET", "/lb-admin/advisor?format=yaml", nil))
+	if w.Header().Get("Content-Type") != "application/yaml" || !strings.Contains(w.Body.String(), "suggestions: []\n") {
+		t.Errorf("Unexpected YAML response %q", w.Body.String())
+	}
+}
+
+func TestRoundUpDuration(t *testing.T) {
+	for d, want := range map[time.Duration]time.Duration{
+		time.Millisecond:        time.Millisecond,
+		1500 * time.Microsecond: 2 * time.Millisecond,
+		3 * time.Second:         5 * time.Second,
+		6 * time.Second:         10 * time.Second,
+	} {
+		if got := roundUpDuration(d); got != want {
+			t.Errorf("roundUpDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregation modes
+const (
+	aggregateJSON  = "json"  // Merge the JSON bodies of all successful responses into an array
+	aggregateFirst = "first" // Return the first successful response
+)
+
+// maxAggregateBody caps the request and response bodies buffered for fan-out
+const maxAggregateBody = 1 << 20
+
+// aggregateRoute fans requests under a path prefix out to every alive
+// backend of a pool and merges the responses. Experimental.
+type aggregateRoute struct {
+	prefix string
+	mode   string
+	pool   string // Named pool, the default servers when empty
+}
+
+// parseAggregateRoutes parses /path/prefix=mode[@pool] definitions
+func parseAggregateRoutes(defs []string, pools map[string]bool) ([]aggregateRoute, error) {
+	var routes []aggregateRoute
+	for _, def := range defs {
+		prefix, spec, ok := strings.Cut(def, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid aggregate route %q, expected /path/prefix=mode[@pool]", def)
+		}
+		mode, pool, _ := strings.Cut(spec, "@")
+		if mode != aggregateJSON && mode != aggregateFirst {
+			return nil, fmt.Errorf("invalid aggregate route %q: mode must be json or first", def)
+		}
+		if pool != "" && !pools[pool] {
+			return nil, fmt.Errorf("aggregate route %s references unknown pool %s", prefix, pool)
+		}
+		routes = append(routes, aggregateRoute{prefix: prefix, mode: mode, pool: pool})
+	}
+	return routes, nil
+}
+
+// aggregateRouteFor returns the aggregate route with the longest prefix
+// matching the request path
+func (lb *LoadBalancer) aggregateRouteFor(r *http.Request) *aggregateRoute {
+	var best *aggregateRoute
+	for i, route := range lb.aggregates {
+		if strings.HasPrefix(r.URL.Path, route.prefix) && (best == nil || len(route.prefix) > len(best.prefix)) {
+			best = &lb.aggregates[i]
+		}
+	}
+	return best
+}
+
+// aggregateResponse is the buffered response of one backend
+type aggregateResponse struct {
+	server *Server
+	resp   *http.Response
+	body   []byte
+	err    error
+}
+
+// serveAggregate fans the request out and writes the merged response
+func (lb *LoadBalancer) serveAggregate(w http.ResponseWriter, r *http.Request, route *aggregateRoute) {
+	servers := lb.servers
+	if route.pool != "" {
+		servers = lb.pools[route.pool].servers()
+	}
+	var alive []*Server
+	for _, server := range servers {
+		if server.available(time.Now()) {
+			alive = append(alive, server)
+		}
+	}
+	if len(alive) == 0 {
+		lb.writeUnavailable(w, r)
+		return
+	}
+
+	// Buffer the body so it can be sent to every backend
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxAggregateBody+1))
+		if bodyTooLarge(err) {
+			lb.writeError(w, errBodyTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			lb.writeError(w, errBadRequest, err.Error())
+			return
+		}
+		if len(body) > maxAggregateBody {
+			lb.writeError(w, errBodyTooLarge, "Request body too large to aggregate")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	results := make(chan aggregateResponse, len(alive))
+	var wg sync.WaitGroup
+	for _, server := range alive {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- lb.fetchAggregate(ctx, r, server, body)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if route.mode == aggregateFirst {
+		lb.writeFirstSuccess(w, results, cancel)
+	} else {
+		lb.writeJSONArray(w, results, alive)
+	}
+}
+
+// fetchAggregate sends the request to one backend and buffers the response
+func (lb *LoadBalancer) fetchAggregate(ctx context.Context, r *http.Request, server *Server, body []byte) aggregateResponse {
+	in := r.WithContext(ctx)
+	in.Body = io.NopCloser(bytes.NewReader(body))
+	req, err := lb.newBackendRequest(in, server)
+	if err != nil {
+		return aggregateResponse{server: server, err: err}
+	}
+	req.ContentLength = int64(len(body))
+
+	lb.recordRequest(server)
+	start := time.Now()
+	resp, err := lb.upstreamClient().Do(req)
+	if err != nil {
+		lb.observeOutcome(server, 0, err, time.Since(start))
+		return aggregateResponse{server: server, err: err}
+	}
+	lb.observeOutcome(server, resp.StatusCode, nil, time.Since(start))
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAggregateBody))
+	return aggregateResponse{server: server, resp: resp, body: data, err: err}
+}
+
+// ok reports whether the backend answered with a 2xx response
+func (a aggregateResponse) ok() bool {
+	return a.err == nil && a.resp.StatusCode >= 200 && a.resp.StatusCode < 300
+}
+
+// writeFirstSuccess writes the first 2xx response and cancels the others
+func (lb *LoadBalancer) writeFirstSuccess(w http.ResponseWriter, results <-chan aggregateResponse, cancel context.CancelFunc) {
+	var last aggregateResponse
+	for result := range results {
+		if !result.ok() {
+			last = result
+			continue
+		}
+		cancel()
+		for name, values := range result.resp.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("X-Aggregate-Backend", result.server.URL.Host)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(result.resp.StatusCode)
+		w.Write(result.body)
+		return
+	}
+
+	if last.err != nil {
+		lb.writeError(w, upstreamError(last.err), last.err.Error())
+		return
+	}
+	lb.writeError(w, errUpstreamFailed, "No backend answered successfully")
+}
+
+// writeJSONArray merges the JSON bodies of all 2xx responses into an array
+// in backend order. Failed or non-JSON responses are left out and counted.
+func (lb *LoadBalancer) writeJSONArray(w http.ResponseWriter, results <-chan aggregateResponse, servers []*Server) {
+	byServer := make(map[*Server]aggregateResponse)
+	for result := range results {
+		byServer[result.server] = result
+	}
+
+	merged := []json.RawMessage{}
+	failures := 0
+	for _, server := range servers {
+		result := byServer[server]
+		if !result.ok() || !json.Valid(result.body) {
+			failures++
+			continue
+		}
+		merged = append(merged, result.body)
+	}
+	if len(merged) == 0 {
+		lb.writeError(w, errUpstreamFailed, "No backend answered successfully")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Aggregate-Failures", strconv.Itoa(failures))
+	json.NewEncoder(w).Encode(merged)
+}
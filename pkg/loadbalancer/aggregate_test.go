@@ -0,0 +1,74 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func aggregateBackend(t *testing.T, status int, body string) *Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	return &Server{URL: u, Alive: true}
+}
+
+func TestAggregateJSON(t *testing.T) {
+	lb := &LoadBalancer{
+		servers: []*Server{
+			aggregateBackend(t, http.StatusOK, `{"shard":1}`),
+			aggregateBackend(t, http.StatusInternalServerError, `oops`),
+			aggregateBackend(t, http.StatusOK, `{"shard":2}`),
+		},
+		aggregates: []aggregateRoute{{prefix: "/search", mode: aggregateJSON}},
+	}
+
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "/search?q=x", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if got, want := rec.Body.String(), "[{\"shard\":1},{\"shard\":2}]\n"; got != want {
+		t.Errorf("Expected merged body %q, got %q", want, got)
+	}
+	if got := rec.Header().Get("X-Aggregate-Failures"); got != "1" {
+		t.Errorf("Expected 1 failure, got %q", got)
+	}
+}
+
+func TestAggregateFirstSuccess(t *testing.T) {
+	good := aggregateBackend(t, http.StatusOK, "hello")
+	lb := &LoadBalancer{
+		servers:    []*Server{aggregateBackend(t, http.StatusServiceUnavailable, "down"), good},
+		aggregates: []aggregateRoute{{prefix: "/", mode: aggregateFirst}},
+	}
+
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("Expected the successful response, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Aggregate-Backend"); got != good.URL.Host {
+		t.Errorf("Expected X-Aggregate-Backend %s, got %q", good.URL.Host, got)
+	}
+}
+
+func TestParseAggregateRoutes(t *testing.T) {
+	routes, err := parseAggregateRoutes([]string{"/search=json@shards", "/lookup=first"}, map[string]bool{"shards": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0] != (aggregateRoute{prefix: "/search", mode: aggregateJSON, pool: "shards"}) {
+		t.Errorf("Unexpected routes %+v", routes)
+	}
+	for _, def := range []string{"search=json", "/search", "/search=all", "/search=json@missing"} {
+		if _, err := parseAggregateRoutes([]string{def}, nil); err == nil {
+			t.Errorf("Expected error for %q", def)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication methods
+const (
+	authMTLS   = "mtls"
+	authJWT    = "jwt"
+	authAPIKey = "apikey"
+)
+
+// Headers telling backends how a request was authenticated. Values sent by
+// clients are always removed.
+const (
+	authMethodHeader  = "X-LB-Auth-Method"
+	authSubjectHeader = "X-LB-Auth-Subject"
+)
+
+// authRoute requires requests under a path prefix to pass one of the
+// methods, tried in order
+type authRoute struct {
+	prefix  string
+	methods []string
+}
+
+// parseAuthRoutes parses /path/prefix=method|method definitions
+func parseAuthRoutes(defs []string) ([]authRoute, error) {
+	var routes []authRoute
+	for _, def := range defs {
+		prefix, value, ok := strings.Cut(def, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || value == "" {
+			return nil, fmt.Errorf("invalid auth route %q, expected /path/prefix=method|method", def)
+		}
+		route := authRoute{prefix: prefix}
+		for _, method := range strings.Split(value, "|") {
+			switch method {
+			case authMTLS, authJWT, authAPIKey:
+				route.methods = append(route.methods, method)
+			default:
+				return nil, fmt.Errorf("invalid auth route %q: unknown method %q, expected mtls, jwt or apikey", def, method)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// authDecision is the cached outcome of verifying a credential
+type authDecision struct {
+	subject string
+	err     error
+	expires time.Time
+}
+
+// authCacheEntry is an entry of the cache's LRU list
+type authCacheEntry struct {
+	key      string
+	decision authDecision
+}
+
+// authCache remembers verification outcomes keyed on a hash of the
+// credential, so repeated requests with the same token or key skip the
+// expensive checks. Rejections are cached too, so bad credentials cannot
+// be used to burn CPU.
+type authCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+}
+
+// newAuthCache creates a cache of up to maxSize decisions, nil when
+// caching is disabled
+func newAuthCache(ttl time.Duration, maxSize int) *authCache {
+	if ttl <= 0 || maxSize <= 0 {
+		return nil
+	}
+	return &authCache{ttl: ttl, maxSize: maxSize, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// authCacheKey derives the cache key of a credential without keeping the
+// credential itself in memory
+func authCacheKey(method, credential string) string {
+	sum := sha256.Sum256([]byte(method + "\x00" + credential))
+	return string(sum[:])
+}
+
+// get returns an unexpired decision
+func (c *authCache) get(key string, now time.Time) (authDecision, bool) {
+	if c == nil {
+		return authDecision{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return authDecision{}, false
+	}
+	entry := elem.Value.(*authCacheEntry)
+	if !now.Before(entry.decision.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return authDecision{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.decision, true
+}
+
+// put stores a decision for at most the cache TTL, or until the decision
+// expires when that is sooner
+func (c *authCache) put(key string, decision authDecision, now time.Time) {
+	if c == nil {
+		return
+	}
+	if expires := now.Add(c.ttl); decision.expires.IsZero() || expires.Before(decision.expires) {
+		decision.expires = expires
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*authCacheEntry).decision = decision
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&authCacheEntry{key: key, decision: decision})
+}
+
+// jwtVerifier checks the signature and claims of bearer tokens
+type jwtVerifier struct {
+	secret    []byte           // HMAC key for HS256, nil when not accepted
+	publicKey crypto.PublicKey // RSA key for RS256 or ECDSA P-256 key for ES256, nil when not accepted
+	issuer    string
+	audience  string
+	leeway    time.Duration // Clock skew tolerated for exp and nbf
+}
+
+// loadJWTVerifier reads the HMAC secret and PEM public key files, returning
+// nil when neither is configured
+func loadJWTVerifier(secretFile, publicKeyFile, issuer, audience string) (*jwtVerifier, error) {
+	if secretFile == "" && publicKeyFile == "" {
+		return nil, nil
+	}
+	v := &jwtVerifier{issuer: issuer, audience: audience, leeway: 30 * time.Second}
+	if secretFile != "" {
+		secret, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT secret: %w", err)
+		}
+		v.secret = []byte(strings.TrimSpace(string(secret)))
+	}
+	if publicKeyFile != "" {
+		data, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT public key: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in JWT public key %s", publicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWT public key: %w", err)
+		}
+		v.publicKey = key
+	}
+	return v, nil
+}
+
+// jwtClaims are the registered claims checked by the verifier
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// hasAudience reports whether the aud claim, a string or a list, names the
+// audience
+func (c jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	json.Unmarshal(c.Audience, &list)
+	for _, aud := range list {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks a compact JWS token and returns its subject and expiry
+func (v *jwtVerifier) verify(token string, now time.Time) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", time.Time{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", time.Time{}, errors.New("malformed token signature")
+	}
+	if err := v.checkSignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", time.Time{}, err
+	}
+	var expires time.Time
+	if claims.ExpiresAt != nil {
+		expires = time.Unix(*claims.ExpiresAt, 0).Add(v.leeway)
+		if !now.Before(expires) {
+			return "", time.Time{}, errors.New("token expired")
+		}
+	}
+	if claims.NotBefore != nil {
+		// The rejection only holds until the token becomes valid
+		if valid := time.Unix(*claims.NotBefore, 0).Add(-v.leeway); now.Before(valid) {
+			return "", valid, errors.New("token not yet valid")
+		}
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return "", time.Time{}, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return "", time.Time{}, errors.New("token not issued for this audience")
+	}
+	return claims.Subject, expires, nil
+}
+
+// checkSignature verifies the signature with the key matching the
+// algorithm. Algorithms without a configured key, including none, are
+// rejected.
+func (v *jwtVerifier) checkSignature(alg, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "HS256":
+		if v.secret == nil {
+			break
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS256":
+		key, ok := v.publicKey.(*rsa.PublicKey)
+		if !ok {
+			break
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "ES256":
+		key, ok := v.publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			break
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm %q", alg)
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a token
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// apiKeys maps the SHA-256 of each accepted key to the name of its owner
+type apiKeys map[[sha256.Size]byte]string
+
+// loadAPIKeys reads one key per line, optionally as name=key. Blank lines
+// and lines starting with # are skipped.
+func loadAPIKeys(path string) (apiKeys, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading API keys: %w", err)
+	}
+	defer f.Close()
+	keys := make(apiKeys)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, key, ok := strings.Cut(text, "=")
+		if !ok {
+			name, key = fmt.Sprintf("key %d", line), text
+		}
+		keys[sha256.Sum256([]byte(key))] = name
+	}
+	return keys, scanner.Err()
+}
+
+// lookup returns the owner of a key. Keys are compared by hash in constant
+// time, so lookups do not leak how much of a key matched.
+func (k apiKeys) lookup(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	for hash, name := range k {
+		if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// authenticator verifies requests on routes that require authentication
+type authenticator struct {
+	routes       []authRoute
+	jwt          *jwtVerifier
+	apiKeys      apiKeys
+	apiKeyHeader string
+	cache        *authCache
+}
+
+// validate checks that every method used by a route can be verified
+func (a *authenticator) validate() error {
+	for _, route := range a.routes {
+		for _, method := range route.methods {
+			if method == authJWT && a.jwt == nil {
+				return fmt.Errorf("auth route %s accepts jwt but neither -auth-jwt-secret nor -auth-jwt-public-key is set", route.prefix)
+			}
+			if method == authAPIKey && len(a.apiKeys) == 0 {
+				return fmt.Errorf("auth route %s accepts apikey but -auth-api-keys lists no keys", route.prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// routeFor returns the auth route with the longest prefix matching the
+// path, or nil. /api protects /api and /api/users but not /apis.
+func (a *authenticator) routeFor(path string) *authRoute {
+	var best *authRoute
+	for i, route := range a.routes {
+		if (pathRoute{prefix: strings.TrimSuffix(route.prefix, "/")}).matches(path) && (best == nil || len(route.prefix) > len(best.prefix)) {
+			best = &a.routes[i]
+		}
+	}
+	return best
+}
+
+// credential returns what the client presented for a method, or an empty
+// string when it presented nothing
+func (a *authenticator) credential(r *http.Request, method string) string {
+	switch method {
+	case authJWT:
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	case authAPIKey:
+		return r.Header.Get(a.apiKeyHeader)
+	}
+	return ""
+}
+
+// verify checks a credential with the method
+func (a *authenticator) verify(method, credential string, now time.Time) authDecision {
+	switch method {
+	case authJWT:
+		if a.jwt == nil {
+			return authDecision{err: errors.New("no JWT keys configured")}
+		}
+		subject, expires, err := a.jwt.verify(credential, now)
+		return authDecision{subject: subject, err: err, expires: expires}
+	case authAPIKey:
+		if name, ok := a.apiKeys.lookup(credential); ok {
+			return authDecision{subject: name}
+		}
+		return authDecision{err: errors.New("unknown API key")}
+	}
+	return authDecision{err: fmt.Errorf("unknown method %s", method)}
+}
+
+// authenticated answers the request with 401 unless it passes one of the
+// methods of its route. Methods are tried in order, and a credential that
+// fails falls through to the next method the client presented one for.
+func (lb *LoadBalancer) authenticated(w http.ResponseWriter, r *http.Request) bool {
+	if lb.auth == nil {
+		return true
+	}
+	r.Header.Del(authMethodHeader)
+	r.Header.Del(authSubjectHeader)
+	route := lb.auth.routeFor(r.URL.Path)
+	if route == nil {
+		return true
+	}
+	now := time.Now()
+	var failures []string
+	for _, method := range route.methods {
+		if method == authMTLS {
+			if identity := clientIdentity(r); identity != "" {
+				lb.acceptAuth(r, method, identity)
+				return true
+			}
+			continue
+		}
+		credential := lb.auth.credential(r, method)
+		if credential == "" {
+			continue
+		}
+
+		key := authCacheKey(method, credential)
+		decision, cached := lb.auth.cache.get(key, now)
+		if cached {
+			lb.metrics().IncCounter("lb_auth_cache_hits_total", map[string]string{"method": method})
+		} else {
+			decision = lb.auth.verify(method, credential, now)
+			lb.auth.cache.put(key, decision, now)
+		}
+		if decision.err != nil {
+			lb.countAuth(method, "failure")
+			failures = append(failures, fmt.Sprintf("%s authentication failed: %s", method, decision.err))
+			continue
+		}
+		lb.acceptAuth(r, method, decision.subject)
+		return true
+	}
+	if len(failures) > 0 {
+		lb.rejectUnauthorized(w, route, strings.Join(failures, "; "))
+		return false
+	}
+	lb.countAuth("none", "failure")
+	lb.rejectUnauthorized(w, route, "No credentials presented")
+	return false
+}
+
+// acceptAuth counts a successful authentication and tells the backend who
+// the client is
+func (lb *LoadBalancer) acceptAuth(r *http.Request, method, subject string) {
+	lb.countAuth(method, "success")
+	r.Header.Set(authMethodHeader, method)
+	if subject != "" {
+		r.Header.Set(authSubjectHeader, subject)
+	}
+}
+
+// countAuth counts an authentication outcome
+func (lb *LoadBalancer) countAuth(method, result string) {
+	lb.metrics().IncCounter("lb_auth_total", map[string]string{"method": method, "result": result})
+}
+
+// rejectUnauthorized answers with 401, challenging for bearer tokens when
+// the route accepts them
+func (lb *LoadBalancer) rejectUnauthorized(w http.ResponseWriter, route *authRoute, message string) {
+	for _, method := range route.methods {
+		if method == authJWT {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lb"`)
+		}
+	}
+	lb.writeError(w, errUnauthorized, message)
+}
@@ -0,0 +1,263 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a compact token with the claims, signed by sign
+func signJWT(t *testing.T, alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// hs256 signs tokens with the secret
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWTVerifierHS256(t *testing.T) {
+	now := time.Now()
+	v := &jwtVerifier{secret: []byte("s3cret"), issuer: "https://issuer.example.com", audience: "lb"}
+	claims := map[string]any{"sub": "alice", "iss": "https://issuer.example.com", "aud": []string{"lb", "other"}, "exp": now.Add(time.Hour).Unix()}
+
+	subject, expires, err := v.verify(signJWT(t, "HS256", claims, hs256("s3cret")), now)
+	if err != nil || subject != "alice" || expires.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("Expected a valid token for alice, got %q %s %v", subject, expires, err)
+	}
+
+	if _, _, err := v.verify(signJWT(t, "HS256", claims, hs256("wrong")), now); err == nil {
+		t.Errorf("Expected a token signed with another secret to be rejected")
+	}
+	if _, _, err := v.verify(signJWT(t, "none", claims, func([]byte) []byte { return nil }), now); err == nil {
+		t.Errorf("Expected an unsigned token to be rejected")
+	}
+	if _, _, err := v.verify("not-a-token", now); err == nil {
+		t.Errorf("Expected a malformed token to be rejected")
+	}
+
+	rejected := map[string]map[string]any{
+		"expired":        {"iss": "https://issuer.example.com", "aud": "lb", "exp": now.Add(-time.Hour).Unix()},
+		"not yet valid":  {"iss": "https://issuer.example.com", "aud": "lb", "nbf": now.Add(time.Hour).Unix()},
+		"wrong issuer":   {"iss": "https://evil.example.com", "aud": "lb"},
+		"wrong audience": {"iss": "https://issuer.example.com", "aud": "someone-else"},
+	}
+	for name, claims := range rejected {
+		if _, _, err := v.verify(signJWT(t, "HS256", claims, hs256("s3cret")), now); err == nil {
+			t.Errorf("Expected a token that is %s to be rejected", name)
+		}
+	}
+}
+
+func TestJWTVerifierPublicKeys(t *testing.T) {
+	now := time.Now()
+	claims := map[string]any{"sub": "bob"}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := &jwtVerifier{publicKey: &rsaKey.PublicKey}
+	token := signJWT(t, "RS256", claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return sig
+	})
+	if subject, _, err := v.verify(token, now); err != nil || subject != "bob" {
+		t.Errorf("Expected a valid RS256 token, got %q %v", subject, err)
+	}
+	// An RSA public key must not be usable as an HMAC secret
+	if _, _, err := v.verify(signJWT(t, "HS256", claims, hs256("")), now); err == nil {
+		t.Errorf("Expected HS256 to be rejected without a secret")
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v = &jwtVerifier{publicKey: &ecKey.PublicKey}
+	token = signJWT(t, "ES256", claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	})
+	if subject, _, err := v.verify(token, now); err != nil || subject != "bob" {
+		t.Errorf("Expected a valid ES256 token, got %q %v", subject, err)
+	}
+}
+
+func TestAuthenticatedRoutes(t *testing.T) {
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keysFile, []byte("# partners\nacme=k-123\n\nk-456\n"), 0o600)
+	keys, err := loadAPIKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := parseAuthRoutes([]string{"/api=mtls|jwt|apikey"})
+	lb := &LoadBalancer{
+		servers: []*Server{{URL: backendURL, Alive: true}},
+		current: -1,
+		auth: &authenticator{
+			routes:       routes,
+			jwt:          &jwtVerifier{secret: []byte("s3cret")},
+			apiKeys:      keys,
+			apiKeyHeader: "X-API-Key",
+			cache:        newAuthCache(time.Minute, 100),
+		},
+	}
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		seen = nil
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	// Routes without an auth requirement are left alone
+	if w := serve(httptest.NewRequest("GET", "/public", nil)); w.Code != http.StatusOK {
+		t.Errorf("Expected an open route to be served, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set(authSubjectHeader, "spoofed")
+	w := serve(r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get(errorCodeHeader) != "unauthorized" || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with a bearer challenge without credentials, got %d %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("X-API-Key", "k-123")
+	r.Header.Set(authSubjectHeader, "spoofed")
+	if w := serve(r); w.Code != http.StatusOK || seen.Get(authMethodHeader) != "apikey" || seen.Get(authSubjectHeader) != "acme" {
+		t.Errorf("Expected the API key of acme to be accepted, got %d %v", w.Code, seen)
+	}
+
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("X-API-Key", "k-999")
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown API key to be rejected, got %d", w.Code)
+	}
+
+	token := signJWT(t, "HS256", map[string]any{"sub": "alice"}, hs256("s3cret"))
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(r); w.Code != http.StatusOK || seen.Get(authSubjectHeader) != "alice" {
+		t.Errorf("Expected the bearer token of alice to be accepted, got %d %v", w.Code, seen)
+	}
+
+	// The decision is cached, so the token is not verified again
+	lb.auth.jwt.secret = []byte("rotated")
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("Expected the cached decision to be used, got %d", w.Code)
+	}
+
+	// A failing credential falls through to the next method presented
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("Authorization", "Bearer not-a-token")
+	r.Header.Set("X-API-Key", "k-123")
+	if w := serve(r); w.Code != http.StatusOK || seen.Get(authMethodHeader) != "apikey" || seen.Get(authSubjectHeader) != "acme" {
+		t.Errorf("Expected the API key to be accepted after an invalid token, got %d %v", w.Code, seen)
+	}
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set("Authorization", "Bearer not-a-token")
+	r.Header.Set("X-API-Key", "k-999")
+	if w := serve(r); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "jwt authentication failed") ||
+		!strings.Contains(w.Body.String(), "apikey authentication failed") {
+		t.Errorf("Expected 401 naming both failed methods, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Dot segments cannot walk from an open route into a protected one, and
+	// a prefix only covers whole path segments
+	if w := serve(httptest.NewRequest("GET", "/public/../api/orders", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected dot segments to be resolved before the auth route, got %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "//api//orders", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected duplicate slashes to be collapsed before the auth route, got %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/apis", nil)); w.Code != http.StatusOK {
+		t.Errorf("Expected /apis to be outside the /api route, got %d", w.Code)
+	}
+
+	// A verified client certificate is enough on its own
+	r = httptest.NewRequest("GET", "/api/orders", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "svc-billing"}}}}}
+	if w := serve(r); w.Code != http.StatusOK || seen.Get(authMethodHeader) != "mtls" || seen.Get(authSubjectHeader) != "CN=svc-billing" {
+		t.Errorf("Expected the client certificate to be accepted, got %d %v", w.Code, seen)
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+	now := time.Now()
+	cache := newAuthCache(time.Minute, 2)
+	cache.put("a", authDecision{subject: "a"}, now)
+	cache.put("b", authDecision{subject: "b", expires: now.Add(time.Second)}, now)
+
+	if _, ok := cache.get("b", now.Add(2*time.Second)); ok {
+		t.Errorf("Expected a decision not to outlive the credential")
+	}
+	if _, ok := cache.get("a", now.Add(2*time.Minute)); ok {
+		t.Errorf("Expected a decision not to outlive the cache TTL")
+	}
+
+	cache.put("a", authDecision{subject: "a"}, now)
+	cache.put("b", authDecision{subject: "b"}, now)
+	cache.get("a", now)
+	cache.put("c", authDecision{subject: "c"}, now)
+	if _, ok := cache.get("b", now); ok {
+		t.Errorf("Expected the least recently used decision to be evicted")
+	}
+	if decision, ok := cache.get("a", now); !ok || decision.subject != "a" {
+		t.Errorf("Expected a recently used decision to be kept")
+	}
+
+	if newAuthCache(0, 100) != nil {
+		t.Errorf("Expected no cache with a zero TTL")
+	}
+}
+
+func TestParseAuthRoutes(t *testing.T) {
+	routes, err := parseAuthRoutes([]string{"/api=jwt|apikey"})
+	if err != nil || len(routes) != 1 || routes[0].prefix != "/api" || len(routes[0].methods) != 2 {
+		t.Errorf("Unexpected routes %+v, %v", routes, err)
+	}
+	for _, def := range []string{"/api", "api=jwt", "/api=", "/api=jwt|basic"} {
+		if _, err := parseAuthRoutes([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+
+	a := &authenticator{routes: routes}
+	if err := a.validate(); err == nil {
+		t.Errorf("Expected routes without keys to be rejected")
+	}
+}
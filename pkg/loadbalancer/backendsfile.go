@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// backendsFileDelay lets a file settle after a change before it is read
+// again, so a write in several steps is applied once and complete
+const backendsFileDelay = 100 * time.Millisecond
+
+// backendsFileEntry is a backend of a YAML backends file, written either
+// as a URL or as a mapping with the URL and a weight
+type backendsFileEntry struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// UnmarshalYAML accepts a plain URL as well as the mapping
+func (e *backendsFileEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&e.URL)
+	}
+	type plain backendsFileEntry
+	return node.Decode((*plain)(e))
+}
+
+// readBackendsFile reads the backends listed in a file. Files ending in
+// .yaml or .yml hold a backends list; other files have a URL per line,
+// optionally followed by a weight, with blank lines and # comments ignored.
+func readBackendsFile(path string) ([]discoveredBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []backendsFileEntry
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		var doc struct {
+			Backends []backendsFileEntry `yaml:"backends"`
+		}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid backends file %s: %s", path, err)
+		}
+		entries = doc.Backends
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text, _, _ := strings.Cut(scanner.Text(), "#")
+			fields := strings.Fields(text)
+			if len(fields) == 0 {
+				continue
+			}
+			entry := backendsFileEntry{URL: fields[0]}
+			if len(fields) > 2 {
+				return nil, fmt.Errorf("invalid backends file %s, line %d: expected a URL and an optional weight", path, line)
+			}
+			if len(fields) == 2 {
+				if entry.Weight, err = strconv.Atoi(fields[1]); err != nil {
+					return nil, fmt.Errorf("invalid backends file %s, line %d: invalid weight %q", path, line, fields[1])
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	backends := make([]discoveredBackend, 0, len(entries))
+	for _, entry := range entries {
+		backend, err := parseBackendsFileEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backends file %s: %s", path, err)
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// parseBackendsFileEntry parses a URL, or a host:port taking the scheme of
+// the discovery
+func parseBackendsFileEntry(entry backendsFileEntry) (discoveredBackend, error) {
+	if entry.Weight < 0 {
+		return discoveredBackend{}, fmt.Errorf("weight of %s must not be negative", entry.URL)
+	}
+	raw := entry.URL
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Port() == "" && u.Scheme == "" || u.Path != "" && u.Path != "/" {
+		return discoveredBackend{}, fmt.Errorf("invalid backend %q, expected a URL or host:port", entry.URL)
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return discoveredBackend{}, fmt.Errorf("invalid backend %q: scheme must be http or https", entry.URL)
+	}
+	return discoveredBackend{addr: u.Host, scheme: u.Scheme, weight: entry.Weight}, nil
+}
+
+// watchBackendsFile calls changed whenever the file is written, created,
+// replaced or removed. The directory is watched rather than the file so
+// that files replaced by renaming, as configuration management tools do,
+// stay watched. Watch errors are logged through logf.
+func watchBackendsFile(path string, changed func(), logf func(format string, v ...any)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op != fsnotify.Chmod {
+					settle = time.After(backendsFileDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logf("Watching backends file %s: %s", path, err)
+			case <-settle:
+				settle = nil
+				changed()
+			}
+		}
+	}()
+	return nil
+}
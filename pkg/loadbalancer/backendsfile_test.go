@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadBackendsFile(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "backends.txt")
+	os.WriteFile(text, []byte("# api servers\nhttp://10.0.0.1:8080 3\n\n10.0.0.2:8080  # weight from -weight\nhttps://api-3.internal\n"), 0o644)
+	backends, err := readBackendsFile(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []discoveredBackend{
+		{addr: "10.0.0.1:8080", scheme: "http", weight: 3},
+		{addr: "10.0.0.2:8080"},
+		{addr: "api-3.internal", scheme: "https"},
+	}
+	if len(backends) != len(want) {
+		t.Fatalf("Expected %d backends, got %+v", len(want), backends)
+	}
+	for i := range want {
+		if backends[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], backends[i])
+		}
+	}
+
+	yamlFile := filepath.Join(dir, "backends.yaml")
+	os.WriteFile(yamlFile, []byte("backends:\n  - http://10.0.0.1:8080\n  - url: 10.0.0.2:8080\n    weight: 5\n"), 0o644)
+	backends, err = readBackendsFile(yamlFile)
+	if err != nil || len(backends) != 2 || backends[1] != (discoveredBackend{addr: "10.0.0.2:8080", weight: 5}) {
+		t.Errorf("Unexpected YAML backends %+v, %v", backends, err)
+	}
+
+	for _, content := range []string{"10.0.0.1", "ftp://10.0.0.1:21", "http://10.0.0.1:8080/api", "10.0.0.1:8080 heavy", "10.0.0.1:8080 -1", "10.0.0.1:8080 1 2"} {
+		os.WriteFile(text, []byte(content), 0o644)
+		if _, err := readBackendsFile(text); err == nil {
+			t.Errorf("Expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestBackendsFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.txt")
+	os.WriteFile(path, []byte("127.0.1.1:8080\n"), 0o644)
+	pool := newPool("api", nil)
+	source, _ := url.Parse("file://" + path)
+	d, err := newDiscovery(pool, nil, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.healthInterval = time.Hour
+	lb := &LoadBalancer{pools: map[string]*Pool{"api": pool}, discoveries: []*discovery{d}}
+	lb.refreshDiscovery(d)
+	lb.ScheduleDiscovery(time.Hour)
+	if servers := pool.servers(); len(servers) != 1 || servers[0].URL.String() != "http://127.0.1.1:8080" {
+		t.Fatalf("Expected the server from the file, got %v", servers)
+	}
+
+	// Replace the file the way configuration management tools do
+	next := path + ".tmp"
+	os.WriteFile(next, []byte("127.0.1.1:8080\nhttps://127.0.1.2:8443 2\n"), 0o644)
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pool.servers()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers := pool.servers()
+	if len(servers) != 2 || servers[1].URL.String() != "https://127.0.1.2:8443" || servers[1].TargetWeight() != 2 {
+		t.Fatalf("Expected the change to be picked up, got %v", servers)
+	}
+}
+
+func TestLintBackendsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.txt")
+	os.WriteFile(path, []byte("10.0.0.1\n"), 0o644)
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-server", "http://localhost:8081", "-pool", "api=file://"+path)
+	if !hasFinding(findings, lintError, "expected a URL or host:port") {
+		t.Error("Expected an invalid backends file to be reported")
+	}
+}
@@ -0,0 +1,173 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bindSpec is where the main and TLS listeners bind, given with -bind
+type bindSpec struct {
+	hosts []string // IP addresses, or "" for every interface
+	port  int      // Replaces -port when set
+}
+
+// parseBind parses -bind: an address with a port such as 0.0.0.0:8080 or
+// [::1]:8080, an IP address without one, or a network interface name
+// standing for every address of the interface
+func parseBind(bind string) (bindSpec, error) {
+	if bind == "" {
+		return bindSpec{hosts: []string{""}}, nil
+	}
+	var spec bindSpec
+	host := bind
+	if h, p, err := net.SplitHostPort(bind); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return bindSpec{}, fmt.Errorf("invalid bind address %q: bad port", bind)
+		}
+		host, spec.port = h, port
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" || net.ParseIP(host) != nil {
+		spec.hosts = []string{host}
+		return spec, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return bindSpec{}, fmt.Errorf("invalid bind address %q: not an IP address or interface", bind)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return bindSpec{}, fmt.Errorf("reading addresses of interface %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		// Link-local addresses are only reachable with a zone; skip them
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		spec.hosts = append(spec.hosts, ipNet.IP.String())
+	}
+	if len(spec.hosts) == 0 {
+		return bindSpec{}, fmt.Errorf("interface %s has no addresses to bind", host)
+	}
+	return spec, nil
+}
+
+// addrs returns the addresses to listen on for the port
+func (b bindSpec) addrs(port int) []string {
+	addrs := make([]string, 0, len(b.hosts))
+	for _, host := range b.hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addrs
+}
+
+// listenNetwork returns the network to listen on for an address. An IPv4
+// address binds IPv4 only, while an empty host or :: is dual-stack where
+// the system allows.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp"
+}
+
+// listenAll listens on every address, closing the listeners already open
+// when one fails
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := net.Listen(listenNetwork(addr), addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// mergeListeners returns a listener accepting the connections of all the
+// listeners
+func mergeListeners(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go m.accept(ln)
+	}
+	return m
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// accept hands the connections of one listener to Accept
+func (m *multiListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			m.errs <- err
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next connection from any of the listeners
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every listener
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
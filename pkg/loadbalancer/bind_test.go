@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestParseBind(t *testing.T) {
+	for bind, want := range map[string]bindSpec{
+		"":             {hosts: []string{""}},
+		"0.0.0.0:8080": {hosts: []string{"0.0.0.0"}, port: 8080},
+		"[::1]:8080":   {hosts: []string{"::1"}, port: 8080},
+		":8080":        {hosts: []string{""}, port: 8080},
+		"10.0.0.1":     {hosts: []string{"10.0.0.1"}},
+		"[::]":         {hosts: []string{"::"}},
+	} {
+		got, err := parseBind(bind)
+		if err != nil || !slices.Equal(got.hosts, want.hosts) || got.port != want.port {
+			t.Errorf("parseBind(%q) = %+v, %v, want %+v", bind, got, err, want)
+		}
+	}
+	for _, bind := range []string{"0.0.0.0:http", "[::1]:0", "no-such-interface0"} {
+		if _, err := parseBind(bind); err == nil {
+			t.Errorf("Expected %q to be rejected", bind)
+		}
+	}
+
+	// The loopback interface stands for its addresses
+	if _, err := net.InterfaceByName("lo"); err == nil {
+		spec, err := parseBind("lo")
+		if err != nil || !slices.Contains(spec.hosts, "127.0.0.1") {
+			t.Errorf("Expected lo to bind 127.0.0.1, got %+v, %v", spec, err)
+		}
+	}
+
+	spec, _ := parseBind("[::1]")
+	if addrs := spec.addrs(443); len(addrs) != 1 || addrs[0] != "[::1]:443" {
+		t.Errorf("Expected [::1]:443, got %v", addrs)
+	}
+	for addr, want := range map[string]string{":80": "tcp", "0.0.0.0:80": "tcp4", "[::]:80": "tcp", "[::1]:80": "tcp"} {
+		if got := listenNetwork(addr); got != want {
+			t.Errorf("listenNetwork(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	listeners, err := listenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := mergeListeners(listeners)
+	defer ln.Close()
+	m := ln.(*multiListener)
+	for _, l := range m.listeners {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if _, err := ln.Accept(); err != nil {
+			t.Errorf("Expected a connection to %s to be accepted, got %s", l.Addr(), err)
+		}
+	}
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Expected Accept to fail once closed")
+	}
+}
@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blueGreen sends the traffic of the default servers to one of two pools
+// and flips between them in one step. Requests already sent to the old
+// pool are left to complete there.
+type blueGreen struct {
+	pools [2]*Pool
+
+	mu         sync.Mutex
+	live       int // Index of the pool receiving traffic
+	previous   int // Index of the pool live before the last switch, -1 before any
+	switchedAt time.Time
+}
+
+// parseBlueGreen parses the two pools of a blue/green pair as blue,green
+func parseBlueGreen(value string, poolNames map[string]bool) ([2]string, error) {
+	blue, green, ok := strings.Cut(value, ",")
+	if !ok || blue == green {
+		return [2]string{}, fmt.Errorf("invalid blue/green pools %q, expected two pool names as blue,green", value)
+	}
+	for _, name := range []string{blue, green} {
+		if !poolNames[name] {
+			return [2]string{}, fmt.Errorf("blue/green pool %s is not defined", name)
+		}
+	}
+	return [2]string{blue, green}, nil
+}
+
+// newBlueGreen creates a pair with the first pool live
+func newBlueGreen(blue, green *Pool) *blueGreen {
+	return &blueGreen{pools: [2]*Pool{blue, green}, previous: -1}
+}
+
+// livePool returns the pool receiving traffic
+func (bg *blueGreen) livePool() *Pool {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	return bg.pools[bg.live]
+}
+
+// switchTo makes the named pool live, or the standby pool when name is
+// empty. It returns the pools traffic moved from and to.
+func (bg *blueGreen) switchTo(name string, now time.Time) (*Pool, *Pool, error) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	to := 1 - bg.live
+	if name != "" {
+		switch name {
+		case bg.pools[0].name:
+			to = 0
+		case bg.pools[1].name:
+			to = 1
+		default:
+			return nil, nil, fmt.Errorf("pool %s is not part of the blue/green pair", name)
+		}
+	}
+	from := bg.live
+	if to != from {
+		bg.previous, bg.live, bg.switchedAt = from, to, now
+	}
+	return bg.pools[from], bg.pools[to], nil
+}
+
+// rollback returns traffic to the pool that was live before the last
+// switch
+func (bg *blueGreen) rollback(now time.Time) (*Pool, *Pool, error) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.previous < 0 || bg.previous == bg.live {
+		return nil, nil, fmt.Errorf("nothing to roll back")
+	}
+	from := bg.live
+	bg.live, bg.previous, bg.switchedAt = bg.previous, from, now
+	return bg.pools[from], bg.pools[bg.live], nil
+}
+
+// blueGreenPool returns the live pool of the blue/green pair, or nil when
+// none is configured
+func (lb *LoadBalancer) blueGreenPool() *Pool {
+	if lb.blueGreen == nil {
+		return nil
+	}
+	return lb.blueGreen.livePool()
+}
+
+// inFlight returns the requests still being served by a pool's backends
+func (p *Pool) inFlight() int64 {
+	var n int64
+	for _, server := range p.servers() {
+		n += server.inflight.Load()
+	}
+	return n
+}
+
+// blueGreenStatus is the JSON view of the blue/green pair
+type blueGreenStatus struct {
+	Live            string     `json:"live"`
+	Standby         string     `json:"standby"`
+	SwitchedAt      *time.Time `json:"switched_at,omitempty"`
+	StandbyInFlight int64      `json:"standby_in_flight"`
+}
+
+// handleBlueGreen reports which pool is live and how many requests are
+// still completing on the standby pool
+func (lb *LoadBalancer) handleBlueGreen(w http.ResponseWriter, r *http.Request) {
+	bg := lb.blueGreen
+	bg.mu.Lock()
+	live, standby := bg.pools[bg.live], bg.pools[1-bg.live]
+	status := blueGreenStatus{Live: live.name, Standby: standby.name}
+	if !bg.switchedAt.IsZero() {
+		switchedAt := bg.switchedAt
+		status.SwitchedAt = &switchedAt
+	}
+	bg.mu.Unlock()
+	status.StandbyInFlight = standby.inFlight()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleBlueGreenSwitch makes a pool live, e.g.
+// POST /lb-admin/blue-green/switch?to=green, or the standby pool without
+// a name
+func (lb *LoadBalancer) handleBlueGreenSwitch(w http.ResponseWriter, r *http.Request) {
+	from, to, err := lb.blueGreen.switchTo(r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	lb.reportBlueGreenSwitch(from, to, "switched")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBlueGreenRollback returns traffic to the pool that was live before
+// the last switch
+func (lb *LoadBalancer) handleBlueGreenRollback(w http.ResponseWriter, r *http.Request) {
+	from, to, err := lb.blueGreen.rollback(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	lb.reportBlueGreenSwitch(from, to, "rolled back")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reportBlueGreenSwitch logs, counts and emits a change of the live pool
+func (lb *LoadBalancer) reportBlueGreenSwitch(from, to *Pool, action string) {
+	if from == to {
+		return
+	}
+	message := fmt.Sprintf("traffic %s from pool %s to %s", action, from.name, to.name)
+	lb.logf("Blue/green: %s; %d requests still completing on %s", message, from.inFlight(), from.name)
+	lb.metrics().IncCounter("lb_blue_green_switches_total", map[string]string{"pool": to.name})
+	lb.emit(EventBlueGreenSwitched, to.name, message)
+}
@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBlueGreenSwitch(t *testing.T) {
+	blue := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	green := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:9000"}, Alive: true}
+	bluePool, greenPool := newPool("blue", []*Server{blue}), newPool("green", []*Server{green})
+	lb := &LoadBalancer{
+		current:    -1,
+		pools:      map[string]*Pool{"blue": bluePool, "green": greenPool},
+		blueGreen:  newBlueGreen(bluePool, greenPool),
+		adminLocal: true,
+	}
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if got := lb.nextServerFor(httptest.NewRequest("GET", "/", nil)); got != blue {
+		t.Fatalf("Expected the blue pool to start live, got %s", got.URL.Host)
+	}
+	if w := admin("POST", "/lb-admin/blue-green/rollback"); w.Code != http.StatusConflict {
+		t.Errorf("Expected nothing to roll back before a switch, got %d", w.Code)
+	}
+
+	// A request in flight on blue is left to complete
+	if !blue.startRequest() {
+		t.Fatal("Expected a request slot on blue")
+	}
+	if w := admin("POST", "/lb-admin/blue-green/switch"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the switch to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		if got := lb.nextServerFor(httptest.NewRequest("GET", "/", nil)); got != green {
+			t.Fatalf("Expected all traffic on green after the switch, got %s", got.URL.Host)
+		}
+	}
+	var status blueGreenStatus
+	json.NewDecoder(admin("GET", "/lb-admin/blue-green").Body).Decode(&status)
+	if status.Live != "green" || status.Standby != "blue" || status.StandbyInFlight != 1 || status.SwitchedAt == nil {
+		t.Errorf("Unexpected status after the switch: %+v", status)
+	}
+	blue.finishRequest()
+
+	if w := admin("POST", "/lb-admin/blue-green/rollback"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the rollback to succeed, got %d", w.Code)
+	}
+	if got := lb.nextServerFor(httptest.NewRequest("GET", "/", nil)); got != blue {
+		t.Errorf("Expected traffic back on blue after the rollback, got %s", got.URL.Host)
+	}
+
+	if w := admin("POST", "/lb-admin/blue-green/switch?to=red"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown pool to be rejected, got %d", w.Code)
+	}
+}
+
+func TestBlueGreenSwitchToLivePool(t *testing.T) {
+	bg := newBlueGreen(newPool("blue", nil), newPool("green", nil))
+	from, to, err := bg.switchTo("blue", time.Now())
+	if err != nil || from != to {
+		t.Errorf("Expected switching to the live pool to change nothing, got %v %v %v", from, to, err)
+	}
+	if _, _, err := bg.rollback(time.Now()); err == nil {
+		t.Errorf("Expected nothing to roll back")
+	}
+}
+
+func TestParseBlueGreen(t *testing.T) {
+	pools := map[string]bool{"blue": true, "green": true}
+	if names, err := parseBlueGreen("blue,green", pools); err != nil || names != [2]string{"blue", "green"} {
+		t.Errorf("Expected blue and green, got %v %v", names, err)
+	}
+	for _, value := range []string{"blue", "blue,blue", "blue,red"} {
+		if _, err := parseBlueGreen(value, pools); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
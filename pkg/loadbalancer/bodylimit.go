@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bodyLimit caps the request body size of requests under a path prefix
+type bodyLimit struct {
+	prefix string
+	max    int64 // Bytes, 0 for no limit
+}
+
+// parseBodyLimits parses /path/prefix=bytes limits
+func parseBodyLimits(defs []string) ([]bodyLimit, error) {
+	var limits []bodyLimit
+	for _, def := range defs {
+		prefix, value, ok := strings.Cut(def, "=")
+		max, err := strconv.ParseInt(value, 10, 64)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || max < 0 {
+			return nil, fmt.Errorf("invalid body limit %q, expected /path/prefix=bytes", def)
+		}
+		limits = append(limits, bodyLimit{prefix: strings.TrimSuffix(prefix, "/"), max: max})
+	}
+	return limits, nil
+}
+
+// maxBodyFor returns the body size limit of the request path: the limit of
+// the longest matching route, or the global one
+func (lb *LoadBalancer) maxBodyFor(path string) int64 {
+	max, longest := lb.maxBody, -1
+	for _, limit := range lb.bodyLimits {
+		if (pathRoute{prefix: limit.prefix}).matches(path) && len(limit.prefix) > longest {
+			max, longest = limit.max, len(limit.prefix)
+		}
+	}
+	return max
+}
+
+// limitBody enforces the body size limit of the request. Requests declaring
+// a larger Content-Length are answered with 413 right away; other bodies
+// are cut off once they exceed the limit, failing the request with 413 if
+// no response has started.
+func (lb *LoadBalancer) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	max := lb.maxBodyFor(r.URL.Path)
+	if max == 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > max {
+		lb.writeError(w, errBodyTooLarge, fmt.Sprintf("Request body of %d bytes exceeds the limit of %d", r.ContentLength, max))
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+// bodyTooLarge reports whether the error comes from a request body cut off
+// at its size limit
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
@@ -0,0 +1,73 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimit(t *testing.T) {
+	received := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received += len(body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	server := &Server{URL: backendURL, Alive: true}
+	lb := &LoadBalancer{
+		servers:    []*Server{server},
+		current:    -1,
+		maxBody:    16,
+		bodyLimits: []bodyLimit{{prefix: "/upload", max: 64}, {prefix: "/upload/raw", max: 0}},
+		passive:    passiveSettings{failures: 1},
+	}
+	send := func(path, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if chunked {
+			// Hide the length so the body has to be cut off while streaming
+			r.Body = io.NopCloser(strings.NewReader(body))
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("/api", strings.Repeat("x", 16), false); w.Code != http.StatusOK {
+		t.Errorf("Expected a body at the limit to pass, got %d", w.Code)
+	}
+	if w := send("/api", strings.Repeat("x", 17), false); w.Code != http.StatusRequestEntityTooLarge || w.Header().Get(errorCodeHeader) != "body_too_large" {
+		t.Errorf("Expected 413 body_too_large for a declared length over the limit, got %d %q", w.Code, w.Header().Get(errorCodeHeader))
+	}
+	if received != 16 {
+		t.Errorf("Expected only the allowed body to reach the backend, got %d bytes", received)
+	}
+	if w := send("/api", strings.Repeat("x", 1<<20), true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a streamed body over the limit, got %d", w.Code)
+	}
+	if !server.IsAlive() {
+		t.Error("Expected an oversized body not to count against the backend")
+	}
+	if w := send("/upload/file", strings.Repeat("x", 64), false); w.Code != http.StatusOK {
+		t.Errorf("Expected the route limit to replace the global one, got %d", w.Code)
+	}
+	if w := send("/upload/raw", strings.Repeat("x", 1<<16), true); w.Code != http.StatusOK {
+		t.Errorf("Expected a route limit of 0 to lift the limit, got %d", w.Code)
+	}
+}
+
+func TestParseBodyLimits(t *testing.T) {
+	limits, err := parseBodyLimits([]string{"/upload/=1048576", "/raw=0"})
+	if err != nil || len(limits) != 2 || limits[0].prefix != "/upload" || limits[0].max != 1<<20 {
+		t.Errorf("Unexpected limits %+v, %v", limits, err)
+	}
+	for _, def := range []string{"upload=10", "/upload", "/upload=big", "/upload=-1"} {
+		if _, err := parseBodyLimits([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// breakerSettings configure when a circuit breaker trips
+type breakerSettings struct {
+	failures    int           // Consecutive failures that open the circuit, 0 disables
+	errorRate   float64       // Failure ratio within the window that opens the circuit, 0 disables
+	minRequests int           // Requests needed in the window before the error rate applies
+	window      time.Duration // Length of the error rate window
+	cooldown    time.Duration // Time the circuit stays open before probing
+}
+
+// enabled reports whether any trip condition is configured
+func (s breakerSettings) enabled() bool {
+	return s.failures > 0 || s.errorRate > 0
+}
+
+// circuitBreaker stops traffic to a failing backend for a cooldown period
+// and then lets a single probe request through to test recovery
+type circuitBreaker struct {
+	settings breakerSettings
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failed      int
+	openedAt    time.Time
+	probing     bool
+}
+
+// newCircuitBreaker creates a closed circuit breaker
+func newCircuitBreaker(settings breakerSettings) *circuitBreaker {
+	return &circuitBreaker{settings: settings, state: circuitClosed}
+}
+
+// blocked reports whether the breaker currently rejects traffic, without
+// changing its state
+func (b *circuitBreaker) blocked(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return now.Sub(b.openedAt) < b.settings.cooldown
+	case circuitHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// acquire admits a request, moving an open circuit whose cooldown has
+// passed to half-open and reserving its single probe slot
+func (b *circuitBreaker) acquire(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.settings.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// release gives up the probe slot of a request abandoned before the backend
+// answered, so the next request can probe instead
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probing = false
+	}
+}
+
+// record tracks a request outcome and returns the new state when it changed
+func (b *circuitBreaker) record(success bool, now time.Time) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.state
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if success {
+			b.reset(now)
+			b.state = circuitClosed
+		} else {
+			b.trip(now)
+		}
+	case circuitClosed:
+		if now.Sub(b.windowStart) >= b.settings.window {
+			b.windowStart, b.requests, b.failed = now, 0, 0
+		}
+		b.requests++
+		if success {
+			b.consecutive = 0
+		} else {
+			b.consecutive++
+			b.failed++
+		}
+
+		tooMany := b.settings.failures > 0 && b.consecutive >= b.settings.failures
+		tooHigh := b.settings.errorRate > 0 && b.requests >= b.settings.minRequests &&
+			float64(b.failed)/float64(b.requests) >= b.settings.errorRate
+		if tooMany || tooHigh {
+			b.trip(now)
+		}
+	}
+	return b.state, b.state != previous
+}
+
+// trip opens the circuit. Must hold b.mu.
+func (b *circuitBreaker) trip(now time.Time) {
+	b.state = circuitOpen
+	b.openedAt = now
+	b.probing = false
+}
+
+// reset clears the failure counters. Must hold b.mu.
+func (b *circuitBreaker) reset(now time.Time) {
+	b.consecutive = 0
+	b.windowStart, b.requests, b.failed = now, 0, 0
+}
+
+// State returns the breaker's current state
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// available reports whether the server is alive, not ejected as an outlier
+// and its circuit admits traffic
+func (s *Server) available(now time.Time) bool {
+	return s.IsAlive() && !s.outlier.ejected(now) && (s.breaker == nil || !s.breaker.blocked(now))
+}
+
+// acquire reserves the server for a request, which only fails for a
+// half-open circuit whose probe is already in flight
+func (s *Server) acquire(now time.Time) bool {
+	return s.breaker == nil || s.breaker.acquire(now)
+}
+
+// release gives up a reservation made with acquire when the request ends
+// without an outcome for the breaker
+func (s *Server) release() {
+	if s.breaker != nil {
+		s.breaker.release()
+	}
+}
+
+// CircuitState returns the state of the server's circuit breaker
+func (s *Server) CircuitState() string {
+	if s.breaker == nil {
+		return circuitClosed
+	}
+	return s.breaker.State()
+}
+
+// recordOutcome feeds a request outcome to the server's circuit breaker and
+// reports state transitions
+func (lb *LoadBalancer) recordOutcome(server *Server, success bool) {
+	if server.breaker == nil {
+		return
+	}
+	state, changed := server.breaker.record(success, time.Now())
+	if !changed {
+		return
+	}
+	lb.logf("Circuit for %s is now %s", server.URL.Host, state)
+	switch state {
+	case circuitOpen:
+		lb.emit(EventCircuitOpen, server.URL.Host, "circuit breaker opened")
+	case circuitClosed:
+		lb.emit(EventCircuitClosed, server.URL.Host, "circuit breaker closed")
+	}
+}
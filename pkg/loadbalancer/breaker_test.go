@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	b := newCircuitBreaker(breakerSettings{failures: 3, window: time.Minute, cooldown: 10 * time.Second})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		b.record(false, now)
+	}
+	if b.State() != circuitClosed {
+		t.Fatalf("Expected closed after 2 failures, got %s", b.State())
+	}
+	if state, changed := b.record(false, now); state != circuitOpen || !changed {
+		t.Fatalf("Expected circuit to open after 3 failures, got %s (changed %v)", state, changed)
+	}
+	if !b.blocked(now.Add(5 * time.Second)) {
+		t.Errorf("Expected open circuit to block during cooldown")
+	}
+
+	// After the cooldown a single probe is let through
+	later := now.Add(11 * time.Second)
+	if !b.acquire(later) {
+		t.Fatalf("Expected probe to be admitted after cooldown")
+	}
+	if b.acquire(later) {
+		t.Errorf("Expected only one probe while half-open")
+	}
+
+	// A failed probe reopens the circuit, a successful one closes it
+	if state, _ := b.record(false, later); state != circuitOpen {
+		t.Errorf("Expected failed probe to reopen circuit, got %s", state)
+	}
+	recovered := later.Add(11 * time.Second)
+	b.acquire(recovered)
+	if state, _ := b.record(true, recovered); state != circuitClosed {
+		t.Errorf("Expected successful probe to close circuit, got %s", state)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	b := newCircuitBreaker(breakerSettings{errorRate: 0.5, minRequests: 4, window: 10 * time.Second, cooldown: time.Second})
+	now := time.Now()
+
+	// Alternating outcomes never trip a consecutive threshold, but reach 50%
+	b.record(false, now)
+	b.record(true, now)
+	b.record(false, now)
+	if b.State() != circuitClosed {
+		t.Fatalf("Expected closed below minimum requests, got %s", b.State())
+	}
+	b.record(true, now)
+	if b.State() != circuitOpen {
+		t.Errorf("Expected circuit to open at 50%% errors, got %s", b.State())
+	}
+
+	// Failures from an earlier window do not count
+	b = newCircuitBreaker(breakerSettings{errorRate: 0.5, minRequests: 4, window: 10 * time.Second, cooldown: time.Second})
+	b.record(false, now)
+	b.record(false, now)
+	later := now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		b.record(true, later)
+	}
+	b.record(false, later)
+	if b.State() != circuitClosed {
+		t.Errorf("Expected closed with 25%% errors in the current window, got %s", b.State())
+	}
+}
+
+func TestNextServerSkipsOpenCircuit(t *testing.T) {
+	var servers []*Server
+	for _, host := range []string{"localhost:8081", "localhost:8082"} {
+		u, _ := url.Parse("http://" + host)
+		servers = append(servers, &Server{URL: u, Alive: true})
+	}
+	servers[0].breaker = newCircuitBreaker(breakerSettings{failures: 1, cooldown: time.Minute})
+	servers[0].breaker.record(false, time.Now())
+
+	lb := &LoadBalancer{servers: servers}
+	for i := 0; i < 4; i++ {
+		if next := lb.NextServer(); next != servers[1] {
+			t.Errorf("Expected %s, got %v", servers[1].URL.Host, next)
+		}
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	received := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			received <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	server := &Server{URL: u, Alive: true}
+	server.breaker = newCircuitBreaker(breakerSettings{failures: 1, cooldown: time.Second})
+	server.breaker.record(false, time.Now().Add(-time.Minute))
+	lb := &LoadBalancer{servers: []*Server{server}, current: -1}
+
+	// The probe is abandoned by its client before the backend answers
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil).WithContext(ctx))
+	}()
+	<-received
+	cancel()
+	<-done
+	if server.CircuitState() != circuitHalfOpen || server.breaker.blocked(time.Now()) {
+		t.Fatalf("Expected the half-open circuit to admit another probe, got %s (blocked %v)",
+			server.CircuitState(), server.breaker.blocked(time.Now()))
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || server.CircuitState() != circuitClosed {
+		t.Errorf("Expected the next probe to close the circuit, got %d and %s", w.Code, server.CircuitState())
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	b := newCircuitBreaker(breakerSettings{failures: 1, cooldown: time.Second})
+	now := time.Now()
+	b.record(false, now)
+	b.release()
+	if b.State() != circuitOpen || !b.blocked(now) {
+		t.Errorf("Expected release to leave an open circuit alone, got %s", b.State())
+	}
+	later := now.Add(2 * time.Second)
+	if !b.acquire(later) || b.acquire(later) {
+		t.Fatalf("Expected a single probe after the cooldown")
+	}
+	b.release()
+	if !b.acquire(later) {
+		t.Errorf("Expected a released probe slot to admit another probe")
+	}
+}
@@ -0,0 +1,26 @@
+package loadbalancer
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to stream bodies
+const copyBufferSize = 32 << 10
+
+// copyBuffers holds reusable buffers for streaming bodies and connections
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyPooled copies src to dst through a pooled buffer instead of
+// allocating one per copy. Connections that can splice or sendfile still
+// bypass the buffer.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,31 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// writerOnly hides io.ReaderFrom so copies go through the buffer
+type writerOnly struct {
+	io.Writer
+}
+
+func TestCopyPooled(t *testing.T) {
+	body := strings.Repeat("x", 3*copyBufferSize+7)
+	var out bytes.Buffer
+	n, err := copyPooled(writerOnly{&out}, strings.NewReader(body))
+	if err != nil || n != int64(len(body)) || out.String() != body {
+		t.Fatalf("Expected %d bytes copied, got %d (%v)", len(body), n, err)
+	}
+
+	// Copies reuse pooled buffers instead of allocating 32 KiB each
+	allocs := testing.AllocsPerRun(100, func() {
+		out.Reset()
+		copyPooled(writerOnly{&out}, io.LimitReader(strings.NewReader(body), 1024))
+	})
+	if allocs > 3 {
+		t.Errorf("Expected copies to reuse buffers, got %.0f allocations per copy", allocs)
+	}
+}
@@ -0,0 +1,204 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheStatsKeys bounds the number of URLs remembered for hit estimation
+const maxCacheStatsKeys = 10000
+
+// heuristicallyCacheable are the status codes a shared cache may store
+// without explicit freshness (RFC 9110 section 15.1)
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheStatsReport is the JSON view of the cache statistics
+type cacheStatsReport struct {
+	Responses     int64            `json:"responses"`
+	Cacheable     int64            `json:"cacheable"`
+	Uncacheable   map[string]int64 `json:"uncacheable"`
+	PotentialHits int64            `json:"potential_hits"`
+	HitRatio      float64          `json:"potential_hit_ratio"`
+	Conditional   int64            `json:"conditional_requests"`
+	NotModified   int64            `json:"not_modified"`
+	WithValidator int64            `json:"with_validators"`
+}
+
+// cacheStats estimates how effective a shared cache in front of the
+// backends would be. Responses are only observed, never stored: a repeat
+// request for a URL whose previous response would still be fresh counts
+// as a potential hit.
+type cacheStats struct {
+	mu     sync.Mutex
+	report cacheStatsReport
+	fresh  map[string]time.Time // URL to the end of its freshness lifetime
+	now    func() time.Time
+}
+
+// newCacheStats creates empty cache statistics
+func newCacheStats() *cacheStats {
+	return &cacheStats{
+		report: cacheStatsReport{Uncacheable: make(map[string]int64)},
+		fresh:  make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// cacheKey identifies the cached representation of a request
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// observe records a proxied response and returns why it could not be
+// cached, or an empty string when it could
+func (c *cacheStats) observe(r *http.Request, resp *http.Response) string {
+	now := c.now()
+	key := cacheKey(r)
+	lifetime, reason := freshnessLifetime(r, resp, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report.Responses++
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		c.report.Conditional++
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		c.report.NotModified++
+	}
+	if resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" {
+		c.report.WithValidator++
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && now.Before(c.fresh[key]) {
+		c.report.PotentialHits++
+	}
+
+	if reason != "" {
+		c.report.Uncacheable[reason]++
+		return reason
+	}
+	c.report.Cacheable++
+	if _, ok := c.fresh[key]; !ok && len(c.fresh) >= maxCacheStatsKeys {
+		c.expire(now)
+	}
+	if _, ok := c.fresh[key]; ok || len(c.fresh) < maxCacheStatsKeys {
+		c.fresh[key] = now.Add(lifetime)
+	}
+	return ""
+}
+
+// expire forgets URLs whose responses are no longer fresh. Must hold c.mu.
+func (c *cacheStats) expire(now time.Time) {
+	for key, until := range c.fresh {
+		if !now.Before(until) {
+			delete(c.fresh, key)
+		}
+	}
+}
+
+// snapshot returns a copy of the statistics with the hit ratio filled in
+func (c *cacheStats) snapshot() cacheStatsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := c.report
+	report.Uncacheable = make(map[string]int64, len(c.report.Uncacheable))
+	for reason, n := range c.report.Uncacheable {
+		report.Uncacheable[reason] = n
+	}
+	if report.Responses > 0 {
+		report.HitRatio = float64(report.PotentialHits) / float64(report.Responses)
+	}
+	return report
+}
+
+// freshnessLifetime returns how long a shared cache could serve the
+// response, or the reason it could not store it at all
+func freshnessLifetime(r *http.Request, resp *http.Response, now time.Time) (time.Duration, string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return 0, "method"
+	}
+	if !heuristicallyCacheable[resp.StatusCode] {
+		return 0, "status"
+	}
+	if r.Header.Get("Authorization") != "" {
+		return 0, "authorization"
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return 0, "set-cookie"
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return 0, "vary"
+	}
+
+	directives := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return 0, "no-store"
+	}
+	if _, ok := directives["private"]; ok {
+		return 0, "private"
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, "no-cache"
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, "expired"
+			}
+			return time.Duration(seconds) * time.Second, ""
+		}
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		until, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, "expired"
+		}
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			now = date
+		}
+		if !until.After(now) {
+			return 0, "expired"
+		}
+		return until.Sub(now), ""
+	}
+	return 0, "no-freshness"
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase
+// directives and their unquoted values
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
+
+// observeCache records cache statistics for a proxied response
+func (lb *LoadBalancer) observeCache(r *http.Request, resp *http.Response) {
+	if lb.cacheStats == nil {
+		return
+	}
+	reason := lb.cacheStats.observe(r, resp)
+	if reason == "" {
+		reason = "cacheable"
+	}
+	lb.metrics().IncCounter("lb_cache_responses_total", map[string]string{"cacheability": reason})
+}
+
+// handleCacheStats reports the cache statistics, e.g. GET /lb-admin/cache-stats
+func (lb *LoadBalancer) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.cacheStats.snapshot())
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		method   string
+		status   int
+		headers  map[string]string
+		lifetime time.Duration
+		reason   string
+	}{
+		{"GET", 200, map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, ""},
+		{"GET", 200, map[string]string{"Cache-Control": "max-age=60, s-maxage=10"}, 10 * time.Second, ""},
+		{"GET", 200, map[string]string{"Expires": now.Add(time.Hour).Format(http.TimeFormat)}, time.Hour, ""},
+		{"GET", 200, map[string]string{"Cache-Control": "private, max-age=60"}, 0, "private"},
+		{"GET", 200, map[string]string{"Cache-Control": "no-store"}, 0, "no-store"},
+		{"GET", 200, map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"}, 0, "set-cookie"},
+		{"GET", 200, map[string]string{"Cache-Control": "max-age=0"}, 0, "expired"},
+		{"GET", 200, nil, 0, "no-freshness"},
+		{"GET", 500, map[string]string{"Cache-Control": "max-age=60"}, 0, "status"},
+		{"POST", 200, map[string]string{"Cache-Control": "max-age=60"}, 0, "method"},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: make(http.Header)}
+		for name, value := range tc.headers {
+			resp.Header.Set(name, value)
+		}
+		lifetime, reason := freshnessLifetime(httptest.NewRequest(tc.method, "/", nil), resp, now)
+		if lifetime != tc.lifetime || reason != tc.reason {
+			t.Errorf("%s %d %v: got (%s, %q), want (%s, %q)", tc.method, tc.status, tc.headers, lifetime, reason, tc.lifetime, tc.reason)
+		}
+	}
+}
+
+func TestCacheStatsPotentialHits(t *testing.T) {
+	now := time.Now()
+	stats := newCacheStats()
+	stats.now = func() time.Time { return now }
+
+	fresh := &http.Response{StatusCode: 200, Header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}}
+	stats.observe(httptest.NewRequest("GET", "/a", nil), fresh)
+	stats.observe(httptest.NewRequest("GET", "/a", nil), fresh)
+	stats.observe(httptest.NewRequest("GET", "/b", nil), fresh)
+
+	// The cached copy of /a has gone stale
+	now = now.Add(2 * time.Minute)
+	conditional := httptest.NewRequest("GET", "/a", nil)
+	conditional.Header.Set("If-None-Match", `"v1"`)
+	stats.observe(conditional, &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Etag": {`"v1"`}}})
+
+	report := stats.snapshot()
+	if report.Responses != 4 || report.PotentialHits != 1 || report.HitRatio != 0.25 {
+		t.Errorf("Expected 1 potential hit in 4 responses, got %+v", report)
+	}
+	if report.Conditional != 1 || report.NotModified != 1 || report.WithValidator != 4 {
+		t.Errorf("Expected revalidation to be counted, got %+v", report)
+	}
+	if report.Cacheable != 3 || report.Uncacheable["status"] != 1 {
+		t.Errorf("Expected 3 cacheable responses and one by status, got %+v", report)
+	}
+}
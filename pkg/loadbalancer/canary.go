@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// canarySplit sends a fixed percentage of the default servers' traffic to a
+// canary pool. Unlike a cutover, the split only changes when an operator
+// changes it.
+type canarySplit struct {
+	pool *Pool
+
+	mu       sync.Mutex
+	percent  float64
+	stable   int64 // Requests left on the default servers
+	canaries int64 // Requests sent to the canary pool
+}
+
+// parseCanary parses a canary split as pool=percent, e.g. canary=5
+func parseCanary(value string, poolNames map[string]bool) (string, float64, error) {
+	name, percentStr, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid canary %q, expected pool=percent", value)
+	}
+	if !poolNames[name] {
+		return "", 0, fmt.Errorf("canary pool %s is not defined", name)
+	}
+	percent, err := parseCanaryPercent(percentStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return name, percent, nil
+}
+
+// parseCanaryPercent parses the share of traffic sent to the canary pool
+func parseCanaryPercent(value string) (float64, error) {
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid canary percentage %q, expected 0-100", value)
+	}
+	return percent, nil
+}
+
+// pick returns the canary pool for its share of requests, or nil
+func (c *canarySplit) pick() *Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.percent > 0 && rand.Float64()*100 < c.percent {
+		c.canaries++
+		return c.pool
+	}
+	c.stable++
+	return nil
+}
+
+// canaryPool returns the canary pool for the share of requests it receives,
+// or nil
+func (lb *LoadBalancer) canaryPool() *Pool {
+	if lb.canary == nil {
+		return nil
+	}
+	return lb.canary.pick()
+}
+
+// canaryStatus is the JSON view of the canary split
+type canaryStatus struct {
+	Pool     string  `json:"pool"`
+	Percent  float64 `json:"percent"`
+	Stable   int64   `json:"stable_requests"`
+	Canaries int64   `json:"canary_requests"`
+}
+
+// handleCanary reports the canary split and the requests sent to each side
+func (lb *LoadBalancer) handleCanary(w http.ResponseWriter, r *http.Request) {
+	lb.canary.mu.Lock()
+	status := canaryStatus{
+		Pool:     lb.canary.pool.name,
+		Percent:  lb.canary.percent,
+		Stable:   lb.canary.stable,
+		Canaries: lb.canary.canaries,
+	}
+	lb.canary.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSetCanary changes the canary split, e.g.
+// POST /lb-admin/canary?percent=25
+func (lb *LoadBalancer) handleSetCanary(w http.ResponseWriter, r *http.Request) {
+	percent, err := parseCanaryPercent(r.URL.Query().Get("percent"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lb.canary.mu.Lock()
+	from := lb.canary.percent
+	lb.canary.percent = percent
+	lb.canary.mu.Unlock()
+
+	lb.logf("Canary pool %s now receives %g%% of traffic (was %g%%)", lb.canary.pool.name, percent, from)
+	lb.metrics().SetGauge("lb_canary_percent", percent, map[string]string{"pool": lb.canary.pool.name})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCanarySplit(t *testing.T) {
+	stable := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	canary := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:9000"}, Alive: true}
+	pool := newPool("canary", []*Server{canary})
+	lb := &LoadBalancer{
+		servers:    []*Server{stable},
+		current:    -1,
+		pools:      map[string]*Pool{"canary": pool},
+		canary:     &canarySplit{pool: pool, percent: 20},
+		adminLocal: true,
+	}
+
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		if lb.nextServerFor(httptest.NewRequest("GET", "/", nil)) == canary {
+			canaries++
+		}
+	}
+	if canaries < 120 || canaries > 280 {
+		t.Errorf("Expected about 200 of 1000 requests on the canary, got %d", canaries)
+	}
+
+	// The split is changed at runtime through the admin API
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/canary?percent=0", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < 100; i++ {
+		if lb.nextServerFor(httptest.NewRequest("GET", "/", nil)) == canary {
+			t.Fatalf("Expected no traffic on the canary at 0%%")
+		}
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/lb-admin/canary", nil))
+	var status canaryStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.Pool != "canary" || status.Percent != 0 || status.Stable+status.Canaries != 1100 || status.Canaries != int64(canaries) {
+		t.Errorf("Unexpected canary status: %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/canary?percent=150", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an out of range percentage to be rejected, got %d", w.Code)
+	}
+}
+
+func TestParseCanary(t *testing.T) {
+	pools := map[string]bool{"canary": true}
+	if name, percent, err := parseCanary("canary=5", pools); err != nil || name != "canary" || percent != 5 {
+		t.Errorf("Expected canary at 5%%, got %q %g %v", name, percent, err)
+	}
+	for _, value := range []string{"canary", "missing=5", "canary=-1", "canary=101", "canary=lots"} {
+		if _, _, err := parseCanary(value, pools); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is a list of networks whose forwarding headers are believed
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of CIDRs or bare IP addresses
+func parseTrustedProxies(values []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", value)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR: %s", value)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// contains reports whether the IP belongs to one of the trusted networks
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP determines the originating client IP of a request. Forwarding
+// headers are only believed when the direct peer is a trusted proxy, and
+// X-Forwarded-For is walked from the right so that spoofed entries added
+// by the client itself are ignored.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer := remoteIP(r.RemoteAddr)
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !t.contains(peerIP) {
+		return peer
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				break
+			}
+			if i == 0 || !t.contains(ip) {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
+}
+
+// remoteIP strips the port from a host:port address
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"trusted peer uses forwarded for", "10.1.2.3:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"skips trusted hops from the right", "10.1.2.3:1234", "198.51.100.1, 192.168.1.1, 10.0.0.7", "", "198.51.100.1"},
+		{"ignores spoofed leftmost entry", "10.1.2.3:1234", "1.1.1.1, 198.51.100.1", "", "198.51.100.1"},
+		{"trusted peer uses real ip", "192.168.1.1:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"trusted peer without headers", "10.1.2.3:1234", "", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		if got := proxies.clientIP(r); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Errorf("Expected an error for an invalid trusted proxy")
+	}
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// coalesceKeyHeaders are the request headers that can change a response,
+// so requests differing in them are never coalesced
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Origin", "Cookie"}
+
+// coalescedCall is a backend request shared by identical concurrent requests
+type coalescedCall struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	ok     bool // The whole response was captured and can be replayed
+}
+
+// coalescer collapses identical concurrent GET requests under its path
+// prefixes into a single backend request whose response is fanned out to
+// every waiter
+type coalescer struct {
+	prefixes     []string
+	maxBody      int64  // Largest response body that is fanned out
+	apiKeyHeader string // Requests carrying an API key are never coalesced
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// newCoalescer creates a coalescer, or returns nil without prefixes
+func newCoalescer(prefixes []string, maxBody int64, apiKeyHeader string) (*coalescer, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	c := &coalescer{maxBody: maxBody, apiKeyHeader: apiKeyHeader, calls: make(map[string]*coalescedCall)}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid coalesced route %q, expected a path prefix", prefix)
+		}
+		c.prefixes = append(c.prefixes, strings.TrimSuffix(prefix, "/"))
+	}
+	return c, nil
+}
+
+// key returns the key shared by requests that get the same response, or
+// false when the request must not be coalesced. Requests carrying an API key
+// or a client certificate may get a response meant for their identity alone.
+func (c *coalescer) key(r *http.Request) (string, bool) {
+	if c == nil || r.Method != http.MethodGet || cacheBypass(r) != "" {
+		return "", false
+	}
+	if (c.apiKeyHeader != "" && r.Header.Get(c.apiKeyHeader) != "") || clientIdentity(r) != "" {
+		return "", false
+	}
+	matched := false
+	for _, prefix := range c.prefixes {
+		matched = matched || (pathRoute{prefix: prefix}).matches(r.URL.Path)
+	}
+	if !matched {
+		return "", false
+	}
+	var key strings.Builder
+	key.WriteString(cacheKey(r))
+	for _, name := range coalesceKeyHeaders {
+		key.WriteString("\x00" + strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String(), true
+}
+
+// join returns the call in flight for the key, or starts one and reports
+// that the caller leads it
+func (c *coalescer) join(key string) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's response to the waiters
+func (c *coalescer) finish(key string, call *coalescedCall, w *coalescingWriter, r *http.Request) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	// A response cut short because the leader's client went away is of no
+	// use to the others, and one meant for the leader alone must not reach
+	// them
+	call.ok = w.status != 0 && !w.overflow && r.Context().Err() == nil && shareable(w.snapshot)
+	call.status, call.header, call.body = w.status, w.snapshot, w.body.Bytes()
+	close(call.done)
+}
+
+// shareable reports whether a response may be handed to other clients: it
+// sets no cookie and is neither private nor no-store
+func shareable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	directives := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	_, private := directives["private"]
+	_, noStore := directives["no-store"]
+	return !private && !noStore
+}
+
+// coalescingWriter captures the leader's response while writing it
+type coalescingWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	snapshot http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *coalescingWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+		w.snapshot = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *coalescingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if int64(w.body.Len()+len(b)) > w.limit {
+		w.overflow = true
+	} else if !w.overflow {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *coalescingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// coalesce joins the request to an identical one in flight. A follower is
+// answered with the leader's response and true is returned. The leader gets
+// a writer capturing its response and a function publishing it when done.
+// Requests that are not coalesced, or whose leader's response could not be
+// shared, get the writer unchanged.
+func (lb *LoadBalancer) coalesce(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	key, ok := lb.coalescer.key(r)
+	if !ok || !lb.featureEnabled(gateCoalesce, r) {
+		return w, func() {}, false
+	}
+	call, leader := lb.coalescer.join(key)
+	if leader {
+		capture := &coalescingWriter{ResponseWriter: w, limit: lb.coalescer.maxBody}
+		return capture, func() { lb.coalescer.finish(key, call, capture, r) }, false
+	}
+
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return w, func() {}, false
+	}
+	if !call.ok {
+		return w, func() {}, false
+	}
+	lb.metrics().IncCounter("lb_coalesced_requests_total", nil)
+	for name, values := range call.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+	return w, func() {}, true
+}
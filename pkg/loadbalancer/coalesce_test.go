@@ -0,0 +1,153 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if r.URL.Path == "/hot/key" {
+			<-release
+		}
+		w.Header().Set("X-Hit", fmt.Sprint(n))
+		fmt.Fprint(w, strings.Repeat("v", 8))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	c, err := newCoalescer([]string{"/hot/"}, 16, "X-API-Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, coalescer: c}
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.ServeHTTP(recorders[i], httptest.NewRequest("GET", "/hot/key", nil))
+		}()
+	}
+	// Let every request join before the backend answers
+	for deadline := time.Now().Add(time.Second); hits.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits.Load() != 1 {
+		t.Errorf("Expected one backend request for identical concurrent requests, got %d", hits.Load())
+	}
+	for _, w := range recorders {
+		if w.Code != http.StatusOK || w.Body.String() != "vvvvvvvv" || w.Header().Get("X-Hit") != "1" {
+			t.Errorf("Expected every waiter to get the shared response, got %d %q %v", w.Code, w.Body.String(), w.Header())
+		}
+	}
+}
+
+func TestCoalesceUnshareable(t *testing.T) {
+	for _, header := range []string{"Set-Cookie", "Cache-Control: private", "Cache-Control: max-age=60, no-store"} {
+		t.Run(header, func(t *testing.T) {
+			var hits atomic.Int32
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := hits.Add(1)
+				<-release
+				if name, value, ok := strings.Cut(header, ": "); ok {
+					w.Header().Set(name, value)
+				} else {
+					w.Header().Set(header, fmt.Sprintf("session=%d", n))
+				}
+				w.Header().Set("X-Hit", fmt.Sprint(n))
+			}))
+			defer backend.Close()
+			backendURL, _ := url.Parse(backend.URL)
+			c, _ := newCoalescer([]string{"/hot/"}, 16, "X-API-Key")
+			lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, coalescer: c}
+
+			var wg sync.WaitGroup
+			recorders := make([]*httptest.ResponseRecorder, 3)
+			for i := range recorders {
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lb.ServeHTTP(recorders[i], httptest.NewRequest("GET", "/hot/key", nil))
+				}()
+			}
+			for deadline := time.Now().Add(time.Second); hits.Load() == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if hits.Load() != int32(len(recorders)) {
+				t.Errorf("Expected every request to reach the backend, got %d backend requests", hits.Load())
+			}
+			seen := make(map[string]bool)
+			for _, w := range recorders {
+				seen[w.Header().Get("X-Hit")] = true
+			}
+			if len(seen) != len(recorders) {
+				t.Errorf("Expected every request to get its own response, got %v", seen)
+			}
+		})
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	c, _ := newCoalescer([]string{"/hot"}, 16, "X-API-Key")
+	request := func(method, path string, header ...string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	key, ok := c.key(request("GET", "/hot/a"))
+	if !ok {
+		t.Fatal("Expected GET requests on the route to be coalesced")
+	}
+	withCert := request("GET", "/hot/a")
+	withCert.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client"}}}}}
+	for _, r := range []*http.Request{
+		withCert,
+		request("POST", "/hot/a"),
+		request("GET", "/cold/a"),
+		request("GET", "/hotter"),
+		request("GET", "/hot/a", "Authorization", "Bearer x"),
+		request("GET", "/hot/a", "X-API-Key", "secret"),
+		request("GET", "/hot/a", "Cache-Control", "no-cache"),
+	} {
+		if _, ok := c.key(r); ok {
+			t.Errorf("Expected %s %s %v not to be coalesced", r.Method, r.URL.Path, r.Header)
+		}
+	}
+	if other, _ := c.key(request("GET", "/hot/a", "Accept-Encoding", "gzip")); other == key {
+		t.Error("Expected requests with different Accept-Encoding not to share a response")
+	}
+	if other, _ := c.key(request("GET", "/hot/a?page=2")); other == key {
+		t.Error("Expected requests with different queries not to share a response")
+	}
+	if _, err := newCoalescer([]string{"hot"}, 16, "X-API-Key"); err == nil {
+		t.Error("Expected a prefix without a leading slash to be rejected")
+	}
+}
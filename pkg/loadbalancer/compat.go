@@ -0,0 +1,205 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// compatProbe is the suite a backend must pass before it is admitted to
+// rotation for the first time
+type compatProbe struct {
+	versionHeader string         // Response header carrying the backend version
+	version       *regexp.Regexp // Pattern the version must match, nil when unchecked
+	endpoints     []string       // Paths that must answer with a non-error status
+	verifyTLS     bool           // Whether https:// backends must present a valid certificate
+	tlsConfig     *tls.Config    // Backend TLS settings used for verification
+	timeout       time.Duration
+}
+
+// newCompatProbe builds the probe suite, returning nil when nothing is
+// configured
+func newCompatProbe(versionHeader, version string, endpoints []string, verifyTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*compatProbe, error) {
+	if version == "" && len(endpoints) == 0 && !verifyTLS {
+		return nil, nil
+	}
+	probe := &compatProbe{
+		versionHeader: versionHeader,
+		endpoints:     endpoints,
+		verifyTLS:     verifyTLS,
+		tlsConfig:     tlsConfig,
+		timeout:       timeout,
+	}
+	if version != "" {
+		re, err := regexp.Compile(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compatibility version pattern: %w", err)
+		}
+		probe.version = re
+	}
+	for _, path := range endpoints {
+		if len(path) == 0 || path[0] != '/' {
+			return nil, fmt.Errorf("invalid compatibility endpoint %q, expected a path", path)
+		}
+	}
+	return probe, nil
+}
+
+// compatCheck is the result of one probe
+type compatCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// compatReport is the outcome of the probe suite for one backend
+type compatReport struct {
+	Backend    string        `json:"backend"`
+	Compatible bool          `json:"compatible"`
+	Checked    time.Time     `json:"checked"`
+	Checks     []compatCheck `json:"checks"`
+}
+
+// compatState records whether a backend has been admitted
+type compatState struct {
+	mu       sync.Mutex
+	admitted bool
+	report   *compatReport
+}
+
+// run probes the backend and reports every check, passed or not
+func (p *compatProbe) run(client *http.Client, backend *Server) *compatReport {
+	report := &compatReport{Backend: backend.URL.Host, Compatible: true, Checked: time.Now()}
+	add := func(name string, err error) {
+		check := compatCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Detail = err.Error()
+			report.Compatible = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	if p.verifyTLS && backend.URL.Scheme == "https" {
+		add("tls", p.checkTLS(backend))
+	}
+
+	// The version is read from the first endpoint, or the root path
+	paths := p.endpoints
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for i, path := range paths {
+		header, err := p.get(client, backend, path)
+		if len(p.endpoints) > 0 {
+			add("endpoint "+path, err)
+		}
+		if i == 0 && p.version != nil {
+			if err == nil {
+				err = p.checkVersion(header)
+			}
+			add("version", err)
+		}
+	}
+	return report
+}
+
+// get requests a path and returns the response headers, failing on
+// connection errors and error statuses
+func (p *compatProbe) get(client *http.Client, backend *Server, path string) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	target := *backend.URL
+	target.Path = path
+	req, err := newBackendRequestTo(ctx, http.MethodGet, &target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.Header, nil
+}
+
+// checkVersion validates the version header
+func (p *compatProbe) checkVersion(header http.Header) error {
+	version := header.Get(p.versionHeader)
+	if version == "" {
+		return fmt.Errorf("no %s header", p.versionHeader)
+	}
+	if !p.version.MatchString(version) {
+		return fmt.Errorf("%s %q does not match %s", p.versionHeader, version, p.version)
+	}
+	return nil
+}
+
+// checkTLS verifies the backend certificate even when verification is
+// otherwise disabled for proxied traffic
+func (p *compatProbe) checkTLS(backend *Server) error {
+	config := &tls.Config{}
+	if p.tlsConfig != nil {
+		config = p.tlsConfig.Clone()
+	}
+	config.InsecureSkipVerify = false
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: p.timeout}, Config: config}
+	conn, err := dialer.Dial("tcp", healthAddress(backend.URL))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// admitted runs the probe suite for a backend that has not passed it yet
+// and reports whether the backend may enter rotation
+func (lb *LoadBalancer) admitted(server *Server) bool {
+	if lb.compat == nil {
+		return true
+	}
+	server.compat.mu.Lock()
+	defer server.compat.mu.Unlock()
+	if server.compat.admitted {
+		return true
+	}
+
+	client := lb.healthClient
+	if client == nil {
+		client = lb.upstreamClient()
+	}
+	report := lb.compat.run(client, server)
+	server.compat.report = report
+	if !report.Compatible {
+		for _, check := range report.Checks {
+			if !check.OK {
+				lb.errorf("Backend %s rejected: %s check failed: %s", server.URL.Host, check.Name, check.Detail)
+			}
+		}
+		return false
+	}
+	server.compat.admitted = true
+	lb.logf("Backend %s passed compatibility checks", server.URL.Host)
+	return true
+}
+
+// handleCompat reports the latest compatibility probe of every backend
+func (lb *LoadBalancer) handleCompat(w http.ResponseWriter, r *http.Request) {
+	reports := []*compatReport{}
+	for _, server := range lb.allServers() {
+		server.compat.mu.Lock()
+		if server.compat.report != nil {
+			reports = append(reports, server.compat.report)
+		}
+		server.compat.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCompatProbeGatesRotation(t *testing.T) {
+	version := "1.9.0"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Version", version)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	probe, err := newCompatProbe("X-Version", `^2\.`, []string{"/healthz"}, false, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{URL: backendURL}
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/", compat: probe}
+
+	lb.HealthCheck()
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Fatalf("Expected an incompatible backend to stay out of rotation")
+	}
+	report := server.compat.report
+	if report == nil || report.Compatible || len(report.Checks) != 2 || report.Checks[1].Name != "version" || report.Checks[1].OK {
+		t.Fatalf("Expected a failed version check, got %+v", report)
+	}
+
+	version = "2.1.0"
+	lb.HealthCheck()
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected a compatible backend to enter rotation")
+	}
+	if !server.compat.admitted || !server.compat.report.Compatible {
+		t.Errorf("Expected the backend to be admitted, got %+v", server.compat.report)
+	}
+
+	// Once admitted, the probe is not repeated
+	version = "1.0.0"
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected an admitted backend to stay in rotation")
+	}
+}
+
+func TestCompatProbeEndpoints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	probe, _ := newCompatProbe("X-Version", "", []string{"/healthz", "/missing"}, false, nil, time.Second)
+	report := probe.run(http.DefaultClient, &Server{URL: backendURL})
+	if report.Compatible {
+		t.Fatalf("Expected a missing endpoint to fail the probe")
+	}
+	if !report.Checks[0].OK || report.Checks[1].OK || report.Checks[1].Detail != "status 404" {
+		t.Errorf("Unexpected checks: %+v", report.Checks)
+	}
+}
+
+func TestCompatProbeTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	server := &Server{URL: backendURL}
+	client := backend.Client()
+
+	// Verification is enforced even when proxied traffic skips it
+	probe, _ := newCompatProbe("X-Version", "", nil, true, &tls.Config{InsecureSkipVerify: true}, time.Second)
+	if report := probe.run(client, server); report.Compatible {
+		t.Errorf("Expected an untrusted certificate to fail the probe")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	probe, _ = newCompatProbe("X-Version", "", nil, true, &tls.Config{RootCAs: roots}, time.Second)
+	if report := probe.run(client, server); !report.Compatible {
+		t.Errorf("Expected a trusted certificate to pass the probe, got %+v", report.Checks)
+	}
+}
+
+func TestNewCompatProbe(t *testing.T) {
+	if probe, err := newCompatProbe("X-Version", "", nil, false, nil, time.Second); probe != nil || err != nil {
+		t.Errorf("Expected no probe when nothing is configured")
+	}
+	if _, err := newCompatProbe("X-Version", "(", nil, false, nil, time.Second); err == nil {
+		t.Errorf("Expected an invalid version pattern to be rejected")
+	}
+	if _, err := newCompatProbe("X-Version", "", []string{"healthz"}, false, nil, time.Second); err == nil {
+		t.Errorf("Expected an endpoint without a leading slash to be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultGzipTypes are the content types compressed unless configured
+// otherwise
+const defaultGzipTypes = "text/*,application/json,application/javascript,application/xml,image/svg+xml"
+
+// compression gzips responses for clients that accept it when the backend
+// sent them uncompressed
+type compression struct {
+	minSize int64    // Smaller bodies are sent as they are
+	types   []string // Media types, or type/* for a whole type
+}
+
+// gzipWriters holds reusable gzip writers
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// newCompression creates compression settings from a comma separated list
+// of content types
+func newCompression(minSize int64, types string) *compression {
+	c := &compression{minSize: minSize}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			c.types = append(c.types, t)
+		}
+	}
+	return c
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(r *http.Request) bool {
+	accepted := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64)
+		}
+		if coding == "gzip" {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// compressible reports whether the content type is one to compress.
+// Event streams are never compressed since gzip would hold events back.
+func (c *compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse decides whether to gzip the response and, if so,
+// adjusts the headers already copied to w and returns a writer for the
+// body and a function that flushes it. Otherwise it returns w itself.
+// Bodies of unknown length are peeked at so short ones are left alone.
+func (lb *LoadBalancer) compressResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) (io.Writer, func() error) {
+	noop := func() error { return nil }
+	c := lb.compression
+	header := w.Header()
+	if c == nil || !lb.featureEnabled(gateCompress, r) || header.Get("Content-Encoding") != "" || !c.compressible(header.Get("Content-Type")) ||
+		strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return w, noop
+	}
+	// The representation depends on the client's Accept-Encoding, whether
+	// or not this response is compressed
+	header.Add("Vary", "Accept-Encoding")
+	if r.Method == http.MethodHead || !acceptsGzip(r) ||
+		resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent ||
+		(resp.ContentLength >= 0 && resp.ContentLength < c.minSize) {
+		return w, noop
+	}
+	if resp.ContentLength < 0 && c.minSize > 0 {
+		peeked := make([]byte, c.minSize)
+		n, err := io.ReadFull(resp.Body, peeked)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peeked[:n]), resp.Body), resp.Body}
+		if err != nil {
+			return w, noop
+		}
+	}
+
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "gzip")
+	// The compressed body is a different representation
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	lb.metrics().IncCounter("lb_responses_compressed_total", nil)
+
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return gz, func() error {
+		defer gzipWriters.Put(gz)
+		return gz.Close()
+	}
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, page)
+		case "/streamed":
+			w.Header().Set("Content-Type", "application/json")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, `{"ok":true}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, page)
+		case "/compressed":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, page)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{
+		servers:     []*Server{{URL: backendURL, Alive: true}},
+		current:     -1,
+		compression: newCompression(64, defaultGzipTypes),
+	}
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/page", "br;q=1.0, gzip;q=0.8")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Fatalf("Expected a gzipped response, got %v", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != page {
+		t.Errorf("Expected the page to survive compression, got %d bytes", len(body))
+	}
+
+	w = get("/page", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != page || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected an uncompressed response that varies on Accept-Encoding, got %v", w.Header())
+	}
+	if w := get("/page", "gzip;q=0, *"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected gzip;q=0 to be honoured")
+	}
+	if w := get("/streamed", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"ok":true}` {
+		t.Errorf("Expected a short body of unknown length to be sent as is, got %v %q", w.Header(), w.Body.String())
+	}
+	if w := get("/image", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected images not to be compressed")
+	}
+	if w := get("/compressed", "gzip"); w.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("Expected an already compressed response to be left alone, got %v", w.Header())
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	c := newCompression(0, "text/*, application/json")
+	for contentType, want := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"application/jsonl":        false,
+		"text/event-stream":        false,
+		"image/png":                false,
+		"":                         false,
+	} {
+		if got := c.compressible(contentType); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
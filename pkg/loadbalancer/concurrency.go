@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// saturated reports whether the server has reached its cap of in-flight
+// requests
+func (s *Server) saturated() bool {
+	limit := s.maxConcurrent.Load()
+	return limit > 0 && s.inflight.Load() >= limit
+}
+
+// startRequest takes one of the server's request slots, failing when the
+// server is at its cap
+func (s *Server) startRequest() bool {
+	for {
+		n := s.inflight.Load()
+		if limit := s.maxConcurrent.Load(); limit > 0 && n >= limit {
+			return false
+		}
+		if s.inflight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// finishRequest returns a request slot taken with startRequest
+func (s *Server) finishRequest() {
+	s.inflight.Add(-1)
+}
+
+// SetMaxConcurrent caps the server's in-flight requests, 0 for no cap
+func (s *Server) SetMaxConcurrent(limit int) {
+	s.maxConcurrent.Store(int64(limit))
+}
+
+// parseMaxConcurrent parses host:port=limit definitions
+func parseMaxConcurrent(defs []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, def := range defs {
+		host, value, ok := strings.Cut(def, "=")
+		limit, err := strconv.Atoi(value)
+		if !ok || host == "" || err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid concurrency limit %q, expected host:port=limit", def)
+		}
+		limits[host] = limit
+	}
+	return limits, nil
+}
+
+// routeSaturated reports whether an available backend of the pool the
+// request is routed to is at its cap, so the request found no backend
+// because of the caps rather than failed backends. Saturated backends of
+// other pools never hold it in the queue.
+func (lb *LoadBalancer) routeSaturated(r *http.Request) bool {
+	servers := lb.servers
+	if pool := lb.routeFor(r); pool != nil {
+		servers = pool.servers()
+	}
+	now := time.Now()
+	for _, server := range servers {
+		if server.saturated() && server.available(now) {
+			return true
+		}
+	}
+	return false
+}
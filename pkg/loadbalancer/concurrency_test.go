@@ -0,0 +1,34 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSaturatedServerIsSkipped(t *testing.T) {
+	small := &Server{URL: &url.URL{Scheme: "http", Host: "small:80"}, Alive: true}
+	large := &Server{URL: &url.URL{Scheme: "http", Host: "large:80"}, Alive: true}
+	small.SetMaxConcurrent(1)
+
+	pool := newPool("capped", []*Server{small, large})
+	if !small.startRequest() {
+		t.Fatalf("Expected a free slot on an idle server")
+	}
+	if small.startRequest() {
+		t.Fatalf("Expected the cap of 1 to be enforced")
+	}
+	for i := 0; i < 4; i++ {
+		if pool.NextServer() != large {
+			t.Fatalf("Expected a saturated server to be skipped")
+		}
+	}
+
+	small.finishRequest()
+	counts := make(map[*Server]int)
+	for i := 0; i < 4; i++ {
+		counts[pool.NextServer()]++
+	}
+	if counts[small] != 2 {
+		t.Errorf("Expected the server back in rotation once a slot frees, got %d of 4", counts[small])
+	}
+}
@@ -0,0 +1,603 @@
+package loadbalancer
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config holds the effective load balancer configuration
+type Config struct {
+	Mode                string
+	Port                int
+	Listeners           stringSliceFlag // addr?cert=...&key=...&pool=name
+	Bind                string          // host:port, IP or interface
+	AdminPort           int
+	AdminHost           string
+	DebugPort           int
+	DebugHost           string
+	SelfHealth          bool
+	HealthCheckPath     string
+	HealthCheckInterval int // Seconds
+	HealthCheckType     string
+	HealthTimeout       time.Duration
+	HealthJitter        float64
+	HealthStatus        string // Comma-separated status codes
+	HealthBody          string
+	HealthBodyRegex     string
+	HealthJSON          string // field=value
+	HealthGRPCService   string
+	HealthHost          string
+	HealthHeaders       stringSliceFlag // Name: value
+	HealthRise          int
+	HealthFall          int
+	HealthThresholds    stringSliceFlag // host:port=rise/fall
+	BackendHealth       stringSliceFlag // host:port?path=/healthz&interval=10s&timeout=2s
+	SyntheticFile       string
+	Servers             stringSliceFlag
+	TrustedProxies      stringSliceFlag
+	ProxyProtocol       bool
+	Retries             int
+	RetryMethods        string // Comma separated
+	RetryOn             string // Comma separated connect-error, timeout, 5xx or status codes
+	RetryKeyHeader      string
+	RetryMaxBody        int64
+	RetryBudget         float64
+	RetryBudgetMin      int
+	RetryBudgetWindow   time.Duration
+	Weights             stringSliceFlag // host:port=weight
+	WeightRamp          int             // Seconds
+	MaxConcurrent       int
+	BackendConcurrency  stringSliceFlag // host:port=limit
+	QueueDepth          int
+	QueueTimeout        time.Duration
+	DrainNotify         string          // METHOD /path
+	UndrainNotify       string          // METHOD /path
+	QuarantineShare     float64         // Percent
+	Pools               stringSliceFlag // name=url1,url2
+	PoolConfigs         stringSliceFlag // name?strategy=least-conn&path=/healthz
+	DiscoveryInterval   time.Duration
+	SNIRoutes           stringSliceFlag // hostname=pool
+	PathRoutes          stringSliceFlag // /path/prefix=pool[,strip]
+	TemplateRoutes      stringSliceFlag // /pattern=pool[,/path]
+	Rewrites            stringSliceFlag // /prefix=/replacement or ~regex=/replacement
+	QueryRewrites       stringSliceFlag // /prefix=op:name[=value],...
+	ResponseHeaders     stringSliceFlag // /prefix=op:Name[: value]
+	DeviceRoutes        stringSliceFlag // class=pool
+	DeviceHeader        string
+	Kills               stringSliceFlag // /path/prefix=status
+	Aggregates          stringSliceFlag // /path/prefix=mode[@pool]
+	Hedges              stringSliceFlag // /path/prefix
+	Coalesce            stringSliceFlag // /path/prefix
+	CoalesceMaxBody     int64
+	HedgeQuantile       float64
+	HedgeMinDelay       time.Duration
+	HedgeBudget         float64
+	UploadPool          string
+	UploadMinSize       int64
+	UploadContentTypes  stringSliceFlag
+	Canary              string // pool=percent
+	BlueGreen           string // blue,green
+
+	// Frontend server limits
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// Proxy timeouts
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+	RouteTimeouts         stringSliceFlag // /path/prefix=duration[,header=duration]
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DisableKeepAlives     bool
+	ServerTiming          bool
+	CacheStats            bool
+	DeadlineBudget        time.Duration
+
+	// Reverse tunnels from backends behind NAT
+	TunnelPort     int
+	TunnelToken    string
+	TunnelTLSCert  string
+	TunnelTLSKey   string
+	TunnelClientCA string
+
+	// Passive health checks
+	PassiveFailures int
+	Passive5xx      int
+
+	// Rate limiting
+	RateLimit            float64 // Requests per second
+	RateBurst            int
+	ClientRateLimit      float64 // Requests per second per client IP
+	ClientRateBurst      int
+	ClientRateOverrides  stringSliceFlag
+	ClientRateMaxClients int
+	RateLimitWarn        float64 // Share of the burst
+
+	// Compatibility probe run before backends enter rotation
+	CompatVersionHeader string
+	CompatVersion       string
+	CompatEndpoints     stringSliceFlag
+	CompatTLS           bool
+
+	// Traffic mirroring to a shadow pool
+	MirrorPool             string
+	MirrorPercent          float64
+	MirrorMaxBody          int64
+	MirrorTimeout          time.Duration
+	MirrorConcurrency      int
+	MirrorCompareBody      bool
+	MirrorLatencyTolerance time.Duration
+	MirrorIgnore           stringSliceFlag // Regular expression
+
+	// Authentication required on routes
+	AuthRoutes       stringSliceFlag // /path/prefix=method|method
+	AuthJWTSecret    string          // File
+	AuthJWTPublicKey string          // File
+	AuthJWTIssuer    string
+	AuthJWTAudience  string
+	AuthAPIKeys      string // File
+	AuthAPIKeyHeader string
+	AuthCacheTTL     time.Duration
+	AuthCacheSize    int
+
+	// Custom responses when no backend can take a request
+	NoRouteResponse   string
+	NoBackendResponse string
+	ErrorPages        stringSliceFlag // status=file or code=file
+
+	// Response compression
+	Gzip        bool
+	GzipMinSize int64
+	GzipTypes   string // Comma separated, type/* for a whole type
+
+	// Response cache
+	CacheSize      int64
+	CacheMaxObject int64
+	CacheTTLs      stringSliceFlag // /path/prefix=duration
+
+	CacheStaleWhileRevalidate time.Duration
+	CacheStaleIfError         time.Duration
+
+	// CORS
+	CORSOrigins       stringSliceFlag
+	CORSMethods       string // Comma separated
+	CORSHeaders       string // Comma separated, empty to allow any
+	CORSExposeHeaders string // Comma separated
+	CORSCredentials   bool
+	CORSMaxAge        time.Duration
+
+	// IP filtering
+	AllowIPs stringSliceFlag // cidr or /path/prefix=cidr[,cidr...]
+	DenyIPs  stringSliceFlag
+
+	// Request body limits
+	MaxBodySize int64
+	BodyLimits  stringSliceFlag // /path/prefix=bytes
+
+	// Lua plugins
+	Plugins           stringSliceFlag
+	PluginTimeout     time.Duration
+	PluginMemoryLimit int64
+
+	// Admin access
+	AdminToken     string
+	AdminBasicAuth string // user:password
+
+	// Configuration advisor
+	Advisor       time.Duration
+	AdvisorOutput string // File
+
+	// Blue/green cutover
+	CutoverSteps         string
+	CutoverBake          time.Duration
+	CutoverErrorDelta    float64
+	CutoverLatencyFactor float64
+	CutoverMinRequests   int
+
+	// Outlier detection
+	OutlierInterval      time.Duration
+	OutlierErrorFactor   float64
+	OutlierLatencyFactor float64
+	OutlierMinRequests   int
+	OutlierCooldown      time.Duration
+	OutlierRamp          time.Duration
+	OutlierMaxEjected    float64
+
+	// Circuit breaker
+	BreakerFailures    int
+	BreakerErrorRate   float64
+	BreakerMinRequests int
+	BreakerWindow      time.Duration
+	BreakerCooldown    time.Duration
+
+	// State store URL
+	Store string
+
+	// Usage accounting
+	UsageHeader     string
+	UsagePeriod     int // Seconds
+	UsageRetain     int
+	UsageMaxTenants int
+
+	// Backend TLS
+	BackendCA         string
+	BackendServerName string
+	BackendCert       string
+	BackendKey        string
+	BackendInsecure   bool
+
+	BackendHTTP3         bool
+	BackendTLSResumption bool
+
+	// Feature flags
+	FlagsFile         string
+	FlagsURL          string
+	FlagsPoll         int // Seconds
+	FlagSegmentHeader string
+	FlagGates         stringSliceFlag // feature=flag
+
+	// Frontend TLS
+	TLSPort          int
+	HTTP3            bool
+	ACMEDomains      stringSliceFlag
+	ACMECache        string
+	ACMEEmail        string
+	TLSCert          string
+	TLSKey           string
+	ClientCA         string
+	ClientAuth       string
+	ClientCertHeader string
+
+	// Binary upgrades
+	UpgradeTimeout time.Duration
+	PIDFile        string
+
+	// Logging
+	LogThrottle         time.Duration
+	AccessLog           string
+	AccessLogMaxSize    int64
+	AccessLogMaxAge     time.Duration
+	AccessLogMaxBackups int
+	LogSample           int
+	LogSampleStatus     int
+	Syslog              string
+	SyslogFacility      string
+	SyslogTag           string
+}
+
+// ParseConfig defines the command line flags on the flag set and parses args
+func ParseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := &Config{}
+
+	fs.StringVar(&cfg.Mode, "mode", modeHTTP, "Proxy mode: http or tcp")
+	fs.IntVar(&cfg.Port, "port", 80, "Port to run the load balancer on")
+	fs.StringVar(&cfg.Bind, "bind", "", "Address the main and TLS listeners bind to: host:port such as 0.0.0.0:8080 or [::1]:8080, an IP address, or an interface name (default: every interface, dual-stack)")
+	fs.Var(&cfg.Listeners, "listen", "Listener as addr?tls=true&cert=file&key=file&client-ca=file&client-auth=require&pool=name&proxy-protocol=false, replacing -port and -tls-port (can be specified multiple times)")
+	fs.DurationVar(&cfg.LogThrottle, "log-throttle", time.Minute, "Window in which identical error messages are logged once, followed by a repeat count (0 disables)")
+	fs.StringVar(&cfg.AccessLog, "access-log", "", "File receiving a line per request in the combined log format, reopened on SIGUSR1, or syslog to send the lines to -syslog (default: requests are logged with their headers to stderr)")
+	fs.Int64Var(&cfg.AccessLogMaxSize, "access-log-max-size", 100<<20, "Size in bytes at which the access log is rotated (0 for no limit)")
+	fs.DurationVar(&cfg.AccessLogMaxAge, "access-log-max-age", 0, "Age at which the access log is rotated, e.g. 24h (0 for no limit)")
+	fs.IntVar(&cfg.AccessLogMaxBackups, "access-log-max-backups", 7, "Rotated access log files kept (0 keeps all)")
+	fs.IntVar(&cfg.LogSample, "log-sample", 1, "Log 1 in N requests answered below -log-sample-status, to the access log or stderr (1 logs every request)")
+	fs.IntVar(&cfg.LogSampleStatus, "log-sample-status", 400, "Response status from which every request is logged whatever -log-sample")
+	fs.StringVar(&cfg.Syslog, "syslog", "", "Syslog endpoint receiving the log instead of stderr: local, udp://host:port, tcp://host:port or unix:///path")
+	fs.StringVar(&cfg.SyslogFacility, "syslog-facility", "daemon", "Syslog facility of the messages, e.g. daemon or local0")
+	fs.StringVar(&cfg.SyslogTag, "syslog-tag", "lb", "Tag identifying the load balancer in syslog messages")
+	fs.IntVar(&cfg.AdminPort, "admin-port", 0, "Port to serve stats and the admin API on instead of the main port; required for them in tcp mode (0 disables)")
+	fs.StringVar(&cfg.AdminHost, "admin-host", "", "Address the admin port listens on, e.g. 127.0.0.1 (default all interfaces)")
+	fs.IntVar(&cfg.DebugPort, "debug-port", 0, "Port serving pprof profiles at /debug/pprof/ and runtime statistics at /debug/runtime (0 disables)")
+	fs.StringVar(&cfg.DebugHost, "debug-host", "127.0.0.1", "Address the debug port listens on (empty for all interfaces)")
+	fs.BoolVar(&cfg.SelfHealth, "self-health", false, "Serve the load balancer's own liveness and readiness probes on /healthz and /readyz")
+	fs.StringVar(&cfg.HealthCheckPath, "health", "/", "Path to use for health checks")
+	fs.IntVar(&cfg.HealthCheckInterval, "interval", 30, "Health check interval in seconds")
+	fs.Float64Var(&cfg.HealthJitter, "health-jitter", 0.1, "Delay each health check by a random fraction of the interval, up to this share, to avoid synchronized probes")
+	fs.DurationVar(&cfg.HealthTimeout, "health-timeout", 5*time.Second, "Timeout of a single health check")
+	fs.StringVar(&cfg.HealthCheckType, "health-type", healthHTTP, "Health check type: http (GET the health path), tcp (connect only) or grpc (grpc.health.v1)")
+	fs.StringVar(&cfg.HealthGRPCService, "health-grpc-service", "", "Service name sent with grpc health checks (default: the whole server)")
+	fs.StringVar(&cfg.HealthHost, "health-host", "", "Host header sent with health checks (default: the backend's host)")
+	fs.Var(&cfg.HealthHeaders, "health-header", "Header sent with health checks as \"Name: value\" (can be specified multiple times)")
+	fs.StringVar(&cfg.HealthStatus, "health-status", "", "Comma-separated status codes accepted from health checks (default 200)")
+	fs.StringVar(&cfg.HealthBody, "health-body", "", "Substring the health check response body must contain")
+	fs.StringVar(&cfg.HealthBodyRegex, "health-body-regex", "", "Regular expression the health check response body must match")
+	fs.StringVar(&cfg.HealthJSON, "health-json", "", "JSON field the health check response must have, as field=value with dotted paths, e.g. status=ok")
+	fs.IntVar(&cfg.HealthRise, "health-rise", 2, "Consecutive successful health checks to mark a backend up")
+	fs.IntVar(&cfg.HealthFall, "health-fall", 3, "Consecutive failed health checks to mark a backend down")
+	fs.Var(&cfg.BackendHealth, "backend-health", "Per-backend health check as host:port?path=/healthz&interval=10s&timeout=2s&type=http (can be specified multiple times)")
+	fs.StringVar(&cfg.SyntheticFile, "synthetic-file", "", "JSON file of synthetic checks sent through the proxy path at their own intervals")
+	fs.Var(&cfg.HealthThresholds, "health-threshold", "Per-backend rise and fall thresholds as host:port=rise/fall (can be specified multiple times)")
+	fs.Var(&cfg.Servers, "server", "Backend server URL (can be specified multiple times)")
+	fs.Var(&cfg.Pools, "pool", "Named backend pool as name=url1,url2; dns://hostname:port discovers servers from A/AAAA records, srv://name from SRV records, file:///path from a watched backends file and docker:// from labelled containers (can be specified multiple times)")
+	fs.DurationVar(&cfg.DiscoveryInterval, "discovery-interval", 30*time.Second, "How often pools with a dns://, srv://, file:// or docker:// entry look their servers up again")
+	fs.Var(&cfg.PoolConfigs, "pool-config", "Strategy (round-robin, least-conn or random) and health check of a pool as name?strategy=least-conn&path=/healthz&interval=10s, taking the -backend-health settings (can be specified multiple times)")
+	fs.Var(&cfg.SNIRoutes, "sni-route", "Route a TLS server name to a pool as hostname=pool, wildcards like *.example.com allowed (can be specified multiple times)")
+	fs.Var(&cfg.PathRoutes, "path-route", "Route a path prefix to a pool as /path/prefix=pool, adding ,strip to remove the prefix before forwarding (can be specified multiple times)")
+	fs.Var(&cfg.TemplateRoutes, "template-route", "Route by path template as /{var}/pattern/{rest...}=pool[,/path], building the pool name and backend path from the captured variables (can be specified multiple times)")
+	fs.Var(&cfg.Rewrites, "rewrite", "Rewrite the path forwarded to backends as /prefix=/replacement or ~regex=/replacement with $1 capture groups; the first matching rule applies (can be specified multiple times)")
+	fs.Var(&cfg.QueryRewrites, "rewrite-query", "Change the query string under a path prefix as /prefix=op:name[=value],... with del:name, set:name=value, add:name=value and rename:old=new (can be specified multiple times)")
+	fs.Var(&cfg.ResponseHeaders, "response-header", "Change a header of responses under a path prefix as /prefix=set:Name: value, /prefix=add:Name: value or /prefix=del:Name; rules apply in order (can be specified multiple times)")
+	fs.Var(&cfg.DeviceRoutes, "device-route", "Route a device class (mobile, desktop, bot) to a pool as class=pool (can be specified multiple times)")
+	fs.StringVar(&cfg.UploadPool, "upload-pool", "", "Pool receiving large uploads, keeping them off the other backends")
+	fs.Int64Var(&cfg.UploadMinSize, "upload-min-size", 10<<20, "Content-Length in bytes at or above which a request goes to the upload pool")
+	fs.Var(&cfg.UploadContentTypes, "upload-content-type", "Content type always sent to the upload pool, e.g. multipart/form-data (can be specified multiple times)")
+	fs.StringVar(&cfg.Canary, "canary", "", "Send a percentage of the default servers' traffic to a canary pool as pool=percent, e.g. canary=5")
+	fs.StringVar(&cfg.BlueGreen, "blue-green", "", "Two pools as blue,green taking the default servers' traffic in turn; the first starts live and the admin API flips between them")
+	fs.Var(&cfg.Aggregates, "aggregate", "Experimental: fan requests under a path out to every backend as /path/prefix=json|first[@pool] (can be specified multiple times)")
+	fs.Var(&cfg.Hedges, "hedge", "Path prefix whose slow idempotent requests are also sent to a second backend, using the first response (can be specified multiple times)")
+	fs.Float64Var(&cfg.HedgeQuantile, "hedge-quantile", 0.95, "Rolling latency quantile of a hedged route after which a hedge is sent")
+	fs.DurationVar(&cfg.HedgeMinDelay, "hedge-min-delay", 10*time.Millisecond, "Lower bound of the hedge delay, also used until a route has enough latency samples")
+	fs.Float64Var(&cfg.HedgeBudget, "hedge-budget", 0.1, "Largest share (0-1) of a hedged route's requests that may be hedged")
+	fs.Var(&cfg.Coalesce, "coalesce", "Path prefix whose identical concurrent GET requests share one backend request (can be specified multiple times)")
+	fs.Int64Var(&cfg.CoalesceMaxBody, "coalesce-max-body", 1<<20, "Largest response body in bytes shared with coalesced requests; requests waiting on larger responses are proxied on their own")
+	fs.Var(&cfg.Kills, "kill", "Disable a route at startup as /path/prefix=status, status defaults to 503 (can be specified multiple times)")
+	fs.StringVar(&cfg.DeviceHeader, "device-header", "", "Header used to tag backend requests with the client's device class")
+	fs.Var(&cfg.Weights, "weight", "Weight of a backend as host:port=weight for weighted round-robin (can be specified multiple times)")
+	fs.IntVar(&cfg.WeightRamp, "weight-ramp", 30, "Seconds over which runtime weight changes are ramped in")
+	fs.IntVar(&cfg.MaxConcurrent, "max-concurrent", 0, "In-flight requests each backend may handle before requests go to other backends (0 disables)")
+	fs.Var(&cfg.BackendConcurrency, "backend-max-concurrent", "Per-backend in-flight request cap as host:port=limit (can be specified multiple times)")
+	fs.IntVar(&cfg.QueueDepth, "queue-depth", 100, "Requests queued while every backend is at its cap before answering 503 (0 disables queueing)")
+	fs.DurationVar(&cfg.QueueTimeout, "queue-timeout", time.Second, "How long a queued request waits for a free backend before answering 503")
+	fs.StringVar(&cfg.DrainNotify, "drain-notify", "", "HTTP call made to a backend when its weight is set to 0, as \"METHOD /path\", e.g. \"POST /admin/drain\"")
+	fs.StringVar(&cfg.UndrainNotify, "undrain-notify", "", "HTTP call made to a drained backend when its weight is raised again, as \"METHOD /path\"")
+	fs.Float64Var(&cfg.QuarantineShare, "quarantine-share", 0.5, "Default percentage of traffic sent to a quarantined backend")
+	fs.IntVar(&cfg.Retries, "retries", 2, "Times an idempotent request is retried on another backend when the connection fails (0 disables)")
+	fs.StringVar(&cfg.RetryMethods, "retry-methods", "GET,HEAD,OPTIONS,TRACE,PUT,DELETE", "Comma separated methods that are retried")
+	fs.StringVar(&cfg.RetryOn, "retry-on", "connect-error,timeout", "Comma separated failures that are retried: connect-error, timeout, 5xx or response status codes")
+	fs.StringVar(&cfg.RetryKeyHeader, "retry-idempotency-header", "Idempotency-Key", "Header that makes a request of any method retryable, such as a POST (empty disables)")
+	fs.Int64Var(&cfg.RetryMaxBody, "retry-max-body", 64<<10, "Largest request body in bytes buffered so the request can be retried; larger or chunked bodies are not retried")
+	fs.Float64Var(&cfg.RetryBudget, "retry-budget", 0.2, "Largest share (0-1) of requests within the window that may be retries, so retries cannot amplify an outage (0 disables the budget)")
+	fs.IntVar(&cfg.RetryBudgetMin, "retry-budget-min", 10, "Retries allowed within the window regardless of the budget, so low traffic can still retry")
+	fs.DurationVar(&cfg.RetryBudgetWindow, "retry-budget-window", 10*time.Second, "Sliding window over which the retry budget is measured")
+	fs.BoolVar(&cfg.ProxyProtocol, "proxy-protocol", false, "Expect HAProxy PROXY protocol v1/v2 headers on incoming connections (from trusted proxies only, when configured)")
+	fs.Var(&cfg.TrustedProxies, "trusted-proxy", "CIDR or IP of a proxy whose forwarding headers are trusted (can be specified multiple times)")
+
+	// Frontend server options
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time a client has to send the request headers, guarding against slowloris attacks (0 disables)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 0, "Time a client has to send the whole request including the body (0 disables)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 0, "Time from the end of the request headers until the response must be written, which also cuts off long downloads and streams (0 disables)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "How long an idle client keep-alive connection is kept open (0 falls back to -read-timeout)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", 1<<20, "Largest request line and headers in bytes a client may send")
+
+	// Proxy timeout options
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", 5*time.Second, "Timeout for connecting to a backend (0 disables)")
+	fs.DurationVar(&cfg.TLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake with https:// backends (0 disables)")
+	fs.DurationVar(&cfg.ResponseHeaderTimeout, "response-header-timeout", 30*time.Second, "Timeout waiting for backend response headers (0 disables)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 0, "Timeout for the whole proxied request including the response body (0 disables)")
+	fs.Var(&cfg.RouteTimeouts, "route-timeout", "Request timeout under a path prefix as /path/prefix=duration[,header=duration], replacing -request-timeout and -response-header-timeout there, 0 for no limit (can be specified multiple times)")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", 64, "Idle connections kept open to each backend for reuse")
+	fs.DurationVar(&cfg.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "How long an idle backend connection is kept open (0 keeps it indefinitely)")
+	fs.BoolVar(&cfg.DisableKeepAlives, "disable-keep-alives", false, "Open a new backend connection for every request")
+	fs.DurationVar(&cfg.DeadlineBudget, "deadline-budget", 0, "Default time budget of a request from arrival, on top of client deadlines from X-Request-Deadline and grpc-timeout (0 disables)")
+	fs.BoolVar(&cfg.CacheStats, "cache-stats", false, "Track how many responses a shared cache could store and serve, reported at /lb-admin/cache-stats")
+	fs.BoolVar(&cfg.ServerTiming, "server-timing", false, "Add a Server-Timing header with upstream DNS, connect, TLS and TTFB durations")
+
+	// Reverse tunnel options
+	fs.IntVar(&cfg.TunnelPort, "tunnel-port", 0, "Port accepting reverse tunnels from backends reached as tunnel://name (0 disables)")
+	fs.StringVar(&cfg.TunnelToken, "tunnel-token", "", "Shared token backends must present when opening a tunnel")
+	fs.StringVar(&cfg.TunnelTLSCert, "tunnel-tls-cert", "", "TLS certificate file of the tunnel listener")
+	fs.StringVar(&cfg.TunnelTLSKey, "tunnel-tls-key", "", "TLS private key file of the tunnel listener")
+	fs.StringVar(&cfg.TunnelClientCA, "tunnel-client-ca", "", "CA bundle verifying tunnel agent certificates, which must be issued for the tunnel name")
+
+	// Passive health check options
+	fs.IntVar(&cfg.PassiveFailures, "passive-failures", 3, "Consecutive connection failures or timeouts in live traffic that mark a backend down (0 disables)")
+	fs.IntVar(&cfg.Passive5xx, "passive-5xx", 0, "Consecutive 5xx responses in live traffic that mark a backend down (0 disables)")
+
+	// Rate limiting options
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", 0, "Requests per second accepted across all clients before answering 429 (0 disables)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", 0, "Requests accepted in a burst above the rate limit (default: the rate limit rounded up)")
+	fs.Float64Var(&cfg.ClientRateLimit, "client-rate-limit", 0, "Requests per second accepted from each client IP before answering 429 (0 disables)")
+	fs.IntVar(&cfg.ClientRateBurst, "client-rate-burst", 0, "Requests a client may send in a burst above its rate limit (default: the rate limit rounded up)")
+	fs.Var(&cfg.ClientRateOverrides, "client-rate-override", "Per-client rate limit for a network as cidr=rate (can be specified multiple times)")
+	fs.IntVar(&cfg.ClientRateMaxClients, "client-rate-max-clients", 10000, "Client IPs tracked by the per-client rate limit, least recently seen first to be forgotten")
+	fs.Float64Var(&cfg.RateLimitWarn, "rate-limit-warn", 0.2, "Share (0-1) of the rate limit burst below which allowed responses carry RateLimit headers; throttled responses always do (1 always sends them)")
+
+	// Compatibility probe options
+	fs.StringVar(&cfg.CompatVersionHeader, "compat-version-header", "X-Version", "Response header carrying the backend version checked by -compat-version")
+	fs.StringVar(&cfg.CompatVersion, "compat-version", "", "Regular expression the backend version must match before the backend enters rotation")
+	fs.Var(&cfg.CompatEndpoints, "compat-endpoint", "Path that must answer with a non-error status before a backend enters rotation (can be specified multiple times)")
+	fs.BoolVar(&cfg.CompatTLS, "compat-tls", false, "Require https:// backends to present a certificate that verifies before they enter rotation, even with -backend-insecure")
+
+	// Mirroring options
+	fs.StringVar(&cfg.MirrorPool, "mirror-pool", "", "Pool receiving asynchronous copies of live requests; its responses are discarded")
+	fs.Float64Var(&cfg.MirrorPercent, "mirror-percent", 100, "Percentage of requests copied to the mirror pool")
+	fs.Int64Var(&cfg.MirrorMaxBody, "mirror-max-body", 1<<20, "Largest request body in bytes that is mirrored, also the amount of response body compared")
+	fs.DurationVar(&cfg.MirrorTimeout, "mirror-timeout", 10*time.Second, "Time a shadow request may take")
+	fs.IntVar(&cfg.MirrorConcurrency, "mirror-concurrency", 100, "Shadow requests in flight before further copies are dropped")
+	fs.BoolVar(&cfg.MirrorCompareBody, "mirror-compare-body", false, "Compare primary and shadow response bodies, not only status codes")
+	fs.DurationVar(&cfg.MirrorLatencyTolerance, "mirror-latency-tolerance", 0, "Extra shadow latency tolerated before a response counts as diverged (0 ignores latency)")
+	fs.Var(&cfg.MirrorIgnore, "mirror-ignore", "Regular expression of body fragments, such as timestamps, removed before bodies are compared (can be specified multiple times)")
+
+	// Authentication options
+	fs.Var(&cfg.AuthRoutes, "auth", "Require authentication under a path as /path/prefix=method|method, methods mtls, jwt and apikey tried in order (can be specified multiple times)")
+	fs.StringVar(&cfg.AuthJWTSecret, "auth-jwt-secret", "", "File holding the HMAC secret of HS256 bearer tokens")
+	fs.StringVar(&cfg.AuthJWTPublicKey, "auth-jwt-public-key", "", "PEM file holding the RSA or ECDSA P-256 public key of RS256 or ES256 bearer tokens")
+	fs.StringVar(&cfg.AuthJWTIssuer, "auth-jwt-issuer", "", "Issuer bearer tokens must name in their iss claim")
+	fs.StringVar(&cfg.AuthJWTAudience, "auth-jwt-audience", "", "Audience bearer tokens must name in their aud claim")
+	fs.StringVar(&cfg.AuthAPIKeys, "auth-api-keys", "", "File of accepted API keys, one per line as key or name=key")
+	fs.StringVar(&cfg.AuthAPIKeyHeader, "auth-api-key-header", "X-API-Key", "Request header carrying the API key")
+	fs.DurationVar(&cfg.AuthCacheTTL, "auth-cache-ttl", time.Minute, "How long verification decisions are cached per credential (0 disables caching)")
+	fs.IntVar(&cfg.AuthCacheSize, "auth-cache-size", 10000, "Credentials whose decisions are cached, least recently used first to be forgotten")
+
+	// Unavailable route options
+	fs.StringVar(&cfg.NoRouteResponse, "no-route-response", "", "File answered with 404 when no route matches a request, instead of the default JSON body")
+	fs.StringVar(&cfg.NoBackendResponse, "no-backend-response", "", "File answered with 503 when the matched route has no healthy backend, instead of the default JSON body")
+	fs.Var(&cfg.ErrorPages, "error-page", "Template answered for load balancer errors as status=file or code=file, e.g. 503=unavailable.html or queue_full=busy.json; HTML and JSON pages get the matching Content-Type (can be specified multiple times)")
+
+	// Response compression options
+	fs.BoolVar(&cfg.Gzip, "gzip", false, "Gzip uncompressed responses for clients that send Accept-Encoding: gzip")
+	fs.Int64Var(&cfg.GzipMinSize, "gzip-min-size", 1024, "Smallest response body in bytes that is compressed")
+	fs.StringVar(&cfg.GzipTypes, "gzip-types", defaultGzipTypes, "Comma separated content types to compress, type/* for a whole type")
+
+	// Response cache options
+	fs.Int64Var(&cfg.CacheSize, "cache-size", 0, "Bytes of GET responses kept in memory and served while fresh per Cache-Control and Expires (0 disables)")
+	fs.Int64Var(&cfg.CacheMaxObject, "cache-max-object", 1<<20, "Largest response body in bytes that is cached")
+	fs.DurationVar(&cfg.CacheStaleWhileRevalidate, "cache-stale-while-revalidate", 0, "How long an expired cached response is served while it is refreshed in the background, for responses whose Cache-Control sets no stale-while-revalidate")
+	fs.DurationVar(&cfg.CacheStaleIfError, "cache-stale-if-error", 0, "How long an expired cached response is served in place of a 5xx or failed response, for responses whose Cache-Control sets no stale-if-error")
+	fs.Var(&cfg.CacheTTLs, "cache-ttl", "Freshness lifetime for cached responses under a path prefix as /path/prefix=duration, replacing the backend's own (can be specified multiple times)")
+
+	// CORS options
+	fs.Var(&cfg.CORSOrigins, "cors-origin", "Origin allowed to make cross-origin requests: scheme://host[:port], scheme://*.domain for its subdomains or * for any (can be specified multiple times; none disables CORS handling)")
+	fs.StringVar(&cfg.CORSMethods, "cors-methods", "GET,HEAD,POST,PUT,PATCH,DELETE", "Comma separated methods allowed in cross-origin requests")
+	fs.StringVar(&cfg.CORSHeaders, "cors-headers", "", "Comma separated request headers allowed in cross-origin requests (empty allows any the browser asks for)")
+	fs.StringVar(&cfg.CORSExposeHeaders, "cors-expose-headers", "", "Comma separated response headers pages may read from cross-origin responses")
+	fs.BoolVar(&cfg.CORSCredentials, "cors-credentials", false, "Allow cross-origin requests with cookies or credentials")
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache a preflight response (0 omits Access-Control-Max-Age)")
+
+	// IP filtering options
+	fs.Var(&cfg.AllowIPs, "allow-ip", "CIDR or IP allowed to send requests, or /path/prefix=cidr[,cidr...] for one route; other clients are denied with 403 (can be specified multiple times)")
+	fs.Var(&cfg.DenyIPs, "deny-ip", "CIDR or IP denied with 403, or /path/prefix=cidr[,cidr...] for one route; deny entries win over allow entries (can be specified multiple times)")
+
+	// Request body limit options
+	fs.Int64Var(&cfg.MaxBodySize, "max-body-size", 0, "Largest request body in bytes; larger ones are refused with 413 (0 for no limit)")
+	fs.Var(&cfg.BodyLimits, "max-body-route", "Largest request body under a path prefix as /path/prefix=bytes, replacing -max-body-size there, 0 for no limit (can be specified multiple times)")
+
+	// Plugin options
+	fs.Var(&cfg.Plugins, "plugin", "Lua script defining on_request(req) and/or on_response(req, resp), run for every request in the order given (can be specified multiple times)")
+	fs.DurationVar(&cfg.PluginTimeout, "plugin-timeout", 100*time.Millisecond, "Longest a plugin function may run before the request fails, in wall-clock time")
+	fs.Int64Var(&cfg.PluginMemoryLimit, "plugin-memory-limit", 16<<20, "Bytes of Lua values a plugin function may hold before the request fails (0 for no limit)")
+
+	// Admin access options
+	fs.StringVar(&cfg.AdminToken, "admin-token", "", "Bearer token required for the stats page and admin API")
+	fs.StringVar(&cfg.AdminBasicAuth, "admin-basic-auth", "", "user:password accepted with basic auth for the stats page and admin API")
+
+	// Configuration advisor options
+	fs.DurationVar(&cfg.Advisor, "advisor", 0, "Observe traffic for this long, then suggest timeouts, concurrency caps, pool sizes and strategies (0 disables)")
+	fs.StringVar(&cfg.AdvisorOutput, "advisor-output", "", "File the advisor's suggestions are written to at the end of the period, as YAML for .yaml or .yml and JSON otherwise")
+
+	// Blue/green cutover options
+	fs.StringVar(&cfg.CutoverSteps, "cutover-steps", "10,50,100", "Percentages of traffic shifted to the new pool in a cutover, ending at 100")
+	fs.DurationVar(&cfg.CutoverBake, "cutover-bake", 5*time.Minute, "Time each cutover step must run without regression before the next one")
+	fs.Float64Var(&cfg.CutoverErrorDelta, "cutover-error-delta", 0.01, "Roll back a cutover when the new pool's error rate exceeds the old servers' by this much")
+	fs.Float64Var(&cfg.CutoverLatencyFactor, "cutover-latency-factor", 1.5, "Roll back a cutover when the new pool's mean latency exceeds this multiple of the old servers' (0 disables)")
+	fs.IntVar(&cfg.CutoverMinRequests, "cutover-min-requests", 50, "Requests the new pool must serve in a cutover step before it is judged")
+
+	// Outlier detection options
+	fs.DurationVar(&cfg.OutlierInterval, "outlier-interval", 0, "Window over which backends are compared with their pool for outlier detection (0 disables)")
+	fs.Float64Var(&cfg.OutlierErrorFactor, "outlier-5xx-factor", 3, "Eject a backend whose 5xx rate exceeds this multiple of its peers' (0 disables)")
+	fs.Float64Var(&cfg.OutlierLatencyFactor, "outlier-latency-factor", 3, "Eject a backend whose mean latency exceeds this multiple of its peers' (0 disables)")
+	fs.IntVar(&cfg.OutlierMinRequests, "outlier-min-requests", 20, "Requests a backend must serve in a window before it is judged")
+	fs.DurationVar(&cfg.OutlierCooldown, "outlier-cooldown", 30*time.Second, "How long an outlier stays ejected")
+	fs.DurationVar(&cfg.OutlierRamp, "outlier-ramp", 30*time.Second, "Time over which a reinstated outlier ramps back to its full weight")
+	fs.Float64Var(&cfg.OutlierMaxEjected, "outlier-max-ejected", 0.5, "Largest share of a pool that can be ejected at once")
+
+	// Circuit breaker options
+	fs.IntVar(&cfg.BreakerFailures, "breaker-failures", 5, "Consecutive failures that open a backend's circuit (0 disables)")
+	fs.Float64Var(&cfg.BreakerErrorRate, "breaker-error-rate", 0, "Failure ratio (0-1) within the window that opens a backend's circuit (0 disables)")
+	fs.IntVar(&cfg.BreakerMinRequests, "breaker-min-requests", 20, "Requests needed in the window before the error rate applies")
+	fs.DurationVar(&cfg.BreakerWindow, "breaker-window", 10*time.Second, "Window over which the error rate is measured")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 30*time.Second, "Time a circuit stays open before a probe request is let through")
+
+	fs.StringVar(&cfg.Store, "store", "memory", "State store for rate limits: memory keeps token buckets in process, bolt:///path/to/lb.db or redis://host:6379/0 keep fixed-window counts shared between instances")
+
+	// Usage accounting options
+	fs.StringVar(&cfg.UsageHeader, "usage-header", "", "Request header identifying the tenant or API key for usage accounting (empty disables)")
+	fs.IntVar(&cfg.UsagePeriod, "usage-period", 3600, "Usage reporting period in seconds")
+	fs.IntVar(&cfg.UsageRetain, "usage-retain", 24, "Number of closed usage periods kept for reporting")
+	fs.IntVar(&cfg.UsageMaxTenants, "usage-max-tenants", 1000, "Tenants tracked per usage period; further ones are counted as \"other\" (0 for no limit)")
+
+	// Backend TLS options
+	fs.StringVar(&cfg.BackendCA, "backend-ca", "", "CA bundle used to verify https:// backends")
+	fs.StringVar(&cfg.BackendServerName, "backend-server-name", "", "Server name (SNI) to use when connecting to https:// backends")
+	fs.StringVar(&cfg.BackendCert, "backend-cert", "", "Client certificate file for mutual TLS to backends")
+	fs.StringVar(&cfg.BackendKey, "backend-key", "", "Client private key file for mutual TLS to backends")
+	fs.BoolVar(&cfg.BackendHTTP3, "backend-http3", false, "Reach https:// backends over HTTP/3 (QUIC), falling back to HTTP/2 or HTTP/1.1 over TCP")
+	fs.BoolVar(&cfg.BackendTLSResumption, "backend-tls-resumption", true, "Resume TLS sessions with https:// backends to shorten reconnect handshakes")
+	fs.BoolVar(&cfg.BackendInsecure, "backend-insecure", false, "Skip backend certificate verification (development only)")
+
+	// Feature flag options
+	fs.StringVar(&cfg.FlagsFile, "flags-file", "", "JSON file to load feature flags from")
+	fs.StringVar(&cfg.FlagsURL, "flags-url", "", "URL of a flag service to poll for feature flags")
+	fs.IntVar(&cfg.FlagsPoll, "flags-poll", 10, "Feature flag reload interval in seconds")
+	fs.StringVar(&cfg.FlagSegmentHeader, "flag-segment-header", "X-Segment", "Request header holding the client segment for feature flags")
+	fs.Var(&cfg.FlagGates, "flag-gate", "Apply a feature only to requests a feature flag is on for, as feature=flag with feature cors, rate-limit, body-limit, plugins, cache, compress or coalesce (can be specified multiple times)")
+
+	// TLS options
+	fs.IntVar(&cfg.TLSPort, "tls-port", 443, "Port to run the TLS listener on")
+	fs.BoolVar(&cfg.HTTP3, "http3", false, "Also serve HTTP/3 (QUIC) on the TLS port over UDP")
+	fs.Var(&cfg.ACMEDomains, "acme-domain", "Domain to obtain a Let's Encrypt certificate for (can be specified multiple times)")
+	fs.StringVar(&cfg.ACMECache, "acme-cache", "acme-cache", "Directory to cache ACME certificates in")
+	fs.StringVar(&cfg.ACMEEmail, "acme-email", "", "Contact email for the ACME account")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file (when not using ACME)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file (when not using ACME)")
+	fs.StringVar(&cfg.ClientCA, "client-ca", "", "CA bundle used to verify client certificates")
+	fs.StringVar(&cfg.ClientAuth, "client-auth", clientAuthNone, "Client certificate mode: none, request or require")
+	fs.StringVar(&cfg.ClientCertHeader, "client-cert-header", "", "Header used to forward the verified client certificate subject to backends")
+
+	// Upgrade options
+	fs.DurationVar(&cfg.UpgradeTimeout, "upgrade-timeout", 30*time.Second, "How long the old process lets connections finish after an upgraded process takes over its sockets on SIGUSR2")
+	fs.StringVar(&cfg.PIDFile, "pid-file", "", "File to write the process ID to once serving, rewritten by each upgraded process")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// TLSEnabled reports whether the TLS listener should be started
+func (cfg *Config) TLSEnabled() bool {
+	return len(cfg.ACMEDomains) > 0 || cfg.TLSCert != ""
+}
+
+// parseServerURLs parses the configured backend URLs
+func (cfg *Config) parseServerURLs() ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, serverURL := range cfg.Servers {
+		pUrl, err := url.Parse(serverURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server URL: %s", err)
+		}
+		if err := normalizeUnixURL(pUrl); err != nil {
+			return nil, err
+		}
+		urls = append(urls, pUrl)
+	}
+	return urls, nil
+}
+
+// parsePools parses the named pool definitions
+func (cfg *Config) parsePools() (map[string][]*url.URL, error) {
+	pools := make(map[string][]*url.URL)
+	for _, def := range cfg.Pools {
+		name, list, ok := strings.Cut(def, "=")
+		if !ok || name == "" || list == "" {
+			return nil, fmt.Errorf("invalid pool %q, expected name=url1,url2", def)
+		}
+		if _, exists := pools[name]; exists {
+			return nil, fmt.Errorf("pool %s is defined more than once", name)
+		}
+		for _, serverURL := range strings.Split(list, ",") {
+			pUrl, err := url.Parse(strings.TrimSpace(serverURL))
+			if err != nil {
+				return nil, fmt.Errorf("invalid server URL in pool %s: %s", name, err)
+			}
+			if err := normalizeUnixURL(pUrl); err != nil {
+				return nil, fmt.Errorf("invalid server URL in pool %s: %s", name, err)
+			}
+			pools[name] = append(pools[name], pUrl)
+		}
+	}
+	return pools, nil
+}
+
+// parseSNIRoutes parses the SNI routes, checking that every referenced pool exists
+func (cfg *Config) parseSNIRoutes(pools map[string][]*url.URL) (sniRoutes, error) {
+	routes := make(sniRoutes)
+	for _, def := range cfg.SNIRoutes {
+		host, pool, ok := strings.Cut(def, "=")
+		if !ok || host == "" || pool == "" {
+			return nil, fmt.Errorf("invalid SNI route %q, expected hostname=pool", def)
+		}
+		if _, exists := pools[pool]; !exists {
+			return nil, fmt.Errorf("SNI route %s references unknown pool %s", host, pool)
+		}
+		routes[strings.ToLower(host)] = pool
+	}
+	return routes, nil
+}
@@ -0,0 +1,232 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connRateWindow is the window over which the new-connection rate of a
+// backend is measured
+const connRateWindow = time.Minute
+
+// connStats records per-backend connection setup latency and connection
+// reuse observed by tracing the upstream transport
+type connStats struct {
+	maxIdlePerHost int // Idle connections the pool keeps per backend, 0 when unknown
+
+	mu       sync.Mutex
+	backends map[string]*backendConnStats
+}
+
+// backendConnStats holds the connection setup distributions and reuse
+// counts for one backend
+type backendConnStats struct {
+	connect      *histogram
+	tlsHandshake *histogram
+	resumed      int64 // TLS handshakes that resumed a previous session
+	reused       int64 // Requests sent on a pooled connection
+	created      int64 // Requests that needed a new connection
+	exhausted    int64 // New connections beyond what the idle pool can keep
+
+	windowStart time.Time
+	windowNew   int64   // New connections in the current window
+	newRate     float64 // New connections per second in the last full window
+}
+
+// newConnStats creates empty connection statistics for a pool keeping up
+// to maxIdlePerHost idle connections per backend
+func newConnStats(maxIdlePerHost int) *connStats {
+	return &connStats{maxIdlePerHost: maxIdlePerHost, backends: make(map[string]*backendConnStats)}
+}
+
+// recordConn counts whether a request got a pooled or a new connection.
+// A new connection while more requests are in flight than the idle pool
+// can keep means the pool is exhausted: the extra connection is closed
+// when it is returned instead of being reused.
+func (c *connStats) recordConn(host string, reused bool, inFlight int64, now time.Time) (exhausted bool) {
+	stats := c.backend(host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reused {
+		stats.reused++
+		return false
+	}
+	stats.created++
+	if stats.windowStart.IsZero() {
+		stats.windowStart = now
+	}
+	if elapsed := now.Sub(stats.windowStart); elapsed >= connRateWindow {
+		stats.newRate = float64(stats.windowNew) / elapsed.Seconds()
+		stats.windowStart, stats.windowNew = now, 0
+	}
+	stats.windowNew++
+	if c.maxIdlePerHost > 0 && inFlight > int64(c.maxIdlePerHost) {
+		stats.exhausted++
+		return true
+	}
+	return false
+}
+
+// backend returns the statistics for a backend, creating them on first use
+func (c *connStats) backend(host string) *backendConnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.backends[host]
+	if !ok {
+		stats = &backendConnStats{connect: newHistogram(), tlsHandshake: newHistogram()}
+		c.backends[host] = stats
+	}
+	return stats
+}
+
+// withConnTrace attaches a trace to the backend request that records
+// connection reuse, and TCP connect and TLS handshake latency for newly
+// dialed connections
+func (lb *LoadBalancer) withConnTrace(req *http.Request, server *Server) *http.Request {
+	if lb.connStats == nil {
+		return req
+	}
+	host := server.URL.Host
+	labels := map[string]string{"backend": host}
+
+	var connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := "false"
+			if info.Reused {
+				reused = "true"
+			}
+			lb.metrics().IncCounter("lb_upstream_conns_total", map[string]string{"backend": host, "reused": reused})
+			if lb.connStats.recordConn(host, info.Reused, server.inflight.Load(), time.Now()) {
+				lb.metrics().IncCounter("lb_upstream_pool_exhausted_total", labels)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil || connectStart.IsZero() {
+				return
+			}
+			d := time.Since(connectStart)
+			lb.connStats.backend(host).connect.observe(d)
+			lb.metrics().ObserveDuration("lb_upstream_connect_seconds", d, labels)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil || tlsStart.IsZero() {
+				return
+			}
+			d := time.Since(tlsStart)
+			stats := lb.connStats.backend(host)
+			stats.tlsHandshake.observe(d)
+			if state.DidResume {
+				lb.connStats.mu.Lock()
+				stats.resumed++
+				lb.connStats.mu.Unlock()
+			}
+			lb.metrics().ObserveDuration("lb_upstream_tls_handshake_seconds", d, labels)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// connPoolReport is the JSON view of how well a backend's connection pool
+// is reused
+type connPoolReport struct {
+	Backend        string  `json:"backend"`
+	Requests       int64   `json:"requests"`
+	Reused         int64   `json:"reused"`
+	New            int64   `json:"new"`
+	ReuseRatio     float64 `json:"reuse_ratio"`
+	NewPerSecond   float64 `json:"new_per_second"`
+	PoolExhausted  int64   `json:"pool_exhausted"`
+	MaxIdlePerHost int     `json:"max_idle_per_host"`
+}
+
+// newConnRate returns the new connections per second of the last full
+// window, or of the current one once it is longer than a window or before
+// a window has completed
+func (s *backendConnStats) newConnRate(now time.Time) float64 {
+	elapsed := now.Sub(s.windowStart)
+	if s.windowStart.IsZero() || elapsed < time.Second {
+		return s.newRate
+	}
+	if s.newRate == 0 || elapsed >= connRateWindow {
+		return float64(s.windowNew) / elapsed.Seconds()
+	}
+	return s.newRate
+}
+
+// poolReport summarises connection reuse of every backend, sorted by host
+func (c *connStats) poolReport(now time.Time) []connPoolReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := make([]connPoolReport, 0, len(c.backends))
+	for host, stats := range c.backends {
+		entry := connPoolReport{
+			Backend:        host,
+			Requests:       stats.reused + stats.created,
+			Reused:         stats.reused,
+			New:            stats.created,
+			NewPerSecond:   stats.newConnRate(now),
+			PoolExhausted:  stats.exhausted,
+			MaxIdlePerHost: c.maxIdlePerHost,
+		}
+		if entry.Requests > 0 {
+			entry.ReuseRatio = float64(stats.reused) / float64(entry.Requests)
+		}
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Backend < report[j].Backend })
+	return report
+}
+
+// handleConnPool reports connection reuse, the new-connection rate and
+// pool exhaustion per backend
+func (lb *LoadBalancer) handleConnPool(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.connStats.poolReport(time.Now()))
+}
+
+// handleUpstreamLatency reports connection setup latency per backend
+func (lb *LoadBalancer) handleUpstreamLatency(w http.ResponseWriter, r *http.Request) {
+	type backendReport struct {
+		Backend          string         `json:"backend"`
+		Connect          latencySummary `json:"connect"`
+		TLSHandshake     latencySummary `json:"tls_handshake"`
+		ResumedHandshake int64          `json:"resumed_handshakes"`
+	}
+
+	lb.connStats.mu.Lock()
+	hosts := make([]string, 0, len(lb.connStats.backends))
+	for host := range lb.connStats.backends {
+		hosts = append(hosts, host)
+	}
+	lb.connStats.mu.Unlock()
+	sort.Strings(hosts)
+
+	report := make([]backendReport, 0, len(hosts))
+	for _, host := range hosts {
+		stats := lb.connStats.backend(host)
+		lb.connStats.mu.Lock()
+		resumed := stats.resumed
+		lb.connStats.mu.Unlock()
+		report = append(report, backendReport{
+			Backend:          host,
+			Connect:          stats.connect.summary(),
+			TLSHandshake:     stats.tlsHandshake.summary(),
+			ResumedHandshake: resumed,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnPoolReuse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	lb := &LoadBalancer{
+		servers:   []*Server{{URL: backendURL, Alive: true}},
+		current:   -1,
+		transport: newBackendTransports(http.DefaultTransport.(*http.Transport).Clone()),
+		connStats: newConnStats(64),
+	}
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/lb-admin/conn-pool", nil))
+	var report []connPoolReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if len(report) != 1 || report[0].Backend != backendURL.Host {
+		t.Fatalf("Expected a report for the backend, got %+v", report)
+	}
+	if report[0].New != 1 || report[0].Reused != 3 || report[0].ReuseRatio != 0.75 || report[0].PoolExhausted != 0 {
+		t.Errorf("Expected 1 new and 3 reused connections, got %+v", report[0])
+	}
+}
+
+func TestConnPoolExhaustion(t *testing.T) {
+	now := time.Now()
+	stats := newConnStats(2)
+	if stats.recordConn("a:80", false, 2, now) {
+		t.Errorf("Expected a new connection within the idle pool not to count as exhaustion")
+	}
+	if !stats.recordConn("a:80", false, 3, now) {
+		t.Errorf("Expected a new connection beyond the idle pool to count as exhaustion")
+	}
+	if stats.recordConn("a:80", true, 3, now) {
+		t.Errorf("Expected a reused connection never to count as exhaustion")
+	}
+
+	// The new-connection rate covers the last full window
+	for i := 0; i < 118; i++ {
+		stats.recordConn("a:80", false, 1, now.Add(time.Duration(i)*500*time.Millisecond))
+	}
+	stats.recordConn("a:80", false, 1, now.Add(connRateWindow))
+	report := stats.poolReport(now.Add(connRateWindow + time.Second))
+	if got := report[0].NewPerSecond; got != 2 {
+		t.Errorf("Expected 2 new connections per second, got %g", got)
+	}
+	if report[0].New != 121 || report[0].PoolExhausted != 1 {
+		t.Errorf("Unexpected counts %+v", report[0])
+	}
+}
@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy answers cross-origin requests on behalf of the backends
+type corsPolicy struct {
+	origins       []string // Exact origins, * for any, or scheme://*.domain
+	methods       []string
+	headers       []string // Allowed request headers, empty to allow what is asked for
+	exposeHeaders []string
+	credentials   bool
+	maxAge        time.Duration
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newCORSPolicy validates the allowed origins and builds the policy
+func newCORSPolicy(origins []string, methods, headers, exposeHeaders string, credentials bool, maxAge time.Duration) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		methods:       splitList(strings.ToUpper(methods)),
+		exposeHeaders: splitList(exposeHeaders),
+		credentials:   credentials,
+		maxAge:        maxAge,
+	}
+	for _, header := range splitList(headers) {
+		policy.headers = append(policy.headers, http.CanonicalHeaderKey(header))
+	}
+	for _, origin := range origins {
+		origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+		if origin != "*" {
+			u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" ||
+				(strings.Contains(origin, "*") && !strings.HasPrefix(origin, u.Scheme+"://*.")) {
+				return nil, fmt.Errorf("invalid CORS origin %q, expected *, scheme://host[:port] or scheme://*.domain", origin)
+			}
+		}
+		policy.origins = append(policy.origins, origin)
+	}
+	return policy, nil
+}
+
+// allowsOrigin reports whether the origin may make cross-origin requests
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok && strings.HasSuffix(rest, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowOrigin sets the headers letting the origin read the response
+func (p *corsPolicy) allowOrigin(header http.Header, origin string) {
+	if slices.Contains(p.origins, "*") && !p.credentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight checks the method and headers a preflight request asks for,
+// returning the headers to allow or the reason to refuse
+func (p *corsPolicy) preflight(r *http.Request) ([]string, string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !slices.Contains(p.methods, method) {
+		return nil, fmt.Sprintf("method %s is not allowed", method)
+	}
+	requested := splitList(r.Header.Get("Access-Control-Request-Headers"))
+	if len(p.headers) == 0 {
+		return requested, ""
+	}
+	for _, header := range requested {
+		if !slices.Contains(p.headers, http.CanonicalHeaderKey(header)) {
+			return nil, fmt.Sprintf("header %s is not allowed", header)
+		}
+	}
+	return p.headers, ""
+}
+
+// sameOrigin reports whether the Origin header names the host the request
+// was sent to, as browsers also send it on same-origin requests
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleCORS applies the CORS policy to the request. Preflight requests are
+// answered without reaching a backend, 403 when the policy refuses them.
+// Allowed cross-origin requests get the CORS response headers; others are
+// forwarded without them, so browsers keep the response from the page.
+// It reports whether the request has been answered.
+func (lb *LoadBalancer) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	p := lb.cors
+	origin := r.Header.Get("Origin")
+	if p == nil || origin == "" || sameOrigin(r, origin) {
+		return false
+	}
+	isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if !p.allowsOrigin(origin) {
+		if !isPreflight {
+			return false
+		}
+		lb.metrics().IncCounter("lb_cors_rejected_total", nil)
+		lb.writeError(w, errCORSRejected, fmt.Sprintf("Origin %s is not allowed", origin))
+		return true
+	}
+	if !isPreflight {
+		p.allowOrigin(w.Header(), origin)
+		if len(p.exposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.exposeHeaders, ", "))
+		}
+		return false
+	}
+
+	headers, refused := p.preflight(r)
+	if refused != "" {
+		lb.metrics().IncCounter("lb_cors_rejected_total", nil)
+		lb.writeError(w, errCORSRejected, refused)
+		return true
+	}
+	p.allowOrigin(w.Header(), origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if p.maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+	}
+	lb.metrics().IncCounter("lb_cors_preflights_total", nil)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// stripCORS removes the CORS headers a backend sent, so the load
+// balancer's policy is the only one clients see
+func (lb *LoadBalancer) stripCORS(header http.Header) {
+	if lb.cors == nil {
+		return
+	}
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+}
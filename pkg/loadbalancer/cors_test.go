@@ -0,0 +1,114 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	backendHits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHits++
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Request-Id", "42")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	cors, err := newCORSPolicy([]string{"https://app.example.com", "https://*.example.org"}, "GET,POST", "Content-Type", "X-Request-Id", true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers: []*Server{{URL: backendURL, Alive: true}},
+		current: -1,
+		cors:    cors,
+	}
+	send := func(method, origin string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://lb.example.net/api", nil)
+		r.Header.Set("Origin", origin)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("OPTIONS", "https://app.example.com", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "content-type")
+	if w.Code != http.StatusNoContent || backendHits != 0 {
+		t.Fatalf("Expected the preflight to be answered with 204 at the edge, got %d after %d backend requests", w.Code, backendHits)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" || w.Header().Get("Access-Control-Max-Age") != "3600" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Unexpected preflight headers %v", w.Header())
+	}
+
+	for _, tc := range []struct {
+		origin string
+		header []string
+	}{
+		{"https://evil.example.com", []string{"Access-Control-Request-Method", "GET"}},
+		{"https://app.example.com", []string{"Access-Control-Request-Method", "DELETE"}},
+		{"https://app.example.com", []string{"Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "X-Secret"}},
+	} {
+		w := send("OPTIONS", tc.origin, tc.header...)
+		if w.Code != http.StatusForbidden || w.Header().Get(errorCodeHeader) != "cors_rejected" || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected the preflight from %s with %v to be refused, got %d %v", tc.origin, tc.header, w.Code, w.Header())
+		}
+	}
+
+	w = send("GET", "https://shop.example.org")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://shop.example.org" || w.Header().Get("Access-Control-Expose-Headers") != "X-Request-Id" {
+		t.Errorf("Expected an allowed subdomain to get CORS headers, got %v", w.Header())
+	}
+	if values := w.Header().Values("Access-Control-Allow-Origin"); len(values) != 1 {
+		t.Errorf("Expected the backend's CORS headers to be replaced, got %v", values)
+	}
+
+	w = send("GET", "https://evil.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a disallowed origin to be forwarded without CORS headers, got %d %v", w.Code, w.Header())
+	}
+	w = send("POST", "http://lb.example.net")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a same-origin request to pass untouched, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	p, err := newCORSPolicy([]string{"*"}, "GET", "", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	p.allowOrigin(header, "https://anywhere.example")
+	if header.Get("Access-Control-Allow-Origin") != "*" || header.Get("Vary") != "" {
+		t.Errorf("Expected a wildcard origin without credentials, got %v", header)
+	}
+	r := httptest.NewRequest("OPTIONS", "/", nil)
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "X-Anything, Authorization")
+	if headers, refused := p.preflight(r); refused != "" || len(headers) != 2 {
+		t.Errorf("Expected any requested header to be allowed, got %v %q", headers, refused)
+	}
+}
+
+func TestNewCORSPolicy(t *testing.T) {
+	for _, origin := range []string{"app.example.com", "https://app.example.com/path", "https://app.*.com", "*.example.com"} {
+		if _, err := newCORSPolicy([]string{origin}, "GET", "", "", false, 0); err == nil {
+			t.Errorf("Expected origin %q to be rejected", origin)
+		}
+	}
+	p, err := newCORSPolicy([]string{"https://*.example.com", "http://localhost:3000/"}, "get, post", "", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.allowsOrigin("http://localhost:3000") || !p.allowsOrigin("https://a.b.example.com") || p.allowsOrigin("https://example.com") ||
+		p.allowsOrigin("http://a.example.com") || p.methods[1] != "POST" {
+		t.Errorf("Unexpected policy %+v", p)
+	}
+}
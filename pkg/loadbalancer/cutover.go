@@ -0,0 +1,330 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cutover states
+const (
+	cutoverBaking     = "baking"
+	cutoverPromoted   = "promoted"
+	cutoverRolledBack = "rolled_back"
+)
+
+// cutoverTick is how often a running cutover is evaluated
+const cutoverTick = time.Second
+
+// cutoverSettings configure a blue/green cutover from the default servers
+// to a pool
+type cutoverSettings struct {
+	steps         []float64     // Percentages of traffic sent to the new pool, ending at 100
+	bake          time.Duration // Time each step must run without regression
+	errorDelta    float64       // Roll back when the new pool's error rate exceeds the old one's by this much
+	latencyFactor float64       // Roll back when the new pool's mean latency exceeds this multiple of the old one's, 0 disables
+	minRequests   int           // Requests the new pool must serve in a step before it is judged
+}
+
+// parseCutoverSteps parses comma-separated percentages such as 10,50,100
+func parseCutoverSteps(value string) ([]float64, error) {
+	var steps []float64
+	for _, part := range strings.Split(value, ",") {
+		step, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || step <= 0 || step > 100 || (len(steps) > 0 && step <= steps[len(steps)-1]) {
+			return nil, fmt.Errorf("invalid cutover steps %q, expected increasing percentages like 10,50,100", value)
+		}
+		steps = append(steps, step)
+	}
+	if steps[len(steps)-1] != 100 {
+		return nil, fmt.Errorf("invalid cutover steps %q, the last step must be 100", value)
+	}
+	return steps, nil
+}
+
+// cutoverOutcomes accumulates the outcomes of one side of a cutover
+type cutoverOutcomes struct {
+	Requests int           `json:"requests"`
+	Failures int           `json:"failures"`
+	latency  time.Duration // Total time to response headers
+}
+
+// errorRate returns the share of failed requests
+func (o cutoverOutcomes) errorRate() float64 {
+	if o.Requests == 0 {
+		return 0
+	}
+	return float64(o.Failures) / float64(o.Requests)
+}
+
+// meanLatency returns the mean time to response headers
+func (o cutoverOutcomes) meanLatency() time.Duration {
+	if o.Requests == 0 {
+		return 0
+	}
+	return o.latency / time.Duration(o.Requests)
+}
+
+// cutover shifts traffic from the default servers to a pool in steps,
+// baking each step and rolling back when the pool regresses
+type cutover struct {
+	pool     *Pool
+	settings cutoverSettings
+	green    map[*Server]bool // Servers of the new pool
+	blue     map[*Server]bool // Default servers
+
+	mu         sync.Mutex
+	state      string
+	reason     string
+	stage      int
+	stageStart time.Time
+	old        cutoverOutcomes // Default servers since the cutover started
+	new        cutoverOutcomes // New pool in the current step
+}
+
+// newCutover starts a cutover to the pool at its first step
+func newCutover(pool *Pool, blue []*Server, settings cutoverSettings, now time.Time) *cutover {
+	c := &cutover{
+		pool:       pool,
+		settings:   settings,
+		green:      make(map[*Server]bool),
+		blue:       make(map[*Server]bool),
+		state:      cutoverBaking,
+		stageStart: now,
+	}
+	for _, server := range pool.servers() {
+		c.green[server] = true
+	}
+	for _, server := range blue {
+		c.blue[server] = true
+	}
+	return c
+}
+
+// share returns the percentage of traffic currently sent to the new pool
+func (c *cutover) share() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case cutoverBaking:
+		return c.settings.steps[c.stage]
+	case cutoverPromoted:
+		return 100
+	}
+	return 0
+}
+
+// running reports whether the cutover is still moving through its steps
+func (c *cutover) running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == cutoverBaking
+}
+
+// record counts the outcome of a request to either side
+func (c *cutover) record(server *Server, failed bool, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != cutoverBaking {
+		return
+	}
+	outcomes := &c.old
+	if c.green[server] {
+		outcomes = &c.new
+	} else if !c.blue[server] {
+		return
+	}
+	outcomes.Requests++
+	outcomes.latency += d
+	if failed {
+		outcomes.Failures++
+	}
+}
+
+// regression explains why the new pool is worse than the old one, or
+// returns an empty string when it is not
+func (c *cutover) regression() string {
+	newRate, oldRate := c.new.errorRate(), c.old.errorRate()
+	if newRate > oldRate+c.settings.errorDelta {
+		return fmt.Sprintf("error rate %.1f%% against %.1f%% before the cutover", newRate*100, oldRate*100)
+	}
+	newLatency, oldLatency := c.new.meanLatency(), c.old.meanLatency()
+	if c.settings.latencyFactor > 0 && c.old.Requests > 0 && float64(newLatency) > float64(oldLatency)*c.settings.latencyFactor {
+		return fmt.Sprintf("mean latency %s against %s before the cutover", newLatency.Round(time.Millisecond), oldLatency.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// advance evaluates the current step. It rolls back on regression and moves
+// to the next step once the bake time has passed with enough traffic. It
+// returns the event to emit and its message, or an empty event type.
+func (c *cutover) advance(now time.Time) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != cutoverBaking || c.new.Requests < max(c.settings.minRequests, 1) {
+		return "", ""
+	}
+	if reason := c.regression(); reason != "" {
+		c.state, c.reason = cutoverRolledBack, reason
+		return EventCutoverRolledBack, reason
+	}
+	if now.Sub(c.stageStart) < c.settings.bake {
+		return "", ""
+	}
+
+	c.stage++
+	if c.stage == len(c.settings.steps) {
+		c.stage--
+		c.state = cutoverPromoted
+		return EventCutoverPromoted, fmt.Sprintf("pool %s promoted", c.pool.name)
+	}
+	c.stageStart = now
+	c.new = cutoverOutcomes{}
+	return EventCutoverAdvanced, fmt.Sprintf("pool %s now receives %g%% of traffic", c.pool.name, c.settings.steps[c.stage])
+}
+
+// cutoverPool returns the cutover's pool for the share of requests it
+// currently receives, or nil
+func (lb *LoadBalancer) cutoverPool() *Pool {
+	c := lb.cutover.Load()
+	if c == nil {
+		return nil
+	}
+	share := c.share()
+	if share <= 0 || rand.Float64()*100 >= share {
+		return nil
+	}
+	return c.pool
+}
+
+// observeCutover feeds a request outcome to the running cutover
+func (lb *LoadBalancer) observeCutover(server *Server, failed bool, d time.Duration) {
+	if c := lb.cutover.Load(); c != nil {
+		c.record(server, failed, d)
+	}
+}
+
+// runCutover evaluates the cutover until it is promoted, rolled back or
+// replaced
+func (lb *LoadBalancer) runCutover(c *cutover) {
+	ticker := time.NewTicker(cutoverTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if lb.cutover.Load() != c {
+			return
+		}
+		lb.stepCutover(c, now)
+		if !c.running() {
+			return
+		}
+	}
+}
+
+// stepCutover advances the cutover and reports the outcome
+func (lb *LoadBalancer) stepCutover(c *cutover, now time.Time) {
+	event, message := c.advance(now)
+	if event == "" {
+		return
+	}
+	lb.logf("Cutover to %s: %s", c.pool.name, message)
+	lb.metrics().IncCounter("lb_cutover_transitions_total", map[string]string{"pool": c.pool.name, "event": event})
+	lb.emit(event, c.pool.name, message)
+}
+
+// cutoverStatus is the JSON view of a cutover
+type cutoverStatus struct {
+	Pool   string          `json:"pool"`
+	State  string          `json:"state"`
+	Reason string          `json:"reason,omitempty"`
+	Share  float64         `json:"share"`
+	Steps  []float64       `json:"steps"`
+	Since  time.Time       `json:"step_since"`
+	Old    cutoverOutcomes `json:"old"`
+	New    cutoverOutcomes `json:"new"`
+}
+
+// handleCutover reports the current cutover
+func (lb *LoadBalancer) handleCutover(w http.ResponseWriter, r *http.Request) {
+	c := lb.cutover.Load()
+	if c == nil {
+		http.Error(w, "no cutover", http.StatusNotFound)
+		return
+	}
+	share := c.share()
+	c.mu.Lock()
+	status := cutoverStatus{
+		Pool:   c.pool.name,
+		State:  c.state,
+		Reason: c.reason,
+		Share:  share,
+		Steps:  c.settings.steps,
+		Since:  c.stageStart,
+		Old:    c.old,
+		New:    c.new,
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleStartCutover starts shifting traffic to a pool, e.g.
+// POST /lb-admin/cutover?pool=green&steps=10,50,100&bake=5m
+func (lb *LoadBalancer) handleStartCutover(w http.ResponseWriter, r *http.Request) {
+	pool, ok := lb.pools[r.URL.Query().Get("pool")]
+	if !ok {
+		http.Error(w, "unknown pool", http.StatusNotFound)
+		return
+	}
+	settings := lb.cutoverSettings
+	if value := r.URL.Query().Get("steps"); value != "" {
+		steps, err := parseCutoverSteps(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		settings.steps = steps
+	}
+	if value := r.URL.Query().Get("bake"); value != "" {
+		bake, err := time.ParseDuration(value)
+		if err != nil || bake < 0 {
+			http.Error(w, "invalid bake value", http.StatusBadRequest)
+			return
+		}
+		settings.bake = bake
+	}
+	if len(settings.steps) == 0 {
+		http.Error(w, "no cutover steps configured", http.StatusBadRequest)
+		return
+	}
+
+	if current := lb.cutover.Load(); current != nil && current.running() {
+		http.Error(w, "a cutover is already running", http.StatusConflict)
+		return
+	}
+	c := newCutover(pool, lb.servers, settings, time.Now())
+	lb.cutover.Store(c)
+	go lb.runCutover(c)
+
+	message := fmt.Sprintf("pool %s now receives %g%% of traffic", pool.name, settings.steps[0])
+	lb.logf("Cutover to %s started: %s", pool.name, message)
+	lb.emit(EventCutoverAdvanced, pool.name, message)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAbortCutover removes the cutover, returning all traffic to the
+// default servers
+func (lb *LoadBalancer) handleAbortCutover(w http.ResponseWriter, r *http.Request) {
+	c := lb.cutover.Swap(nil)
+	if c == nil {
+		http.Error(w, "no cutover", http.StatusNotFound)
+		return
+	}
+	lb.logf("Cutover to %s aborted", c.pool.name)
+	lb.emit(EventCutoverRolledBack, c.pool.name, "cutover aborted")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func cutoverServers() (*Server, *Pool) {
+	blue := &Server{URL: &url.URL{Scheme: "http", Host: "blue:80"}, Alive: true}
+	green := &Server{URL: &url.URL{Scheme: "http", Host: "green:80"}, Alive: true}
+	return blue, newPool("green", []*Server{green})
+}
+
+func TestCutoverPromotion(t *testing.T) {
+	blue, pool := cutoverServers()
+	green := pool.servers()[0]
+	settings := cutoverSettings{steps: []float64{10, 50, 100}, bake: time.Minute, errorDelta: 0.01, latencyFactor: 1.5, minRequests: 10}
+	now := time.Now()
+	c := newCutover(pool, []*Server{blue}, settings, now)
+
+	for _, want := range []float64{10, 50, 100} {
+		if got := c.share(); got != want {
+			t.Fatalf("Expected %g%% of traffic on the new pool, got %g", want, got)
+		}
+		for i := 0; i < 20; i++ {
+			c.record(blue, false, 10*time.Millisecond)
+			c.record(green, false, 12*time.Millisecond)
+		}
+		if event, _ := c.advance(now.Add(30 * time.Second)); event != "" {
+			t.Fatalf("Expected the step to keep baking, got %s", event)
+		}
+		now = now.Add(time.Minute)
+		event, _ := c.advance(now)
+		if want == 100 && event != EventCutoverPromoted {
+			t.Fatalf("Expected promotion after the last step, got %q", event)
+		} else if want < 100 && event != EventCutoverAdvanced {
+			t.Fatalf("Expected the cutover to advance after baking, got %q", event)
+		}
+	}
+	if c.running() || c.share() != 100 {
+		t.Errorf("Expected the promoted pool to keep all traffic")
+	}
+}
+
+func TestCutoverRollback(t *testing.T) {
+	blue, pool := cutoverServers()
+	green := pool.servers()[0]
+	settings := cutoverSettings{steps: []float64{10, 100}, bake: time.Minute, errorDelta: 0.01, minRequests: 10}
+	c := newCutover(pool, []*Server{blue}, settings, time.Now())
+
+	for i := 0; i < 20; i++ {
+		c.record(blue, false, time.Millisecond)
+		c.record(green, i%4 == 0, time.Millisecond)
+	}
+	event, reason := c.advance(time.Now())
+	if event != EventCutoverRolledBack || reason == "" {
+		t.Fatalf("Expected a rollback on the error rate regression, got %q", event)
+	}
+	if c.share() != 0 {
+		t.Errorf("Expected a rolled back cutover to send no traffic to the new pool, got %g", c.share())
+	}
+}
+
+func TestCutoverAdmin(t *testing.T) {
+	blue, pool := cutoverServers()
+	lb := &LoadBalancer{
+		servers:         []*Server{blue},
+		pools:           map[string]*Pool{"green": pool},
+		cutoverSettings: cutoverSettings{steps: []float64{10, 100}, bake: time.Hour},
+		adminLocal:      true,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/cutover?pool=green&steps=25,100", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 starting the cutover, got %d", w.Code)
+	}
+	if got := lb.cutover.Load().share(); got != 25 {
+		t.Errorf("Expected the first step to send 25%%, got %g", got)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/cutover?pool=green", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while a cutover is running, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("DELETE", "/lb-admin/cutover", nil))
+	if w.Code != http.StatusNoContent || lb.cutover.Load() != nil {
+		t.Errorf("Expected the cutover to be aborted, got %d", w.Code)
+	}
+	for i := 0; i < 20; i++ {
+		if server := lb.nextServerFor(httptest.NewRequest("GET", "/", nil)); server != blue {
+			t.Fatalf("Expected all traffic back on the default servers")
+		}
+	}
+}
+
+func TestParseCutoverSteps(t *testing.T) {
+	steps, err := parseCutoverSteps("10, 50,100")
+	if err != nil || len(steps) != 3 || steps[1] != 50 {
+		t.Fatalf("Expected 3 steps, got %v (%v)", steps, err)
+	}
+	for _, value := range []string{"", "10,50", "50,10,100", "0,100", "10,x,100", "10,150"} {
+		if _, err := parseCutoverSteps(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deadlineHeader carries an absolute client deadline in Unix milliseconds
+const deadlineHeader = "X-Request-Deadline"
+
+// grpcTimeoutUnits maps grpc-timeout unit suffixes to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// requestDeadline returns the earliest deadline of the request: an absolute
+// X-Request-Deadline, a relative grpc-timeout, or the configured budget
+// counted from arrival
+func (lb *LoadBalancer) requestDeadline(r *http.Request, arrival time.Time) (time.Time, bool) {
+	var deadline time.Time
+	earliest := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+
+	if value := r.Header.Get(deadlineHeader); value != "" {
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+			earliest(time.UnixMilli(ms))
+		}
+	}
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		earliest(arrival.Add(timeout))
+	}
+	if lb.deadlineBudget > 0 {
+		earliest(arrival.Add(lb.deadlineBudget))
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// parseGRPCTimeout parses a grpc-timeout value such as 100m or 5S
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// applyDeadline bounds the request by the client's deadline. It answers
+// with 504 and returns false when the deadline has already passed, so no
+// backend capacity is spent on a response nobody is waiting for.
+func (lb *LoadBalancer) applyDeadline(w http.ResponseWriter, r *http.Request, arrival time.Time) (*http.Request, context.CancelFunc, bool) {
+	deadline, ok := lb.requestDeadline(r, arrival)
+	if !ok {
+		return r, func() {}, true
+	}
+	if !time.Now().Before(deadline) {
+		lb.metrics().IncCounter("lb_expired_requests_total", nil)
+		lb.writeError(w, errDeadlineExceeded, "Request deadline exceeded")
+		return r, func() {}, false
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return r.WithContext(ctx), cancel, true
+}
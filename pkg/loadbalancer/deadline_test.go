@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"100m": 100 * time.Millisecond,
+		"5S":   5 * time.Second,
+		"1H":   time.Hour,
+		"250u": 250 * time.Microsecond,
+	} {
+		if got, ok := parseGRPCTimeout(value); !ok || got != want {
+			t.Errorf("parseGRPCTimeout(%q) = %s, want %s", value, got, want)
+		}
+	}
+	for _, value := range []string{"", "m", "10x", "-1S", "1234567890S"} {
+		if _, ok := parseGRPCTimeout(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRequestDeadlineEarliestWins(t *testing.T) {
+	lb := &LoadBalancer{deadlineBudget: time.Second}
+	arrival := time.Now()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Grpc-Timeout", "200m")
+	if deadline, ok := lb.requestDeadline(r, arrival); !ok || !deadline.Equal(arrival.Add(200*time.Millisecond)) {
+		t.Errorf("Expected the grpc-timeout to win over the budget, got %s", deadline.Sub(arrival))
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	if deadline, _ := lb.requestDeadline(r, arrival); !deadline.Equal(arrival.Add(time.Second)) {
+		t.Errorf("Expected the budget without client deadlines, got %s", deadline.Sub(arrival))
+	}
+}
+
+func TestExpiredDeadlineDropped(t *testing.T) {
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(deadlineHeader, strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10))
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusGatewayTimeout || called {
+		t.Errorf("Expected 504 without reaching the backend, got %d (called %v)", w.Code, called)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(deadlineHeader, strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10))
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !called {
+		t.Errorf("Expected a request with time left to be proxied, got %d", w.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugPrefix is the path prefix of the debug endpoints
+const debugPrefix = "/debug/"
+
+// maxProfileDuration bounds CPU profiles and execution traces
+const maxProfileDuration = 5 * time.Minute
+
+// processStart is when the process started, for the reported uptime
+var processStart = time.Now()
+
+// debugHandler serves profiles and runtime statistics on the debug port.
+// The handlers are built on runtime/pprof rather than net/http/pprof, whose
+// import would register them on http.DefaultServeMux of every program
+// embedding the load balancer.
+func (lb *LoadBalancer) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/{$}", handlePprofIndex)
+	mux.HandleFunc("GET /debug/pprof/cmdline", handlePprofCmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", handleCPUProfile)
+	mux.HandleFunc("GET /debug/pprof/trace", handleTrace)
+	mux.HandleFunc("GET /debug/pprof/{profile}", handlePprofProfile)
+	mux.HandleFunc("GET /debug/runtime", handleRuntime)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, debugPrefix) {
+			lb.writeError(w, errRouteNotFound, "404 page not found")
+			return
+		}
+		if lb.adminAuth != nil && !lb.adminAuth.authorized(r) {
+			lb.metrics().IncCounter("lb_admin_auth_failures_total", nil)
+			lb.writeError(w, errUnauthorized, "Admin credentials required")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handlePprofIndex lists the available profiles
+func handlePprofIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<html><head><title>/debug/pprof/</title></head><body>\n<p>Profiles:</p>\n<ul>\n")
+	for _, p := range pprof.Profiles() {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", name, name, p.Count())
+	}
+	fmt.Fprint(w, "<li><a href=\"profile?seconds=30\">profile</a> (CPU, 30s)</li>\n")
+	fmt.Fprint(w, "<li><a href=\"trace?seconds=5\">trace</a> (execution trace, 5s)</li>\n")
+	fmt.Fprint(w, "</ul>\n</body></html>\n")
+}
+
+// handlePprofCmdline returns the command line, NUL separated
+func handlePprofCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// handlePprofProfile writes a named profile such as heap or goroutine, in
+// the protobuf format or as text with ?debug=1
+func handlePprofProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("profile")
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		http.Error(w, "Unknown profile "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if name == "heap" && r.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	profile.WriteTo(w, debug)
+}
+
+// profileDuration returns the ?seconds= duration of a CPU profile or trace
+func profileDuration(r *http.Request, fallback time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("seconds")
+	if value == "" {
+		return fallback, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid seconds %q", value)
+	}
+	return min(time.Duration(seconds*float64(time.Second)), maxProfileDuration), nil
+}
+
+// handleCPUProfile records a CPU profile for ?seconds= (default 30)
+func handleCPUProfile(w http.ResponseWriter, r *http.Request) {
+	duration, err := profileDuration(r, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Only one CPU profile can run at a time
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not start CPU profile: "+err.Error(), http.StatusConflict)
+		return
+	}
+	sleepOrDone(r, duration)
+	pprof.StopCPUProfile()
+}
+
+// handleTrace records an execution trace for ?seconds= (default 1)
+func handleTrace(w http.ResponseWriter, r *http.Request) {
+	duration, err := profileDuration(r, time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not start trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	sleepOrDone(r, duration)
+	trace.Stop()
+}
+
+// sleepOrDone waits for the duration or until the client goes away
+func sleepOrDone(r *http.Request, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// runtimeStats is the JSON view of the Go runtime
+type runtimeStats struct {
+	GoVersion     string  `json:"go_version"`
+	Uptime        string  `json:"uptime"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	NumCPU        int     `json:"num_cpu"`
+	Goroutines    int     `json:"goroutines"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapInuse     uint64  `json:"heap_inuse_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	Sys           uint64  `json:"sys_bytes"`
+	TotalAlloc    uint64  `json:"total_alloc_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	GCPauseTotal  float64 `json:"gc_pause_total_ms"`
+	LastGCPause   float64 `json:"last_gc_pause_ms"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+// handleRuntime reports goroutine, memory and garbage collector statistics
+func handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		GoVersion:     runtime.Version(),
+		Uptime:        time.Since(processStart).Round(time.Second).String(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		NumCPU:        runtime.NumCPU(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		TotalAlloc:    mem.TotalAlloc,
+		NumGC:         mem.NumGC,
+		GCPauseTotal:  durationMs(time.Duration(mem.PauseTotalNs)),
+		GCCPUFraction: mem.GCCPUFraction,
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPause = durationMs(time.Duration(mem.PauseNs[(mem.NumGC+255)%256]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
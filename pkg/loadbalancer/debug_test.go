@@ -0,0 +1,66 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	lb := &LoadBalancer{}
+	server := httptest.NewServer(lb.debugHandler())
+	defer server.Close()
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, body := get("/debug/pprof/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "heap") {
+		t.Errorf("Expected the index to list the heap profile, got %d", resp.StatusCode)
+	}
+	if resp, body := get("/debug/pprof/goroutine?debug=1"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine profile") {
+		t.Errorf("Expected a text goroutine profile, got %d %.40q", resp.StatusCode, body)
+	}
+	if resp, body := get("/debug/pprof/profile?seconds=0.05"); resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("Expected a CPU profile, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, _ := get("/debug/pprof/profile?seconds=soon"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid duration to be rejected, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/debug/pprof/nothing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown profile to be 404, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/lb-stats"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected only debug paths to be served, got %d", resp.StatusCode)
+	}
+
+	resp, body := get("/debug/runtime")
+	var stats runtimeStats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected runtime statistics, got %d %s", resp.StatusCode, body)
+	}
+	if stats.Goroutines == 0 || stats.HeapAlloc == 0 || stats.GoVersion == "" {
+		t.Errorf("Expected goroutine and heap statistics, got %+v", stats)
+	}
+
+	// Admin credentials protect the debug endpoints too
+	lb.adminAuth, _ = newAdminAuth("secret", "")
+	if resp, _ := get("/debug/runtime"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the debug port to require admin credentials, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/debug/runtime", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the admin token to be accepted, got %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
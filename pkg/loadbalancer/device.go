@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Device classes
+const (
+	deviceMobile  = "mobile"
+	deviceDesktop = "desktop"
+	deviceBot     = "bot"
+)
+
+// botMarkers identify crawlers and automated clients in the User-Agent
+var botMarkers = []string{"bot", "crawl", "spider", "slurp", "facebookexternalhit", "headless", "preview"}
+
+// mobileMarkers identify phones and tablets in the User-Agent
+var mobileMarkers = []string{"mobi", "iphone", "ipod", "ipad", "android", "windows phone", "opera mini", "blackberry"}
+
+// classifyDevice classifies the client as mobile, desktop or bot, preferring
+// the Sec-CH-UA-Mobile client hint over User-Agent sniffing
+func classifyDevice(r *http.Request) string {
+	ua := strings.ToLower(r.UserAgent())
+	for _, marker := range botMarkers {
+		if strings.Contains(ua, marker) {
+			return deviceBot
+		}
+	}
+
+	switch r.Header.Get("Sec-CH-UA-Mobile") {
+	case "?1":
+		return deviceMobile
+	case "?0":
+		return deviceDesktop
+	}
+
+	for _, marker := range mobileMarkers {
+		if strings.Contains(ua, marker) {
+			return deviceMobile
+		}
+	}
+	return deviceDesktop
+}
+
+// parseDeviceRoutes parses class=pool definitions, checking classes and pools
+func parseDeviceRoutes(defs []string, pools map[string]bool) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, def := range defs {
+		class, pool, ok := strings.Cut(def, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid device route %q, expected class=pool", def)
+		}
+		switch class {
+		case deviceMobile, deviceDesktop, deviceBot:
+		default:
+			return nil, fmt.Errorf("unknown device class %q, expected mobile, desktop or bot", class)
+		}
+		if !pools[pool] {
+			return nil, fmt.Errorf("device route %s references unknown pool %s", class, pool)
+		}
+		routes[class] = pool
+	}
+	return routes, nil
+}
+
+// devicePool returns the pool routed to by the request's device class
+func (lb *LoadBalancer) devicePool(r *http.Request) *Pool {
+	if len(lb.deviceRoutes) == 0 {
+		return nil
+	}
+	name, ok := lb.deviceRoutes[classifyDevice(r)]
+	if !ok {
+		return nil
+	}
+	return lb.pools[name]
+}
+
+// advertiseDeviceHints asks clients for the client hints used for
+// classification when device routing or tagging is configured
+func (lb *LoadBalancer) advertiseDeviceHints(w http.ResponseWriter) {
+	if lb.deviceHeader == "" && len(lb.deviceRoutes) == 0 {
+		return
+	}
+	w.Header().Set("Accept-CH", "Sec-CH-UA-Mobile")
+	w.Header().Add("Vary", "User-Agent, Sec-CH-UA-Mobile")
+}
+
+// tagDevice tags the backend request with the device class when configured
+func (lb *LoadBalancer) tagDevice(r *http.Request, req *http.Request) {
+	if lb.deviceHeader != "" {
+		req.Header.Set(lb.deviceHeader, classifyDevice(r))
+	}
+}
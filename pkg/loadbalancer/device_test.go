@@ -0,0 +1,46 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClassifyDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		mobileCH  string
+		expected  string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", "", deviceMobile},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36", "", deviceMobile},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0", "", deviceDesktop},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "", deviceBot},
+		{"Mozilla/5.0 (Linux; Android 14) Chrome/120.0", "?0", deviceDesktop},
+		{"Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0", "?1", deviceMobile},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		if tt.mobileCH != "" {
+			r.Header.Set("Sec-CH-UA-Mobile", tt.mobileCH)
+		}
+		if got := classifyDevice(r); got != tt.expected {
+			t.Errorf("%q (%s): expected %s, got %s", tt.userAgent, tt.mobileCH, tt.expected, got)
+		}
+	}
+}
+
+func TestParseDeviceRoutes(t *testing.T) {
+	pools := map[string]bool{"lite": true}
+	routes, err := parseDeviceRoutes([]string{"mobile=lite"}, pools)
+	if err != nil || routes[deviceMobile] != "lite" {
+		t.Errorf("Expected mobile to route to lite, got %v (%v)", routes, err)
+	}
+	if _, err := parseDeviceRoutes([]string{"tv=lite"}, pools); err == nil {
+		t.Errorf("Expected an error for an unknown device class")
+	}
+	if _, err := parseDeviceRoutes([]string{"bot=missing"}, pools); err == nil {
+		t.Errorf("Expected an error for an unknown pool")
+	}
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// activeRequest is a proxied request that has not completed yet
+type activeRequest struct {
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Path    string        `json:"path"`
+	Backend string        `json:"backend"`
+	Client  string        `json:"client"`
+	Start   time.Time     `json:"start"`
+	Timeout time.Duration `json:"-"`
+
+	cancel context.CancelFunc
+}
+
+// diagnostics tracks in-flight proxied requests and open backend
+// connections to help find goroutine and connection leaks
+type diagnostics struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeRequest
+	conns  map[string]int // Open connections per dialed address
+}
+
+// newDiagnostics creates empty diagnostics
+func newDiagnostics() *diagnostics {
+	return &diagnostics{
+		active: make(map[uint64]*activeRequest),
+		conns:  make(map[string]int),
+	}
+}
+
+// track registers an in-flight request bounded by ctx and returns a
+// function that removes it again. The request can be aborted through cancel.
+func (d *diagnostics) track(ctx context.Context, r *http.Request, client string, server *Server, cancel context.CancelFunc) func() {
+	req := &activeRequest{
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Backend: server.URL.Host,
+		Client:  client,
+		Start:   time.Now(),
+		cancel:  cancel,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = deadline.Sub(req.Start)
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	req.ID = d.nextID
+	d.active[req.ID] = req
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		delete(d.active, req.ID)
+		d.mu.Unlock()
+	}
+}
+
+// abort cancels an in-flight request, returning false when it is unknown
+func (d *diagnostics) abort(id uint64) bool {
+	d.mu.Lock()
+	req, ok := d.active[id]
+	d.mu.Unlock()
+	if ok {
+		req.cancel()
+	}
+	return ok
+}
+
+// trackConns wraps a dial function to count open connections per address
+func (d *diagnostics) trackConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		d.conns[addr]++
+		d.mu.Unlock()
+		return &trackedConn{Conn: conn, release: func() {
+			d.mu.Lock()
+			if d.conns[addr]--; d.conns[addr] <= 0 {
+				delete(d.conns, addr)
+			}
+			d.mu.Unlock()
+		}}, nil
+	}
+}
+
+// trackedConn releases its connection count once when closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// diagnosticsReport is the JSON view of the diagnostics
+type diagnosticsReport struct {
+	Goroutines  int                 `json:"goroutines"`
+	Active      []activeRequestView `json:"active"`
+	Stuck       []uint64            `json:"stuck"`
+	Connections map[string]int      `json:"connections"`
+}
+
+// activeRequestView adds the running duration to an active request
+type activeRequestView struct {
+	*activeRequest
+	Duration string `json:"duration"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// report summarizes the in-flight requests, oldest first. Requests that
+// have run for more than twice their timeout are listed as stuck.
+func (d *diagnostics) report(now time.Time) diagnosticsReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	report := diagnosticsReport{
+		Goroutines:  runtime.NumGoroutine(),
+		Active:      make([]activeRequestView, 0, len(d.active)),
+		Stuck:       []uint64{},
+		Connections: make(map[string]int, len(d.conns)),
+	}
+	for _, req := range d.active {
+		view := activeRequestView{activeRequest: req, Duration: now.Sub(req.Start).String()}
+		if req.Timeout > 0 {
+			view.Timeout = req.Timeout.String()
+		}
+		report.Active = append(report.Active, view)
+	}
+	sort.Slice(report.Active, func(i, j int) bool { return report.Active[i].ID < report.Active[j].ID })
+	for _, view := range report.Active {
+		if view.activeRequest.Timeout > 0 && now.Sub(view.Start) > 2*view.activeRequest.Timeout {
+			report.Stuck = append(report.Stuck, view.ID)
+		}
+	}
+	for addr, n := range d.conns {
+		report.Connections[addr] = n
+	}
+	return report
+}
+
+// handleDiagnostics reports in-flight requests and open backend connections
+func (lb *LoadBalancer) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.diagnostics.report(time.Now()))
+}
+
+// handleAbortRequest aborts a stuck request, e.g.
+// POST /lb-admin/diagnostics/requests/42/abort
+func (lb *LoadBalancer) handleAbortRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid request id", http.StatusBadRequest)
+		return
+	}
+	if !lb.diagnostics.abort(id) {
+		http.Error(w, "unknown request", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,106 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDiagnosticsAbortStuckRequest(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	lb := &LoadBalancer{
+		servers:     []*Server{{URL: backendURL, Alive: true}},
+		current:     -1,
+		diagnostics: newDiagnostics(),
+		adminLocal:  true,
+	}
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+		done <- rec.Code
+	}()
+
+	var report diagnosticsReport
+	for i := 0; i < 100 && len(report.Active) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		report = lb.diagnostics.report(time.Now())
+	}
+	if len(report.Active) != 1 || report.Active[0].Path != "/slow" || report.Active[0].Backend != backendURL.Host {
+		t.Fatalf("Expected the in-flight request to be reported, got %+v", report.Active)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/lb-admin/diagnostics/requests/1/abort", nil)
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 from abort, got %d", rec.Code)
+	}
+	select {
+	case code := <-done:
+		if code != http.StatusBadGateway {
+			t.Errorf("Expected the aborted request to fail with 502, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the aborted request to complete")
+	}
+	if report := lb.diagnostics.report(time.Now()); len(report.Active) != 0 {
+		t.Errorf("Expected no active requests after abort, got %+v", report.Active)
+	}
+
+	rec = httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("POST", "/lb-admin/diagnostics/requests/1/abort", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a finished request, got %d", rec.Code)
+	}
+}
+
+func TestDiagnosticsStuckAndConnections(t *testing.T) {
+	d := newDiagnostics()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	u, _ := url.Parse("http://backend:8080")
+	untrack := d.track(ctx, httptest.NewRequest("GET", "/", nil), "10.0.0.1", &Server{URL: u}, cancel)
+	defer untrack()
+
+	if report := d.report(time.Now()); len(report.Stuck) != 0 {
+		t.Errorf("Expected no stuck requests yet, got %v", report.Stuck)
+	}
+	if report := d.report(time.Now().Add(3 * time.Second)); len(report.Stuck) != 1 {
+		t.Errorf("Expected a request past twice its timeout to be stuck, got %v", report.Stuck)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dial := d.trackConns((&net.Dialer{}).DialContext)
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.report(time.Now()).Connections[ln.Addr().String()]; got != 1 {
+		t.Errorf("Expected 1 open connection, got %d", got)
+	}
+	conn.Close()
+	conn.Close()
+	if got := len(d.report(time.Now()).Connections); got != 0 {
+		t.Errorf("Expected closed connections to be released, got %d addresses", got)
+	}
+}
@@ -0,0 +1,257 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool entries resolved through DNS rather than naming a backend
+const (
+	dnsScheme  = "dns"  // A/AAAA records, e.g. dns://api.internal:8080
+	srvScheme  = "srv"  // SRV records, e.g. srv://_http._tcp.api.internal
+	fileScheme = "file" // A watched backends file, e.g. file:///etc/lb/api.txt
+)
+
+// discoveryTimeout bounds a single lookup
+const discoveryTimeout = 5 * time.Second
+
+// discoveredBackend is a backend address found by discovery
+type discoveredBackend struct {
+	addr   string // host:port
+	scheme string // Empty uses the scheme of the discovery
+	weight int    // 0 keeps the configured weight
+}
+
+// discovery keeps the servers of a pool in sync with a dynamic source.
+// Servers listed with the pool itself stay as they are.
+type discovery struct {
+	pool    *Pool
+	source  string // Shown in logs
+	scheme  string // Scheme of discovered backends
+	static  []*Server
+	resolve func(ctx context.Context) ([]discoveredBackend, error)
+	watch   func(changed func()) error    // Reports changes between refreshes, when the source can
+	logf    func(format string, v ...any) // Logs problems that do not fail a lookup
+
+	// setup applies the configured settings to a new server, and
+	// healthInterval is how often its health is checked
+	setup          func(*Server)
+	healthInterval time.Duration
+
+	mu    sync.Mutex
+	stops map[*Server]chan struct{} // Stops the health checks of discovered servers
+}
+
+// isDiscoveryURL reports whether a pool entry is a discovery source rather
+// than a backend
+func isDiscoveryURL(u *url.URL) bool {
+	switch u.Scheme {
+	case dnsScheme, srvScheme, fileScheme, dockerScheme:
+		return true
+	}
+	return false
+}
+
+// newDiscovery creates the discovery of the pool from a source URL
+func newDiscovery(pool *Pool, static []*Server, u *url.URL, resolver *net.Resolver) (*discovery, error) {
+	scheme := u.Query().Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("invalid discovery source %s: scheme must be http or https", u)
+	}
+	d := &discovery{
+		pool:   pool,
+		source: u.Redacted(),
+		scheme: scheme,
+		static: static,
+		logf:   log.Printf,
+		stops:  make(map[*Server]chan struct{}),
+	}
+	switch u.Scheme {
+	case dnsScheme:
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid discovery source %s, expected dns://hostname:port", u)
+		}
+		d.resolve = func(ctx context.Context) ([]discoveredBackend, error) {
+			addrs, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			backends := make([]discoveredBackend, 0, len(addrs))
+			for _, addr := range addrs {
+				backends = append(backends, discoveredBackend{addr: net.JoinHostPort(addr.IP.String(), port)})
+			}
+			return backends, nil
+		}
+	case srvScheme:
+		name := u.Hostname()
+		if name == "" || u.Port() != "" {
+			return nil, fmt.Errorf("invalid discovery source %s, expected srv://_service._proto.name", u)
+		}
+		d.resolve = func(ctx context.Context) ([]discoveredBackend, error) {
+			_, records, err := resolver.LookupSRV(ctx, "", "", name)
+			if err != nil {
+				return nil, err
+			}
+			return srvBackends(records), nil
+		}
+	case fileScheme:
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" || (u.Host != "" && u.Host != "localhost") {
+			return nil, fmt.Errorf("invalid discovery source %s, expected file:///path/to/backends", u)
+		}
+		d.resolve = func(context.Context) ([]discoveredBackend, error) {
+			return readBackendsFile(path)
+		}
+		d.watch = func(changed func()) error {
+			return watchBackendsFile(path, changed, d.logf)
+		}
+	case dockerScheme:
+		client, err := newDockerClient(u)
+		if err != nil {
+			return nil, err
+		}
+		network := u.Query().Get("network")
+		d.resolve = func(ctx context.Context) ([]discoveredBackend, error) {
+			containers, err := client.containers(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return dockerBackends(containers, pool.name, network, d.logf), nil
+		}
+		d.watch = func(changed func()) error {
+			watchDocker(client, d.source, changed, d.logf)
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown discovery source %s", u)
+	}
+	return d, nil
+}
+
+// srvBackends returns the targets of the most preferred SRV records, those
+// with the lowest priority value, weighted by their SRV weight. A weight of
+// 0 counts as 1 so the target still gets a small share.
+func srvBackends(records []*net.SRV) []discoveredBackend {
+	if len(records) == 0 {
+		return nil
+	}
+	priority := records[0].Priority
+	for _, record := range records {
+		priority = min(priority, record.Priority)
+	}
+	var backends []discoveredBackend
+	for _, record := range records {
+		if record.Priority != priority {
+			continue
+		}
+		target := strings.TrimSuffix(record.Target, ".")
+		backends = append(backends, discoveredBackend{
+			addr:   net.JoinHostPort(target, strconv.Itoa(int(record.Port))),
+			weight: max(int(record.Weight), 1),
+		})
+	}
+	slices.SortFunc(backends, func(a, b discoveredBackend) int { return strings.Compare(a.addr, b.addr) })
+	return backends
+}
+
+// refreshDiscovery looks the source up again and updates the pool. Servers
+// still present keep their state; new ones join in rotation with their
+// health checks started, and vanished ones are dropped. A failed lookup
+// keeps the current servers.
+func (lb *LoadBalancer) refreshDiscovery(d *discovery) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	found, err := d.resolve(ctx)
+	if err != nil {
+		lb.errorf("Discovery of pool %s from %s failed: %s", d.pool.name, d.source, err)
+		lb.metrics().IncCounter("lb_discovery_errors_total", map[string]string{"pool": d.pool.name})
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := make(map[string]*Server)
+	for _, server := range d.pool.servers() {
+		if !slices.Contains(d.static, server) {
+			current[server.URL.String()] = server
+		}
+	}
+	servers := slices.Clone(d.static)
+	seen := make(map[string]bool)
+	for _, backend := range found {
+		u := &url.URL{Scheme: cmp.Or(backend.scheme, d.scheme), Host: backend.addr}
+		key := u.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		server, ok := current[key]
+		if !ok {
+			// Discovered backends go through the same admission and circuit
+			// breaking as configured ones
+			server = &Server{URL: u, Alive: lb.compat == nil}
+			if lb.breaker.enabled() {
+				server.breaker = newCircuitBreaker(lb.breaker)
+			}
+			if d.setup != nil {
+				d.setup(server)
+			}
+			stop := make(chan struct{})
+			d.stops[server] = stop
+			lb.scheduleHealthCheck(server, d.healthInterval, stop)
+			lb.logf("Discovered backend %s for pool %s", backend.addr, d.pool.name)
+			lb.emit(EventBackendAdded, backend.addr, "discovered for pool "+d.pool.name)
+		}
+		if backend.weight > 0 && server.TargetWeight() != backend.weight {
+			server.SetWeight(backend.weight, 0)
+		}
+		delete(current, key)
+		servers = append(servers, server)
+	}
+	for _, server := range current {
+		addr := server.URL.Host
+		if stop, ok := d.stops[server]; ok {
+			close(stop)
+			delete(d.stops, server)
+		}
+		lb.logf("Backend %s left pool %s", addr, d.pool.name)
+		lb.emit(EventBackendRemoved, addr, "no longer discovered for pool "+d.pool.name)
+	}
+	d.pool.setServers(servers)
+	lb.metrics().SetGauge("lb_pool_servers", float64(len(servers)), map[string]string{"pool": d.pool.name})
+}
+
+// ScheduleDiscovery refreshes every discovered pool on the interval, and
+// whenever a watched source reports a change
+func (lb *LoadBalancer) ScheduleDiscovery(interval time.Duration) {
+	for _, d := range lb.discoveries {
+		if d.watch != nil {
+			if err := d.watch(func() { lb.refreshDiscovery(d) }); err != nil {
+				lb.errorf("Watching %s for pool %s failed, polling every %s: %s", d.source, d.pool.name, interval, err)
+			}
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				lb.refreshDiscovery(d)
+			}
+		}()
+	}
+}
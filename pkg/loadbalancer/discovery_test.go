@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDNSDiscovery(t *testing.T) {
+	static := testServers("10.0.0.1:8080")
+	pool := newPool("api", static)
+	source, _ := url.Parse("dns://api.internal:8080?scheme=https")
+	d, err := newDiscovery(pool, static, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []string{"127.0.1.1", "127.0.1.2"}
+	var lookupErr error
+	d.resolve = func(ctx context.Context) ([]discoveredBackend, error) {
+		var backends []discoveredBackend
+		for _, ip := range records {
+			backends = append(backends, discoveredBackend{addr: ip + ":8080"})
+		}
+		return backends, lookupErr
+	}
+	configured := 0
+	d.setup = func(*Server) { configured++ }
+	d.healthInterval = time.Hour
+	lb := &LoadBalancer{pools: map[string]*Pool{"api": pool}}
+	hosts := func() []string {
+		var hosts []string
+		for _, server := range pool.servers() {
+			hosts = append(hosts, server.URL.String())
+		}
+		return hosts
+	}
+
+	lb.refreshDiscovery(d)
+	if got := hosts(); len(got) != 3 || got[0] != "http://10.0.0.1:8080" || got[1] != "https://127.0.1.1:8080" || got[2] != "https://127.0.1.2:8080" {
+		t.Fatalf("Expected the static server and both records, got %v", got)
+	}
+	kept := pool.servers()[2]
+
+	records = []string{"127.0.1.2", "127.0.1.3", "127.0.1.3"}
+	lb.refreshDiscovery(d)
+	if got := hosts(); len(got) != 3 || got[1] != "https://127.0.1.2:8080" || got[2] != "https://127.0.1.3:8080" {
+		t.Fatalf("Expected 127.0.1.1 replaced by 127.0.1.3, got %v", got)
+	}
+	if pool.servers()[1] != kept {
+		t.Error("Expected a server still in DNS to keep its state")
+	}
+	if configured != 3 || len(d.stops) != 2 {
+		t.Errorf("Expected 3 servers set up and 2 health checks running, got %d and %d", configured, len(d.stops))
+	}
+
+	lookupErr = errors.New("no such host")
+	records = nil
+	lb.refreshDiscovery(d)
+	if got := hosts(); len(got) != 3 {
+		t.Errorf("Expected a failed lookup to keep the servers, got %v", got)
+	}
+}
+
+func TestDiscoveredServersAdmission(t *testing.T) {
+	pool := newPool("api", nil)
+	source, _ := url.Parse("dns://api.internal:8080")
+	d, err := newDiscovery(pool, nil, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.resolve = func(ctx context.Context) ([]discoveredBackend, error) {
+		return []discoveredBackend{{addr: "127.0.1.1:8080"}}, nil
+	}
+	d.healthInterval = time.Hour
+	lb := &LoadBalancer{
+		pools:   map[string]*Pool{"api": pool},
+		compat:  &compatProbe{},
+		breaker: breakerSettings{failures: 3, cooldown: time.Second},
+	}
+
+	lb.refreshDiscovery(d)
+	servers := pool.servers()
+	if len(servers) != 1 {
+		t.Fatalf("Expected the discovered server, got %d servers", len(servers))
+	}
+	if servers[0].IsAlive() {
+		t.Error("Expected a discovered server to wait for the compatibility probe")
+	}
+	if servers[0].breaker == nil {
+		t.Error("Expected a discovered server to get a circuit breaker")
+	}
+}
+
+func TestSRVBackends(t *testing.T) {
+	backends := srvBackends([]*net.SRV{
+		{Target: "b.internal.", Port: 8080, Priority: 10, Weight: 60},
+		{Target: "a.internal.", Port: 8080, Priority: 10, Weight: 0},
+		{Target: "backup.internal.", Port: 8080, Priority: 20, Weight: 100},
+	})
+	if len(backends) != 2 {
+		t.Fatalf("Expected only the lowest priority records, got %+v", backends)
+	}
+	if backends[0] != (discoveredBackend{addr: "a.internal:8080", weight: 1}) || backends[1] != (discoveredBackend{addr: "b.internal:8080", weight: 60}) {
+		t.Errorf("Expected the SRV weights on the backends, got %+v", backends)
+	}
+	if srvBackends(nil) != nil {
+		t.Error("Expected no backends without records")
+	}
+}
+
+func TestNewDiscovery(t *testing.T) {
+	for _, source := range []string{"dns://api.internal", "dns://:8080", "dns://api.internal:8080?scheme=tcp", "srv://_http._tcp.api.internal:8080", "srv://"} {
+		u, _ := url.Parse(source)
+		if _, err := newDiscovery(newPool("api", nil), nil, u, nil); err == nil {
+			t.Errorf("Expected %s to be rejected", source)
+		}
+	}
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-server", "http://localhost:8081", "-pool", "api=dns://a.internal:80,dns://b.internal:80")
+	if !hasFinding(findings, lintError, "more than one discovery source") {
+		t.Error("Expected pools with two discovery sources to be refused")
+	}
+}
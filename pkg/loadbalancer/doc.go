@@ -0,0 +1,23 @@
+// Package loadbalancer is an HTTP and TCP load balancer that can be
+// embedded in other programs. The lb command is a thin wrapper around it.
+//
+// New returns a LoadBalancer for a set of backends with every optional
+// feature off. It is an http.Handler, so it can be served by any
+// http.Server or mounted in a mux:
+//
+//	lb := loadbalancer.New(backendA, backendB)
+//	lb.ScheduleHealthChecks(10 * time.Second)
+//	http.ListenAndServe(":8080", lb)
+//
+// Run starts a load balancer from a Config, as the lb command does,
+// including its listeners and background tasks. ParseConfig fills a Config
+// from command line flags, and Lint reports problems in one.
+//
+// Use adds Middleware run before each request is proxied, after the
+// built-in filtering, limits, authentication and logging.
+//
+// SetMetricsSink, AddEventListener and SetLogger connect a LoadBalancer to
+// the embedding program's metrics, alerting and logging. NewPool and
+// Pool.NextServer select among servers with one of the strategies
+// StrategyRoundRobin, StrategyLeastConn or StrategyRandom.
+package loadbalancer
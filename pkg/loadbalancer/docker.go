@@ -0,0 +1,230 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// dockerScheme marks a pool entry discovering containers through the Docker
+// API, e.g. docker:// for the local socket or docker://10.0.0.5:2375
+const dockerScheme = "docker"
+
+// defaultDockerSocket is where the Docker daemon listens unless the pool
+// entry names another socket
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// Container labels configuring a container as a backend
+const (
+	dockerEnableLabel = "lb.enable" // Must be true for the container to be used
+	dockerPortLabel   = "lb.port"   // Port to send requests to
+	dockerWeightLabel = "lb.weight" // Weight of the backend
+	dockerPoolLabel   = "lb.pool"   // Restricts the container to the named pool
+)
+
+// dockerReconnectDelay is how long to wait before watching the Docker
+// events again after the stream broke
+const dockerReconnectDelay = 5 * time.Second
+
+// dockerClient talks to the Docker Engine API
+type dockerClient struct {
+	client *http.Client
+	base   string // Base URL of the API
+}
+
+// dockerContainer is a running container as listed by the Docker API
+type dockerContainer struct {
+	ID     string
+	Names  []string
+	State  string
+	Labels map[string]string
+	Ports  []struct {
+		PrivatePort int
+		Type        string
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+// name returns the container name for logs
+func (c dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return c.Names[0]
+	}
+	return c.ID
+}
+
+// newDockerClient creates a client for the daemon of the pool entry: the
+// local socket for docker://, another socket for docker:///path/to/socket
+// or a TCP endpoint for docker://host:port
+func newDockerClient(u *url.URL) (*dockerClient, error) {
+	if u.Host != "" {
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid discovery source %s, expected docker://host:port", u)
+		}
+		return &dockerClient{client: &http.Client{}, base: "http://" + u.Host}, nil
+	}
+	socket := u.Path
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{client: &http.Client{Transport: transport}, base: "http://docker"}, nil
+}
+
+// get requests an API path, with filters encoded the way the API expects
+func (c *dockerClient) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	encoded, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base+path+"?filters="+url.QueryEscape(string(encoded)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker API %s returned %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// containers lists the running containers enabled for load balancing
+func (c *dockerClient) containers(ctx context.Context) ([]dockerContainer, error) {
+	resp, err := c.get(ctx, "/containers/json", map[string][]string{"label": {dockerEnableLabel + "=true"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("invalid docker container list: %s", err)
+	}
+	return containers, nil
+}
+
+// watch calls changed for every container starting, stopping, pausing or
+// dying, until the event stream ends
+func (c *dockerClient) watch(ctx context.Context, changed func()) error {
+	resp, err := c.get(ctx, "/events", map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "stop", "die", "pause", "unpause"},
+		"label": {dockerEnableLabel + "=true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		changed()
+	}
+}
+
+// dockerBackends turns the containers into backends of the pool. The
+// address is the container's IP on the named network, or on its only
+// network; the port comes from the lb.port label, or the single TCP port
+// the container exposes. Containers that cannot be addressed are logged
+// through logf and skipped.
+func dockerBackends(containers []dockerContainer, pool, network string, logf func(format string, v ...any)) []discoveredBackend {
+	var backends []discoveredBackend
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		if name, ok := c.Labels[dockerPoolLabel]; ok && name != pool {
+			continue
+		}
+		backend, err := dockerBackend(c, network)
+		if err != nil {
+			logf("Skipping container %s for pool %s: %s", c.name(), pool, err)
+			continue
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// dockerBackend finds the address and weight of a container
+func dockerBackend(c dockerContainer, network string) (discoveredBackend, error) {
+	var ip string
+	if network != "" {
+		ip = c.NetworkSettings.Networks[network].IPAddress
+	} else if len(c.NetworkSettings.Networks) == 1 {
+		for _, n := range c.NetworkSettings.Networks {
+			ip = n.IPAddress
+		}
+	} else {
+		return discoveredBackend{}, fmt.Errorf("attached to %d networks, set ?network= on the pool entry", len(c.NetworkSettings.Networks))
+	}
+	if ip == "" {
+		return discoveredBackend{}, fmt.Errorf("no IP address on network %q", network)
+	}
+
+	port := 0
+	if label, ok := c.Labels[dockerPortLabel]; ok {
+		p, err := strconv.Atoi(label)
+		if err != nil || p < 1 || p > 65535 {
+			return discoveredBackend{}, fmt.Errorf("invalid %s label %q", dockerPortLabel, label)
+		}
+		port = p
+	} else {
+		var ports []int
+		for _, p := range c.Ports {
+			if p.Type == "tcp" && !slices.Contains(ports, p.PrivatePort) {
+				ports = append(ports, p.PrivatePort)
+			}
+		}
+		if len(ports) != 1 {
+			return discoveredBackend{}, fmt.Errorf("exposes %d TCP ports, set the %s label", len(ports), dockerPortLabel)
+		}
+		port = ports[0]
+	}
+
+	weight := 0
+	if label, ok := c.Labels[dockerWeightLabel]; ok {
+		w, err := strconv.Atoi(label)
+		if err != nil || w < 0 {
+			return discoveredBackend{}, fmt.Errorf("invalid %s label %q", dockerWeightLabel, label)
+		}
+		weight = w
+	}
+	return discoveredBackend{addr: net.JoinHostPort(ip, strconv.Itoa(port)), weight: weight}, nil
+}
+
+// watchDocker follows the Docker events in the background, calling changed
+// for each container change and after reconnecting, as events may have
+// been missed while the stream was down. Interruptions are logged through
+// logf.
+func watchDocker(client *dockerClient, source string, changed func(), logf func(format string, v ...any)) {
+	go func() {
+		for {
+			err := client.watch(context.Background(), changed)
+			logf("Docker events from %s interrupted, reconnecting in %s: %s", source, dockerReconnectDelay, err)
+			time.Sleep(dockerReconnectDelay)
+			changed()
+		}
+	}()
+}
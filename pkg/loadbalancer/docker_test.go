@@ -0,0 +1,128 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContainer builds a running container on a single network
+func testContainer(name, ip string, labels map[string]string, ports ...int) dockerContainer {
+	c := dockerContainer{ID: name, Names: []string{"/" + name}, State: "running", Labels: labels}
+	for _, port := range ports {
+		c.Ports = append(c.Ports, struct {
+			PrivatePort int
+			Type        string
+		}{port, "tcp"})
+	}
+	c.NetworkSettings.Networks = map[string]struct{ IPAddress string }{"app_default": {ip}}
+	return c
+}
+
+func TestDockerBackends(t *testing.T) {
+	multi := testContainer("multi", "172.18.0.5", map[string]string{dockerPortLabel: "9000"})
+	multi.NetworkSettings.Networks["backend"] = struct{ IPAddress string }{"172.19.0.5"}
+	paused := testContainer("paused", "172.18.0.6", nil, 8080)
+	paused.State = "paused"
+	containers := []dockerContainer{
+		testContainer("web-1", "172.18.0.2", nil, 8080),
+		testContainer("web-2", "172.18.0.3", map[string]string{dockerPortLabel: "8081", dockerWeightLabel: "3"}, 8080, 8081),
+		testContainer("other", "172.18.0.4", map[string]string{dockerPoolLabel: "admin"}, 8080),
+		testContainer("two-ports", "172.18.0.7", nil, 8080, 8081),
+		testContainer("bad-weight", "172.18.0.8", map[string]string{dockerWeightLabel: "heavy"}, 8080),
+		multi,
+		paused,
+	}
+	backends := dockerBackends(containers, "api", "", t.Logf)
+	want := []discoveredBackend{{addr: "172.18.0.2:8080"}, {addr: "172.18.0.3:8081", weight: 3}}
+	if len(backends) != len(want) || backends[0] != want[0] || backends[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, backends)
+	}
+
+	backends = dockerBackends([]dockerContainer{multi}, "api", "backend", t.Logf)
+	if len(backends) != 1 || backends[0].addr != "172.19.0.5:9000" {
+		t.Errorf("Expected the address on the chosen network, got %+v", backends)
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	var mu sync.Mutex
+	containers := []dockerContainer{testContainer("web-1", "127.0.1.1", nil, 8080)}
+	events := make(chan struct{})
+	done := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		if len(filters["label"]) != 1 || filters["label"][0] != "lb.enable=true" {
+			t.Errorf("Expected the containers to be filtered by label, got %v", filters)
+		}
+		switch r.URL.Path {
+		case "/containers/json":
+			mu.Lock()
+			defer mu.Unlock()
+			json.NewEncoder(w).Encode(containers)
+		case "/events":
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-events:
+					fmt.Fprintln(w, `{"Type":"container","Action":"start"}`)
+					w.(http.Flusher).Flush()
+				case <-done:
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	defer close(done) // Ends the event stream before the server closes
+
+	pool := newPool("api", nil)
+	source, _ := url.Parse("docker://" + strings.TrimPrefix(api.URL, "http://"))
+	d, err := newDiscovery(pool, nil, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.healthInterval = time.Hour
+	lb := &LoadBalancer{pools: map[string]*Pool{"api": pool}, discoveries: []*discovery{d}}
+	lb.refreshDiscovery(d)
+	lb.ScheduleDiscovery(time.Hour)
+	if servers := pool.servers(); len(servers) != 1 || servers[0].URL.String() != "http://127.0.1.1:8080" {
+		t.Fatalf("Expected the labelled container, got %v", servers)
+	}
+
+	mu.Lock()
+	containers = append(containers, testContainer("web-2", "127.0.1.2", map[string]string{dockerWeightLabel: "4"}, 8080))
+	mu.Unlock()
+	events <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pool.servers()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers := pool.servers()
+	if len(servers) != 2 || servers[1].URL.Host != "127.0.1.2:8080" || servers[1].TargetWeight() != 4 {
+		t.Fatalf("Expected the started container to join, got %v", servers)
+	}
+}
+
+func TestNewDockerClient(t *testing.T) {
+	for source, base := range map[string]string{"docker://": "http://docker", "docker:///run/user/1000/docker.sock": "http://docker", "docker://10.0.0.5:2375": "http://10.0.0.5:2375"} {
+		u, _ := url.Parse(source)
+		client, err := newDockerClient(u)
+		if err != nil || client.base != base {
+			t.Errorf("Expected %s to use %s, got %v", source, base, err)
+		}
+	}
+	u, _ := url.Parse("docker://10.0.0.5")
+	if _, err := newDockerClient(u); err == nil {
+		t.Error("Expected a TCP endpoint without a port to be rejected")
+	}
+}
@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// drainNotifyTimeout bounds a drain notification call to a backend
+const drainNotifyTimeout = 10 * time.Second
+
+// drainCall is an HTTP call made to a backend when it is drained or
+// returned to rotation, e.g. POST /admin/drain
+type drainCall struct {
+	method string
+	path   string
+}
+
+// parseDrainCall parses a "METHOD /path" definition, defaulting the method
+// to POST. An empty definition returns nil.
+func parseDrainCall(def string) (*drainCall, error) {
+	if def == "" {
+		return nil, nil
+	}
+	method, path := http.MethodPost, def
+	if before, after, ok := strings.Cut(def, " "); ok {
+		method, path = strings.ToUpper(before), strings.TrimSpace(after)
+	}
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(method, "/ ") {
+		return nil, fmt.Errorf("invalid drain call %q, expected \"METHOD /path\"", def)
+	}
+	return &drainCall{method: method, path: path}, nil
+}
+
+// String returns the call as "METHOD /path"
+func (c *drainCall) String() string {
+	return c.method + " " + c.path
+}
+
+// notifyDrain tells a backend that it is being drained, or returned to
+// rotation, when its weight moves to or from 0. The backend learns how long
+// the drain ramp takes from the X-LB-Drain-Ramp header, in seconds.
+func (lb *LoadBalancer) notifyDrain(server *Server, from, to int, ramp time.Duration) {
+	call, action := lb.drainNotify, "drain"
+	if from == 0 && to > 0 {
+		call, action = lb.undrainNotify, "undrain"
+	} else if from == 0 || to != 0 {
+		return
+	}
+	if call == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainNotifyTimeout)
+	defer cancel()
+	target := *server.URL
+	target.Path = call.path
+	req, err := newBackendRequestTo(ctx, call.method, &target, nil)
+	if err == nil {
+		req.Header.Set("X-LB-Drain-Ramp", strconv.Itoa(int(ramp.Seconds())))
+		var resp *http.Response
+		resp, err = lb.upstreamClient().Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "failed"
+		lb.errorf("Failed to notify %s of %s with %s: %s", server.URL.Host, action, call, err)
+	} else {
+		lb.logf("Notified %s of %s with %s", server.URL.Host, action, call)
+	}
+	lb.metrics().IncCounter("lb_drain_notifications_total", map[string]string{"backend": server.URL.Host, "action": action, "result": result})
+}
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDrainNotification(t *testing.T) {
+	calls := make(chan string, 4)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- r.Method + " " + r.URL.Path + " " + r.Header.Get("X-LB-Drain-Ramp")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	drain, _ := parseDrainCall("POST /admin/drain")
+	undrain, _ := parseDrainCall("DELETE /admin/drain")
+	server := &Server{URL: backendURL, Alive: true}
+	lb := &LoadBalancer{adminLocal: true, servers: []*Server{server}, drainNotify: drain, undrainNotify: undrain}
+
+	setWeight := func(query string) {
+		r := httptest.NewRequest("POST", "/lb-admin/backends/"+backendURL.Host+"/weight?"+query, nil)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204 setting the weight, got %d", w.Code)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q, got no call", want)
+		}
+	}
+
+	setWeight("weight=0&ramp=30")
+	expect("POST /admin/drain 30")
+
+	// Staying drained does not notify again
+	setWeight("weight=0")
+	setWeight("weight=2&ramp=0")
+	expect("DELETE /admin/drain 0")
+
+	// Changing a non-zero weight is not a drain
+	setWeight("weight=3")
+	select {
+	case got := <-calls:
+		t.Errorf("Expected no call for a weight change, got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseDrainCall(t *testing.T) {
+	call, err := parseDrainCall("/admin/drain")
+	if err != nil || call.String() != "POST /admin/drain" {
+		t.Errorf("Expected the method to default to POST, got %v, %v", call, err)
+	}
+	call, err = parseDrainCall("put /drain")
+	if err != nil || call.String() != "PUT /drain" {
+		t.Errorf("Expected PUT /drain, got %v, %v", call, err)
+	}
+	if call, err := parseDrainCall(""); call != nil || err != nil {
+		t.Errorf("Expected no call when disabled")
+	}
+	if _, err := parseDrainCall("POST admin/drain"); err == nil {
+		t.Errorf("Expected a path without a leading slash to be rejected")
+	}
+}
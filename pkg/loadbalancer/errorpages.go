@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// errorPage is a custom body for errors generated by the load balancer
+type errorPage struct {
+	tmpl        interface{ Execute(io.Writer, any) error }
+	contentType string
+}
+
+// errorPageData is what an error page template can refer to
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+}
+
+// errorPageFuncs are the functions available to error page templates
+var errorPageFuncs = map[string]any{
+	// json quotes a value as a JSON string, for JSON pages
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// errorPageKey matches the status or error code an error page is for
+var errorPageKey = regexp.MustCompile(`^([45][0-9][0-9]|[a-z_]+)$`)
+
+// parseErrorPages parses key=file definitions, where key is an HTTP status
+// such as 503 or an error code such as queue_full
+func parseErrorPages(defs []string) (map[string]*errorPage, error) {
+	pages := make(map[string]*errorPage)
+	for _, def := range defs {
+		key, path, ok := strings.Cut(def, "=")
+		if !ok || path == "" || !errorPageKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid error page %q, expected status=file or code=file", def)
+		}
+		if isStatus := strings.Trim(key, "0123456789") == ""; !isStatus && !knownErrorCode(key) {
+			return nil, fmt.Errorf("invalid error page %q: unknown error code %s", def, key)
+		}
+		page, err := loadErrorPage(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %q: %w", def, err)
+		}
+		pages[key] = page
+	}
+	return pages, nil
+}
+
+// knownErrorCode reports whether the load balancer generates the code
+func knownErrorCode(code string) bool {
+	for _, e := range lbErrors {
+		if e.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// loadErrorPage reads an error page template. HTML pages are parsed as
+// HTML templates so the message is escaped; other pages, such as JSON, as
+// text templates.
+func loadErrorPage(path string) (*errorPage, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	page := &errorPage{contentType: fileContentType(path, body)}
+	if strings.HasPrefix(page.contentType, "text/html") {
+		page.tmpl, err = htmltemplate.New(path).Funcs(errorPageFuncs).Parse(string(body))
+	} else {
+		page.tmpl, err = template.New(path).Funcs(errorPageFuncs).Parse(string(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// errorPageFor returns the page for the error's code, or else for its
+// status, or nil
+func (lb *LoadBalancer) errorPageFor(e lbError) *errorPage {
+	if page := lb.errorPages[e.code]; page != nil {
+		return page
+	}
+	return lb.errorPages[strconv.Itoa(e.status)]
+}
+
+// writeErrorPage answers with the custom page for the error, reporting
+// false when there is none or it fails to render
+func (lb *LoadBalancer) writeErrorPage(w http.ResponseWriter, e lbError, message string) bool {
+	page := lb.errorPageFor(e)
+	if page == nil {
+		return false
+	}
+	var body bytes.Buffer
+	data := errorPageData{Status: e.status, StatusText: http.StatusText(e.status), Code: e.code, Message: message}
+	if err := page.tmpl.Execute(&body, data); err != nil {
+		lb.errorf("Rendering error page for %s: %s", e.code, err)
+		return false
+	}
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	w.Write(body.Bytes())
+	return true
+}
@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePage writes an error page template to a temporary file
+func writePage(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestErrorPages(t *testing.T) {
+	html := writePage(t, "502.html", "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p>")
+	jsonPage := writePage(t, "busy.json", `{"error":"{{.Code}}","message":{{json .Message}}}`)
+	pages, err := parseErrorPages([]string{"502=" + html, "queue_full=" + jsonPage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{errorPages: pages}
+
+	w := httptest.NewRecorder()
+	lb.writeError(w, errUpstreamFailed, "dial <backend> failed")
+	if w.Code != http.StatusBadGateway || w.Header().Get("Content-Type") != "text/html; charset=utf-8" || w.Header().Get(errorCodeHeader) != "upstream_failed" {
+		t.Errorf("Expected the HTML page for 502, got %d %v", w.Code, w.Header())
+	}
+	if got := w.Body.String(); got != "<h1>502 Bad Gateway</h1><p>dial &lt;backend&gt; failed</p>" {
+		t.Errorf("Expected the escaped message in the HTML page, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	lb.writeError(w, errQueueFull, `queue "full"`)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the JSON page for queue_full, got %d %v", w.Code, w.Header())
+	}
+	if got := w.Body.String(); got != `{"error":"queue_full","message":"queue \"full\""}` {
+		t.Errorf("Unexpected JSON page %q", got)
+	}
+
+	// Errors without a page keep the plain text body
+	w = httptest.NewRecorder()
+	lb.writeError(w, errUpstreamTimeout, "timeout")
+	if w.Code != http.StatusGatewayTimeout || w.Body.String() != "timeout\n" {
+		t.Errorf("Expected the plain text error, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorPageForUnavailable(t *testing.T) {
+	page := writePage(t, "503.html", "<p>{{.Code}}</p>")
+	pages, _ := parseErrorPages([]string{"503=" + page})
+	lb := &LoadBalancer{errorPages: pages}
+
+	w := httptest.NewRecorder()
+	lb.writeUnavailable(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<p>no_healthy_upstream</p>" {
+		t.Errorf("Expected the 503 page, got %d %q", w.Code, w.Body.String())
+	}
+
+	// A -no-backend-response file takes precedence
+	lb.noBackendResponse = &unavailableResponse{body: []byte("maintenance"), contentType: "text/plain"}
+	w = httptest.NewRecorder()
+	lb.writeUnavailable(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "maintenance" {
+		t.Errorf("Expected the no-backend response, got %q", w.Body.String())
+	}
+}
+
+func TestParseErrorPages(t *testing.T) {
+	page := writePage(t, "page.html", "ok")
+	broken := writePage(t, "broken.html", "{{.Status")
+	for _, def := range []string{"503", "503=", "unknown_code=" + page, "5xx=" + page, "200=" + page, "503=/missing.html", "503=" + broken} {
+		if _, err := parseErrorPages([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+// errorCodeHeader carries the error code of responses generated by the
+// load balancer itself rather than a backend
+const errorCodeHeader = "X-LB-Error"
+
+// lbError is a class of failure generated by the load balancer. Codes are
+// stable so alerting and clients can key off them instead of messages.
+type lbError struct {
+	code   string
+	status int
+}
+
+// Load balancer error codes
+var (
+	errNoHealthyUpstream = lbError{"no_healthy_upstream", http.StatusServiceUnavailable}
+	errUpstreamSaturated = lbError{"upstream_saturated", http.StatusServiceUnavailable}
+	errQueueFull         = lbError{"queue_full", http.StatusServiceUnavailable}
+	errUpstreamTimeout   = lbError{"upstream_timeout", http.StatusGatewayTimeout}
+	errUpstreamFailed    = lbError{"upstream_failed", http.StatusBadGateway}
+	errResponseAborted   = lbError{"response_aborted", http.StatusBadGateway}
+	errDeadlineExceeded  = lbError{"deadline_exceeded", http.StatusGatewayTimeout}
+	errRateLimited       = lbError{"rate_limited", http.StatusTooManyRequests}
+	errBodyTooLarge      = lbError{"body_too_large", http.StatusRequestEntityTooLarge}
+	errBadRequest        = lbError{"bad_request", http.StatusBadRequest}
+	errUnauthorized      = lbError{"unauthorized", http.StatusUnauthorized}
+	errRouteNotFound     = lbError{"route_not_found", http.StatusNotFound}
+	errRouteDisabled     = lbError{"route_disabled", http.StatusServiceUnavailable}
+	errCORSRejected      = lbError{"cors_rejected", http.StatusForbidden}
+	errIPDenied          = lbError{"ip_denied", http.StatusForbidden}
+	errPluginRejected    = lbError{"plugin_rejected", http.StatusForbidden}
+	errPluginFailed      = lbError{"plugin_failed", http.StatusInternalServerError}
+)
+
+// lbErrors lists every load balancer error, for configuration that refers
+// to errors by code
+var lbErrors = []lbError{
+	errNoHealthyUpstream, errUpstreamSaturated, errQueueFull, errUpstreamTimeout,
+	errUpstreamFailed, errResponseAborted, errDeadlineExceeded, errRateLimited,
+	errBodyTooLarge, errBadRequest, errUnauthorized, errRouteNotFound, errRouteDisabled,
+	errCORSRejected, errIPDenied, errPluginRejected, errPluginFailed,
+}
+
+// withStatus returns the error answered with a different status code
+func (e lbError) withStatus(status int) lbError {
+	e.status = status
+	return e
+}
+
+// upstreamError classifies an error returned while proxying to a backend
+func upstreamError(err error) lbError {
+	if bodyTooLarge(err) {
+		return errBodyTooLarge
+	}
+	if isTimeout(err) {
+		return errUpstreamTimeout
+	}
+	return errUpstreamFailed
+}
+
+// recordError logs and counts a load balancer failure
+func (lb *LoadBalancer) recordError(e lbError, message string) {
+	lb.metrics().IncCounter("lb_errors_total", map[string]string{"code": e.code})
+	lb.errorf("Request failed with %s: %s", e.code, message)
+}
+
+// writeError answers the request with a load balancer failure, tagging the
+// response with its error code
+func (lb *LoadBalancer) writeError(w http.ResponseWriter, e lbError, message string) {
+	lb.recordError(e, message)
+	w.Header().Set(errorCodeHeader, e.code)
+	if lb.writeErrorPage(w, e, message) {
+		return
+	}
+	http.Error(w, message, e.status)
+}
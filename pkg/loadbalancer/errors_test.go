@@ -0,0 +1,54 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingMetrics counts counter increments by name and code label
+type countingMetrics struct {
+	nopMetrics
+	counters map[string]int
+}
+
+func (m *countingMetrics) IncCounter(name string, labels map[string]string) {
+	m.counters[name+"/"+labels["code"]]++
+}
+
+func TestErrorCodes(t *testing.T) {
+	metrics := &countingMetrics{counters: make(map[string]int)}
+	lb := &LoadBalancer{servers: []*Server{{URL: closedServerURL(t), Alive: true}}, current: -1}
+	lb.SetMetricsSink(metrics)
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway || w.Header().Get(errorCodeHeader) != "upstream_failed" {
+		t.Errorf("Expected 502 upstream_failed, got %d %q", w.Code, w.Header().Get(errorCodeHeader))
+	}
+
+	lb.servers[0].SetAlive(false)
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(errorCodeHeader) != "no_healthy_upstream" {
+		t.Errorf("Expected 503 no_healthy_upstream, got %d %q", w.Code, w.Header().Get(errorCodeHeader))
+	}
+
+	if metrics.counters["lb_errors_total/upstream_failed"] != 1 || metrics.counters["lb_errors_total/no_healthy_upstream"] != 1 {
+		t.Errorf("Expected each error to be counted by code, got %v", metrics.counters)
+	}
+}
+
+func TestUpstreamErrorClassification(t *testing.T) {
+	if got := upstreamError(context.DeadlineExceeded); got != errUpstreamTimeout {
+		t.Errorf("Expected a timeout to be classified as upstream_timeout, got %s", got.code)
+	}
+	if got := upstreamError(errors.New("connection refused")); got != errUpstreamFailed {
+		t.Errorf("Expected other errors to be classified as upstream_failed, got %s", got.code)
+	}
+	if got := errRouteDisabled.withStatus(http.StatusNotFound); got.code != "route_disabled" || got.status != http.StatusNotFound {
+		t.Errorf("Expected withStatus to keep the code, got %+v", got)
+	}
+}
@@ -0,0 +1,51 @@
+package loadbalancer_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/iamyusuf/own_lb/pkg/loadbalancer"
+)
+
+func ExampleNew() {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from the backend")
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	lb := loadbalancer.New(u)
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(string(body))
+	// Output: hello from the backend
+}
+
+func ExampleNewPool() {
+	var servers []*loadbalancer.Server
+	for _, addr := range []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"} {
+		u, _ := url.Parse(addr)
+		servers = append(servers, loadbalancer.NewServer(u))
+	}
+	pool, err := loadbalancer.NewPool("api", loadbalancer.StrategyRoundRobin, servers)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(pool.NextServer().URL.Host)
+	fmt.Println(pool.NextServer().URL.Host)
+	// Output:
+	// 10.0.0.1:8080
+	// 10.0.0.2:8080
+}
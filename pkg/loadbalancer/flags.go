@@ -0,0 +1,339 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// featureFlag is a toggle that gates a route or middleware, optionally for
+// only a percentage of clients or a set of segments
+type featureFlag struct {
+	Name       string   `json:"name"`
+	Enabled    bool     `json:"enabled"`
+	Percentage float64  `json:"percentage"`         // Share of clients the flag is on for (0-100)
+	Segments   []string `json:"segments,omitempty"` // Segment header values the flag is limited to
+}
+
+// featureFlags holds the flags loaded from a source plus admin overrides
+type featureFlags struct {
+	mu            sync.RWMutex
+	flags         map[string]featureFlag // Flags from the file or URL source
+	overrides     map[string]featureFlag // Flags toggled through the admin API
+	segmentHeader string
+}
+
+// newFeatureFlags creates an empty flag set
+func newFeatureFlags(segmentHeader string) *featureFlags {
+	return &featureFlags{
+		flags:         make(map[string]featureFlag),
+		overrides:     make(map[string]featureFlag),
+		segmentHeader: segmentHeader,
+	}
+}
+
+// parseFeatureFlags decodes a flag document of the form
+// {"flags": [{"name": "new-cache", "enabled": true, "percentage": 25}]}.
+// An omitted percentage means the flag is on for everyone.
+func parseFeatureFlags(data []byte) (map[string]featureFlag, error) {
+	var doc struct {
+		Flags []json.RawMessage `json:"flags"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing feature flags: %w", err)
+	}
+
+	flags := make(map[string]featureFlag)
+	for _, raw := range doc.Flags {
+		flag := featureFlag{Percentage: 100}
+		if err := json.Unmarshal(raw, &flag); err != nil {
+			return nil, fmt.Errorf("parsing feature flag: %w", err)
+		}
+		if flag.Name == "" {
+			return nil, fmt.Errorf("feature flag without a name")
+		}
+		flags[flag.Name] = flag
+	}
+	return flags, nil
+}
+
+// load replaces the source flags with the given document
+func (f *featureFlags) load(data []byte) error {
+	flags, err := parseFeatureFlags(data)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.flags = flags
+	f.mu.Unlock()
+	return nil
+}
+
+// set overrides a flag through the admin API
+func (f *featureFlags) set(flag featureFlag) {
+	f.mu.Lock()
+	f.overrides[flag.Name] = flag
+	f.mu.Unlock()
+}
+
+// clear removes an admin override so the source value applies again
+func (f *featureFlags) clear(name string) {
+	f.mu.Lock()
+	delete(f.overrides, name)
+	f.mu.Unlock()
+}
+
+// lookup returns the effective flag, admin overrides taking precedence
+func (f *featureFlags) lookup(name string) (featureFlag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if flag, ok := f.overrides[name]; ok {
+		return flag, true
+	}
+	flag, ok := f.flags[name]
+	return flag, ok
+}
+
+// all returns the effective flags sorted by name
+func (f *featureFlags) all() []featureFlag {
+	f.mu.RLock()
+	merged := make(map[string]featureFlag, len(f.flags)+len(f.overrides))
+	for name, flag := range f.flags {
+		merged[name] = flag
+	}
+	for name, flag := range f.overrides {
+		merged[name] = flag
+	}
+	f.mu.RUnlock()
+
+	flags := make([]featureFlag, 0, len(merged))
+	for _, flag := range merged {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Enabled reports whether the named flag is on for this request. The
+// percentage rollout hashes the client key so a client consistently
+// sees the same decision.
+func (f *featureFlags) Enabled(name string, r *http.Request, clientKey string) bool {
+	flag, ok := f.lookup(name)
+	if !ok || !flag.Enabled {
+		return false
+	}
+
+	if len(flag.Segments) > 0 {
+		segment := r.Header.Get(f.segmentHeader)
+		found := false
+		for _, s := range flag.Segments {
+			if s == segment {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if flag.Percentage >= 100 {
+		return true
+	}
+	if flag.Percentage <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "|" + clientKey))
+	return float64(h.Sum32()%10000) < flag.Percentage*100
+}
+
+// watchFile reloads flags from a file whenever its modification time
+// changes, logging through logf
+func (f *featureFlags) watchFile(path string, interval time.Duration, logf func(format string, v ...any)) {
+	var lastMod time.Time
+	reload := func() {
+		info, err := os.Stat(path)
+		if err != nil {
+			logf("Feature flags file unavailable: %s", err)
+			return
+		}
+		if info.ModTime().Equal(lastMod) {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logf("Failed to read feature flags: %s", err)
+			return
+		}
+		if err := f.load(data); err != nil {
+			logf("Failed to load feature flags: %s", err)
+			return
+		}
+		lastMod = info.ModTime()
+		logf("Loaded feature flags from %s", path)
+	}
+
+	reload()
+	go func() {
+		for range time.Tick(interval) {
+			reload()
+		}
+	}()
+}
+
+// pollURL periodically fetches flags from a remote flag service returning
+// the same document format as the flags file, logging through logf
+func (f *featureFlags) pollURL(url string, interval time.Duration, logf func(format string, v ...any)) {
+	client := &http.Client{Timeout: interval}
+	var last []byte
+	fetch := func() {
+		resp, err := client.Get(url)
+		if err != nil {
+			logf("Failed to fetch feature flags: %s", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logf("Failed to fetch feature flags: %s", resp.Status)
+			return
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			logf("Failed to fetch feature flags: %s", err)
+			return
+		}
+		if bytes.Equal(data, last) {
+			return
+		}
+		if err := f.load(data); err != nil {
+			logf("Failed to load feature flags: %s", err)
+			return
+		}
+		last = data
+		logf("Loaded feature flags from %s", url)
+	}
+
+	fetch()
+	go func() {
+		for range time.Tick(interval) {
+			fetch()
+		}
+	}()
+}
+
+// handleFlags lists the effective feature flags
+func (lb *LoadBalancer) handleFlags(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.flags.all())
+}
+
+// handleSetFlag toggles a flag, e.g. POST /lb-admin/flags/new-cache?enabled=true&percentage=10
+func (lb *LoadBalancer) handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	flag := featureFlag{Name: r.PathValue("name"), Percentage: 100}
+	if current, ok := lb.flags.lookup(flag.Name); ok {
+		flag = current
+	}
+
+	if value := r.URL.Query().Get("enabled"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "invalid enabled value", http.StatusBadRequest)
+			return
+		}
+		flag.Enabled = enabled
+	}
+	if value := r.URL.Query().Get("percentage"); value != "" {
+		percentage, err := strconv.ParseFloat(value, 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			http.Error(w, "invalid percentage value", http.StatusBadRequest)
+			return
+		}
+		flag.Percentage = percentage
+	}
+	if segments, ok := r.URL.Query()["segment"]; ok {
+		flag.Segments = segments
+	}
+
+	lb.flags.set(flag)
+	lb.logf("Feature flag %s set: enabled=%t percentage=%.1f", flag.Name, flag.Enabled, flag.Percentage)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+// handleClearFlag removes an admin override for a flag
+func (lb *LoadBalancer) handleClearFlag(w http.ResponseWriter, r *http.Request) {
+	lb.flags.clear(r.PathValue("name"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Features that -flag-gate can put behind a feature flag
+const (
+	gateCORS      = "cors"
+	gateRateLimit = "rate-limit"
+	gateBodyLimit = "body-limit"
+	gatePlugins   = "plugins"
+	gateCache     = "cache"
+	gateCompress  = "compress"
+	gateCoalesce  = "coalesce"
+)
+
+// gateableFeatures lists the features a flag can gate
+var gateableFeatures = []string{gateCORS, gateRateLimit, gateBodyLimit, gatePlugins, gateCache, gateCompress, gateCoalesce}
+
+// parseFlagGates parses feature=flag definitions into the flag gating each
+// feature
+func parseFlagGates(defs []string) (map[string]string, error) {
+	gates := make(map[string]string)
+	for _, def := range defs {
+		feature, flag, ok := strings.Cut(def, "=")
+		if !ok || flag == "" || !slices.Contains(gateableFeatures, feature) {
+			return nil, fmt.Errorf("invalid flag gate %q, expected feature=flag with feature one of %s", def, strings.Join(gateableFeatures, ", "))
+		}
+		gates[feature] = flag
+	}
+	return gates, nil
+}
+
+// featureEnabled reports whether the feature applies to the request: it is
+// not gated, or its flag is on for the request
+func (lb *LoadBalancer) featureEnabled(feature string, r *http.Request) bool {
+	return lb.flagEnabled(lb.flagGates[feature], r)
+}
+
+// gated makes a middleware skipped for requests its feature's flag is off for
+func (lb *LoadBalancer) gated(feature string, middleware Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if lb.featureEnabled(feature, r) {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// flagEnabled reports whether a feature gated by the named flag is active
+// for the request. An empty name means the feature is not gated.
+func (lb *LoadBalancer) flagEnabled(name string, r *http.Request) bool {
+	if name == "" {
+		return true
+	}
+	if lb.flags == nil {
+		return false
+	}
+	return lb.flags.Enabled(name, r, lb.trustedProxies.clientIP(r))
+}
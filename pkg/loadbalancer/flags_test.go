@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	flags := newFeatureFlags("X-Segment")
+	err := flags.load([]byte(`{"flags": [
+		{"name": "on", "enabled": true},
+		{"name": "off", "enabled": false},
+		{"name": "beta", "enabled": true, "segments": ["beta"]},
+		{"name": "half", "enabled": true, "percentage": 50}
+	]}`))
+	if err != nil {
+		t.Fatalf("Failed to load flags: %s", err)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	if !flags.Enabled("on", r, "client") {
+		t.Errorf("Expected flag 'on' to be enabled")
+	}
+	if flags.Enabled("off", r, "client") {
+		t.Errorf("Expected flag 'off' to be disabled")
+	}
+	if flags.Enabled("missing", r, "client") {
+		t.Errorf("Expected unknown flag to be disabled")
+	}
+	if flags.Enabled("beta", r, "client") {
+		t.Errorf("Expected segment flag to be disabled without the segment header")
+	}
+	r.Header.Set("X-Segment", "beta")
+	if !flags.Enabled("beta", r, "client") {
+		t.Errorf("Expected segment flag to be enabled for the beta segment")
+	}
+
+	// Percentage rollout should be sticky per client and roughly proportional
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		first := flags.Enabled("half", r, key)
+		if first != flags.Enabled("half", r, key) {
+			t.Fatalf("Expected a consistent decision for client %s", key)
+		}
+		if first {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Errorf("Expected about half of clients enabled, got %d/1000", enabled)
+	}
+}
+
+func TestFeatureFlagsAdminOverride(t *testing.T) {
+	lb := &LoadBalancer{adminLocal: true, flags: newFeatureFlags("X-Segment")}
+	lb.flags.load([]byte(`{"flags": [{"name": "new-pool", "enabled": false}]}`))
+
+	req := httptest.NewRequest("POST", "/lb-admin/flags/new-pool?enabled=true", nil)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from flag toggle, got %d", w.Code)
+	}
+	if !lb.flagEnabled("new-pool", req) {
+		t.Errorf("Expected flag to be enabled after admin toggle")
+	}
+
+	req = httptest.NewRequest("DELETE", "/lb-admin/flags/new-pool", nil)
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+	if lb.flagEnabled("new-pool", req) {
+		t.Errorf("Expected flag to fall back to the source value after clearing the override")
+	}
+}
+
+func TestFlagGatedRouting(t *testing.T) {
+	echo := func(name string) *Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		u, _ := url.Parse(backend.URL)
+		return &Server{URL: u, Alive: true}
+	}
+	routes, err := parsePathRoutes([]string{"/api=new,flag=new-pool"}, map[string]bool{"new": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers:    []*Server{echo("old")},
+		current:    -1,
+		pools:      map[string]*Pool{"new": newPool("new", []*Server{echo("new")})},
+		pathRoutes: routes,
+		flags:      newFeatureFlags("X-Segment"),
+	}
+	get := func(segment string) string {
+		req := httptest.NewRequest("GET", "/api/users", nil)
+		req.Header.Set("X-Segment", segment)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if got := get(""); got != "old" {
+		t.Errorf("Expected an unknown flag to leave the route off, got %q", got)
+	}
+	lb.flags.set(featureFlag{Name: "new-pool", Enabled: true, Percentage: 100, Segments: []string{"beta"}})
+	if got := get("beta"); got != "new" {
+		t.Errorf("Expected the beta segment to be routed to the new pool, got %q", got)
+	}
+	if got := get("stable"); got != "old" {
+		t.Errorf("Expected other segments to stay on the default servers, got %q", got)
+	}
+	lb.flags.set(featureFlag{Name: "new-pool", Enabled: false})
+	if got := get("beta"); got != "old" {
+		t.Errorf("Expected a disabled flag to turn the route off, got %q", got)
+	}
+}
+
+func TestFlagGatedMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, strings.Repeat("compressible ", 100))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	gates, err := parseFlagGates([]string{"compress=gzip-rollout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers:     []*Server{{URL: u, Alive: true}},
+		current:     -1,
+		compression: newCompression(64, defaultGzipTypes),
+		flags:       newFeatureFlags("X-Segment"),
+		flagGates:   gates,
+	}
+	encoding := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		return w.Header().Get("Content-Encoding")
+	}
+
+	if got := encoding(); got != "" {
+		t.Errorf("Expected no compression while the flag is off, got %q", got)
+	}
+	lb.flags.set(featureFlag{Name: "gzip-rollout", Enabled: true, Percentage: 100})
+	if got := encoding(); got != "gzip" {
+		t.Errorf("Expected compression once the flag is on, got %q", got)
+	}
+
+	if _, err := parseFlagGates([]string{"auth=off"}); err == nil {
+		t.Error("Expected features that cannot be gated to be rejected")
+	}
+}
@@ -0,0 +1,31 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// frontendSettings bound how long clients may take on connections to the
+// load balancer's own listeners. Zero disables a timeout.
+type frontendSettings struct {
+	readHeaderTimeout time.Duration // Reading the request line and headers
+	readTimeout       time.Duration // Reading the whole request including the body
+	writeTimeout      time.Duration // From the end of the request headers to the end of the response
+	idleTimeout       time.Duration // Waiting for the next request on a keep-alive connection
+	maxHeaderBytes    int           // Size of the request line and headers
+	errorLog          *log.Logger   // Connection errors, nil for the standard logger
+}
+
+// newServer creates an http.Server serving the handler with the settings
+func (s frontendSettings) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+		ErrorLog:          s.errorLog,
+	}
+}
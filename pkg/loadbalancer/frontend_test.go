@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrontendReadHeaderTimeout(t *testing.T) {
+	settings := frontendSettings{readHeaderTimeout: 100 * time.Millisecond, maxHeaderBytes: 1 << 20}
+	server := settings.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A slowloris client sends its headers a trickle at a time
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	// The server may answer 408 before closing the connection
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the server to close the connection, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the slow client to be cut off after the header timeout, took %s", elapsed)
+	}
+}
+
+func TestFrontendMaxHeaderBytes(t *testing.T) {
+	settings := frontendSettings{readHeaderTimeout: time.Second, maxHeaderBytes: 1024}
+	server := settings.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431 for oversized headers, got %d", resp.StatusCode)
+	}
+}
+
+func TestLintFrontendTimeouts(t *testing.T) {
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-read-header-timeout", "0")
+	if !hasFinding(findings, lintWarning, "slowloris") {
+		t.Error("Expected a warning without read timeouts")
+	}
+	findings = lintArgs(t, "-server", "http://localhost:8080")
+	if hasFinding(findings, lintWarning, "slowloris") || hasFinding(findings, lintWarning, "idle client connections") {
+		t.Error("Did not expect frontend warnings with the default timeouts")
+	}
+}
@@ -0,0 +1,173 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcHealthPath is the method path of the standard gRPC health check
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING value of HealthCheckResponse.ServingStatus
+const grpcServing = 1
+
+// grpcTransport speaks HTTP/2 to gRPC backends: cleartext (h2c) for
+// http:// backends and over TLS for https:// backends
+type grpcTransport struct {
+	h2c *http2.Transport
+	h2  *http2.Transport
+}
+
+// newGRPCTransport creates the transport used for gRPC health checks
+func newGRPCTransport(tlsConfig *tls.Config) *grpcTransport {
+	return &grpcTransport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+		h2: &http2.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.h2.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// grpcHealthTransport returns the gRPC health check transport, creating one
+// with the default TLS settings when none was configured
+func (lb *LoadBalancer) grpcHealthTransport() http.RoundTripper {
+	lb.grpcOnce.Do(func() {
+		if lb.grpcTransport == nil {
+			lb.grpcTransport = newGRPCTransport(nil)
+		}
+	})
+	return lb.grpcTransport
+}
+
+// checkGRPC calls grpc.health.v1.Health/Check on the backend and reports
+// an error unless the service is SERVING. An empty service checks the
+// server as a whole.
+func checkGRPC(ctx context.Context, transport http.RoundTripper, backend *url.URL, check healthCheck) error {
+	target := *backend
+	target.Path = grpcHealthPath
+	target.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(grpcFrame(encodeHealthRequest(check.service))))
+	if err != nil {
+		return err
+	}
+	check.apply(req)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	// Trailers-only responses carry the status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, message)
+	}
+
+	serving, err := decodeHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("service not serving (status %d)", serving)
+	}
+	return nil
+}
+
+// grpcFrame wraps a message in the gRPC length-prefixed framing
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// encodeHealthRequest encodes a HealthCheckRequest{service} message
+func encodeHealthRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	message := []byte{0x0a} // Field 1, length-delimited
+	message = binary.AppendUvarint(message, uint64(len(service)))
+	return append(message, service...)
+}
+
+// decodeHealthResponse returns the status field of a framed
+// HealthCheckResponse, skipping unknown fields
+func decodeHealthResponse(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("missing health check response")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("compressed health check response")
+	}
+	size := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < size {
+		return 0, errors.New("truncated health check response")
+	}
+	message := frame[5 : 5+size]
+
+	var status uint64
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0: // Varint
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			if key>>3 == 1 {
+				status = value
+			}
+			message = message[n:]
+		case 2: // Length-delimited
+			size, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < size {
+				return 0, errors.New("malformed health check response")
+			}
+			message = message[n+int(size):]
+		default:
+			return 0, errors.New("malformed health check response")
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcHealthServer answers gRPC health checks with the given serving status
+func grpcHealthServer(t *testing.T, status *uint64) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthPath || r.Header.Get("Content-Type") != "application/grpc" {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		message := []byte{0x08} // Field 1, varint
+		message = append(message, byte(*status))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame(message))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	status := uint64(grpcServing)
+	backend := grpcHealthServer(t, &status)
+	backendURL, _ := url.Parse(backend.URL)
+
+	server := &Server{URL: backendURL, Alive: false}
+	lb := &LoadBalancer{servers: []*Server{server}, healthType: healthGRPC}
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Fatalf("Expected a SERVING backend to be marked up")
+	}
+
+	status = 2 // NOT_SERVING
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Errorf("Expected a NOT_SERVING backend to be marked down")
+	}
+}
+
+func TestHealthRequestEncoding(t *testing.T) {
+	if got := encodeHealthRequest("orders"); string(got) != "\x0a\x06orders" {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+	if got := encodeHealthRequest(""); len(got) != 0 {
+		t.Errorf("Expected an empty message for the whole server, got %q", got)
+	}
+
+	// Unknown fields before the status are skipped
+	frame := grpcFrame([]byte{0x12, 0x02, 'h', 'i', 0x08, 0x01})
+	if status, err := decodeHealthResponse(frame); err != nil || status != grpcServing {
+		t.Errorf("Expected SERVING, got %d %v", status, err)
+	}
+	if _, err := decodeHealthResponse(grpcFrame([]byte{0x08})); err == nil {
+		t.Errorf("Expected a truncated varint to fail")
+	}
+}
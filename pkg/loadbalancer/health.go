@@ -0,0 +1,369 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health check types
+const (
+	healthHTTP = "http" // GET the health path and expect 200 OK
+	healthTCP  = "tcp"  // Only establish a TCP connection
+	healthGRPC = "grpc" // Call grpc.health.v1.Health/Check
+)
+
+// healthAddress returns the host:port dialed by TCP health checks,
+// defaulting the port from the scheme
+func healthAddress(u *url.URL) string {
+	if u.Port() != "" || u.Scheme == unixScheme {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// maxHealthBody caps how much of a health check response is read
+const maxHealthBody = 64 << 10
+
+// healthCheck holds a backend's own health check settings. Zero values
+// fall back to the global settings.
+type healthCheck struct {
+	typ        string
+	path       string
+	interval   time.Duration
+	timeout    time.Duration
+	service    string // gRPC service name
+	host       string // Host header, the backend's host when empty
+	headers    http.Header
+	validation *healthValidation
+}
+
+// apply sets the configured Host and headers on a health check request
+func (c healthCheck) apply(req *http.Request) {
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+}
+
+// parseHeaders parses "Name: value" header definitions
+func parseHeaders(defs []string) (http.Header, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+	headers := make(http.Header)
+	for _, def := range defs {
+		name, value, ok := strings.Cut(def, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", def)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// healthValidation asserts on a health check response beyond its status,
+// so backends answering 200 with a degraded status can be taken down
+type healthValidation struct {
+	statuses  []int          // Accepted status codes, 200 when empty
+	body      string         // Substring the body must contain
+	bodyRegex *regexp.Regexp // Pattern the body must match
+	jsonField string         // Dotted path of a JSON field, e.g. checks.db
+	jsonValue string         // Expected value of the JSON field
+}
+
+// newHealthValidation builds a validation from a comma-separated status
+// list, a body substring, a body regex and a field=value JSON check. It
+// returns nil when nothing beyond 200 OK is expected.
+func newHealthValidation(statuses, body, bodyRegex, jsonCheck string) (*healthValidation, error) {
+	if statuses == "" && body == "" && bodyRegex == "" && jsonCheck == "" {
+		return nil, nil
+	}
+	v := &healthValidation{body: body}
+	if statuses != "" {
+		for _, value := range strings.Split(statuses, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid health check status %q", value)
+			}
+			v.statuses = append(v.statuses, code)
+		}
+	}
+	if bodyRegex != "" {
+		re, err := regexp.Compile(bodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex: %w", err)
+		}
+		v.bodyRegex = re
+	}
+	if jsonCheck != "" {
+		field, value, ok := strings.Cut(jsonCheck, "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("invalid health check JSON assertion %q, expected field=value", jsonCheck)
+		}
+		v.jsonField, v.jsonValue = field, value
+	}
+	return v, nil
+}
+
+// validate checks a health check response, returning why it is unhealthy
+func (v *healthValidation) validate(status int, body []byte) error {
+	if v == nil {
+		if status != http.StatusOK {
+			return fmt.Errorf("status %d", status)
+		}
+		return nil
+	}
+
+	if len(v.statuses) == 0 && status != http.StatusOK || len(v.statuses) > 0 && !slices.Contains(v.statuses, status) {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	if v.body != "" && !bytes.Contains(body, []byte(v.body)) {
+		return fmt.Errorf("body does not contain %q", v.body)
+	}
+	if v.bodyRegex != nil && !v.bodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %s", v.bodyRegex)
+	}
+	if v.jsonField != "" {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not JSON: %w", err)
+		}
+		for _, key := range strings.Split(v.jsonField, ".") {
+			object, ok := doc.(map[string]any)
+			if !ok {
+				return fmt.Errorf("JSON field %s not found", v.jsonField)
+			}
+			if doc, ok = object[key]; !ok {
+				return fmt.Errorf("JSON field %s not found", v.jsonField)
+			}
+		}
+		if got := fmt.Sprint(doc); got != v.jsonValue {
+			return fmt.Errorf("JSON field %s is %q, expected %q", v.jsonField, got, v.jsonValue)
+		}
+	}
+	return nil
+}
+
+// healthCheckFor returns the effective health check settings of a server
+func (lb *LoadBalancer) healthCheckFor(server *Server) healthCheck {
+	check := server.HealthCheck()
+	if check.typ == "" {
+		check.typ = lb.healthType
+	}
+	if check.path == "" {
+		check.path = lb.healthCheck
+	}
+	if check.service == "" {
+		check.service = lb.grpcService
+	}
+	if check.host == "" {
+		check.host = lb.healthHost
+	}
+	if check.headers == nil {
+		check.headers = lb.healthHeaders
+	}
+	if check.timeout == 0 {
+		check.timeout = lb.healthTimeout
+	}
+	if check.validation == nil {
+		check.validation = lb.healthExpect
+	}
+	return check
+}
+
+// SetHealthCheck overrides the server's health check settings
+func (s *Server) SetHealthCheck(check healthCheck) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.check = check
+}
+
+// HealthCheck returns the server's own health check settings
+func (s *Server) HealthCheck() healthCheck {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	return s.health.check
+}
+
+// parseHealthChecks parses per-backend health check definitions of the
+// form host:port?path=/healthz&interval=10s&timeout=2s&type=http, which may
+// also set status, body, body_regex and json assertions, a gRPC service, a
+// Host and repeated header=Name:value headers
+func parseHealthChecks(defs []string) (map[string]healthCheck, error) {
+	checks := make(map[string]healthCheck)
+	for _, def := range defs {
+		host, query, _ := strings.Cut(def, "?")
+		values, err := url.ParseQuery(query)
+		if host == "" || err != nil {
+			return nil, fmt.Errorf("invalid backend health check %q, expected host:port?path=/healthz&interval=10s", def)
+		}
+		check, err := parseHealthCheck(def, values)
+		if err != nil {
+			return nil, err
+		}
+		checks[host] = check
+	}
+	return checks, nil
+}
+
+// parseHealthCheck parses the health check settings of a definition
+func parseHealthCheck(def string, values url.Values) (healthCheck, error) {
+	var check healthCheck
+	var err error
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "type":
+			if value != healthHTTP && value != healthTCP && value != healthGRPC {
+				return healthCheck{}, fmt.Errorf("invalid backend health check %q: unknown type %q", def, value)
+			}
+			check.typ = value
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return healthCheck{}, fmt.Errorf("invalid backend health check %q: path must start with /", def)
+			}
+			check.path = value
+		case "interval", "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return healthCheck{}, fmt.Errorf("invalid backend health check %q: bad %s", def, key)
+			}
+			if key == "interval" {
+				check.interval = d
+			} else {
+				check.timeout = d
+			}
+		case "service":
+			check.service = value
+		case "host":
+			check.host = value
+		case "header":
+			if check.headers, err = parseHeaders(values[key]); err != nil {
+				return healthCheck{}, fmt.Errorf("invalid backend health check %q: %w", def, err)
+			}
+		case "status", "body", "body_regex", "json":
+		default:
+			return healthCheck{}, fmt.Errorf("invalid backend health check %q: unknown setting %q", def, key)
+		}
+	}
+	check.validation, err = newHealthValidation(values.Get("status"), values.Get("body"), values.Get("body_regex"), values.Get("json"))
+	if err != nil {
+		return healthCheck{}, fmt.Errorf("invalid backend health check %q: %w", def, err)
+	}
+	return check, nil
+}
+
+// newHealthTransport creates the transport of the health check client. It
+// keeps its own small connection pool so checks neither wait behind nor
+// disturb proxied traffic, and bounds each phase by the check timeout.
+func newHealthTransport(tlsConfig *tls.Config, timeout time.Duration) *http.Transport {
+	transport := newUpstreamTransport(tlsConfig, proxyTimeouts{
+		dial:           timeout,
+		tlsHandshake:   timeout,
+		responseHeader: timeout,
+	})
+	transport.MaxIdleConnsPerHost = 1
+	return transport
+}
+
+// healthThresholds are the consecutive check results needed to change a
+// backend's state
+type healthThresholds struct {
+	rise int // Successful checks to mark a down backend up
+	fall int // Failed checks to mark an up backend down
+}
+
+// healthState holds one backend's health check settings and counts its
+// consecutive results
+type healthState struct {
+	mu         sync.Mutex
+	check      healthCheck
+	thresholds healthThresholds
+	successes  int
+	failures   int
+}
+
+// SetHealthThresholds changes the rise and fall thresholds of the server
+func (s *Server) SetHealthThresholds(t healthThresholds) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.thresholds = t
+}
+
+// checked reports whether any health check result has been recorded
+func (h *healthState) checked() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.successes > 0 || h.failures > 0
+}
+
+// record counts a check result and returns whether the backend should be
+// alive, which only changes once the rise or fall threshold is reached
+func (h *healthState) record(alive, healthy bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if healthy {
+		h.successes++
+		h.failures = 0
+		if !alive && h.successes >= max(h.thresholds.rise, 1) {
+			return true
+		}
+	} else {
+		h.failures++
+		h.successes = 0
+		if alive && h.failures >= max(h.thresholds.fall, 1) {
+			return false
+		}
+	}
+	return alive
+}
+
+// recordHealthCheck applies a health check result to the server
+func (lb *LoadBalancer) recordHealthCheck(server *Server, healthy bool) {
+	lb.setServerAlive(server, server.health.record(server.IsAlive(), healthy))
+}
+
+// healthJitterFor returns a random delay of up to the configured fraction
+// of the interval
+func (lb *LoadBalancer) healthJitterFor(interval time.Duration) time.Duration {
+	spread := time.Duration(float64(interval) * lb.healthJitter)
+	if spread <= 0 {
+		return 0
+	}
+	return rand.N(spread)
+}
+
+// parseHealthThresholds parses host:port=rise/fall definitions
+func parseHealthThresholds(defs []string) (map[string]healthThresholds, error) {
+	thresholds := make(map[string]healthThresholds)
+	for _, def := range defs {
+		host, value, ok := strings.Cut(def, "=")
+		riseValue, fallValue, ok2 := strings.Cut(value, "/")
+		rise, err1 := strconv.Atoi(riseValue)
+		fall, err2 := strconv.Atoi(fallValue)
+		if !ok || !ok2 || host == "" || err1 != nil || err2 != nil || rise < 1 || fall < 1 {
+			return nil, fmt.Errorf("invalid health threshold %q, expected host:port=rise/fall", def)
+		}
+		thresholds[host] = healthThresholds{rise: rise, fall: fall}
+	}
+	return thresholds, nil
+}
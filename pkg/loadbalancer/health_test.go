@@ -0,0 +1,294 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthRiseFall(t *testing.T) {
+	healthy := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	server := &Server{URL: backendURL, Alive: true}
+	server.SetHealthThresholds(healthThresholds{rise: 2, fall: 3})
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/"}
+
+	// Two failures and a success do not take the backend down
+	healthy = false
+	lb.HealthCheck()
+	lb.HealthCheck()
+	healthy = true
+	lb.HealthCheck()
+	healthy = false
+	lb.HealthCheck()
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Fatalf("Expected backend to stay up before 3 consecutive failures")
+	}
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Fatalf("Expected backend to be down after 3 consecutive failures")
+	}
+
+	healthy = true
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Errorf("Expected backend to stay down after a single success")
+	}
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected backend to be up after 2 consecutive successes")
+	}
+}
+
+func TestParseHealthThresholds(t *testing.T) {
+	thresholds, err := parseHealthThresholds([]string{"localhost:8080=3/5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := thresholds["localhost:8080"]; got.rise != 3 || got.fall != 5 {
+		t.Errorf("Expected rise 3 fall 5, got %+v", got)
+	}
+
+	for _, def := range []string{"localhost:8080=3", "localhost:8080=0/2", "=1/1", "localhost:8080=a/b"} {
+		if _, err := parseHealthThresholds([]string{def}); err == nil {
+			t.Errorf("Expected error for %q", def)
+		}
+	}
+}
+
+func TestTCPHealthCheckInHTTPMode(t *testing.T) {
+	// The backend accepts connections but has no HTTP health endpoint
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	server := &Server{URL: backendURL, Alive: false}
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/", healthType: healthTCP}
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected TCP health check to mark the backend up")
+	}
+
+	backend.Close()
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Errorf("Expected TCP health check to mark a closed backend down")
+	}
+}
+
+func TestHealthAddress(t *testing.T) {
+	for raw, want := range map[string]string{
+		"http://localhost:8080": "localhost:8080",
+		"http://example.com":    "example.com:80",
+		"https://example.com":   "example.com:443",
+		"http://[::1]":          "[::1]:80",
+	} {
+		u, _ := url.Parse(raw)
+		if got := healthAddress(u); got != want {
+			t.Errorf("healthAddress(%s) = %s, want %s", raw, got, want)
+		}
+	}
+}
+
+func TestPerBackendHealthCheck(t *testing.T) {
+	checks, err := parseHealthChecks([]string{"localhost:8081?path=/status&interval=10s&timeout=2s&type=http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := healthCheck{typ: healthHTTP, path: "/status", interval: 10 * time.Second, timeout: 2 * time.Second}
+	if got := checks["localhost:8081"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	for _, def := range []string{"localhost:8081?path=status", "localhost:8081?interval=soon", "localhost:8081?type=udp", "localhost:8081?port=1"} {
+		if _, err := parseHealthChecks([]string{def}); err == nil {
+			t.Errorf("Expected error for %q", def)
+		}
+	}
+
+	// Backends with different health endpoints share one load balancer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {})
+	backend := httptest.NewServer(mux)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	server := &Server{URL: backendURL, Alive: false}
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/healthz"}
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Fatalf("Expected the global health path to fail")
+	}
+	server.SetHealthCheck(healthCheck{path: "/status"})
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected the backend's own health path to pass")
+	}
+}
+
+func TestHealthValidation(t *testing.T) {
+	v, err := newHealthValidation("200,204", "", "", "checks.db=ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		status int
+		body   string
+		ok     bool
+	}{
+		{200, `{"checks": {"db": "ok"}}`, true},
+		{204, `{"checks": {"db": "ok"}}`, true},
+		{503, `{"checks": {"db": "ok"}}`, false},
+		{200, `{"checks": {"db": "degraded"}}`, false},
+		{200, `{"status": "ok"}`, false},
+		{200, `not json`, false},
+	} {
+		if err := v.validate(tc.status, []byte(tc.body)); (err == nil) != tc.ok {
+			t.Errorf("validate(%d, %s) = %v, want ok %v", tc.status, tc.body, err, tc.ok)
+		}
+	}
+
+	v, _ = newHealthValidation("", "alive", `version=\d+`, "")
+	if err := v.validate(200, []byte("alive version=3")); err != nil {
+		t.Errorf("Expected body checks to pass, got %v", err)
+	}
+	if err := v.validate(200, []byte("alive version=x")); err == nil {
+		t.Errorf("Expected the body regex to fail")
+	}
+
+	for _, args := range [][4]string{{"abc", "", "", ""}, {"", "", "(", ""}, {"", "", "", "status"}} {
+		if _, err := newHealthValidation(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("Expected error for %q", args)
+		}
+	}
+}
+
+func TestHealthCheckDegradedJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"degraded"}`)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	checks, err := parseHealthChecks([]string{backendURL.Host + "?json=status=ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{URL: backendURL, Alive: true}
+	server.SetHealthCheck(checks[backendURL.Host])
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/"}
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Errorf("Expected a 200 with a degraded status to mark the backend down")
+	}
+}
+
+func TestHealthCheckHostAndHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "api.internal" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	server := &Server{URL: backendURL, Alive: false}
+	lb := &LoadBalancer{servers: []*Server{server}, healthCheck: "/"}
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Fatalf("Expected the check to fail without credentials")
+	}
+
+	checks, err := parseHealthChecks([]string{backendURL.Host + "?host=api.internal&header=Authorization:Bearer+secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetHealthCheck(checks[backendURL.Host])
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected the check to pass with the configured Host and headers")
+	}
+
+	if _, err := parseHeaders([]string{"no colon"}); err == nil {
+		t.Errorf("Expected an error for a header without a colon")
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer hung.Close()
+	hungURL, _ := url.Parse(hung.URL)
+
+	server := &Server{URL: hungURL, Alive: true}
+	lb := &LoadBalancer{
+		servers:       []*Server{server},
+		healthCheck:   "/",
+		healthClient:  &http.Client{Transport: newHealthTransport(nil, time.Second)},
+		healthTimeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	lb.HealthCheck()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the check to give up after the timeout, took %s", elapsed)
+	}
+	if server.IsAlive() {
+		t.Errorf("Expected a hung backend to be marked down")
+	}
+}
+
+func TestHealthCheckRunsConcurrently(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+
+	var servers []*Server
+	for i := 0; i < 5; i++ {
+		servers = append(servers, &Server{URL: slowURL, Alive: false})
+	}
+	lb := &LoadBalancer{servers: servers, healthCheck: "/"}
+
+	start := time.Now()
+	lb.HealthCheck()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("Expected checks to run in parallel, took %s", elapsed)
+	}
+	for _, server := range servers {
+		if !server.IsAlive() {
+			t.Errorf("Expected every backend to be checked")
+		}
+	}
+}
+
+func TestHealthJitter(t *testing.T) {
+	lb := &LoadBalancer{}
+	if got := lb.healthJitterFor(time.Second); got != 0 {
+		t.Errorf("Expected no jitter by default, got %s", got)
+	}
+	lb.healthJitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := lb.healthJitterFor(time.Second); got < 0 || got >= 200*time.Millisecond {
+			t.Fatalf("Expected jitter below 200ms, got %s", got)
+		}
+	}
+}
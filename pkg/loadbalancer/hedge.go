@@ -0,0 +1,313 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hedgeSamples is the number of recent latencies kept per hedged route
+const hedgeSamples = 512
+
+// hedgeMinSamples is the number of latencies needed before the hedge delay
+// is derived from them instead of the minimum delay
+const hedgeMinSamples = 20
+
+// hedgeRecompute is how many new latencies trigger a recomputation of the
+// hedge delay
+const hedgeRecompute = 16
+
+// hedgeSettings configure request hedging on hedged routes
+type hedgeSettings struct {
+	quantile float64       // Latency quantile of the route after which a hedge is sent
+	minDelay time.Duration // Lower bound of the hedge delay, used until enough latencies are known
+	budget   float64       // Largest share of the route's requests that may be hedged
+}
+
+// hedgeRoute sends a second copy of slow requests under a path prefix to
+// another backend and uses whichever answers first. The hedge delay follows
+// the route's rolling latency quantile.
+type hedgeRoute struct {
+	prefix   string
+	settings hedgeSettings
+
+	mu       sync.Mutex
+	samples  []time.Duration // Ring of recent times to response headers
+	next     int
+	fresh    int // Samples since the delay was last computed
+	delay    time.Duration
+	requests int64
+	hedged   int64
+	wins     int64         // Hedges that answered first
+	wasted   int64         // Attempts whose work was thrown away
+	wastedD  time.Duration // Time backends spent on thrown away attempts
+}
+
+// parseHedgeRoutes parses the path prefixes of hedged routes
+func parseHedgeRoutes(prefixes []string, settings hedgeSettings) ([]*hedgeRoute, error) {
+	var routes []*hedgeRoute
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid hedge route %q, expected a path prefix", prefix)
+		}
+		routes = append(routes, &hedgeRoute{prefix: prefix, settings: settings, delay: settings.minDelay})
+	}
+	return routes, nil
+}
+
+// hedgeRouteFor returns the hedged route with the longest prefix matching
+// the request, or nil. Only requests without a body that the retry policy
+// considers safe to send twice are hedged.
+func (lb *LoadBalancer) hedgeRouteFor(r *http.Request) *hedgeRoute {
+	if !lb.retryRules().repeatable(r) || r.ContentLength != 0 || isProtocolUpgrade(r) {
+		return nil
+	}
+	var best *hedgeRoute
+	for _, route := range lb.hedges {
+		if (pathRoute{prefix: strings.TrimSuffix(route.prefix, "/")}).matches(r.URL.Path) && (best == nil || len(route.prefix) > len(best.prefix)) {
+			best = route
+		}
+	}
+	return best
+}
+
+// currentDelay returns how long to wait for a response before hedging
+func (h *hedgeRoute) currentDelay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.delay
+}
+
+// observe records a time to response headers and recomputes the delay
+// every few samples. It returns the new delay, or 0 when unchanged.
+func (h *hedgeRoute) observe(d time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.fresh++
+	if len(h.samples) < hedgeMinSamples || h.fresh < hedgeRecompute {
+		return 0
+	}
+	h.fresh = 0
+
+	sorted := slices.Clone(h.samples)
+	slices.Sort(sorted)
+	index := min(int(h.settings.quantile*float64(len(sorted))), len(sorted)-1)
+	h.delay = max(sorted[index], h.settings.minDelay)
+	return h.delay
+}
+
+// startRequest counts a request to the route
+func (h *hedgeRoute) startRequest() {
+	h.mu.Lock()
+	h.requests++
+	h.mu.Unlock()
+}
+
+// takeHedge reserves a hedge from the budget
+func (h *hedgeRoute) takeHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if float64(h.hedged+1) > h.settings.budget*float64(h.requests) {
+		return false
+	}
+	h.hedged++
+	return true
+}
+
+// recordWaste counts an attempt whose work was thrown away
+func (h *hedgeRoute) recordWaste(d time.Duration) {
+	h.mu.Lock()
+	h.wasted++
+	h.wastedD += d
+	h.mu.Unlock()
+}
+
+// hedgeAttempt is the outcome of one copy of a hedged request
+type hedgeAttempt struct {
+	server *Server
+	resp   *http.Response
+	err    error
+	hedge  bool
+	start  time.Time
+	cancel context.CancelFunc
+}
+
+// cancelOnClose cancels the winning attempt's context once its body has
+// been consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// hedgedRoundTrip sends the request to the server and, when no response
+// arrives within the route's hedge delay or the server fails before then,
+// a second copy to another backend. The first successful response wins and
+// the other attempt is cancelled.
+// The caller holds a request slot of the server; the returned server keeps
+// its slot and every other attempt's slot is returned here.
+func (lb *LoadBalancer) hedgedRoundTrip(r *http.Request, server *Server, route *hedgeRoute) (*http.Response, *Server, error) {
+	route.startRequest()
+	labels := map[string]string{"route": route.prefix}
+	attempts := make(chan hedgeAttempt, 2)
+	launch := func(server *Server, hedge bool) context.CancelFunc {
+		ctx, cancel := context.WithCancel(r.Context())
+		start := time.Now()
+		go func() {
+			resp, err := lb.attempt(r.WithContext(ctx), server)
+			attempts <- hedgeAttempt{server: server, resp: resp, err: err, hedge: hedge, start: start, cancel: cancel}
+		}()
+		return cancel
+	}
+
+	cancelPrimary, cancelHedge := launch(server, false), context.CancelFunc(nil)
+	pending := 1
+	timer := time.NewTimer(route.currentDelay())
+	defer timer.Stop()
+
+	var result hedgeAttempt
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if hedge := lb.hedgeServer(r, server, route); hedge != nil {
+				lb.recordRequest(hedge)
+				lb.metrics().IncCounter("lb_hedges_total", labels)
+				cancelHedge = launch(hedge, true)
+				pending++
+			}
+			continue
+		case result = <-attempts:
+			pending--
+		}
+		// A primary failing before the hedge delay is hedged right away
+		// rather than failing the request
+		if result.err != nil && pending == 0 && cancelHedge == nil {
+			if hedge := lb.hedgeServer(r, server, route); hedge != nil {
+				timer.Stop()
+				result.cancel()
+				result.server.finishRequest()
+				lb.recordRequest(hedge)
+				lb.metrics().IncCounter("lb_hedges_total", labels)
+				cancelHedge = launch(hedge, true)
+				pending++
+				continue
+			}
+		}
+		if result.err == nil || pending == 0 {
+			break
+		}
+		// One attempt failed, wait for the other
+		result.cancel()
+		result.server.finishRequest()
+	}
+
+	// Cancel and drain the losing attempt in the background
+	if pending > 0 {
+		if result.hedge {
+			cancelPrimary()
+		} else {
+			cancelHedge()
+		}
+		go func() {
+			loser := <-attempts
+			if loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+			loser.cancel()
+			loser.server.finishRequest()
+			d := time.Since(loser.start)
+			route.recordWaste(d)
+			lb.metrics().ObserveDuration("lb_hedge_wasted_seconds", d, labels)
+		}()
+	}
+
+	if result.err != nil {
+		result.cancel()
+		return nil, result.server, result.err
+	}
+	if delay := route.observe(time.Since(result.start)); delay > 0 {
+		lb.metrics().SetGauge("lb_hedge_delay_seconds", delay.Seconds(), labels)
+	}
+	if result.hedge {
+		route.mu.Lock()
+		route.wins++
+		route.mu.Unlock()
+		lb.metrics().IncCounter("lb_hedge_wins_total", labels)
+	}
+	result.resp.Body = &cancelOnClose{ReadCloser: result.resp.Body, cancel: result.cancel}
+	return result.resp, result.server, nil
+}
+
+// hedgeServer picks another backend for a hedge and takes one of its
+// request slots, or returns nil when the budget is used up or no other
+// backend is free
+func (lb *LoadBalancer) hedgeServer(r *http.Request, primary *Server, route *hedgeRoute) *Server {
+	next := lb.nextUntriedServer(r, map[*Server]bool{primary: true})
+	if next == nil {
+		return nil
+	}
+	if !next.startRequest() {
+		next.release()
+		return nil
+	}
+	if !route.takeHedge() {
+		next.finishRequest()
+		next.release()
+		return nil
+	}
+	return next
+}
+
+// hedgeStatus is the JSON view of a hedged route
+type hedgeStatus struct {
+	Route     string  `json:"route"`
+	DelayMs   float64 `json:"delay_ms"`
+	Requests  int64   `json:"requests"`
+	Hedged    int64   `json:"hedged"`
+	HedgeRate float64 `json:"hedge_rate"`
+	Wins      int64   `json:"hedge_wins"`
+	Wasted    int64   `json:"wasted_requests"`
+	WastedMs  float64 `json:"wasted_ms"`
+}
+
+// handleHedging reports the delay, hedge rate and wasted work of every
+// hedged route
+func (lb *LoadBalancer) handleHedging(w http.ResponseWriter, r *http.Request) {
+	statuses := []hedgeStatus{}
+	for _, route := range lb.hedges {
+		route.mu.Lock()
+		status := hedgeStatus{
+			Route:    route.prefix,
+			DelayMs:  durationMs(route.delay),
+			Requests: route.requests,
+			Hedged:   route.hedged,
+			Wins:     route.wins,
+			Wasted:   route.wasted,
+			WastedMs: durationMs(route.wastedD),
+		}
+		if route.requests > 0 {
+			status.HedgeRate = float64(route.hedged) / float64(route.requests)
+		}
+		route.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHedgeDelayFollowsQuantile(t *testing.T) {
+	routes, _ := parseHedgeRoutes([]string{"/api"}, hedgeSettings{quantile: 0.95, minDelay: 5 * time.Millisecond, budget: 0.1})
+	route := routes[0]
+
+	if d := route.currentDelay(); d != 5*time.Millisecond {
+		t.Errorf("Expected the minimum delay without samples, got %s", d)
+	}
+	for i := 1; i <= 100; i++ {
+		route.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := route.currentDelay(); d != 96*time.Millisecond {
+		t.Errorf("Expected the delay at the 95th percentile of 100 samples, got %s", d)
+	}
+
+	// The delay never drops below the minimum
+	for i := 0; i < hedgeSamples; i++ {
+		route.observe(time.Millisecond)
+	}
+	if d := route.currentDelay(); d != 5*time.Millisecond {
+		t.Errorf("Expected the delay to be floored at the minimum, got %s", d)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	route := &hedgeRoute{settings: hedgeSettings{budget: 0.1}}
+	hedged := 0
+	for i := 0; i < 100; i++ {
+		route.startRequest()
+		if route.takeHedge() {
+			hedged++
+		}
+	}
+	if hedged != 10 {
+		t.Errorf("Expected 10 hedges within a 10%% budget, got %d", hedged)
+	}
+}
+
+func TestHedgedRequest(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, "slow")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fast")
+	}))
+	defer fast.Close()
+	slowURL, _ := url.Parse(slow.URL)
+	fastURL, _ := url.Parse(fast.URL)
+
+	slowServer := &Server{URL: slowURL, Alive: true}
+	fastServer := &Server{URL: fastURL, Alive: true}
+	routes, _ := parseHedgeRoutes([]string{"/api"}, hedgeSettings{quantile: 0.95, minDelay: 20 * time.Millisecond, budget: 1})
+	lb := &LoadBalancer{servers: []*Server{slowServer, fastServer}, current: -1, hedges: routes}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/search", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "fast" {
+		t.Fatalf("Expected the hedge to answer, got %d %q", w.Code, w.Body.String())
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the hedge to cut the slow request short")
+	}
+
+	// The losing attempt is cancelled and its slot returned
+	deadline := time.Now().Add(5 * time.Second)
+	for slowServer.inflight.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	route := routes[0]
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	if route.requests != 1 || route.hedged != 1 || route.wins != 1 || route.wasted != 1 {
+		t.Errorf("Unexpected hedge stats: requests=%d hedged=%d wins=%d wasted=%d", route.requests, route.hedged, route.wins, route.wasted)
+	}
+	if slowServer.inflight.Load() != 0 || fastServer.inflight.Load() != 0 {
+		t.Errorf("Expected all request slots to be returned")
+	}
+	if !slowServer.IsAlive() {
+		t.Errorf("Expected the cancelled attempt not to count against the slow backend")
+	}
+}
+
+func TestHedgeAfterFailedPrimary(t *testing.T) {
+	// The primary refuses connections long before the hedge delay
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downURL, _ := url.Parse("http://" + down.Addr().String())
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up")
+	}))
+	defer up.Close()
+	upURL, _ := url.Parse(up.URL)
+
+	downServer := &Server{URL: downURL, Alive: true}
+	upServer := &Server{URL: upURL, Alive: true}
+	routes, _ := parseHedgeRoutes([]string{"/api"}, hedgeSettings{quantile: 0.95, minDelay: time.Minute, budget: 1})
+	lb := &LoadBalancer{servers: []*Server{downServer, upServer}, current: -1, hedges: routes}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/search", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "up" {
+		t.Fatalf("Expected the failed primary to be hedged, got %d %q", w.Code, w.Body.String())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Expected the hedge to be sent without waiting for the delay")
+	}
+	if downServer.inflight.Load() != 0 || upServer.inflight.Load() != 0 {
+		t.Error("Expected all request slots to be returned")
+	}
+}
+
+func TestHedgeRouteFor(t *testing.T) {
+	routes, _ := parseHedgeRoutes([]string{"/api", "/api/search"}, hedgeSettings{})
+	lb := &LoadBalancer{hedges: routes}
+
+	if route := lb.hedgeRouteFor(httptest.NewRequest("GET", "/api/search/x", nil)); route == nil || route.prefix != "/api/search" {
+		t.Errorf("Expected the longest matching prefix")
+	}
+	if lb.hedgeRouteFor(httptest.NewRequest("POST", "/api", nil)) != nil {
+		t.Errorf("Expected non-idempotent requests not to be hedged")
+	}
+	keyed := httptest.NewRequest("POST", "/api", nil)
+	keyed.Header.Set("Idempotency-Key", "abc")
+	if lb.hedgeRouteFor(keyed) == nil {
+		t.Errorf("Expected requests with an idempotency key to be hedged")
+	}
+	lb.retryPolicy, _ = parseRetryPolicy("GET", "", "", 0)
+	if lb.hedgeRouteFor(httptest.NewRequest("HEAD", "/api", nil)) != nil || lb.hedgeRouteFor(keyed) != nil {
+		t.Errorf("Expected hedging to follow the retried methods")
+	}
+	if lb.hedgeRouteFor(httptest.NewRequest("GET", "/other", nil)) != nil || lb.hedgeRouteFor(httptest.NewRequest("GET", "/apis", nil)) != nil {
+		t.Errorf("Expected other paths not to be hedged")
+	}
+	if _, err := parseHedgeRoutes([]string{"api"}, hedgeSettings{}); err == nil {
+		t.Errorf("Expected a prefix without a leading slash to be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the histogram buckets
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is a fixed-bucket latency distribution
+type histogram struct {
+	mu     sync.Mutex
+	counts []int64 // One per bucket plus an overflow bucket
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// newHistogram creates an empty histogram
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+// observe records a duration
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+	h.mu.Unlock()
+}
+
+// quantile estimates the q-th quantile (0-1) as the upper bound of the
+// bucket it falls in, capped at the largest observed value
+func (h *histogram) quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.count) + 0.5)
+	rank = max(rank, 1)
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if i < len(latencyBuckets) {
+				return min(latencyBuckets[i], h.max)
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// latencySummary is a JSON friendly summary of a histogram
+type latencySummary struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// summary returns the histogram's count, mean and common quantiles
+func (h *histogram) summary() latencySummary {
+	p50, p90, p99 := h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := latencySummary{
+		Count: h.count,
+		P50Ms: durationMs(p50),
+		P90Ms: durationMs(p90),
+		P99Ms: durationMs(p99),
+		MaxMs: durationMs(h.max),
+	}
+	if h.count > 0 {
+		s.MeanMs = durationMs(h.sum / time.Duration(h.count))
+	}
+	return s
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := newHistogram()
+	if h.quantile(0.5) != 0 {
+		t.Errorf("Expected empty histogram quantile to be 0")
+	}
+
+	for i := 0; i < 90; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(400 * time.Millisecond)
+	}
+
+	if q := h.quantile(0.5); q != 5*time.Millisecond {
+		t.Errorf("Expected p50 in the 5ms bucket, got %s", q)
+	}
+	if q := h.quantile(0.99); q != 400*time.Millisecond {
+		t.Errorf("Expected p99 capped at the observed max, got %s", q)
+	}
+
+	s := h.summary()
+	if s.Count != 100 || s.MaxMs != 400 {
+		t.Errorf("Unexpected summary: %+v", s)
+	}
+	if s.MeanMs < 42 || s.MeanMs > 43 {
+		t.Errorf("Expected mean of 42.7ms, got %.1f", s.MeanMs)
+	}
+}
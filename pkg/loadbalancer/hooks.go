@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"log"
+	"time"
+)
+
+// MetricsSink receives metrics emitted by the load balancer. Embedders can
+// implement it to bridge into Prometheus, StatsD or any other metrics stack.
+type MetricsSink interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+// Event types emitted to event listeners
+const (
+	EventBackendUp   = "backend_up"
+	EventBackendDown = "backend_down"
+
+	EventBackendAdded   = "backend_added"
+	EventBackendRemoved = "backend_removed"
+
+	EventCircuitOpen   = "circuit_open"
+	EventCircuitClosed = "circuit_closed"
+
+	EventBackendQuarantined = "backend_quarantined"
+	EventBackendReinstated  = "backend_reinstated"
+
+	EventOutlierEjected    = "outlier_ejected"
+	EventOutlierReinstated = "outlier_reinstated"
+
+	EventCutoverAdvanced   = "cutover_advanced"
+	EventCutoverPromoted   = "cutover_promoted"
+	EventCutoverRolledBack = "cutover_rolled_back"
+
+	EventBlueGreenSwitched = "blue_green_switched"
+
+	EventSyntheticFailed    = "synthetic_failed"
+	EventSyntheticRecovered = "synthetic_recovered"
+)
+
+// Event describes a notable state change inside the load balancer
+type Event struct {
+	Type    string
+	Backend string
+	Message string
+	Time    time.Time
+}
+
+// EventListener is notified of load balancer events
+type EventListener interface {
+	OnEvent(event Event)
+}
+
+// Logger is the logging interface used by the load balancer core.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// nopMetrics discards all metrics
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, map[string]string)                     {}
+func (nopMetrics) ObserveDuration(string, time.Duration, map[string]string) {}
+func (nopMetrics) SetGauge(string, float64, map[string]string)              {}
+
+// SetMetricsSink sets the sink that receives load balancer metrics
+func (lb *LoadBalancer) SetMetricsSink(sink MetricsSink) {
+	lb.metricsSink = sink
+}
+
+// AddEventListener registers a listener for load balancer events
+func (lb *LoadBalancer) AddEventListener(listener EventListener) {
+	lb.listenersMu.Lock()
+	lb.listeners = append(lb.listeners, listener)
+	lb.listenersMu.Unlock()
+}
+
+// SetLogger sets the logger used by the load balancer core
+func (lb *LoadBalancer) SetLogger(logger Logger) {
+	lb.logger = logger
+}
+
+// metrics returns the configured metrics sink or a no-op sink
+func (lb *LoadBalancer) metrics() MetricsSink {
+	if lb.metricsSink == nil {
+		return nopMetrics{}
+	}
+	return lb.metricsSink
+}
+
+// logf logs through the configured logger, defaulting to the standard logger
+func (lb *LoadBalancer) logf(format string, v ...any) {
+	if lb.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	lb.logger.Printf(format, v...)
+}
+
+// emit notifies all registered listeners of an event
+func (lb *LoadBalancer) emit(eventType, backend, message string) {
+	event := Event{Type: eventType, Backend: backend, Message: message, Time: time.Now()}
+
+	lb.listenersMu.RLock()
+	listeners := lb.listeners
+	lb.listenersMu.RUnlock()
+
+	for _, listener := range listeners {
+		listener.OnEvent(event)
+	}
+}
+
+// setServerAlive updates a backend's health and reports state transitions
+func (lb *LoadBalancer) setServerAlive(server *Server, alive bool) {
+	reason := "backend passed health check"
+	if !alive {
+		reason = "backend failed health check"
+	}
+	lb.setServerAliveReason(server, alive, reason)
+}
+
+// setServerAliveReason is setServerAlive with the message of the emitted event
+func (lb *LoadBalancer) setServerAliveReason(server *Server, alive bool, reason string) {
+	wasAlive := server.IsAlive()
+	server.SetAlive(alive)
+
+	labels := map[string]string{"backend": server.URL.Host}
+	if alive {
+		lb.metrics().SetGauge("lb_backend_up", 1, labels)
+	} else {
+		lb.metrics().SetGauge("lb_backend_up", 0, labels)
+	}
+
+	if wasAlive == alive {
+		return
+	}
+	if alive {
+		lb.emit(EventBackendUp, server.URL.Host, reason)
+	} else {
+		lb.emit(EventBackendDown, server.URL.Host, reason)
+	}
+}
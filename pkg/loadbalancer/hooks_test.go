@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingListener collects events for assertions
+type recordingListener struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *recordingListener) OnEvent(event Event) {
+	l.mu.Lock()
+	l.events = append(l.events, event)
+	l.mu.Unlock()
+}
+
+// recordingMetrics collects gauge values for assertions
+type recordingMetrics struct {
+	nopMetrics
+	gauges map[string]float64
+}
+
+func (m *recordingMetrics) SetGauge(name string, value float64, labels map[string]string) {
+	m.gauges[name+"/"+labels["backend"]] = value
+}
+
+func TestBackendStateEvents(t *testing.T) {
+	server := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	lb := &LoadBalancer{servers: []*Server{server}}
+
+	listener := &recordingListener{}
+	metrics := &recordingMetrics{gauges: make(map[string]float64)}
+	lb.AddEventListener(listener)
+	lb.SetMetricsSink(metrics)
+
+	lb.setServerAlive(server, true)
+	lb.setServerAlive(server, false)
+	lb.setServerAlive(server, false)
+	lb.setServerAlive(server, true)
+
+	if len(listener.events) != 2 {
+		t.Fatalf("Expected 2 transition events, got %d", len(listener.events))
+	}
+	if listener.events[0].Type != EventBackendDown || listener.events[1].Type != EventBackendUp {
+		t.Errorf("Unexpected event sequence: %s, %s", listener.events[0].Type, listener.events[1].Type)
+	}
+	if listener.events[0].Backend != "localhost:8080" || listener.events[0].Time.After(time.Now()) {
+		t.Errorf("Unexpected event contents: %+v", listener.events[0])
+	}
+	if metrics.gauges["lb_backend_up/localhost:8080"] != 1 {
+		t.Errorf("Expected backend up gauge to be 1")
+	}
+}
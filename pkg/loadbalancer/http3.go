@@ -0,0 +1,225 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server creates an HTTP/3 server on the UDP address matching the TLS listener
+func newHTTP3Server(addr string, port int, handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		Port:      port,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
+
+// serveHTTP3 runs the HTTP/3 listener
+func serveHTTP3(server *http3.Server, conn net.PacketConn, logger *log.Logger) {
+	logger.Printf("HTTP/3 listener starting on UDP port %d", server.Port)
+	if err := server.Serve(conn); !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal(err)
+	}
+}
+
+// altSvcHandler advertises the HTTP/3 listener to clients connecting over
+// HTTP/1.1 or HTTP/2 with an Alt-Svc header
+func altSvcHandler(server *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// http3RetryAfter is how long a backend that failed over HTTP/3 is reached
+// over TCP before HTTP/3 is tried again
+const http3RetryAfter = 5 * time.Minute
+
+// altSvcDefaultMaxAge is how long an Alt-Svc advertisement without ma
+// holds, as in RFC 7838
+const altSvcDefaultMaxAge = 24 * time.Hour
+
+// altService is an HTTP/3 endpoint a backend advertised with Alt-Svc
+type altService struct {
+	addr    string // host:port to reach over QUIC
+	expires time.Time
+}
+
+// http3Fallback sends requests to https:// backends over HTTP/3 once they
+// advertise it with Alt-Svc on a response over TCP, and falls back to
+// HTTP/2 or HTTP/1.1 over TCP when HTTP/3 fails
+type http3Fallback struct {
+	h3       http.RoundTripper
+	fallback http.RoundTripper
+	logf     func(format string, v ...any)
+
+	mu       sync.Mutex
+	services map[string]altService // HTTP/3 endpoints advertised by the backends
+	good     map[string]bool       // Backends that have answered over HTTP/3
+	broken   map[string]time.Time  // Backends reached over TCP until the time
+}
+
+// newHTTP3Fallback creates the HTTP/3 upstream transport with the TLS
+// settings of the backends and a QUIC handshake bounded by the dial and
+// TLS handshake timeouts
+func newHTTP3Fallback(tlsConfig *tls.Config, timeouts proxyTimeouts, fallback http.RoundTripper, logf func(format string, v ...any)) *http3Fallback {
+	h3 := &http3.Transport{TLSClientConfig: tlsConfig}
+	if handshake := timeouts.dial + timeouts.tlsHandshake; handshake > 0 {
+		h3.QUICConfig = &quic.Config{HandshakeIdleTimeout: handshake}
+	}
+	return &http3Fallback{
+		h3:       h3,
+		fallback: fallback,
+		logf:     logf,
+		services: make(map[string]altService),
+		good:     make(map[string]bool),
+		broken:   make(map[string]time.Time),
+	}
+}
+
+// replayable reports whether a request can be sent again over TCP after
+// HTTP/3 failed, possibly after the backend received it: its method must
+// be idempotent and it must have no body, which cannot be read twice
+func replayable(req *http.Request) bool {
+	return idempotentMethods[req.Method] && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// http3Addr returns the HTTP/3 endpoint to send the request to, or false
+// when it goes over TCP. Backends are only tried over HTTP/3 once they
+// advertised it, and requests that cannot fall back to TCP only once the
+// backend has answered over HTTP/3. Protocol upgrades need HTTP/1.1.
+func (t *http3Fallback) http3Addr(req *http.Request) (string, bool) {
+	if req.URL.Scheme != "https" || isProtocolUpgrade(req) {
+		return "", false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	host := req.URL.Host
+	now := time.Now()
+	if until, ok := t.broken[host]; ok {
+		if now.Before(until) {
+			return "", false
+		}
+		delete(t.broken, host)
+	}
+	service, ok := t.services[host]
+	if ok && !now.Before(service.expires) {
+		delete(t.services, host)
+		delete(t.good, host)
+		ok = false
+	}
+	if !ok || (!t.good[host] && !replayable(req)) {
+		return "", false
+	}
+	return service.addr, true
+}
+
+// learn records the HTTP/3 endpoint a backend advertises in the Alt-Svc
+// header of a response. Only endpoints on the backend's own host are used,
+// since the backend's certificate has to cover them.
+func (t *http3Fallback) learn(host string, header http.Header) {
+	values := header.Values("Alt-Svc")
+	if len(values) == 0 {
+		return
+	}
+	service, found, clear := parseAltSvc(host, strings.Join(values, ","), time.Now())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case found:
+		t.services[host] = service
+	case clear:
+		delete(t.services, host)
+		delete(t.good, host)
+	}
+}
+
+// parseAltSvc finds an h3 alternative on the host in an Alt-Svc value, such
+// as h3=":443"; ma=3600. It also reports whether the value is "clear",
+// withdrawing earlier advertisements.
+func parseAltSvc(host, value string, now time.Time) (altService, bool, bool) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	if strings.TrimSpace(value) == "clear" {
+		return altService{}, false, true
+	}
+	for _, entry := range strings.Split(value, ",") {
+		params := strings.Split(entry, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		altHost, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || (altHost != "" && altHost != hostname) {
+			continue
+		}
+		maxAge := altSvcDefaultMaxAge
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); name == "ma" && err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+		if maxAge <= 0 {
+			return altService{}, false, true
+		}
+		return altService{addr: net.JoinHostPort(hostname, port), expires: now.Add(maxAge)}, true, false
+	}
+	return altService{}, false, false
+}
+
+// RoundTrip implements http.RoundTripper. A failed HTTP/3 attempt is only
+// repeated over TCP for replayable requests, as the backend may already
+// have received the request.
+func (t *http3Fallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	addr, ok := t.http3Addr(req)
+	if !ok {
+		resp, err := t.fallback.RoundTrip(req)
+		if err == nil && req.URL.Scheme == "https" {
+			t.learn(host, resp.Header)
+		}
+		return resp, err
+	}
+
+	out := req
+	if addr != host {
+		// The request still addresses the origin, only the port changes
+		out = req.Clone(req.Context())
+		out.URL.Host = addr
+		if out.Host == "" {
+			out.Host = host
+		}
+	}
+	resp, err := t.h3.RoundTrip(out)
+	t.mu.Lock()
+	if err == nil {
+		t.good[host] = true
+	} else if req.Context().Err() == nil {
+		delete(t.good, host)
+		t.broken[host] = time.Now().Add(http3RetryAfter)
+	}
+	t.mu.Unlock()
+	if err == nil {
+		t.learn(host, resp.Header)
+	}
+
+	if err != nil && req.Context().Err() == nil && replayable(req) {
+		t.logf("HTTP/3 to %s failed, falling back to TCP: %s", addr, err)
+		return t.fallback.RoundTrip(req)
+	}
+	return resp, err
+}
@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// protoResponder answers every request with an empty response of the protocol
+func protoResponder(proto string, calls *int) http.RoundTripper {
+	return altSvcResponder(proto, "", calls)
+}
+
+// altSvcResponder answers every request with an empty response of the
+// protocol advertising the Alt-Svc value, if any
+func altSvcResponder(proto, altSvc string, calls *int) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		*calls++
+		header := http.Header{}
+		if altSvc != "" {
+			header.Set("Alt-Svc", altSvc)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Proto: proto, Header: header, Body: http.NoBody}, nil
+	})
+}
+
+func TestHTTP3LearnedFromAltSvc(t *testing.T) {
+	var h3Calls, tcpCalls int
+	var h3Host string
+	transport := newHTTP3Fallback(nil, proxyTimeouts{}, protoResponder("HTTP/1.1", &tcpCalls), t.Logf)
+	transport.h3 = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h3Calls++
+		h3Host = req.URL.Host
+		return &http.Response{StatusCode: http.StatusOK, Proto: "HTTP/3.0", Header: http.Header{}, Body: http.NoBody}, nil
+	})
+
+	// Backends that never advertised HTTP/3 are not tried over it
+	for i := 0; i < 2; i++ {
+		transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	}
+	if h3Calls != 0 || tcpCalls != 2 {
+		t.Fatalf("Expected TCP without an Alt-Svc advertisement, got %d HTTP/3 and %d TCP calls", h3Calls, tcpCalls)
+	}
+
+	// An advertisement moves the following requests to the advertised port
+	transport.fallback = altSvcResponder("HTTP/1.1", `h3=":9443"; ma=60, h2=":8443"`, &tcpCalls)
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	if h3Calls != 1 || h3Host != "backend:9443" {
+		t.Errorf("Expected HTTP/3 to the advertised port, got %d calls to %q", h3Calls, h3Host)
+	}
+
+	// Advertisements expire
+	transport.services["backend:8443"] = altService{addr: "backend:9443", expires: time.Now().Add(-time.Second)}
+	transport.fallback = protoResponder("HTTP/1.1", &tcpCalls)
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	if h3Calls != 1 {
+		t.Errorf("Expected TCP once the advertisement expired")
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		value string
+		addr  string
+		clear bool
+		age   time.Duration
+	}{
+		{value: `h3=":443"`, addr: "backend:443", age: altSvcDefaultMaxAge},
+		{value: `h3-29=":443", h3="backend:8444"; ma=30; persist=1`, addr: "backend:8444", age: 30 * time.Second},
+		{value: `h3="other:443"`},
+		{value: `h2=":443"`},
+		{value: `clear`, clear: true},
+		{value: `h3=":443"; ma=0`, clear: true},
+	} {
+		service, found, clear := parseAltSvc("backend:8443", test.value, now)
+		if found != (test.addr != "") || service.addr != test.addr || clear != test.clear {
+			t.Errorf("%q: expected %q (clear %v), got %q %v (clear %v)", test.value, test.addr, test.clear, service.addr, found, clear)
+		}
+		if found && service.expires != now.Add(test.age) {
+			t.Errorf("%q: expected to expire after %s, got %s", test.value, test.age, service.expires.Sub(now))
+		}
+	}
+}
+
+func TestHTTP3FallbackToTCP(t *testing.T) {
+	var h3Calls, tcpCalls int
+	h3Failing := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h3Calls++
+		return nil, errors.New("timeout: no recent network activity")
+	})
+	transport := newHTTP3Fallback(nil, proxyTimeouts{}, altSvcResponder("HTTP/1.1", `h3=":8443"`, &tcpCalls), t.Logf)
+	transport.h3 = h3Failing
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+
+	resp, err := transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	if err != nil || resp.Proto != "HTTP/1.1" || h3Calls != 1 {
+		t.Fatalf("Expected fallback to HTTP/1.1 after HTTP/3 failed, got %v %v", resp, err)
+	}
+
+	// The backend is not tried over HTTP/3 again until the retry interval passes
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	if h3Calls != 1 || tcpCalls != 3 {
+		t.Errorf("Expected 1 HTTP/3 and 3 TCP attempts, got %d and %d", h3Calls, tcpCalls)
+	}
+	transport.broken["backend:8443"] = time.Now().Add(-time.Second)
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	if h3Calls != 2 {
+		t.Errorf("Expected HTTP/3 to be retried after the retry interval")
+	}
+}
+
+func TestHTTP3FallbackOnlyForReplayableRequests(t *testing.T) {
+	var h3Calls, tcpCalls int
+	transport := newHTTP3Fallback(nil, proxyTimeouts{}, altSvcResponder("HTTP/1.1", `h3=":8443"`, &tcpCalls), t.Logf)
+	transport.h3 = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h3Calls++
+		return nil, errors.New("stream reset after the request was sent")
+	})
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+
+	// The backend may have acted on a POST before HTTP/3 failed
+	transport.good["backend:8443"] = true
+	if _, err := transport.RoundTrip(httptest.NewRequest("POST", "https://backend:8443/", nil)); err == nil {
+		t.Errorf("Expected a failed POST not to be repeated over TCP")
+	}
+	if h3Calls != 1 || tcpCalls != 1 {
+		t.Errorf("Expected 1 HTTP/3 and 1 TCP attempt, got %d and %d", h3Calls, tcpCalls)
+	}
+}
+
+func TestHTTP3OnlyForHTTPSAndReplayableRequests(t *testing.T) {
+	var h3Calls, tcpCalls int
+	transport := newHTTP3Fallback(nil, proxyTimeouts{}, altSvcResponder("HTTP/1.1", `h3=":8443"`, &tcpCalls), t.Logf)
+	transport.h3 = protoResponder("HTTP/3.0", &h3Calls)
+
+	transport.RoundTrip(httptest.NewRequest("GET", "http://backend:8080/", nil))
+	transport.RoundTrip(httptest.NewRequest("GET", "http://backend:8080/", nil))
+	if h3Calls != 0 {
+		t.Errorf("Expected plain http backends to use TCP")
+	}
+
+	// A body cannot be replayed over TCP, so it waits until HTTP/3 is known to work
+	post := func() *http.Request {
+		req, _ := http.NewRequest("POST", "https://backend:8443/", strings.NewReader("data"))
+		req.GetBody = nil
+		return req
+	}
+	transport.RoundTrip(post())
+	transport.RoundTrip(post())
+	if h3Calls != 0 || tcpCalls != 4 {
+		t.Errorf("Expected a request body to use TCP for an unknown backend")
+	}
+	transport.RoundTrip(httptest.NewRequest("GET", "https://backend:8443/", nil))
+	transport.RoundTrip(post())
+	if h3Calls != 2 {
+		t.Errorf("Expected a request body to use HTTP/3 once the backend answered over it, got %d calls", h3Calls)
+	}
+}
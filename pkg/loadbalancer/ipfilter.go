@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipACL allows or denies clients by network. Deny entries win; when allow
+// entries are present, clients outside them are denied too.
+type ipACL struct {
+	allow trustedProxies
+	deny  trustedProxies
+}
+
+// permits reports whether the client IP passes the list
+func (acl *ipACL) permits(ip net.IP) bool {
+	if acl.deny.contains(ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || acl.allow.contains(ip)
+}
+
+// ipFilter holds the global list and the lists of routes by path prefix
+type ipFilter struct {
+	global ipACL
+	routes map[string]*ipACL
+}
+
+// parseIPFilter parses allow and deny entries, each either a CIDR or bare
+// IP applying to every request, or /path/prefix=cidr[,cidr...] applying to
+// one route
+func parseIPFilter(allow, deny []string) (*ipFilter, error) {
+	filter := &ipFilter{routes: make(map[string]*ipACL)}
+	for _, list := range []struct {
+		defs  []string
+		allow bool
+	}{{allow, true}, {deny, false}} {
+		for _, def := range list.defs {
+			acl, cidrs := &filter.global, def
+			if prefix, value, ok := strings.Cut(def, "="); ok {
+				if !strings.HasPrefix(prefix, "/") {
+					return nil, fmt.Errorf("invalid IP filter %q, expected cidr or /path/prefix=cidr[,cidr...]", def)
+				}
+				prefix = strings.TrimSuffix(prefix, "/")
+				if filter.routes[prefix] == nil {
+					filter.routes[prefix] = &ipACL{}
+				}
+				acl, cidrs = filter.routes[prefix], value
+			}
+			networks, err := parseTrustedProxies(strings.Split(cidrs, ","))
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP filter %q, expected cidr or /path/prefix=cidr[,cidr...]", def)
+			}
+			if list.allow {
+				acl.allow = append(acl.allow, networks...)
+			} else {
+				acl.deny = append(acl.deny, networks...)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// route returns the list of the longest route prefix matching the path
+func (f *ipFilter) route(path string) (string, *ipACL) {
+	var best string
+	var acl *ipACL
+	for prefix, routeACL := range f.routes {
+		if (pathRoute{prefix: prefix}).matches(path) && (acl == nil || len(prefix) > len(best)) {
+			best, acl = prefix, routeACL
+		}
+	}
+	return best, acl
+}
+
+// check returns the route whose list denies the client, "global" for the
+// global list, or an empty string when the client is allowed
+func (f *ipFilter) check(ip net.IP, path string) string {
+	if !f.global.permits(ip) {
+		return "global"
+	}
+	if prefix, acl := f.route(path); acl != nil && !acl.permits(ip) {
+		return prefix
+	}
+	return ""
+}
+
+// ipDenied answers the request with 403 when the client's IP is not
+// allowed on the route
+func (lb *LoadBalancer) ipDenied(w http.ResponseWriter, r *http.Request) bool {
+	if lb.ipFilter == nil {
+		return false
+	}
+	client := lb.trustedProxies.clientIP(r)
+	route := lb.ipFilter.check(net.ParseIP(client), r.URL.Path)
+	if route == "" {
+		return false
+	}
+	lb.deniedRequests.Add(1)
+	lb.metrics().IncCounter("lb_ip_denied_total", map[string]string{"route": route})
+	lb.writeError(w, errIPDenied, fmt.Sprintf("Client %s is not allowed", client))
+	return true
+}
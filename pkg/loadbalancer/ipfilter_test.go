@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	filter, err := parseIPFilter(
+		[]string{"/admin=10.0.0.0/8,192.168.1.5"},
+		[]string{"203.0.113.0/24", "/admin/public=10.9.0.0/16"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers:  []*Server{{URL: backendURL, Alive: true}},
+		current:  -1,
+		ipFilter: filter,
+	}
+
+	for _, tc := range []struct {
+		client string
+		path   string
+		status int
+	}{
+		{"198.51.100.7", "/", http.StatusOK},
+		{"203.0.113.9", "/", http.StatusForbidden},
+		{"203.0.113.9", "/admin", http.StatusForbidden},
+		{"198.51.100.7", "/admin/users", http.StatusForbidden},
+		{"10.1.2.3", "/admin/users", http.StatusOK},
+		{"192.168.1.5", "/admin", http.StatusOK},
+		{"10.9.1.1", "/admin/public", http.StatusForbidden},
+		{"10.9.1.1", "/administrator", http.StatusOK},
+		{"198.51.100.7", "/public/../admin/users", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.RemoteAddr = tc.client + ":1234"
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Expected %d for %s on %s, got %d", tc.status, tc.client, tc.path, w.Code)
+		}
+		if tc.status == http.StatusForbidden && w.Header().Get(errorCodeHeader) != "ip_denied" {
+			t.Errorf("Expected ip_denied for %s on %s, got %q", tc.client, tc.path, w.Header().Get(errorCodeHeader))
+		}
+	}
+
+	if denied := lb.deniedRequests.Load(); denied != 5 {
+		t.Errorf("Expected 5 denied requests, got %d", denied)
+	}
+	w := httptest.NewRecorder()
+	lb.handleStats(w, httptest.NewRequest("GET", "/lb-stats", nil))
+	if !strings.Contains(w.Body.String(), "Denied by IP filter: 5") {
+		t.Errorf("Expected the stats page to count denied requests, got:\n%s", w.Body.String())
+	}
+}
+
+func TestIPFilterTrustedProxy(t *testing.T) {
+	filter, _ := parseIPFilter(nil, []string{"203.0.113.9"})
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.1"})
+	lb := &LoadBalancer{ipFilter: filter, trustedProxies: proxies}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if w := httptest.NewRecorder(); !lb.ipDenied(w, r) {
+		t.Error("Expected the forwarded client address to be filtered")
+	}
+}
+
+func TestParseIPFilter(t *testing.T) {
+	for _, def := range []string{"10.0.0.0/33", "admin=10.0.0.0/8", "/admin=", "not-an-ip"} {
+		if _, err := parseIPFilter([]string{def}, nil); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+	filter, err := parseIPFilter([]string{"/api/=10.0.0.0/8", "/api=::1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl := filter.routes["/api"]; acl == nil || len(acl.allow) != 2 || !acl.permits(net.ParseIP("::1")) {
+		t.Errorf("Expected both entries under /api, got %+v", filter.routes)
+	}
+}
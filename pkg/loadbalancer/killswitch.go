@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// routeKill describes a disabled route and the response returned instead
+type routeKill struct {
+	Route   string `json:"route"`
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// killSwitches holds the routes disabled for emergency mitigation, keyed by
+// path prefix
+type killSwitches struct {
+	mu    sync.RWMutex
+	kills map[string]routeKill
+}
+
+// newKillSwitches creates an empty set of kill switches
+func newKillSwitches() *killSwitches {
+	return &killSwitches{kills: make(map[string]routeKill)}
+}
+
+// parseKills parses -kill definitions of the form /path/prefix=status,
+// where the status is optional and defaults to 503
+func parseKills(defs []string) (*killSwitches, error) {
+	k := newKillSwitches()
+	for _, def := range defs {
+		route, status := def, http.StatusServiceUnavailable
+		if i := strings.LastIndex(def, "="); i >= 0 {
+			code, err := strconv.Atoi(def[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid kill switch %q: %w", def, err)
+			}
+			route, status = def[:i], code
+		}
+		kill := routeKill{Route: route, Status: status}
+		if err := kill.validate(); err != nil {
+			return nil, fmt.Errorf("invalid kill switch %q: %w", def, err)
+		}
+		k.set(kill)
+	}
+	return k, nil
+}
+
+// validate checks the route and status of a kill switch
+func (k routeKill) validate() error {
+	if !strings.HasPrefix(k.Route, "/") {
+		return fmt.Errorf("route must start with /")
+	}
+	if k.Status < 400 || k.Status > 599 {
+		return fmt.Errorf("status must be a 4xx or 5xx code")
+	}
+	return nil
+}
+
+// set disables a route
+func (k *killSwitches) set(kill routeKill) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.kills[kill.Route] = kill
+}
+
+// clear re-enables a route
+func (k *killSwitches) clear(route string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.kills, route)
+}
+
+// match returns the kill switch with the longest route prefixing the path
+func (k *killSwitches) match(path string) (routeKill, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var best routeKill
+	found := false
+	for route, kill := range k.kills {
+		if (pathRoute{prefix: strings.TrimSuffix(route, "/")}).matches(path) && (!found || len(route) > len(best.Route)) {
+			best, found = kill, true
+		}
+	}
+	return best, found
+}
+
+// all returns the kill switches sorted by route
+func (k *killSwitches) all() []routeKill {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	kills := make([]routeKill, 0, len(k.kills))
+	for _, kill := range k.kills {
+		kills = append(kills, kill)
+	}
+	sort.Slice(kills, func(i, j int) bool { return kills[i].Route < kills[j].Route })
+	return kills
+}
+
+// killed answers the request when its route has been disabled
+func (lb *LoadBalancer) killed(w http.ResponseWriter, r *http.Request) bool {
+	if lb.kills == nil {
+		return false
+	}
+	kill, ok := lb.kills.match(r.URL.Path)
+	if !ok {
+		return false
+	}
+	message := kill.Message
+	if message == "" {
+		message = http.StatusText(kill.Status)
+	}
+	lb.metrics().IncCounter("lb_killed_requests_total", map[string]string{"route": kill.Route})
+	lb.writeError(w, errRouteDisabled.withStatus(kill.Status), message)
+	return true
+}
+
+// handleKills lists the disabled routes
+func (lb *LoadBalancer) handleKills(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.kills.all())
+}
+
+// handleSetKill disables a route, e.g. POST /lb-admin/kill?route=/api/search&status=404
+func (lb *LoadBalancer) handleSetKill(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	kill := routeKill{Route: query.Get("route"), Status: http.StatusServiceUnavailable, Message: query.Get("message")}
+	if value := query.Get("status"); value != "" {
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid status value", http.StatusBadRequest)
+			return
+		}
+		kill.Status = status
+	}
+	if err := kill.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lb.kills.set(kill)
+	lb.logf("Route %s disabled with status %d", kill.Route, kill.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kill)
+}
+
+// handleClearKill re-enables a route, e.g. DELETE /lb-admin/kill?route=/api/search
+func (lb *LoadBalancer) handleClearKill(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	lb.kills.clear(route)
+	lb.logf("Route %s enabled", route)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseKills(t *testing.T) {
+	kills, err := parseKills([]string{"/api/search", "/admin=404"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kill, ok := kills.match("/api/search/users"); !ok || kill.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected /api/search killed with 503, got %+v %v", kill, ok)
+	}
+	if kill, ok := kills.match("/admin"); !ok || kill.Status != http.StatusNotFound {
+		t.Errorf("Expected /admin killed with 404, got %+v %v", kill, ok)
+	}
+
+	for _, def := range []string{"api=503", "/api=200", "/api=abc"} {
+		if _, err := parseKills([]string{def}); err == nil {
+			t.Errorf("Expected error for %q", def)
+		}
+	}
+}
+
+func TestKillSwitchAdmin(t *testing.T) {
+	lb := &LoadBalancer{adminLocal: true, kills: newKillSwitches()}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/kill?route=/api&status=404&message=gone", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from kill, got %d", w.Code)
+	}
+
+	// A more specific route wins over a shorter prefix
+	lb.kills.set(routeKill{Route: "/api/health", Status: http.StatusServiceUnavailable})
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/users", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "gone\n" {
+		t.Errorf("Expected killed route to return 404 gone, got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected longest prefix to return 503, got %d", w.Code)
+	}
+
+	for _, path := range []string{"/static/../api/users", "/api//users"} {
+		w = httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to reach the killed route, got %d", path, w.Code)
+		}
+	}
+	if _, ok := lb.kills.match("/apis"); ok {
+		t.Error("Expected /apis to be outside the killed /api route")
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("DELETE", "/lb-admin/kill?route=/api", nil))
+	if _, ok := lb.kills.match("/api/users"); ok {
+		t.Errorf("Expected /api to be enabled again")
+	}
+}
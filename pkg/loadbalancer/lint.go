@@ -0,0 +1,679 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Lint finding severities
+const (
+	lintWarning = "WARNING"
+	lintError   = "ERROR"
+)
+
+// lintFinding is a single problem found in the configuration
+type lintFinding struct {
+	Severity string
+	Message  string
+}
+
+// lintConfig inspects the effective configuration and reports settings that
+// are invalid or likely to cause an outage
+func lintConfig(cfg *Config) []lintFinding {
+	var findings []lintFinding
+	warn := func(format string, args ...any) {
+		findings = append(findings, lintFinding{lintWarning, fmt.Sprintf(format, args...)})
+	}
+	fail := func(format string, args ...any) {
+		findings = append(findings, lintFinding{lintError, fmt.Sprintf(format, args...)})
+	}
+
+	// Backends
+	switch {
+	case len(cfg.Servers) == 0 && len(cfg.Pools) == 0:
+		fail("no backend servers configured")
+	case len(cfg.Servers) == 0:
+		warn("no default backend servers; requests not matched by a route are answered with 404")
+	case len(cfg.Servers) == 1:
+		warn("only one backend server configured; there is no redundancy when it fails")
+	}
+	seen := make(map[string]bool)
+	serverURLs, err := cfg.parseServerURLs()
+	if err != nil {
+		fail("%s", err)
+	}
+	switch cfg.Mode {
+	case modeHTTP, modeTCP:
+	default:
+		fail("unknown mode %q", cfg.Mode)
+	}
+	for _, u := range serverURLs {
+		if cfg.Mode == modeTCP && u.Scheme != "tcp" {
+			fail("backend %s must use tcp:// in tcp mode", u)
+		}
+		if cfg.Mode != modeTCP && u.Scheme != "http" && u.Scheme != "https" && u.Scheme != tunnelScheme && u.Scheme != unixScheme {
+			fail("backend %s must use http://, https://, tunnel:// or unix://", u)
+		}
+		if u.Scheme == tunnelScheme && cfg.TunnelPort == 0 {
+			fail("backend %s requires -tunnel-port", u)
+		}
+		if seen[u.String()] {
+			warn("backend %s is listed more than once", u)
+		}
+		seen[u.String()] = true
+	}
+
+	// Pools and SNI routes
+	pools, err := cfg.parsePools()
+	if err != nil {
+		fail("%s", err)
+	}
+	for name, urls := range pools {
+		sources := 0
+		for _, u := range urls {
+			if !isDiscoveryURL(u) {
+				continue
+			}
+			sources++
+			d, err := newDiscovery(newPool(name, nil), nil, u, nil)
+			if err != nil {
+				fail("%s", err)
+			} else if u.Scheme == fileScheme {
+				if _, err := d.resolve(context.Background()); err != nil {
+					fail("pool %s: %s", name, err)
+				}
+			}
+		}
+		switch {
+		case sources > 1:
+			fail("pool %s has more than one discovery source", name)
+		case sources == 0 && len(urls) == 1:
+			warn("pool %s has only one backend server; there is no redundancy when it fails", name)
+		}
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		fail("-discovery-interval must be positive, got %s", cfg.DiscoveryInterval)
+	}
+	if _, err := cfg.parseSNIRoutes(pools); err != nil {
+		fail("%s", err)
+	}
+	poolNames := make(map[string]bool)
+	for name := range pools {
+		poolNames[name] = true
+	}
+	if _, err := parsePoolConfigs(cfg.PoolConfigs, poolNames); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseDeviceRoutes(cfg.DeviceRoutes, poolNames); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parsePathRoutes(cfg.PathRoutes, poolNames); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseTemplateRoutes(cfg.TemplateRoutes, poolNames); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseRewrites(cfg.Rewrites); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseQueryRewrites(cfg.QueryRewrites); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseResponseHeaders(cfg.ResponseHeaders); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseAggregateRoutes(cfg.Aggregates, poolNames); err != nil {
+		fail("%s", err)
+	}
+	if _, err := parseHedgeRoutes(cfg.Hedges, hedgeSettings{}); err != nil {
+		fail("%s", err)
+	}
+	if cfg.HedgeQuantile <= 0 || cfg.HedgeQuantile >= 1 || cfg.HedgeBudget < 0 || cfg.HedgeBudget > 1 || cfg.HedgeMinDelay < 0 {
+		fail("-hedge-quantile must be between 0 and 1 exclusive, -hedge-budget between 0 and 1 and -hedge-min-delay not negative")
+	}
+	if len(cfg.Hedges) > 0 && len(cfg.Servers) < 2 && len(cfg.Pools) == 0 {
+		warn("hedging needs a second backend to send hedges to")
+	}
+	if _, err := newCoalescer(cfg.Coalesce, cfg.CoalesceMaxBody, cfg.AuthAPIKeyHeader); err != nil {
+		fail("%s", err)
+	}
+	if len(cfg.Coalesce) > 0 && cfg.CoalesceMaxBody <= 0 {
+		fail("-coalesce-max-body must be positive")
+	}
+	if cfg.UploadPool != "" && !poolNames[cfg.UploadPool] {
+		fail("upload pool %s is not defined", cfg.UploadPool)
+	}
+	if cfg.Canary != "" {
+		if _, _, err := parseCanary(cfg.Canary, poolNames); err != nil {
+			fail("%s", err)
+		}
+	}
+	if cfg.BlueGreen != "" {
+		if _, err := parseBlueGreen(cfg.BlueGreen, poolNames); err != nil {
+			fail("%s", err)
+		} else if len(cfg.Servers) > 0 {
+			warn("the default servers receive no traffic while -blue-green is set")
+		}
+	}
+	if routes, err := parseAuthRoutes(cfg.AuthRoutes); err != nil {
+		fail("%s", err)
+	} else {
+		for _, route := range routes {
+			if slices.Contains(route.methods, authMTLS) && (cfg.ClientAuth == "" || cfg.ClientAuth == clientAuthNone) {
+				warn("auth route %s accepts mtls but -client-auth is none, so no client certificate is ever verified", route.prefix)
+			}
+		}
+	}
+	if cfg.MirrorPool != "" && !poolNames[cfg.MirrorPool] {
+		fail("mirror pool %s is not defined", cfg.MirrorPool)
+	}
+	if err := parseMirrorPercent(cfg.MirrorPercent); err != nil {
+		fail("%s", err)
+	}
+	for _, pattern := range cfg.MirrorIgnore {
+		if _, err := regexp.Compile(pattern); err != nil {
+			fail("invalid mirror ignore pattern %q: %s", pattern, err)
+		}
+	}
+	if cfg.UploadPool == "" && len(cfg.UploadContentTypes) > 0 {
+		warn("upload content types are configured but -upload-pool is not set")
+	}
+	if cfg.Mode == modeTCP && (cfg.TLSEnabled() || len(cfg.SNIRoutes) > 0) {
+		warn("TLS and SNI routing settings are ignored in tcp mode")
+	}
+	listeners, err := parseListeners(cfg.Listeners, cfg.ProxyProtocol)
+	if err != nil {
+		fail("%s", err)
+	}
+	listenerTLS := false
+	for _, l := range listeners {
+		if l.pool != "" && !poolNames[l.pool] {
+			fail("listener %s references unknown pool %s", l.addr, l.pool)
+		}
+		if l.tls {
+			listenerTLS = true
+			if l.certFile == "" && cfg.TLSCert == "" && len(cfg.ACMEDomains) == 0 {
+				fail("listener %s serves TLS without a certificate; set cert and key, -tls-cert or -acme-domain", l.addr)
+			}
+			if l.clientAuth != "" && l.clientAuth != clientAuthNone && l.clientCAFile == "" && cfg.ClientCA == "" {
+				fail("listener %s verifies client certificates without a CA; set client-ca or -client-ca", l.addr)
+			}
+		}
+	}
+	if len(listeners) > 0 {
+		if cfg.Mode == modeTCP {
+			fail("-listen is supported in http mode only")
+		}
+		if cfg.HTTP3 {
+			warn("-http3 is ignored with -listen; HTTP/3 is served on -tls-port only")
+		}
+		if cfg.Bind != "" {
+			warn("-bind is ignored with -listen; give each listener its address")
+		}
+	}
+	bind, err := parseBind(cfg.Bind)
+	if err != nil {
+		fail("%s", err)
+	}
+	port := cfg.Port
+	if bind.port != 0 {
+		port = bind.port
+	}
+	if len(cfg.SNIRoutes) > 0 && !cfg.TLSEnabled() && !listenerTLS {
+		warn("SNI routes are configured but TLS is not enabled")
+	}
+
+	if _, err := parseWeights(cfg.Weights); err != nil {
+		fail("%s", err)
+	}
+	if cfg.WeightRamp < 0 {
+		fail("weight ramp must not be negative, got %d", cfg.WeightRamp)
+	}
+	if _, err := parseMaxConcurrent(cfg.BackendConcurrency); err != nil {
+		fail("%s", err)
+	}
+	if cfg.MaxConcurrent < 0 || cfg.QueueDepth < 0 || cfg.QueueTimeout < 0 {
+		fail("-max-concurrent, -queue-depth and -queue-timeout must not be negative")
+	}
+	if cfg.QueueTimeout > 0 && cfg.RequestTimeout > 0 && cfg.QueueTimeout >= cfg.RequestTimeout {
+		warn("-queue-timeout is not shorter than -request-timeout; queued requests may leave no time for the backend")
+	}
+	if cfg.Mode == modeTCP && (cfg.MaxConcurrent > 0 || len(cfg.BackendConcurrency) > 0) {
+		warn("concurrency caps apply to HTTP requests and are ignored in tcp mode")
+	}
+
+	// Retries
+	if policy, err := parseRetryPolicy(cfg.RetryMethods, cfg.RetryOn, cfg.RetryKeyHeader, cfg.RetryMaxBody); err != nil {
+		fail("%s", err)
+	} else if cfg.Retries > 0 {
+		for _, method := range []string{"POST", "PATCH"} {
+			if policy.methods[method] {
+				warn("%s requests are retried without an idempotency key and may be applied twice", method)
+			}
+		}
+	}
+	if cfg.RetryBudget < 0 || cfg.RetryBudget > 1 || cfg.RetryBudgetMin < 0 {
+		fail("-retry-budget must be between 0 and 1 and -retry-budget-min not negative")
+	}
+	if cfg.RetryBudget > 0 && cfg.RetryBudgetWindow <= 0 {
+		fail("-retry-budget-window must be positive")
+	}
+	if cfg.Retries > 0 && cfg.RetryBudget == 0 {
+		warn("retries have no budget; during an outage they can multiply the load on struggling backends by %d", cfg.Retries+1)
+	}
+
+	// Timeouts
+	if cfg.ResponseHeaderTimeout <= 0 && cfg.RequestTimeout <= 0 {
+		warn("proxied requests have no response timeout; a wedged backend hangs requests forever")
+	}
+	if cfg.DialTimeout <= 0 {
+		warn("no dial timeout; connecting to an unreachable backend can take minutes")
+	}
+	if cfg.RequestTimeout > 0 && cfg.ResponseHeaderTimeout > cfg.RequestTimeout {
+		warn("response header timeout %s exceeds the request timeout %s", cfg.ResponseHeaderTimeout, cfg.RequestTimeout)
+	}
+	routeTimeouts, err := parseRouteTimeouts(cfg.RouteTimeouts, proxyTimeouts{request: cfg.RequestTimeout, responseHeader: cfg.ResponseHeaderTimeout})
+	if err != nil {
+		fail("%s", err)
+	}
+	for _, route := range routeTimeouts {
+		if route.request > 0 && route.responseHeader > route.request {
+			warn("route %s: response header timeout %s exceeds the request timeout %s", route.prefix, route.responseHeader, route.request)
+		}
+		if cfg.WriteTimeout > 0 && (route.request == 0 || route.request > cfg.WriteTimeout) {
+			warn("route %s: write timeout %s cuts responses off before the route timeout", route.prefix, cfg.WriteTimeout)
+		}
+	}
+	if cfg.DisableKeepAlives {
+		warn("backend keep-alives are disabled; every request pays for a new TCP and TLS handshake")
+	} else if cfg.MaxIdleConnsPerHost < 1 {
+		warn("no idle backend connections are kept; most requests pay for a new TCP and TLS handshake")
+	}
+
+	// Frontend server
+	if cfg.ReadHeaderTimeout < 0 || cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		fail("frontend timeouts must not be negative")
+	}
+	if cfg.ReadHeaderTimeout == 0 && cfg.ReadTimeout == 0 {
+		warn("the frontend listener has no read timeouts and is exposed to slowloris attacks; set -read-header-timeout")
+	}
+	if cfg.IdleTimeout == 0 && cfg.ReadTimeout == 0 {
+		warn("idle client connections are kept open forever; set -idle-timeout")
+	}
+	if cfg.WriteTimeout > 0 && cfg.RequestTimeout > cfg.WriteTimeout {
+		warn("write timeout %s is shorter than the request timeout %s and cuts responses off first", cfg.WriteTimeout, cfg.RequestTimeout)
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		fail("-max-header-bytes must be positive, got %d", cfg.MaxHeaderBytes)
+	}
+
+	// Health checks
+	if cfg.HealthCheckInterval <= 0 {
+		fail("health check interval must be positive, got %d", cfg.HealthCheckInterval)
+	} else if cfg.HealthCheckInterval > 60 {
+		warn("health check interval of %ds leaves dead backends in rotation for a long time", cfg.HealthCheckInterval)
+	}
+	if cfg.HealthTimeout <= 0 {
+		fail("health check timeout must be positive")
+	} else if cfg.HealthTimeout >= time.Duration(cfg.HealthCheckInterval)*time.Second && cfg.HealthCheckInterval > 0 {
+		warn("health check timeout of %s is not shorter than the %ds interval", cfg.HealthTimeout, cfg.HealthCheckInterval)
+	}
+	if cfg.HealthJitter < 0 || cfg.HealthJitter >= 1 {
+		fail("health check jitter must be at least 0 and below 1, got %g", cfg.HealthJitter)
+	}
+	switch cfg.HealthCheckType {
+	case healthHTTP, healthTCP, healthGRPC:
+	default:
+		fail("unknown health check type %q", cfg.HealthCheckType)
+	}
+	if cfg.HealthRise < 1 || cfg.HealthFall < 1 {
+		fail("health rise and fall thresholds must be at least 1")
+	} else if cfg.HealthFall == 1 {
+		warn("health fall threshold of 1; a single failed check takes a backend out of rotation")
+	}
+	if _, err := parseHealthThresholds(cfg.HealthThresholds); err != nil {
+		fail("%v", err)
+	}
+	if _, err := parseHealthChecks(cfg.BackendHealth); err != nil {
+		fail("%v", err)
+	}
+	if _, err := parseHeaders(cfg.HealthHeaders); err != nil {
+		fail("health check %v", err)
+	}
+	if _, err := newHealthValidation(cfg.HealthStatus, cfg.HealthBody, cfg.HealthBodyRegex, cfg.HealthJSON); err != nil {
+		fail("%v", err)
+	}
+	if cfg.SyntheticFile != "" {
+		if _, err := loadSynthetics(cfg.SyntheticFile); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		fail("rate limit and burst must not be negative")
+	}
+	if cfg.ClientRateLimit < 0 || cfg.ClientRateBurst < 0 {
+		fail("client rate limit and burst must not be negative")
+	}
+	if cfg.RateLimitWarn < 0 || cfg.RateLimitWarn > 1 {
+		fail("-rate-limit-warn must be between 0 and 1")
+	}
+	if cfg.ClientRateMaxClients < 1 {
+		fail("-client-rate-max-clients must be at least 1")
+	}
+	if _, err := parseClientRateOverrides(cfg.ClientRateOverrides); err != nil {
+		fail("%s", err)
+	}
+	if (cfg.ClientRateLimit > 0 || len(cfg.ClientRateOverrides) > 0) && len(cfg.TrustedProxies) == 0 {
+		warn("per-client rate limiting without -trusted-proxy limits by connection address; behind a proxy all clients share one bucket")
+	}
+
+	if _, err := newCompatProbe(cfg.CompatVersionHeader, cfg.CompatVersion, cfg.CompatEndpoints, cfg.CompatTLS, nil, cfg.HealthTimeout); err != nil {
+		fail("%s", err)
+	} else if cfg.CompatVersion != "" && cfg.CompatVersionHeader == "" {
+		fail("-compat-version requires -compat-version-header")
+	}
+	if cfg.Mode == modeTCP && (cfg.CompatVersion != "" || len(cfg.CompatEndpoints) > 0 || cfg.CompatTLS) {
+		warn("compatibility probes are HTTP checks and are ignored in tcp mode")
+	}
+
+	for _, def := range []string{cfg.DrainNotify, cfg.UndrainNotify} {
+		if _, err := parseDrainCall(def); err != nil {
+			fail("%s", err)
+		}
+	}
+
+	if _, err := parseCutoverSteps(cfg.CutoverSteps); err != nil {
+		fail("%s", err)
+	}
+	if cfg.CutoverErrorDelta < 0 || cfg.CutoverLatencyFactor < 0 {
+		fail("cutover regression thresholds must not be negative")
+	}
+
+	if cfg.OutlierInterval > 0 {
+		for _, factor := range []float64{cfg.OutlierErrorFactor, cfg.OutlierLatencyFactor} {
+			if factor < 0 || (factor > 0 && factor <= 1) {
+				fail("outlier factors must be above 1, or 0 to disable, got %g", factor)
+			}
+		}
+		if cfg.OutlierMaxEjected < 0 || cfg.OutlierMaxEjected > 1 {
+			fail("outlier max ejected share must be between 0 and 1, got %g", cfg.OutlierMaxEjected)
+		}
+		if cfg.OutlierCooldown <= 0 {
+			fail("outlier cooldown must be positive")
+		}
+	}
+
+	if cfg.QuarantineShare < 0 || cfg.QuarantineShare > 100 {
+		fail("quarantine share must be between 0 and 100, got %g", cfg.QuarantineShare)
+	}
+
+	// Reverse tunnels
+	if cfg.TunnelPort != 0 {
+		if cfg.TunnelToken == "" && cfg.TunnelClientCA == "" {
+			fail("tunnel listener requires -tunnel-token or -tunnel-client-ca")
+		}
+		if cfg.TunnelToken != "" && cfg.TunnelTLSCert == "" {
+			warn("tunnel token is sent in plain text; set -tunnel-tls-cert and -tunnel-tls-key")
+		}
+	}
+	if (cfg.TunnelTLSCert == "") != (cfg.TunnelTLSKey == "") {
+		fail("-tunnel-tls-cert and -tunnel-tls-key must be set together")
+	}
+	if cfg.TunnelClientCA != "" && cfg.TunnelTLSCert == "" {
+		fail("-tunnel-client-ca requires -tunnel-tls-cert and -tunnel-tls-key")
+	}
+
+	// Circuit breaker
+	if cfg.BreakerErrorRate < 0 || cfg.BreakerErrorRate > 1 {
+		fail("breaker error rate must be between 0 and 1, got %g", cfg.BreakerErrorRate)
+	}
+	if (cfg.BreakerFailures > 0 || cfg.BreakerErrorRate > 0) && cfg.BreakerCooldown <= 0 {
+		fail("breaker cooldown must be positive")
+	}
+
+	// Backend TLS
+	if cfg.BackendInsecure {
+		warn("backend certificate verification is disabled (-backend-insecure)")
+	}
+	if (cfg.BackendCert == "") != (cfg.BackendKey == "") {
+		fail("-backend-cert and -backend-key must be set together")
+	}
+
+	// Frontend TLS
+	if cfg.TLSCert != "" && len(cfg.ACMEDomains) > 0 {
+		warn("both a static certificate and ACME domains are configured; ACME takes precedence")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fail("-tls-cert and -tls-key must be set together")
+	}
+	if cfg.HTTP3 && !cfg.TLSEnabled() {
+		fail("-http3 requires a TLS listener")
+	}
+	if len(cfg.ACMEDomains) > 0 {
+		if cfg.ACMEEmail == "" {
+			warn("no ACME contact email; you will not receive certificate expiry notices")
+		}
+		if port != 80 {
+			warn("ACME HTTP-01 challenges require the HTTP listener on port 80, got %d", port)
+		}
+	}
+	switch cfg.ClientAuth {
+	case "", clientAuthNone:
+		if cfg.ClientCertHeader != "" {
+			warn("-client-cert-header is set but client certificates are not verified")
+		}
+	case clientAuthRequest, clientAuthRequire:
+		if !cfg.TLSEnabled() {
+			fail("client certificate auth requires a TLS listener")
+		}
+		if cfg.ClientCA == "" {
+			fail("client certificate auth requires -client-ca")
+		}
+	default:
+		fail("unknown client auth mode %q", cfg.ClientAuth)
+	}
+
+	// Trusted proxies
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		fail("%s", err)
+	}
+	for _, network := range proxies {
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			warn("trusted proxy %s trusts every client; forwarding headers can be spoofed", network)
+		}
+	}
+
+	// Usage accounting
+	if cfg.UsageHeader != "" && cfg.UsagePeriod <= 0 {
+		fail("usage period must be positive, got %d", cfg.UsagePeriod)
+	}
+	if cfg.UsageMaxTenants < 0 {
+		fail("-usage-max-tenants must not be negative, got %d", cfg.UsageMaxTenants)
+	}
+	if cfg.UsageHeader != "" && cfg.UsageMaxTenants == 0 {
+		warn("-usage-max-tenants 0 lets clients grow memory without bound by sending new %s values", cfg.UsageHeader)
+	}
+
+	// Feature flags
+	if (cfg.FlagsFile != "" || cfg.FlagsURL != "") && cfg.FlagsPoll <= 0 {
+		fail("feature flag poll interval must be positive, got %d", cfg.FlagsPoll)
+	}
+	if _, err := parseFlagGates(cfg.FlagGates); err != nil {
+		fail("%s", err)
+	}
+	gatedRoutes := slices.ContainsFunc(cfg.PathRoutes, func(def string) bool { return strings.Contains(def, ",flag=") })
+	if (len(cfg.FlagGates) > 0 || gatedRoutes) && cfg.FlagsFile == "" && cfg.FlagsURL == "" {
+		warn("features and routes gated by feature flags stay off until the flags are set through the admin API; set -flags-file or -flags-url")
+	}
+
+	// Response compression
+	if cfg.Gzip && cfg.GzipMinSize < 0 {
+		fail("-gzip-min-size must not be negative, got %d", cfg.GzipMinSize)
+	}
+	if cfg.Gzip && len(newCompression(0, cfg.GzipTypes).types) == 0 {
+		warn("-gzip is set but -gzip-types is empty; no response will be compressed")
+	}
+
+	// Response cache
+	if cfg.CacheSize < 0 {
+		fail("-cache-size must not be negative, got %d", cfg.CacheSize)
+	}
+	if cfg.CacheSize > 0 && cfg.CacheMaxObject <= 0 {
+		fail("-cache-max-object must be positive, got %d", cfg.CacheMaxObject)
+	}
+	if cfg.CacheSize > 0 && cfg.CacheMaxObject > cfg.CacheSize {
+		warn("-cache-max-object %d exceeds -cache-size %d; responses that large are never kept", cfg.CacheMaxObject, cfg.CacheSize)
+	}
+	if _, err := parseCacheTTLs(cfg.CacheTTLs); err != nil {
+		fail("%s", err)
+	}
+	if cfg.CacheStaleWhileRevalidate < 0 || cfg.CacheStaleIfError < 0 {
+		fail("-cache-stale-while-revalidate and -cache-stale-if-error must not be negative")
+	}
+	if len(cfg.CacheTTLs) > 0 && cfg.CacheSize == 0 {
+		warn("-cache-ttl is set but -cache-size is 0; the response cache is disabled")
+	}
+
+	// Request body limits
+	if cfg.MaxBodySize < 0 {
+		fail("-max-body-size must not be negative, got %d", cfg.MaxBodySize)
+	}
+	if _, err := parseBodyLimits(cfg.BodyLimits); err != nil {
+		fail("%s", err)
+	}
+
+	// Plugins
+	if _, err := loadPlugins(cfg.Plugins, cfg.PluginMemoryLimit); err != nil {
+		fail("%s", err)
+	}
+	if len(cfg.Plugins) > 0 && cfg.PluginTimeout <= 0 {
+		fail("-plugin-timeout must be positive, got %s", cfg.PluginTimeout)
+	}
+	if cfg.PluginMemoryLimit < 0 {
+		fail("-plugin-memory-limit must not be negative, got %d", cfg.PluginMemoryLimit)
+	}
+	if len(cfg.Plugins) > 0 && cfg.Mode == modeTCP {
+		warn("plugins run on HTTP requests and are ignored in tcp mode")
+	}
+
+	// Access log
+	if cfg.LogSample < 1 {
+		fail("-log-sample must be at least 1, got %d", cfg.LogSample)
+	}
+	if cfg.LogSample > 1 && (cfg.LogSampleStatus < 100 || cfg.LogSampleStatus > 600) {
+		fail("-log-sample-status must be a status code between 100 and 600, got %d", cfg.LogSampleStatus)
+	}
+	if cfg.AccessLogMaxSize < 0 || cfg.AccessLogMaxAge < 0 || cfg.AccessLogMaxBackups < 0 {
+		fail("-access-log-max-size, -access-log-max-age and -access-log-max-backups must not be negative")
+	}
+	if cfg.AccessLog == accessLogSyslog && cfg.Syslog == "" {
+		fail("-access-log syslog requires -syslog")
+	}
+	if cfg.AccessLog != "" && cfg.AccessLog != accessLogSyslog {
+		if info, err := os.Stat(filepath.Dir(cfg.AccessLog)); err != nil || !info.IsDir() {
+			fail("the directory of -access-log %s does not exist", cfg.AccessLog)
+		}
+		if cfg.AccessLogMaxSize == 0 && cfg.AccessLogMaxAge == 0 {
+			warn("-access-log is never rotated; set -access-log-max-size or -access-log-max-age, or rotate it externally and send SIGUSR1")
+		}
+	}
+	if cfg.AccessLog != "" && cfg.Mode == modeTCP {
+		warn("-access-log records HTTP requests and stays empty in tcp mode")
+	}
+
+	// Syslog
+	if cfg.Syslog != "" {
+		if _, err := parseSyslogAddress(cfg.Syslog); err != nil {
+			fail("%s", err)
+		}
+		if _, err := parseSyslogFacility(cfg.SyslogFacility); err != nil {
+			fail("%s", err)
+		}
+		if cfg.AccessLog == accessLogSyslog && strings.HasPrefix(cfg.Syslog, "udp://") {
+			warn("access log lines sent to syslog over UDP are dropped silently when the network or the receiver is overloaded; consider tcp://")
+		}
+	}
+
+	// Admin access
+	if _, err := newAdminAuth(cfg.AdminToken, cfg.AdminBasicAuth); err != nil {
+		fail("%s", err)
+	}
+	if cfg.AdminToken == "" && cfg.AdminBasicAuth == "" && cfg.AdminHost == "" && (cfg.Mode != modeTCP || cfg.AdminPort != 0) {
+		warn("the stats page and admin API are open to anyone who can reach the load balancer; set -admin-token or -admin-basic-auth, or -admin-port with -admin-host 127.0.0.1")
+	}
+	if cfg.AdminHost != "" && cfg.AdminPort == 0 {
+		warn("-admin-host is set but -admin-port is 0; stats and the admin API are served on the main port")
+	}
+	if cfg.DebugPort != 0 && cfg.DebugHost == "" && cfg.AdminToken == "" && cfg.AdminBasicAuth == "" {
+		warn("the debug port exposes profiles and the command line on all interfaces without credentials; set -debug-host 127.0.0.1 or -admin-token")
+	}
+	if cfg.DebugPort != 0 && (cfg.DebugPort == cfg.Port || cfg.DebugPort == cfg.AdminPort) {
+		fail("-debug-port %d must differ from the main and admin ports", cfg.DebugPort)
+	}
+	if cfg.SelfHealth && cfg.Mode == modeTCP && cfg.AdminPort == 0 {
+		warn("-self-health needs -admin-port in tcp mode; /healthz and /readyz are not served")
+	}
+
+	// IP filtering
+	if _, err := parseIPFilter(cfg.AllowIPs, cfg.DenyIPs); err != nil {
+		fail("%s", err)
+	}
+	if (len(cfg.AllowIPs) > 0 || len(cfg.DenyIPs) > 0) && len(cfg.TrustedProxies) == 0 {
+		warn("IP filtering without -trusted-proxy uses the connecting peer's address; behind another proxy every client shares it")
+	}
+
+	// CORS
+	if cors, err := newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSExposeHeaders, cfg.CORSCredentials, cfg.CORSMaxAge); err != nil {
+		fail("%s", err)
+	} else if len(cfg.CORSOrigins) > 0 {
+		if len(cors.methods) == 0 {
+			fail("-cors-methods must list at least one method")
+		}
+		if cfg.CORSCredentials && slices.Contains(cors.origins, "*") {
+			warn("-cors-credentials with -cors-origin '*' reflects every origin back with credentials; list the trusted origins instead")
+		}
+	}
+
+	// Error pages
+	if _, err := parseErrorPages(cfg.ErrorPages); err != nil {
+		fail("%s", err)
+	}
+
+	// Configuration advisor
+	if cfg.Advisor < 0 {
+		fail("advisor period must not be negative, got %s", cfg.Advisor)
+	}
+	if cfg.AdvisorOutput != "" && cfg.Advisor == 0 {
+		warn("-advisor-output has no effect without -advisor")
+	}
+
+	return findings
+}
+
+// Lint prints the lint findings and returns the process exit code:
+// 0 when clean, 1 when only warnings were found and 2 on errors
+func Lint(cfg *Config, w io.Writer) int {
+	findings := lintConfig(cfg)
+	code := 0
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s: %s\n", finding.Severity, finding.Message)
+		if finding.Severity == lintError {
+			code = 2
+		} else if code == 0 {
+			code = 1
+		}
+	}
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "Configuration OK")
+	}
+	return code
+}
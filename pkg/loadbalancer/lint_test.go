@@ -0,0 +1,60 @@
+package loadbalancer
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// lintArgs parses the arguments and returns the lint findings
+func lintArgs(t *testing.T, args ...string) []lintFinding {
+	cfg, err := ParseConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %s", err)
+	}
+	return lintConfig(cfg)
+}
+
+// hasFinding reports whether a finding with the severity mentions the text
+func hasFinding(findings []lintFinding, severity, text string) bool {
+	for _, f := range findings {
+		if f.Severity == severity && strings.Contains(f.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLintConfig(t *testing.T) {
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-backend-insecure")
+	if !hasFinding(findings, lintWarning, "only one backend") {
+		t.Errorf("Expected a single backend warning")
+	}
+	if !hasFinding(findings, lintWarning, "verification is disabled") {
+		t.Errorf("Expected an insecure backend warning")
+	}
+
+	findings = lintArgs(t, "-server", "http://localhost:8080", "-server", "http://localhost:8081", "-client-auth", "require")
+	if hasFinding(findings, lintWarning, "only one backend") {
+		t.Errorf("Did not expect a single backend warning with two backends")
+	}
+	if !hasFinding(findings, lintError, "requires -client-ca") {
+		t.Errorf("Expected an error for client auth without a CA")
+	}
+
+	findings = lintArgs(t, "-interval", "0")
+	if !hasFinding(findings, lintError, "no backend servers") {
+		t.Errorf("Expected an error for missing backends")
+	}
+	if !hasFinding(findings, lintError, "interval must be positive") {
+		t.Errorf("Expected an error for a zero health check interval")
+	}
+
+	findings = lintArgs(t, "-server", "http://localhost:8080", "-health-fall", "1")
+	if !hasFinding(findings, lintWarning, "fall threshold of 1") {
+		t.Errorf("Expected a warning for a fall threshold of 1")
+	}
+	if hasFinding(lintArgs(t, "-server", "http://localhost:8080"), lintWarning, "fall threshold") {
+		t.Errorf("Did not expect a fall threshold warning with the defaults")
+	}
+}
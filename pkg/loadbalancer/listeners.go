@@ -0,0 +1,167 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// frontendListener is an address the load balancer serves clients on,
+// given with -listen as addr?option=value&...
+type frontendListener struct {
+	addr          string
+	tls           bool   // Serve HTTPS
+	certFile      string // Own certificate, else the global -tls-cert or ACME one
+	keyFile       string
+	clientCAFile  string
+	clientAuth    string
+	pool          string // Pool receiving every request on the listener
+	proxyProtocol bool
+}
+
+// parseListeners parses the -listen definitions. Listeners expect the PROXY
+// protocol when -proxy-protocol is set unless they say otherwise.
+func parseListeners(defs []string, proxyProtocol bool) ([]frontendListener, error) {
+	var listeners []frontendListener
+	seen := make(map[string]bool)
+	for _, def := range defs {
+		addr, query, _ := strings.Cut(def, "?")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listener %q, expected host:port or :port", def)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("listener %s is defined more than once", addr)
+		}
+		seen[addr] = true
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: %s", def, err)
+		}
+		l := frontendListener{addr: addr, proxyProtocol: proxyProtocol}
+		for key, vals := range values {
+			value := vals[len(vals)-1]
+			switch key {
+			case "tls", "proxy-protocol":
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %q for listener %s", key, value, addr)
+				}
+				if key == "tls" {
+					l.tls = b
+				} else {
+					l.proxyProtocol = b
+				}
+			case "cert":
+				l.certFile = value
+			case "key":
+				l.keyFile = value
+			case "client-ca":
+				l.clientCAFile = value
+			case "client-auth":
+				l.clientAuth = value
+			case "pool":
+				l.pool = value
+			default:
+				return nil, fmt.Errorf("unknown option %q for listener %s", key, addr)
+			}
+		}
+		if (l.certFile == "") != (l.keyFile == "") {
+			return nil, fmt.Errorf("listener %s needs both cert and key", addr)
+		}
+		if l.certFile != "" {
+			l.tls = true
+		}
+		switch l.clientAuth {
+		case "", clientAuthNone, clientAuthRequest, clientAuthRequire:
+		default:
+			return nil, fmt.Errorf("unknown client auth mode %q for listener %s", l.clientAuth, addr)
+		}
+		if !l.tls && (l.clientAuth != "" || l.clientCAFile != "") {
+			return nil, fmt.Errorf("listener %s verifies client certificates but does not serve TLS", addr)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// tlsConfig builds the listener's TLS configuration, starting from the
+// global options and replacing the certificate and client verification
+// where the listener sets its own
+func (l frontendListener) tlsConfig(global tlsOptions) (*tls.Config, error) {
+	opts := global
+	if l.certFile != "" {
+		opts.acme = nil
+		opts.certFile, opts.keyFile = l.certFile, l.keyFile
+	}
+	if l.clientAuth != "" || l.clientCAFile != "" {
+		opts.clientAuth, opts.clientCAFile = l.clientAuth, l.clientCAFile
+	}
+	if opts.acme == nil && opts.certFile == "" {
+		return nil, fmt.Errorf("listener %s serves TLS without a certificate; set cert and key, -tls-cert or -acme-domain", l.addr)
+	}
+	return buildTLSConfig(opts)
+}
+
+// listenerContextKey carries the listener a request arrived on
+type listenerContextKey struct{}
+
+// handler tags requests with the listener so its routing applies
+func (l *frontendListener) handler(next http.Handler) http.Handler {
+	if l.pool == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, l)))
+	})
+}
+
+// listenerPool returns the pool of the listener the request arrived on
+func (lb *LoadBalancer) listenerPool(r *http.Request) *Pool {
+	l, _ := r.Context().Value(listenerContextKey{}).(*frontendListener)
+	if l == nil {
+		return nil
+	}
+	return lb.pools[l.pool]
+}
+
+// serveListeners serves clients on every listener until one fails. Plain
+// listeners answer ACME HTTP-01 challenges when ACME is enabled.
+func (lb *LoadBalancer) serveListeners(listeners []frontendListener, frontend frontendSettings, global tlsOptions, proxies trustedProxies) error {
+	errs := make(chan error, len(listeners))
+	for i := range listeners {
+		l := &listeners[i]
+		handler := l.handler(lb)
+		var tlsConfig *tls.Config
+		if l.tls {
+			var err error
+			if tlsConfig, err = l.tlsConfig(global); err != nil {
+				return err
+			}
+		} else if global.acme != nil {
+			handler = global.acme.HTTPHandler(handler)
+		}
+		ln, err := lb.upgrades.listen(fmt.Sprintf("listen%d", i), nil, []string{l.addr}, l.proxyProtocol, proxies)
+		if err != nil {
+			return err
+		}
+		server := frontend.newServer(handler)
+		lb.upgrades.drainOnUpgrade(server.Shutdown)
+		go func() {
+			if tlsConfig != nil {
+				server.TLSConfig = tlsConfig
+				lb.logf("TLS listener starting on %s", ln.Addr())
+				errs <- server.ServeTLS(ln, "", "")
+				return
+			}
+			lb.logf("Listener starting on %s", ln.Addr())
+			errs <- server.Serve(ln)
+		}()
+	}
+	lb.upgrades.ready()
+	return <-errs
+}
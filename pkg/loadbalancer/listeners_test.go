@@ -0,0 +1,128 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// writeSelfSignedCert writes a certificate for localhost and its key
+func writeSelfSignedCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestServeListeners(t *testing.T) {
+	backend := func(name string) *Server {
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) }))
+		t.Cleanup(b.Close)
+		u, _ := url.Parse(b.URL)
+		return &Server{URL: u, Alive: true}
+	}
+	lb := &LoadBalancer{
+		servers: []*Server{backend("web")},
+		current: -1,
+		pools:   map[string]*Pool{"api": newPool("api", []*Server{backend("api")})},
+	}
+	certFile, keyFile := writeSelfSignedCert(t)
+	public, internal := freeAddr(t), freeAddr(t)
+	listeners, err := parseListeners([]string{public, internal + "?cert=" + certFile + "&key=" + keyFile + "&pool=api"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.serveListeners(listeners, frontendSettings{}, tlsOptions{}, nil)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(url string) string {
+		var resp *http.Response
+		var err error
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if resp, err = client.Get(url); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get("http://" + public + "/"); got != "web" {
+		t.Errorf("Expected the plain listener to use the default servers, got %q", got)
+	}
+	if got := get("https://" + internal + "/"); got != "api" {
+		t.Errorf("Expected the TLS listener to route to its pool, got %q", got)
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := parseListeners([]string{":80", "10.0.0.1:8443?cert=a.pem&key=a.key&client-auth=require&client-ca=ca.pem&pool=internal&proxy-protocol=false"}, true)
+	if err != nil || len(listeners) != 2 {
+		t.Fatalf("Unexpected listeners %+v, %v", listeners, err)
+	}
+	if l := listeners[0]; l.tls || !l.proxyProtocol {
+		t.Errorf("Expected a plain listener taking -proxy-protocol, got %+v", l)
+	}
+	if l := listeners[1]; !l.tls || l.certFile != "a.pem" || l.pool != "internal" || l.clientAuth != clientAuthRequire || l.proxyProtocol {
+		t.Errorf("Expected the listener options to apply, got %+v", l)
+	}
+	for _, def := range []string{"80", ":80?cert=a.pem", ":80?client-auth=require", ":80?client-auth=maybe&tls=true", ":80?tls=yes please", ":80?color=blue"} {
+		if _, err := parseListeners([]string{def}, false); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+	if _, err := parseListeners([]string{":80", ":80?pool=api"}, false); err == nil {
+		t.Error("Expected a listener defined twice to be rejected")
+	}
+	if _, err := (frontendListener{addr: ":443", tls: true}).tlsConfig(tlsOptions{}); err == nil {
+		t.Error("Expected a TLS listener without any certificate to be rejected")
+	}
+
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-server", "http://localhost:8081", "-listen", ":8443?tls=true&pool=missing")
+	if !hasFinding(findings, lintError, "unknown pool missing") || !hasFinding(findings, lintError, "without a certificate") {
+		t.Error("Expected lint to report the unknown pool and the missing certificate")
+	}
+}
@@ -0,0 +1,1518 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancer represents a load balancer
+type LoadBalancer struct {
+	servers       []*Server
+	current       int64 // Position in the round-robin schedule, accessed atomically
+	healthCheck   string
+	healthType    string
+	totalRequests atomic.Int64 // Total number of requests handled
+
+	// Expected health check response, 200 OK when nil
+	healthExpect *healthValidation
+
+	// Host and headers sent with health checks
+	healthHost    string
+	healthHeaders http.Header
+
+	// Client used for health checks, separate from proxied traffic, and
+	// the default timeout of a check
+	healthClient  *http.Client
+	healthTimeout time.Duration
+
+	// Fraction of the interval by which each health check is randomly shifted
+	healthJitter float64
+
+	// Default gRPC health check service and the HTTP/2 transport used
+	grpcService   string
+	grpcTransport http.RoundTripper
+	grpcOnce      sync.Once
+
+	// Networks whose X-Forwarded-For/X-Real-IP headers are believed
+	trustedProxies trustedProxies
+
+	// Header used to forward the verified client certificate subject
+	clientCertHeader string
+
+	// Proxy mode, http or tcp
+	mode string
+
+	// Named pools and the TLS server names, path prefixes and path
+	// templates routed to them
+	pools          map[string]*Pool
+	sniRoutes      sniRoutes
+	pathRoutes     []pathRoute
+	templateRoutes []templateRoute
+
+	// Path and query rewrites applied to requests before forwarding
+	rewrites      []rewriteRule
+	queryRewrites []queryRewrite
+
+	// Headers added to, replaced in or removed from proxied responses
+	responseHeaders []responseHeaderRule
+
+	// Routes fanned out to every backend of a pool
+	aggregates []aggregateRoute
+
+	// Custom bodies answered when no route matches a request and when the
+	// matched route has no healthy backend, nil for the default JSON body
+	noRouteResponse   *unavailableResponse
+	noBackendResponse *unavailableResponse
+
+	// Custom pages for load balancer errors by code or status
+	errorPages map[string]*errorPage
+
+	// Gzip compression of responses, nil when disabled
+	compression *compression
+
+	// In-memory cache of GET responses, nil when disabled
+	cache *responseCache
+
+	// Cross-origin policy enforced for the backends, nil when disabled
+	cors *corsPolicy
+
+	// Client networks allowed and denied globally and per route, nil when
+	// disabled, and the number of requests it denied
+	ipFilter       *ipFilter
+	deniedRequests atomic.Int64
+
+	// Pools whose servers come from discovery
+	discoveries []*discovery
+
+	// Request body size limit in bytes, 0 for none, and per route limits
+	maxBody    int64
+	bodyLimits []bodyLimit
+
+	// Routes whose slow requests are hedged to a second backend
+	hedges []*hedgeRoute
+
+	// Pool receiving large uploads, nil when disabled
+	upload *uploadRoute
+
+	// Device class routes to pools and the header tagging backend requests
+	deviceRoutes map[string]string
+	deviceHeader string
+
+	// Thresholds for taking backends out of rotation based on live traffic
+	passive passiveSettings
+
+	// Global and per-client request rate limits, nil when disabled
+	rateLimit       *tokenBucket
+	clientRateLimit *clientLimiter
+
+	// Share of a rate limit quota below which allowed responses carry the
+	// RateLimit headers
+	rateLimitWarn float64
+
+	// Checks backends must pass before entering rotation, nil when disabled
+	compat *compatProbe
+
+	// Circuit breaker settings of every backend, including discovered ones
+	breaker breakerSettings
+
+	// Blue/green cutover from the default servers to a pool, nil when none
+	// has been started, and the defaults for new cutovers
+	cutover         atomic.Pointer[cutover]
+	cutoverSettings cutoverSettings
+
+	// Fixed split of the default servers' traffic to a canary pool, nil
+	// when disabled
+	canary *canarySplit
+
+	// Pair of pools taking the default servers' traffic in turn, nil when
+	// disabled
+	blueGreen *blueGreen
+
+	// Ejection of backends deviating from their peers in the same pool
+	outlier outlierSettings
+
+	// Number of times a failed request may be retried on another backend
+	retries     int
+	retryPolicy *retryPolicy // Which requests and failures are retried, the defaults when nil
+
+	// Collapses identical concurrent GET requests, nil when disabled
+	coalescer *coalescer
+
+	// Caps the share of requests that are retries, nil when unlimited
+	retryBudget *retryBudget
+
+	// Default duration over which runtime weight changes are ramped
+	weightRamp time.Duration
+
+	// Requests waiting while every backend is at its concurrency cap, nil
+	// when requests are turned away immediately
+	queue *requestQueue
+
+	// Calls notifying backends when their weight moves to or from 0, nil
+	// when disabled
+	drainNotify   *drainCall
+	undrainNotify *drainCall
+
+	// Default percentage of traffic sent to quarantined backends
+	quarantineShare float64
+
+	// Authentication required on routes, nil when no route requires it
+	auth *authenticator
+
+	// Routes disabled for emergency mitigation, nil when disabled
+	kills *killSwitches
+
+	// Feature flags gating routes and middleware, and the flag gating each
+	// feature named with -flag-gate
+	flags     *featureFlags
+	flagGates map[string]string
+
+	// Copies a share of requests to a shadow pool, nil when disabled
+	mirror *mirror
+
+	// Compares primary and shadow responses of mirrored requests
+	mirrorDiff *mirrorDiff
+
+	// Synthetic checks sent through the proxy path, nil when disabled
+	synthetics *synthetics
+
+	// Default time budget of a request from arrival, 0 when unbounded
+	deadlineBudget time.Duration
+
+	// Per-tenant usage accounting, nil when disabled
+	usage *usageTracker
+
+	// Cacheability statistics of proxied responses, nil when disabled
+	cacheStats *cacheStats
+
+	// Configuration advisor observing traffic, nil when disabled
+	advisor *advisor
+
+	// Transport used to reach backends, http.DefaultTransport when nil
+	transport http.RoundTripper
+	timeouts  proxyTimeouts
+
+	// Proxy timeouts replacing the global ones under path prefixes
+	routeTimeouts []routeTimeout
+
+	// Client shared by proxied requests, built from transport on first use
+	client     *http.Client
+	clientOnce sync.Once
+
+	// In-flight requests and open backend connections, nil when disabled
+	diagnostics *diagnostics
+
+	// Connection setup latency per backend, nil when disabled
+	connStats *connStats
+
+	// Whether per-phase upstream timing is exposed as a Server-Timing header
+	serverTiming bool
+
+	// Hooks for embedders
+	metricsSink MetricsSink
+	logger      Logger
+	listeners   []EventListener
+	listenersMu sync.RWMutex
+
+	// Deduplicates repeated error messages, nil when disabled
+	logThrottle *logThrottle
+
+	// File or syslog receiving a line per request, nil to log requests
+	// through logf
+	accessLog io.Writer
+
+	// Syslog endpoint receiving the log, nil when logging to stderr
+	syslog syslogWriter
+
+	// Picks the requests that are logged, nil to log every request
+	logSampler *logSampler
+
+	admin     http.Handler // Admin API handler
+	adminOnce sync.Once
+
+	// Middlewares around the proxy, built on first use, and the ones added
+	// with Use
+	chain           http.Handler
+	handlerOnce     sync.Once
+	userMiddlewares []Middleware
+
+	// Lua plugins run for every request, and how long each call may take
+	plugins       []*plugin
+	pluginTimeout time.Duration
+
+	// Credentials for stats and the admin API, nil when open, whether
+	// they are served on the admin listener only, and whether that listener
+	// only accepts local connections
+	adminAuth     *adminAuth
+	adminSeparate bool
+	adminLocal    bool
+
+	// Whether /healthz and /readyz are served, and the backends whose first
+	// health check readiness waits for
+	selfHealth     bool
+	initialServers []*Server
+	initialChecked atomic.Bool
+
+	// Hands the listening sockets to an upgraded process, nil in tests
+	upgrades *upgrader
+
+	// Proxied TCP connections, waited for when draining
+	tcpConns sync.WaitGroup
+}
+
+// New returns a load balancer spreading requests over the backends round
+// robin, with every optional feature off. It is an http.Handler; start
+// health checks with ScheduleHealthChecks. Run builds one from a full
+// Config instead.
+func New(backends ...*url.URL) *LoadBalancer {
+	lb := &LoadBalancer{current: -1}
+	for _, u := range backends {
+		lb.servers = append(lb.servers, NewServer(u))
+	}
+	return lb
+}
+
+// Servers returns the default servers followed by the servers of every pool
+func (lb *LoadBalancer) Servers() []*Server {
+	return lb.allServers()
+}
+
+// NextServer returns the next server based on round-robin algorithm
+func (lb *LoadBalancer) NextServer() *Server {
+	return nextAliveServer(lb.servers, &lb.current)
+}
+
+// nextServerFor picks the backend for a request, honouring listener, plugin,
+// upload, SNI, path, template, device, cutover, canary and blue/green routes
+func (lb *LoadBalancer) nextServerFor(r *http.Request) *Server {
+	if pool := lb.routeFor(r); pool != nil {
+		return pool.NextServer()
+	}
+	return lb.NextServer()
+}
+
+// allServers returns the default servers followed by the servers of every named pool
+func (lb *LoadBalancer) allServers() []*Server {
+	servers := append([]*Server(nil), lb.servers...)
+	names := make([]string, 0, len(lb.pools))
+	for name := range lb.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		servers = append(servers, lb.pools[name].servers()...)
+	}
+	return servers
+}
+
+// ServeHTTP implements the http.Handler interface
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Routes, filters and authentication all see the cleaned path
+	r = cleanRequestPath(r)
+
+	// Stats and the admin API, unless they have a listener of their own
+	if !lb.adminSeparate && lb.serveAdmin(w, r) {
+		return
+	}
+
+	// The load balancer's own liveness and readiness probes
+	if lb.serveSelfHealth(w, r) {
+		return
+	}
+
+	if lb.mode == modeTCP {
+		lb.writeError(w, errRouteNotFound, "404 page not found")
+		return
+	}
+
+	// Filtering, limits, authentication and logging run as middlewares
+	// around the proxy
+	lb.handler().ServeHTTP(w, r)
+}
+
+// proxy sends a request that passed the middlewares to a backend
+func (lb *LoadBalancer) proxy(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Drop requests whose client deadline has already passed and bound the
+	// rest by it
+	r, cancelDeadline, ok := lb.applyDeadline(w, r, start)
+	if !ok {
+		return
+	}
+	defer cancelDeadline()
+
+	// Aggregate routes fan out to every backend instead of picking one
+	if route := lb.aggregateRouteFor(r); route != nil {
+		lb.serveAggregate(w, r, route)
+		return
+	}
+
+	// Answer from the response cache when a fresh copy is stored
+	if lb.serveCached(w, r) {
+		return
+	}
+
+	// Replace failed responses with a stale cached one where allowed
+	w = lb.staleIfError(w, r)
+
+	// Identical concurrent requests on coalesced routes share one backend
+	// request
+	w, publish, answered := lb.coalesce(w, r)
+	if answered {
+		return
+	}
+	defer publish()
+
+	// Account usage to the tenant once the request completes, including
+	// requests refused for want of a backend
+	var usage usageSample
+	if lb.usage != nil {
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			usage.bytesIn = body.n
+			lb.usage.record(r, usage)
+		}()
+	}
+
+	// Get the next available server with a free request slot, queueing
+	// while every server is at its cap
+	server, ok := lb.reserveServer(w, r)
+	if !ok {
+		usage.failed = true
+		return
+	}
+	defer func() {
+		server.finishRequest()
+		lb.queue.release()
+	}()
+
+	// Update statistics
+	lb.recordRequest(server)
+
+	// Copy a share of requests to the shadow pool
+	shadow := lb.mirrorRequest(r)
+
+	// Advertise the client hints used for device classification
+	lb.advertiseDeviceHints(w)
+
+	// Send the request to the backend, retrying on another backend when the
+	// connection fails before any response headers arrive
+	upstreamStart := time.Now()
+	defer func() { usage.upstream = time.Since(upstreamStart) }()
+	ctx := r.Context()
+	if timeout, _ := lb.timeoutsFor(r.URL.Path); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Track the request so it can be inspected and aborted when stuck
+	if lb.diagnostics != nil {
+		var abort context.CancelFunc
+		ctx, abort = context.WithCancel(ctx)
+		defer abort()
+		defer lb.diagnostics.track(ctx, r, lb.trustedProxies.clientIP(r), server, abort)()
+	}
+	timing := &requestTiming{}
+	r = r.WithContext(timing.withTiming(ctx))
+	resp, server, err := lb.roundTrip(r, server)
+	headersAfter := time.Since(upstreamStart)
+	if err != nil {
+		shadow.finish(0, err)
+		usage.failed = true
+		lb.writeError(w, upstreamError(err), err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	// A backend accepting a protocol upgrade such as a WebSocket handshake
+	// hands over its connection, which is relayed until either side closes
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		usage.bytesOut, err = lb.relayUpgrade(w, resp)
+		if err != nil {
+			usage.failed = true
+			lb.writeError(w, errUpstreamFailed, err.Error())
+			return
+		}
+		lb.metrics().IncCounter("lb_requests_total", map[string]string{"backend": server.URL.Host, "code": strconv.Itoa(resp.StatusCode)})
+		return
+	}
+	resp.Body = shadow.capture(resp.Body)
+	lb.observeCache(r, resp)
+	lb.stripCORS(resp.Header)
+	storeResponse := lb.cacheResponse(w, r, resp)
+
+	// Copy the response headers
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	lb.addServerTiming(w, timing)
+	lb.rewriteResponseHeaders(r, w.Header())
+	out, finishBody := lb.compressResponse(w, r, resp)
+
+	// Set status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy the response body
+	usage.bytesOut, err = copyPooled(out, resp.Body)
+	if closeErr := finishBody(); err == nil {
+		err = closeErr
+	}
+	usage.failed = resp.StatusCode >= 500
+	timing.finish()
+	shadow.finish(resp.StatusCode, err)
+	if err != nil {
+		// The status line has already been sent, so the failure can only be
+		// recorded and the response cut short
+		lb.recordError(errResponseAborted, err.Error())
+		return
+	}
+
+	storeResponse()
+	if lb.logsRequest(r, resp.StatusCode) {
+		lb.logf("Response from server: %s %s (%s)", resp.Proto, resp.Status, timing)
+	}
+	lb.observeTiming(timing, server)
+	lb.advisor.observe(server, headersAfter, time.Since(start), time.Now())
+	lb.advisor.observeRequest(r, lb.retryRules().repeatable(r), time.Now())
+	lb.metrics().IncCounter("lb_requests_total", map[string]string{"backend": server.URL.Host, "code": strconv.Itoa(resp.StatusCode)})
+	lb.metrics().ObserveDuration("lb_request_duration_seconds", time.Since(start), map[string]string{"backend": server.URL.Host})
+}
+
+// recordRequest counts a request or connection handled by the server
+func (lb *LoadBalancer) recordRequest(server *Server) {
+	lb.totalRequests.Add(1)
+	server.requests.Add(1)
+}
+
+// HealthCheck performs a health check on all backend servers
+func (lb *LoadBalancer) HealthCheck() {
+	var wg sync.WaitGroup
+	for _, server := range lb.allServers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.checkServer(server)
+		}()
+	}
+	wg.Wait()
+}
+
+// checkServer performs a health check on one backend server using its own
+// health check settings where configured
+func (lb *LoadBalancer) checkServer(server *Server) {
+	// Backends stay out of rotation until they pass the compatibility probe
+	if lb.mode != modeTCP && !lb.admitted(server) {
+		lb.recordHealthCheck(server, false)
+		return
+	}
+
+	check := lb.healthCheckFor(server)
+	ctx := context.Background()
+	if check.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, check.timeout)
+		defer cancel()
+	}
+
+	// In TCP mode, or with TCP health checks, a backend is healthy when
+	// it accepts connections
+	if lb.mode == modeTCP || check.typ == healthTCP {
+		timeout := lb.tcpDialTimeout()
+		if check.timeout > 0 {
+			timeout = check.timeout
+		}
+		err := checkTCP(backendNetwork(server.URL), healthAddress(server.URL), timeout)
+		if err != nil {
+			lb.errorf("Health check failed for %s: %s", server.URL.Host, err)
+		}
+		lb.recordHealthCheck(server, err == nil)
+		return
+	}
+
+	// gRPC backends are probed with the standard health checking protocol
+	if check.typ == healthGRPC {
+		err := checkGRPC(ctx, lb.grpcHealthTransport(), server.URL, check)
+		if err != nil {
+			lb.errorf("Health check failed for %s: %s", server.URL.Host, err)
+		}
+		lb.recordHealthCheck(server, err == nil)
+		return
+	}
+
+	status := "up"
+	serverURL := *server.URL
+	serverURL.Path = check.path
+
+	client := lb.healthClient
+	if client == nil {
+		client = lb.upstreamClient()
+	}
+	req, err := newBackendRequestTo(ctx, http.MethodGet, &serverURL, nil)
+	if err != nil {
+		lb.errorf("Health check failed for %s: %s", serverURL.String(), err)
+		lb.recordHealthCheck(server, false)
+		return
+	}
+	check.apply(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		lb.errorf("Health check failed for %s: %s", serverURL.String(), err)
+		lb.recordHealthCheck(server, false)
+		status = "down"
+	} else {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		resp.Body.Close()
+		if err == nil {
+			err = check.validation.validate(resp.StatusCode, body)
+		}
+		if err != nil {
+			lb.errorf("Health check failed for %s: %s", serverURL.String(), err)
+			status = "down"
+		}
+		lb.recordHealthCheck(server, err == nil)
+	}
+	lb.logf("Health check for %s: %s", serverURL.String(), status)
+}
+
+// ScheduleHealthChecks checks every backend at regular intervals, using
+// the backend's own interval where one is configured
+func (lb *LoadBalancer) ScheduleHealthChecks(interval time.Duration) {
+	lb.initialServers = lb.allServers()
+	for _, server := range lb.initialServers {
+		lb.scheduleHealthCheck(server, interval, nil)
+	}
+}
+
+// scheduleHealthCheck checks the backend at regular intervals until stop is
+// closed, forever with a nil stop
+func (lb *LoadBalancer) scheduleHealthCheck(server *Server, interval time.Duration, stop <-chan struct{}) {
+	every := interval
+	if check := server.HealthCheck(); check.interval > 0 {
+		every = check.interval
+	}
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		// Run an initial health check immediately, delayed by a random
+		// jitter so backends are not all probed at the same instant
+		time.Sleep(lb.healthJitterFor(every))
+		lb.checkServer(server)
+
+		// Then run on the ticker schedule, each check jittered again
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				time.Sleep(lb.healthJitterFor(every))
+				lb.checkServer(server)
+			}
+		}
+	}()
+}
+
+// handleStats displays load balancing statistics
+func (lb *LoadBalancer) handleStats(w http.ResponseWriter, r *http.Request) {
+	total := lb.totalRequests.Load()
+	fmt.Fprintf(w, "Load Balancer Statistics:\n\n")
+	fmt.Fprintf(w, "Total Requests: %d\n", total)
+	if lb.ipFilter != nil {
+		fmt.Fprintf(w, "Denied by IP filter: %d\n", lb.deniedRequests.Load())
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Distribution:\n")
+
+	// A backend can be listed in several pools, so counts are summed per host
+	var hosts []string
+	counts := make(map[string]int64)
+	for _, server := range lb.allServers() {
+		if _, ok := counts[server.URL.Host]; !ok {
+			hosts = append(hosts, server.URL.Host)
+		}
+		counts[server.URL.Host] += server.requests.Load()
+	}
+	for _, host := range hosts {
+		count := counts[host]
+		if count == 0 {
+			continue
+		}
+		percent := 0.0
+		if total > 0 {
+			percent = float64(count) / float64(total) * 100
+		}
+		fmt.Fprintf(w, "  %s: %d requests (%.1f%%)\n", host, count, percent)
+	}
+
+	if len(lb.pools) > 0 {
+		fmt.Fprintf(w, "\nPools:\n")
+		names := make([]string, 0, len(lb.pools))
+		for name := range lb.pools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			status := lb.pools[name].status()
+			fmt.Fprintf(w, "  %s (%s): %d/%d servers up, %d requests, %d in flight\n", name, status.Strategy, status.Alive, status.Servers, status.Requests, status.InFlight)
+		}
+	}
+
+	fmt.Fprintf(w, "\nServer Health:\n")
+	for _, server := range lb.allServers() {
+		status := "UP"
+		if !server.IsAlive() {
+			status = "DOWN"
+		} else if state := server.CircuitState(); state != circuitClosed {
+			status = "UP (circuit " + state + ")"
+		}
+		fmt.Fprintf(w, "  %s: %s\n", server.URL.Host, status)
+	}
+}
+
+// Run starts a load balancer with the configuration and serves until a
+// listener fails, or until an upgraded process has taken over its sockets
+// and the connections have drained
+func Run(cfg *Config) error {
+	// Check if servers are provided, either as default servers or in pools
+	// that routes send requests to
+	if len(cfg.Servers) == 0 && len(cfg.Pools) == 0 {
+		return errors.New("No backend servers specified. Use -server flag to specify at least one server.")
+	}
+
+	// Send the log to syslog from the first line on. Run logs through its
+	// own logger, leaving the standard one to the program.
+	logger := log.Default()
+	var syslogOut syslogWriter
+	if cfg.Syslog != "" {
+		var err error
+		syslogOut, err = openSyslog(cfg.Syslog, cfg.SyslogFacility, cfg.SyslogTag)
+		if err != nil {
+			return err
+		}
+		defer syslogOut.Close()
+		// Syslog timestamps the messages itself
+		logger = log.New(syslogOut, "", 0)
+	}
+
+	// Initialize servers
+	serverURLs, err := cfg.parseServerURLs()
+	if err != nil {
+		return err
+	}
+	// Backends subject to a compatibility probe start out of rotation
+	probing := cfg.CompatVersion != "" || len(cfg.CompatEndpoints) > 0 || cfg.CompatTLS
+	var servers []*Server
+	for _, pUrl := range serverURLs {
+		servers = append(servers, &Server{
+			URL:   pUrl,
+			Alive: !probing,
+		})
+		logger.Printf("Added backend server: %s", pUrl.String())
+	}
+
+	// Initialize named pools
+	poolURLs, err := cfg.parsePools()
+	if err != nil {
+		return err
+	}
+	pools := make(map[string]*Pool)
+	var discoveries []*discovery
+	for name, urls := range poolURLs {
+		var poolServers []*Server
+		var sources []*url.URL
+		for _, pUrl := range urls {
+			if isDiscoveryURL(pUrl) {
+				sources = append(sources, pUrl)
+				continue
+			}
+			poolServers = append(poolServers, &Server{URL: pUrl, Alive: !probing})
+		}
+		pools[name] = newPool(name, poolServers)
+		logger.Printf("Added pool %s with %d servers", name, len(poolServers))
+
+		// Pools with a discovery source get their other servers from it
+		if len(sources) > 1 {
+			return fmt.Errorf("Pool %s has more than one discovery source", name)
+		}
+		for _, source := range sources {
+			d, err := newDiscovery(pools[name], poolServers, source, net.DefaultResolver)
+			if err != nil {
+				return err
+			}
+			discoveries = append(discoveries, d)
+			logger.Printf("Discovering servers of pool %s from %s", name, d.source)
+		}
+	}
+
+	routes, err := cfg.parseSNIRoutes(poolURLs)
+	if err != nil {
+		return err
+	}
+	listeners, err := parseListeners(cfg.Listeners, cfg.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	bind, err := parseBind(cfg.Bind)
+	if err != nil {
+		return err
+	}
+	port := cfg.Port
+	if bind.port != 0 {
+		port = bind.port
+	}
+	activated, err := systemdSockets(cfg.TLSPort)
+	if err != nil {
+		return err
+	}
+	if !activated.empty() {
+		if len(listeners) > 0 {
+			return errors.New("-listen cannot be combined with systemd socket activation")
+		}
+		if len(activated.tls) > 0 && !cfg.TLSEnabled() {
+			return errors.New("systemd passed a TLS socket but no certificate is configured")
+		}
+		logger.Printf("Using %d plain and %d TLS sockets from systemd", len(activated.plain), len(activated.tls))
+	}
+	for _, l := range listeners {
+		if _, ok := pools[l.pool]; l.pool != "" && !ok {
+			return fmt.Errorf("Listener %s references unknown pool %s", l.addr, l.pool)
+		}
+	}
+
+	// Apply configured weights and health check settings
+	weights, err := parseWeights(cfg.Weights)
+	if err != nil {
+		return err
+	}
+	concurrencyLimits, err := parseMaxConcurrent(cfg.BackendConcurrency)
+	if err != nil {
+		return err
+	}
+	thresholds, err := parseHealthThresholds(cfg.HealthThresholds)
+	if err != nil {
+		return err
+	}
+	checks, err := parseHealthChecks(cfg.BackendHealth)
+	if err != nil {
+		return err
+	}
+	healthExpect, err := newHealthValidation(cfg.HealthStatus, cfg.HealthBody, cfg.HealthBodyRegex, cfg.HealthJSON)
+	if err != nil {
+		return err
+	}
+	healthHeaders, err := parseHeaders(cfg.HealthHeaders)
+	if err != nil {
+		return err
+	}
+	configure := func(server *Server) {
+		if weight, ok := weights[server.URL.Host]; ok {
+			server.SetWeight(weight, 0)
+		}
+		limit, ok := concurrencyLimits[server.URL.Host]
+		if !ok {
+			limit = cfg.MaxConcurrent
+		}
+		server.SetMaxConcurrent(limit)
+		threshold, ok := thresholds[server.URL.Host]
+		if !ok {
+			threshold = healthThresholds{rise: cfg.HealthRise, fall: cfg.HealthFall}
+		}
+		server.SetHealthThresholds(threshold)
+		if check, ok := checks[server.URL.Host]; ok {
+			server.SetHealthCheck(check)
+		}
+	}
+	for _, server := range append(append([]*Server(nil), servers...), poolServerList(pools)...) {
+		configure(server)
+	}
+
+	poolNames := make(map[string]bool)
+	for name := range pools {
+		poolNames[name] = true
+	}
+	poolConfigs, err := parsePoolConfigs(cfg.PoolConfigs, poolNames)
+	if err != nil {
+		return err
+	}
+	for name, config := range poolConfigs {
+		pool := pools[name]
+		pool.strategy = config.strategy
+		for _, server := range pool.servers() {
+			if _, ok := checks[server.URL.Host]; !ok && config.health != nil {
+				server.SetHealthCheck(*config.health)
+			}
+		}
+	}
+	for _, d := range discoveries {
+		health := poolConfigs[d.pool.name].health
+		d.setup = func(server *Server) {
+			configure(server)
+			if _, ok := checks[server.URL.Host]; !ok && health != nil {
+				server.SetHealthCheck(*health)
+			}
+		}
+		d.healthInterval = time.Duration(cfg.HealthCheckInterval) * time.Second
+		d.logf = logger.Printf
+	}
+	deviceRoutes, err := parseDeviceRoutes(cfg.DeviceRoutes, poolNames)
+	if err != nil {
+		return err
+	}
+
+	pathRoutes, err := parsePathRoutes(cfg.PathRoutes, poolNames)
+	if err != nil {
+		return err
+	}
+	flagGates, err := parseFlagGates(cfg.FlagGates)
+	if err != nil {
+		return err
+	}
+	templateRoutes, err := parseTemplateRoutes(cfg.TemplateRoutes, poolNames)
+	if err != nil {
+		return err
+	}
+	rewrites, err := parseRewrites(cfg.Rewrites)
+	if err != nil {
+		return err
+	}
+	queryRewrites, err := parseQueryRewrites(cfg.QueryRewrites)
+	if err != nil {
+		return err
+	}
+
+	var upload *uploadRoute
+	if cfg.UploadPool != "" {
+		if !poolNames[cfg.UploadPool] {
+			return fmt.Errorf("upload pool %s is not defined", cfg.UploadPool)
+		}
+		upload = &uploadRoute{pool: cfg.UploadPool, minSize: cfg.UploadMinSize, contentTypes: cfg.UploadContentTypes}
+	}
+
+	hedges, err := parseHedgeRoutes(cfg.Hedges, hedgeSettings{
+		quantile: cfg.HedgeQuantile,
+		minDelay: cfg.HedgeMinDelay,
+		budget:   cfg.HedgeBudget,
+	})
+	if err != nil {
+		return err
+	}
+	aggregates, err := parseAggregateRoutes(cfg.Aggregates, poolNames)
+	if err != nil {
+		return err
+	}
+
+	var shadow *mirror
+	var diff *mirrorDiff
+	if cfg.MirrorPool != "" {
+		if !poolNames[cfg.MirrorPool] {
+			return fmt.Errorf("mirror pool %s is not defined", cfg.MirrorPool)
+		}
+		if err := parseMirrorPercent(cfg.MirrorPercent); err != nil {
+			return err
+		}
+		rules := diffRules{compareBody: cfg.MirrorCompareBody, latencyTolerance: cfg.MirrorLatencyTolerance}
+		for _, pattern := range cfg.MirrorIgnore {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid mirror ignore pattern %q: %s", pattern, err)
+			}
+			rules.ignore = append(rules.ignore, re)
+		}
+		shadow = newMirror(pools[cfg.MirrorPool], mirrorSettings{
+			percent:     cfg.MirrorPercent,
+			maxBody:     cfg.MirrorMaxBody,
+			timeout:     cfg.MirrorTimeout,
+			concurrency: cfg.MirrorConcurrency,
+		})
+		diff = newMirrorDiff(rules)
+	}
+
+	var canary *canarySplit
+	if cfg.Canary != "" {
+		name, percent, err := parseCanary(cfg.Canary, poolNames)
+		if err != nil {
+			return err
+		}
+		canary = &canarySplit{pool: pools[name], percent: percent}
+	}
+
+	var pair *blueGreen
+	if cfg.BlueGreen != "" {
+		names, err := parseBlueGreen(cfg.BlueGreen, poolNames)
+		if err != nil {
+			return err
+		}
+		pair = newBlueGreen(pools[names[0]], pools[names[1]])
+	}
+
+	cutoverSteps, err := parseCutoverSteps(cfg.CutoverSteps)
+	if err != nil {
+		return err
+	}
+
+	kills, err := parseKills(cfg.Kills)
+	if err != nil {
+		return err
+	}
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	backendTLS, err := buildBackendTLSConfig(backendTLSOptions{
+		caFile:     cfg.BackendCA,
+		serverName: cfg.BackendServerName,
+		certFile:   cfg.BackendCert,
+		keyFile:    cfg.BackendKey,
+		insecure:   cfg.BackendInsecure,
+		resumption: cfg.BackendTLSResumption,
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.BackendInsecure {
+		logger.Printf("WARNING: backend TLS certificate verification is disabled")
+	}
+
+	timeouts := proxyTimeouts{
+		dial:           cfg.DialTimeout,
+		tlsHandshake:   cfg.TLSHandshakeTimeout,
+		responseHeader: cfg.ResponseHeaderTimeout,
+		request:        cfg.RequestTimeout,
+	}
+
+	routeTimeouts, err := parseRouteTimeouts(cfg.RouteTimeouts, timeouts)
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := parseRetryPolicy(cfg.RetryMethods, cfg.RetryOn, cfg.RetryKeyHeader, cfg.RetryMaxBody)
+	if err != nil {
+		return err
+	}
+
+	// The template transport is cloned for every backend on first use.
+	// Response header timeouts are enforced per request instead, since
+	// routes can override them.
+	transport := newUpstreamTransport(backendTLS, timeouts)
+	transport.ResponseHeaderTimeout = 0
+	connPoolSettings{
+		maxIdlePerHost:    cfg.MaxIdleConnsPerHost,
+		idleTimeout:       cfg.IdleConnTimeout,
+		disableKeepAlives: cfg.DisableKeepAlives,
+	}.apply(transport)
+	diagnostics := newDiagnostics()
+	transport.DialContext = diagnostics.trackConns(transport.DialContext)
+	var upstream http.RoundTripper = newBackendTransports(transport)
+	healthTransport := newHealthTransport(backendTLS, cfg.HealthTimeout)
+	healthTransport.RegisterProtocol(unixScheme, newBackendTransports(healthTransport))
+
+	// Create load balancer
+	lb := &LoadBalancer{
+		servers:        servers,
+		current:        -1, // Start at -1 so first call to NextServer gives us index 0
+		healthCheck:    cfg.HealthCheckPath,
+		healthType:     cfg.HealthCheckType,
+		healthExpect:   healthExpect,
+		healthHost:     cfg.HealthHost,
+		healthHeaders:  healthHeaders,
+		healthClient:   &http.Client{Transport: healthTransport},
+		healthTimeout:  cfg.HealthTimeout,
+		healthJitter:   cfg.HealthJitter,
+		grpcService:    cfg.HealthGRPCService,
+		grpcTransport:  newGRPCTransport(backendTLS),
+		trustedProxies: proxies,
+		mode:           cfg.Mode,
+		pools:          pools,
+		sniRoutes:      routes,
+		pathRoutes:     pathRoutes,
+		flagGates:      flagGates,
+		templateRoutes: templateRoutes,
+		rewrites:       rewrites,
+		queryRewrites:  queryRewrites,
+		deviceRoutes:   deviceRoutes,
+		deviceHeader:   cfg.DeviceHeader,
+		upload:         upload,
+		aggregates:     aggregates,
+		hedges:         hedges,
+		mirror:         shadow,
+		canary:         canary,
+		blueGreen:      pair,
+		mirrorDiff:     diff,
+		retries:        cfg.Retries,
+		retryPolicy:    retryPolicy,
+		retryBudget: newRetryBudget(retryBudgetSettings{
+			ratio:  cfg.RetryBudget,
+			min:    cfg.RetryBudgetMin,
+			window: cfg.RetryBudgetWindow,
+		}),
+		weightRamp: time.Duration(cfg.WeightRamp) * time.Second,
+
+		queue:            newRequestQueue(cfg.QueueDepth, cfg.QueueTimeout),
+		clientCertHeader: cfg.ClientCertHeader,
+		flags:            newFeatureFlags(cfg.FlagSegmentHeader),
+		transport:        upstream,
+		timeouts:         timeouts,
+		routeTimeouts:    routeTimeouts,
+		connStats:        newConnStats(cfg.MaxIdleConnsPerHost),
+		diagnostics:      diagnostics,
+		serverTiming:     cfg.ServerTiming,
+		kills:            kills,
+		quarantineShare:  cfg.QuarantineShare,
+		deadlineBudget:   cfg.DeadlineBudget,
+		passive: passiveSettings{
+			failures:     cfg.PassiveFailures,
+			serverErrors: cfg.Passive5xx,
+		},
+		cutoverSettings: cutoverSettings{
+			steps:         cutoverSteps,
+			bake:          cfg.CutoverBake,
+			errorDelta:    cfg.CutoverErrorDelta,
+			latencyFactor: cfg.CutoverLatencyFactor,
+			minRequests:   cfg.CutoverMinRequests,
+		},
+		outlier: outlierSettings{
+			interval:      cfg.OutlierInterval,
+			errorFactor:   cfg.OutlierErrorFactor,
+			latencyFactor: cfg.OutlierLatencyFactor,
+			minRequests:   cfg.OutlierMinRequests,
+			cooldown:      cfg.OutlierCooldown,
+			ramp:          cfg.OutlierRamp,
+			maxEjected:    cfg.OutlierMaxEjected,
+		},
+	}
+	if cfg.BackendHTTP3 {
+		lb.transport = newHTTP3Fallback(backendTLS, timeouts, lb.transport, lb.logf)
+	}
+
+	// Sockets handed over by the process this one upgrades take the place of
+	// new ones
+	lb.upgrades, err = newUpgrader(cfg.UpgradeTimeout, cfg.PIDFile, lb.logf, lb.errorf)
+	if err != nil {
+		return err
+	}
+
+	// Accept reverse tunnels from backends behind NAT
+	if cfg.TunnelPort != 0 {
+		if cfg.TunnelToken == "" && cfg.TunnelClientCA == "" {
+			return errors.New("-tunnel-port requires -tunnel-token or -tunnel-client-ca")
+		}
+		var tunnelTLS *tls.Config
+		if cfg.TunnelTLSCert != "" || cfg.TunnelClientCA != "" {
+			opts := tlsOptions{certFile: cfg.TunnelTLSCert, keyFile: cfg.TunnelTLSKey, clientCAFile: cfg.TunnelClientCA}
+			if cfg.TunnelClientCA != "" {
+				opts.clientAuth = clientAuthRequire
+			}
+			if tunnelTLS, err = buildTLSConfig(opts); err != nil {
+				return fmt.Errorf("tunnel listener: %w", err)
+			}
+		}
+		registry := newTunnelRegistry(cfg.TunnelToken, lb.errorf)
+		transport.RegisterProtocol(tunnelScheme, newTunnelTransport(registry, transport, timeouts.dial))
+		healthTransport.RegisterProtocol(tunnelScheme, newTunnelTransport(registry, healthTransport, cfg.HealthTimeout))
+		ln, err := lb.upgrades.listen("tunnel", nil, []string{fmt.Sprintf(":%d", cfg.TunnelPort)}, false, nil)
+		if err != nil {
+			return err
+		}
+		if tunnelTLS != nil {
+			ln = tls.NewListener(ln, tunnelTLS)
+		}
+		// After an upgrade the new process accepts the tunnels, and the agents
+		// reconnect to it once their idle connections here are closed
+		lb.upgrades.drainOnUpgrade(func(context.Context) error {
+			err := ln.Close()
+			registry.Close()
+			return err
+		})
+		logger.Printf("Tunnel listener starting on port %d", cfg.TunnelPort)
+		go func() {
+			if err := registry.Serve(ln); !errors.Is(err, net.ErrClosed) {
+				logger.Fatal(err)
+			}
+		}()
+	} else if hasTunnelBackends(lb.allServers()) {
+		return errors.New("tunnel:// backends require -tunnel-port")
+	}
+
+	if cfg.CacheStats {
+		lb.cacheStats = newCacheStats()
+	}
+
+	store, err := newStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	lb.rateLimitWarn = cfg.RateLimitWarn
+	if cfg.RateLimit > 0 {
+		lb.rateLimit = newTokenBucket(cfg.RateLimit, cfg.RateBurst, time.Now())
+		lb.rateLimit.store, lb.rateLimit.key = sharedStore(store), storeKey("ratelimit", "global")
+	}
+	if cfg.ClientRateLimit > 0 || len(cfg.ClientRateOverrides) > 0 {
+		overrides, err := parseClientRateOverrides(cfg.ClientRateOverrides)
+		if err != nil {
+			return err
+		}
+		lb.clientRateLimit = newClientLimiter(cfg.ClientRateLimit, cfg.ClientRateBurst, overrides, cfg.ClientRateMaxClients)
+		lb.clientRateLimit.store = sharedStore(store)
+	}
+
+	lb.drainNotify, err = parseDrainCall(cfg.DrainNotify)
+	if err != nil {
+		return err
+	}
+	lb.undrainNotify, err = parseDrainCall(cfg.UndrainNotify)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.AuthRoutes) > 0 {
+		routes, err := parseAuthRoutes(cfg.AuthRoutes)
+		if err != nil {
+			return err
+		}
+		jwt, err := loadJWTVerifier(cfg.AuthJWTSecret, cfg.AuthJWTPublicKey, cfg.AuthJWTIssuer, cfg.AuthJWTAudience)
+		if err != nil {
+			return err
+		}
+		keys, err := loadAPIKeys(cfg.AuthAPIKeys)
+		if err != nil {
+			return err
+		}
+		lb.auth = &authenticator{
+			routes:       routes,
+			jwt:          jwt,
+			apiKeys:      keys,
+			apiKeyHeader: cfg.AuthAPIKeyHeader,
+			cache:        newAuthCache(cfg.AuthCacheTTL, cfg.AuthCacheSize),
+		}
+		if err := lb.auth.validate(); err != nil {
+			return err
+		}
+	}
+
+	lb.responseHeaders, err = parseResponseHeaders(cfg.ResponseHeaders)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Gzip {
+		lb.compression = newCompression(cfg.GzipMinSize, cfg.GzipTypes)
+	}
+
+	if cfg.CacheSize > 0 {
+		ttls, err := parseCacheTTLs(cfg.CacheTTLs)
+		if err != nil {
+			return err
+		}
+		lb.cache = newResponseCache(cfg.CacheSize, cfg.CacheMaxObject, ttls)
+		lb.cache.staleWhileRevalidate = cfg.CacheStaleWhileRevalidate
+		lb.cache.staleIfError = cfg.CacheStaleIfError
+	}
+
+	lb.coalescer, err = newCoalescer(cfg.Coalesce, cfg.CoalesceMaxBody, cfg.AuthAPIKeyHeader)
+	if err != nil {
+		return err
+	}
+
+	lb.maxBody = cfg.MaxBodySize
+	lb.bodyLimits, err = parseBodyLimits(cfg.BodyLimits)
+	if err != nil {
+		return err
+	}
+
+	lb.plugins, err = loadPlugins(cfg.Plugins, cfg.PluginMemoryLimit)
+	if err != nil {
+		return err
+	}
+	lb.pluginTimeout = cfg.PluginTimeout
+
+	lb.adminAuth, err = newAdminAuth(cfg.AdminToken, cfg.AdminBasicAuth)
+	if err != nil {
+		return err
+	}
+	lb.selfHealth = cfg.SelfHealth
+
+	if len(cfg.AllowIPs) > 0 || len(cfg.DenyIPs) > 0 {
+		lb.ipFilter, err = parseIPFilter(cfg.AllowIPs, cfg.DenyIPs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.CORSOrigins) > 0 {
+		lb.cors, err = newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSExposeHeaders, cfg.CORSCredentials, cfg.CORSMaxAge)
+		if err != nil {
+			return err
+		}
+	}
+
+	lb.errorPages, err = parseErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return err
+	}
+	lb.noRouteResponse, err = loadUnavailableResponse(cfg.NoRouteResponse)
+	if err != nil {
+		return err
+	}
+	lb.noBackendResponse, err = loadUnavailableResponse(cfg.NoBackendResponse)
+	if err != nil {
+		return err
+	}
+
+	lb.compat, err = newCompatProbe(cfg.CompatVersionHeader, cfg.CompatVersion, cfg.CompatEndpoints, cfg.CompatTLS, backendTLS, cfg.HealthTimeout)
+	if err != nil {
+		return err
+	}
+
+	lb.SetLogger(logger)
+	lb.syslog = syslogOut
+	if cfg.LogThrottle > 0 {
+		lb.logThrottle = newLogThrottle(cfg.LogThrottle, lb.logErrorf)
+		lb.logThrottle.flushEvery(cfg.LogThrottle)
+	}
+
+	lb.logSampler = newLogSampler(cfg.LogSample, cfg.LogSampleStatus)
+	switch {
+	case cfg.AccessLog == accessLogSyslog:
+		if syslogOut == nil {
+			return errors.New("-access-log syslog requires -syslog")
+		}
+		lb.accessLog = syslogAccessLog{syslog: syslogOut}
+	case cfg.AccessLog != "":
+		file, err := openAccessLog(accessLogSettings{
+			path:       cfg.AccessLog,
+			maxSize:    cfg.AccessLogMaxSize,
+			maxAge:     cfg.AccessLogMaxAge,
+			maxBackups: cfg.AccessLogMaxBackups,
+		})
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		file.reopenOnSignal(lb.logf)
+		lb.accessLog = file
+	}
+
+	// Attach circuit breakers
+	breaker := breakerSettings{
+		failures:    cfg.BreakerFailures,
+		errorRate:   cfg.BreakerErrorRate,
+		minRequests: cfg.BreakerMinRequests,
+		window:      cfg.BreakerWindow,
+		cooldown:    cfg.BreakerCooldown,
+	}
+	lb.breaker = breaker
+	if breaker.enabled() {
+		for _, server := range lb.allServers() {
+			server.breaker = newCircuitBreaker(breaker)
+		}
+	}
+
+	if cfg.Advisor > 0 {
+		lb.advisor = newAdvisor(advisorSettings{
+			responseHeaderTimeout: cfg.ResponseHeaderTimeout,
+			requestTimeout:        cfg.RequestTimeout,
+			maxConcurrent:         cfg.MaxConcurrent,
+			maxIdlePerHost:        cfg.MaxIdleConnsPerHost,
+			maxHeaderBytes:        cfg.MaxHeaderBytes,
+			retryMaxBody:          cfg.RetryMaxBody,
+		}, cfg.Advisor, time.Now())
+		time.AfterFunc(cfg.Advisor, func() { lb.finishAdvisor(cfg.AdvisorOutput) })
+	}
+
+	if cfg.UsageHeader != "" {
+		lb.usage = newUsageTracker(cfg.UsageHeader, time.Duration(cfg.UsagePeriod)*time.Second, cfg.UsageRetain, cfg.UsageMaxTenants)
+	}
+
+	// Load feature flags
+	if cfg.FlagsFile != "" {
+		lb.flags.watchFile(cfg.FlagsFile, time.Duration(cfg.FlagsPoll)*time.Second, lb.logf)
+	}
+	if cfg.FlagsURL != "" {
+		lb.flags.pollURL(cfg.FlagsURL, time.Duration(cfg.FlagsPoll)*time.Second, lb.logf)
+	}
+
+	// Schedule health checks
+	lb.ScheduleHealthChecks(time.Duration(cfg.HealthCheckInterval) * time.Second)
+
+	// Fill discovered pools before serving, then keep them up to date
+	lb.discoveries = discoveries
+	for _, d := range discoveries {
+		lb.refreshDiscovery(d)
+	}
+	lb.ScheduleDiscovery(cfg.DiscoveryInterval)
+
+	if lb.outlier.enabled() {
+		lb.ScheduleOutlierDetection()
+	}
+
+	if cfg.SyntheticFile != "" {
+		lb.synthetics, err = loadSynthetics(cfg.SyntheticFile)
+		if err != nil {
+			return err
+		}
+		lb.ScheduleSynthetics()
+	}
+
+	// With an admin port, stats and the admin API are served there only, and
+	// the main listener forwards their paths to backends like any other
+	frontend := frontendSettings{
+		readHeaderTimeout: cfg.ReadHeaderTimeout,
+		readTimeout:       cfg.ReadTimeout,
+		writeTimeout:      cfg.WriteTimeout,
+		idleTimeout:       cfg.IdleTimeout,
+		maxHeaderBytes:    cfg.MaxHeaderBytes,
+		errorLog:          logger,
+	}
+	lb.upgrades.watch()
+	if cfg.AdminPort != 0 {
+		lb.adminSeparate = true
+		lb.adminLocal = loopbackHost(cfg.AdminHost)
+		adminServer := frontend.newServer(lb.adminListenerHandler())
+		adminLn, err := lb.upgrades.listen("admin", nil, []string{net.JoinHostPort(cfg.AdminHost, strconv.Itoa(cfg.AdminPort))}, false, nil)
+		if err != nil {
+			return err
+		}
+		lb.upgrades.drainOnUpgrade(adminServer.Shutdown)
+		go func() {
+			logger.Printf("Admin listener starting on %s", adminLn.Addr())
+			if err := lb.upgrades.wait(adminServer.Serve(adminLn)); err != nil {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
+	// Profiles and runtime statistics are only served on the opt-in debug port
+	if cfg.DebugPort != 0 {
+		debugServer := frontend.newServer(lb.debugHandler())
+		// CPU profiles and traces stream for longer than responses may take
+		debugServer.WriteTimeout = 0
+		debugLn, err := lb.upgrades.listen("debug", nil, []string{net.JoinHostPort(cfg.DebugHost, strconv.Itoa(cfg.DebugPort))}, false, nil)
+		if err != nil {
+			return err
+		}
+		lb.upgrades.drainOnUpgrade(debugServer.Shutdown)
+		go func() {
+			logger.Printf("Debug listener starting on %s", debugLn.Addr())
+			if err := lb.upgrades.wait(debugServer.Serve(debugLn)); err != nil {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
+	// In TCP mode raw connections are proxied and stats are served on the admin port
+	if cfg.Mode == modeTCP {
+		ln, err := lb.upgrades.listen("plain", activated.plain, bind.addrs(port), cfg.ProxyProtocol, proxies)
+		if err != nil {
+			return err
+		}
+		lb.upgrades.drainOnUpgrade(func(ctx context.Context) error {
+			ln.Close()
+			return lb.waitTCPConns(ctx)
+		})
+		logger.Printf("TCP load balancer starting on %s", ln.Addr())
+		lb.upgrades.ready()
+		return lb.upgrades.wait(lb.ServeTCP(ln))
+	}
+
+	// Print startup information
+	if len(listeners) == 0 && len(activated.plain) == 0 {
+		logger.Printf("Load balancer starting on port %d", port)
+	}
+	logger.Printf("Health check path: %s", cfg.HealthCheckPath)
+	logger.Printf("Health check interval: %d seconds", cfg.HealthCheckInterval)
+
+	// Serve HTTPS with automatic certificates when ACME domains are configured,
+	// or with a static certificate. With ACME the plain HTTP listener also
+	// answers HTTP-01 challenges.
+	var handler http.Handler = lb
+	opts := tlsOptions{
+		certFile:     cfg.TLSCert,
+		keyFile:      cfg.TLSKey,
+		clientCAFile: cfg.ClientCA,
+		clientAuth:   cfg.ClientAuth,
+	}
+	if len(cfg.ACMEDomains) > 0 {
+		opts.acme = newACMEManager(cfg.ACMEDomains, cfg.ACMECache, cfg.ACMEEmail)
+		handler = opts.acme.HTTPHandler(lb)
+		logger.Printf("ACME enabled for domains: %v", []string(cfg.ACMEDomains))
+	}
+	// Listeners given with -listen replace the -port and -tls-port ones
+	if len(listeners) > 0 {
+		return lb.upgrades.wait(lb.serveListeners(listeners, frontend, opts, proxies))
+	}
+	if cfg.TLSEnabled() {
+		tlsConfig, err := buildTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+		tlsAddrs := bind.addrs(cfg.TLSPort)
+		tlsLn, err := lb.upgrades.listen("tls", activated.tls, tlsAddrs, cfg.ProxyProtocol, proxies)
+		if err != nil {
+			return err
+		}
+		// Optionally serve HTTP/3 on the same port over UDP, advertised via Alt-Svc
+		var tlsHandler http.Handler = lb
+		if cfg.HTTP3 {
+			h3Addr := fmt.Sprintf(":%d", cfg.TLSPort)
+			if len(tlsAddrs) == 1 {
+				h3Addr = tlsAddrs[0]
+			}
+			h3Conn, err := lb.upgrades.listenPacket(h3Addr)
+			if err != nil {
+				return err
+			}
+			h3 := newHTTP3Server(h3Addr, cfg.TLSPort, lb, tlsConfig)
+			tlsHandler = altSvcHandler(h3, lb)
+			// QUIC connections live in this process and cannot be handed over
+			lb.upgrades.drainOnUpgrade(func(context.Context) error { return h3.Close() })
+			go serveHTTP3(h3, h3Conn, logger)
+		}
+		tlsServer := frontend.newServer(tlsHandler)
+		lb.upgrades.drainOnUpgrade(tlsServer.Shutdown)
+		go serveTLS(tlsLn, tlsServer, tlsConfig, logger)
+	}
+
+	// Start the HTTP server
+	ln, err := lb.upgrades.listen("plain", activated.plain, bind.addrs(port), cfg.ProxyProtocol, proxies)
+	if err != nil {
+		return err
+	}
+	server := frontend.newServer(handler)
+	lb.upgrades.drainOnUpgrade(server.Shutdown)
+	lb.upgrades.ready()
+	return lb.upgrades.wait(server.Serve(ln))
+}
+
+// StringSliceFlag is a custom flag for handling multiple string values
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return fmt.Sprintf("%v", []string(*s))
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -1,9 +1,10 @@
-package main
+package loadbalancer
 
 import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 )
@@ -57,6 +58,36 @@ func TestNextServer(t *testing.T) {
 	}
 }
 
+func TestNextServerConcurrent(t *testing.T) {
+	servers := []*Server{
+		{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true},
+		{URL: &url.URL{Scheme: "http", Host: "localhost:8081"}, Alive: true},
+		{URL: &url.URL{Scheme: "http", Host: "localhost:8082"}, Alive: true},
+	}
+	lb := &LoadBalancer{servers: servers, current: -1}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				lb.recordRequest(lb.NextServer())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := lb.totalRequests.Load(); got != 2400 {
+		t.Errorf("Expected 2400 requests, got %d", got)
+	}
+	for _, server := range servers {
+		if got := server.requests.Load(); got != 800 {
+			t.Errorf("Expected an even split of 800 requests to %s, got %d", server.URL.Host, got)
+		}
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	// Create a test server
 	testServer := http.NewServeMux()
@@ -0,0 +1,46 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// logSampler logs 1 in every few requests that succeeded, and every request
+// answered with an error status, so request logging stays cheap under heavy
+// traffic without losing the failures
+type logSampler struct {
+	every     uint64 // 1 in every this many successful requests is logged
+	minStatus int    // Statuses from which every request is logged
+
+	seen atomic.Uint64 // Requests so far
+}
+
+// logSampleKey marks in the request context whether the request is logged
+// should it succeed
+type logSampleKey struct{}
+
+// newLogSampler creates a sampler, or returns nil when every request is
+// logged
+func newLogSampler(every, minStatus int) *logSampler {
+	if every <= 1 {
+		return nil
+	}
+	return &logSampler{every: uint64(every), minStatus: minStatus}
+}
+
+// pick reports whether an arriving request is logged should it succeed:
+// the first request, then one in every s.every
+func (s *logSampler) pick() bool {
+	return (s.seen.Add(1)-1)%s.every == 0
+}
+
+// logsRequest reports whether the lines logged for a request answered with
+// the status are written. The request log and the response log of a request
+// are either both written or both left out.
+func (lb *LoadBalancer) logsRequest(r *http.Request, status int) bool {
+	if lb.logSampler == nil || status >= lb.logSampler.minStatus {
+		return true
+	}
+	picked, _ := r.Context().Value(logSampleKey{}).(bool)
+	return picked
+}
@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	if newLogSampler(1, 400) != nil {
+		t.Error("Expected no sampler when every request is logged")
+	}
+
+	s := newLogSampler(3, 500)
+	var picked []int
+	for i := 0; i < 7; i++ {
+		if s.pick() {
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) != 3 || picked[0] != 0 || picked[1] != 3 || picked[2] != 6 {
+		t.Errorf("Expected 1 in 3 requests to be picked, got requests %v", picked)
+	}
+
+	lb := &LoadBalancer{logSampler: s}
+	r := httptest.NewRequest("GET", "/", nil)
+	if !lb.logsRequest(r, http.StatusBadGateway) {
+		t.Error("Expected every error to be logged")
+	}
+	if lb.logsRequest(r, http.StatusNotFound) {
+		t.Error("Expected statuses below -log-sample-status to be sampled")
+	}
+	r = r.WithContext(context.WithValue(r.Context(), logSampleKey{}, true))
+	if !lb.logsRequest(r, http.StatusOK) {
+		t.Error("Expected a picked request to be logged")
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lb := &LoadBalancer{
+		servers:    []*Server{{URL: backendURL, Alive: true}},
+		current:    -1,
+		accessLog:  l,
+		logSampler: newLogSampler(10, 400),
+	}
+
+	var logged bytes.Buffer
+	lb.SetLogger(log.New(&logged, "", 0))
+
+	for i := 0; i < 20; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	}
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], `"GET /fail HTTP/1.1" 500`) {
+		t.Errorf("Expected 2 of 20 successes and the failure to be logged, got %q", lines)
+	}
+	if n := strings.Count(logged.String(), "Response from server"); n != 3 {
+		t.Errorf("Expected the response lines of the logged requests only, got %d", n)
+	}
+}
+
+func TestLogSamplingKeepsRefusedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lb := &LoadBalancer{
+		servers:    []*Server{{URL: backendURL, Alive: true}},
+		current:    -1,
+		accessLog:  l,
+		logSampler: newLogSampler(100, 400),
+		rateLimit:  newTokenBucket(0.001, 2, time.Now()),
+	}
+
+	// The first request is picked and the next succeeds unpicked; the rest
+	// are rate limited, which is an error every sampler keeps
+	for i := 0; i < 5; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	content, _ := os.ReadFile(path)
+	if n := strings.Count(string(content), `"GET / HTTP/1.1" 429 `); n != 3 {
+		t.Errorf("Expected the 3 rate limited requests to be logged, got %q", content)
+	}
+	if n := strings.Count(string(content), "\n"); n != 4 {
+		t.Errorf("Expected the picked success and the refusals to be logged, got %q", content)
+	}
+}
+
+func TestLintLogSample(t *testing.T) {
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-log-sample", "0"), lintError, "-log-sample must be at least 1") {
+		t.Error("Expected an error for a sample rate below 1")
+	}
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-log-sample", "100", "-log-sample-status", "5"), lintError, "-log-sample-status") {
+		t.Error("Expected an error for an invalid sample status")
+	}
+}
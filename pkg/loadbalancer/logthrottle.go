@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxThrottledMessages bounds the number of distinct messages tracked; once
+// reached, new messages are logged without deduplication
+const maxThrottledMessages = 1000
+
+// logThrottle suppresses identical error messages logged within a window
+// and summarizes how often they repeated once the window has passed
+type logThrottle struct {
+	window time.Duration
+	logf   func(format string, v ...any)
+
+	mu   sync.Mutex
+	seen map[string]*throttledMessage
+	now  func() time.Time
+}
+
+// throttledMessage tracks the suppressed repeats of one message
+type throttledMessage struct {
+	until    time.Time
+	repeated int
+}
+
+// newLogThrottle creates a throttle writing through logf
+func newLogThrottle(window time.Duration, logf func(format string, v ...any)) *logThrottle {
+	return &logThrottle{
+		window: window,
+		logf:   logf,
+		seen:   make(map[string]*throttledMessage),
+		now:    time.Now,
+	}
+}
+
+// Printf logs the message unless it was already logged within the window
+func (t *logThrottle) Printf(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	now := t.now()
+
+	t.mu.Lock()
+	entry, ok := t.seen[msg]
+	if ok && now.Before(entry.until) {
+		entry.repeated++
+		t.mu.Unlock()
+		return
+	}
+	if ok {
+		t.summarize(msg, entry)
+	}
+	if ok || len(t.seen) < maxThrottledMessages {
+		t.seen[msg] = &throttledMessage{until: now.Add(t.window)}
+	}
+	t.mu.Unlock()
+
+	t.logf("%s", msg)
+}
+
+// summarize logs how often a message was suppressed. Must hold t.mu.
+func (t *logThrottle) summarize(msg string, entry *throttledMessage) {
+	if entry.repeated > 0 {
+		t.logf("%s (message repeated %d times)", msg, entry.repeated)
+	}
+}
+
+// flush summarizes and forgets messages whose window has passed
+func (t *logThrottle) flush() {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for msg, entry := range t.seen {
+		if !now.Before(entry.until) {
+			t.summarize(msg, entry)
+			delete(t.seen, msg)
+		}
+	}
+}
+
+// flushEvery summarizes suppressed messages at the end of each window
+func (t *logThrottle) flushEvery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.flush()
+		}
+	}()
+}
+
+// errorf logs an error message, deduplicating identical messages when log
+// throttling is enabled
+func (lb *LoadBalancer) errorf(format string, v ...any) {
+	if lb.logThrottle == nil {
+		lb.logErrorf(format, v...)
+		return
+	}
+	lb.logThrottle.Printf(format, v...)
+}
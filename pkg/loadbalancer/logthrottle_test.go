@@ -0,0 +1,36 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLogThrottle(t *testing.T) {
+	var lines []string
+	now := time.Now()
+	throttle := newLogThrottle(time.Minute, func(format string, v ...any) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	throttle.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		throttle.Printf("Health check failed for %s: %s", "backend:80", "connection refused")
+	}
+	throttle.Printf("Health check failed for %s: %s", "other:80", "connection refused")
+	if len(lines) != 2 {
+		t.Fatalf("Expected each distinct message once, got %q", lines)
+	}
+
+	now = now.Add(2 * time.Minute)
+	throttle.flush()
+	want := "Health check failed for backend:80: connection refused (message repeated 4 times)"
+	if len(lines) != 3 || lines[2] != want {
+		t.Fatalf("Expected a repeat summary %q, got %q", want, lines)
+	}
+
+	throttle.Printf("Health check failed for %s: %s", "backend:80", "connection refused")
+	if len(lines) != 4 {
+		t.Errorf("Expected the message to be logged again in a new window, got %q", lines)
+	}
+}
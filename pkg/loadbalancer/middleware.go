@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler to run code before and after it, or to answer
+// the request itself without calling it
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps the handler in the middlewares, the first one outermost so it
+// sees each request first
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use adds middlewares that run in order after the built-in ones, right
+// before the request is sent to a backend. They must be added before the
+// load balancer serves its first request.
+func (lb *LoadBalancer) Use(middlewares ...Middleware) {
+	lb.userMiddlewares = append(lb.userMiddlewares, middlewares...)
+}
+
+// handler returns the chain of middlewares around the proxy, building it on
+// first use
+func (lb *LoadBalancer) handler() http.Handler {
+	lb.handlerOnce.Do(func() {
+		lb.chain = Chain(http.HandlerFunc(lb.proxy), lb.middlewares()...)
+	})
+	return lb.chain
+}
+
+// middlewares returns the built-in middlewares in the order requests pass
+// them, followed by the ones added with Use
+func (lb *LoadBalancer) middlewares() []Middleware {
+	builtin := []Middleware{
+		// Every response is logged, including the ones the checks below
+		// answer themselves
+		lb.logRequests,
+		// Clients outside the allowed networks never reach a backend
+		answers(lb.ipDenied),
+		// Routes disabled through the kill switch never reach a backend
+		answers(lb.killed),
+		// Answer CORS preflights and tag cross-origin requests the policy allows
+		lb.gated(gateCORS, answers(lb.handleCORS)),
+		// Shed traffic above the configured rate before it reaches a backend
+		lb.gated(gateRateLimit, answers(lb.rateLimited)),
+		// Routes requiring authentication only accept verified clients
+		passes(lb.authenticated),
+		// Refuse request bodies above the route's size limit
+		lb.gated(gateBodyLimit, passes(lb.limitBody)),
+		// Scripts change, route or reject what passed the checks
+		lb.gated(gatePlugins, lb.runPlugins),
+	}
+	return append(builtin, lb.userMiddlewares...)
+}
+
+// answers makes a middleware of a check that reports whether it answered
+// the request itself
+func answers(check func(http.ResponseWriter, *http.Request) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !check(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// passes makes a middleware of a check that reports whether the request may
+// continue, having answered it otherwise
+func passes(check func(http.ResponseWriter, *http.Request) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if check(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// logRequests logs each incoming request with its headers, or writes a line
+// per request to the access log file when one is configured. With sampling
+// the request is logged once its response status is known.
+func (lb *LoadBalancer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lb.accessLog == nil && lb.logSampler == nil {
+			lb.logf("%s", lb.requestLogLine(r))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if lb.logSampler != nil {
+			r = r.WithContext(context.WithValue(r.Context(), logSampleKey{}, lb.logSampler.pick()))
+		}
+		start := time.Now()
+		record := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(record, r)
+		if !lb.logsRequest(r, record.status) {
+			lb.metrics().IncCounter("lb_request_logs_sampled_out_total", nil)
+			return
+		}
+		if lb.accessLog == nil {
+			lb.logf("%s", lb.requestLogLine(r))
+			return
+		}
+		line := accessLogLine(lb.trustedProxies.clientIP(r), r, record.status, record.bytes, start, time.Since(start))
+		if _, err := lb.accessLog.Write([]byte(line)); err != nil {
+			lb.errorf("Error writing access log: %s", err)
+		}
+	})
+}
+
+// requestLogLine describes a request with its headers for the log
+func (lb *LoadBalancer) requestLogLine(r *http.Request) string {
+	var requestLog strings.Builder
+	fmt.Fprintf(&requestLog, "Received request from %s\n%s %s %s", lb.trustedProxies.clientIP(r), r.Method, r.URL.Path, r.Proto)
+	for name, headers := range r.Header {
+		for _, h := range headers {
+			fmt.Fprintf(&requestLog, "\n%s: %s", name, h)
+		}
+	}
+	return requestLog.String()
+}
@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	named := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), named("first"), named("second"))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []string{"first", "second", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("Expected %v, got %v", want, order)
+	}
+}
+
+func TestUseMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Tenant"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	filter, err := parseIPFilter(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := New(backendURL)
+	lb.ipFilter = filter
+	var seen int
+	lb.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen++
+			if r.URL.Path == "/blocked" {
+				http.Error(w, "blocked", http.StatusTeapot)
+				return
+			}
+			r.Header.Set("X-Tenant", "acme")
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	serve := func(path, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = client + ":1234"
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("/", "198.51.100.7"); rec.Code != http.StatusOK || rec.Body.String() != "acme" {
+		t.Errorf("Expected the middleware to change the proxied request, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := serve("/blocked", "198.51.100.7"); rec.Code != http.StatusTeapot {
+		t.Errorf("Expected the middleware to answer the request itself, got %d", rec.Code)
+	}
+	if rec := serve("/", "203.0.113.9"); rec.Code != http.StatusForbidden || seen != 2 {
+		t.Errorf("Expected the IP filter to refuse the request before the middleware, got %d after %d calls", rec.Code, seen)
+	}
+}
@@ -0,0 +1,207 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shadowHeader marks requests sent to the shadow pool, so shadow backends
+// can skip side effects such as sending emails
+const shadowHeader = "X-LB-Shadow"
+
+// mirrorSettings configure traffic mirroring
+type mirrorSettings struct {
+	percent     float64       // Share of requests copied to the shadow pool
+	maxBody     int64         // Largest request or response body buffered for mirroring
+	timeout     time.Duration // Time a shadow request may take
+	concurrency int           // Shadow requests in flight before further copies are dropped
+}
+
+// mirror asynchronously copies a share of live requests to a shadow pool
+// and discards its responses. Outcomes are compared with the primary
+// responses.
+type mirror struct {
+	pool     *Pool
+	settings mirrorSettings
+	slots    chan struct{}
+}
+
+// newMirror creates a mirror to the pool
+func newMirror(pool *Pool, settings mirrorSettings) *mirror {
+	return &mirror{pool: pool, settings: settings, slots: make(chan struct{}, max(settings.concurrency, 1))}
+}
+
+// mirrorRoute returns the route a request is compared under, its first
+// path segment, which keeps the number of routes bounded
+func mirrorRoute(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + segment
+}
+
+// shadowRequest follows a mirrored request until both the primary and the
+// shadow response are known
+type shadowRequest struct {
+	lb     *LoadBalancer
+	route  string
+	start  time.Time
+	result chan mirrorResult
+	body   *bytes.Buffer // Primary response body kept for comparison, nil when bodies are not compared
+	limit  int64
+}
+
+// mirrorRequest copies the request to the shadow pool for the configured
+// share of traffic. The request body is buffered so both backends receive
+// it. It returns nil when the request is not mirrored.
+func (lb *LoadBalancer) mirrorRequest(r *http.Request) *shadowRequest {
+	m := lb.mirror
+	if m == nil || isProtocolUpgrade(r) || rand.Float64()*100 >= m.settings.percent {
+		return nil
+	}
+	labels := map[string]string{"pool": m.pool.name}
+	drop := func(reason string) *shadowRequest {
+		lb.metrics().IncCounter("lb_mirror_dropped_total", map[string]string{"pool": m.pool.name, "reason": reason})
+		return nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > m.settings.maxBody {
+		return drop("body_too_large")
+	}
+	server := m.pool.NextServer()
+	if server == nil {
+		return drop("no_healthy_upstream")
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		server.release()
+		return drop("busy")
+	}
+	if !server.startRequest() {
+		<-m.slots
+		server.release()
+		return drop("busy")
+	}
+
+	var body []byte
+	if r.ContentLength > 0 {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.settings.maxBody))
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			server.finishRequest()
+			<-m.slots
+			server.release()
+			return drop("body_unreadable")
+		}
+	}
+
+	s := &shadowRequest{
+		lb:     lb,
+		route:  mirrorRoute(r.URL.Path),
+		start:  time.Now(),
+		result: make(chan mirrorResult, 1),
+		limit:  m.settings.maxBody,
+	}
+	if lb.mirrorDiff != nil && lb.mirrorDiff.rules.compareBody {
+		s.body = &bytes.Buffer{}
+	}
+
+	// The shadow request outlives the client's, so it is detached from
+	// its cancellation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.settings.timeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.Header.Set(shadowHeader, "1")
+	lb.metrics().IncCounter("lb_mirrored_total", labels)
+	go func() {
+		defer cancel()
+		defer func() { <-m.slots }()
+		defer server.finishRequest()
+		s.result <- lb.sendShadow(shadow, server, s.body != nil)
+	}()
+	return s
+}
+
+// sendShadow sends a shadow request and discards the response, keeping only
+// what is needed to compare it with the primary response
+func (lb *LoadBalancer) sendShadow(r *http.Request, server *Server, hashBody bool) mirrorResult {
+	start := time.Now()
+	resp, err := lb.attempt(r, server)
+	if err != nil {
+		lb.logf("Shadow request to %s failed: %s", server.URL.Host, err)
+		return mirrorResult{Err: err, Latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	result := mirrorResult{Status: resp.StatusCode}
+	if hashBody && lb.mirrorDiff != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, lb.mirror.settings.maxBody))
+		if err != nil {
+			return mirrorResult{Err: err, Latency: time.Since(start)}
+		}
+		result.BodyHash = lb.mirrorDiff.rules.hashBody(body)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return mirrorResult{Err: err, Latency: time.Since(start)}
+	}
+	result.Latency = time.Since(start)
+	return result
+}
+
+// capture keeps up to the body limit of the primary response body as it is
+// sent to the client, when bodies are compared
+func (s *shadowRequest) capture(body io.ReadCloser) io.ReadCloser {
+	if s == nil || s.body == nil {
+		return body
+	}
+	return &capturingBody{ReadCloser: body, buf: s.body, limit: s.limit}
+}
+
+// finish records the primary outcome and compares it with the shadow one
+// once it arrives
+func (s *shadowRequest) finish(status int, err error) {
+	if s == nil || s.lb.mirrorDiff == nil {
+		return
+	}
+	primary := mirrorResult{Status: status, Err: err, Latency: time.Since(s.start)}
+	if s.body != nil {
+		primary.BodyHash = s.lb.mirrorDiff.rules.hashBody(s.body.Bytes())
+	}
+	go func() {
+		shadow := <-s.result
+		s.lb.mirrorDiff.record(s.route, primary, shadow)
+		if shadow.Err != nil {
+			s.lb.metrics().IncCounter("lb_mirror_errors_total", map[string]string{"pool": s.lb.mirror.pool.name})
+		}
+	}()
+}
+
+// capturingBody copies what is read from a body into a buffer, up to a
+// limit
+type capturingBody struct {
+	io.ReadCloser
+	buf   *bytes.Buffer
+	limit int64
+}
+
+func (c *capturingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		c.buf.Write(p[:min(int64(n), room)])
+	}
+	return n, err
+}
+
+// parseMirrorPercent validates the share of mirrored traffic
+func parseMirrorPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid mirror percentage %g, expected 0-100", percent)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorRequest(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte("primary:"), body...))
+	}))
+	defer primary.Close()
+	shadowed := make(chan string, 1)
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowed <- r.Header.Get(shadowHeader) + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowBackend.Close()
+	primaryURL, _ := url.Parse(primary.URL)
+	shadowURL, _ := url.Parse(shadowBackend.URL)
+
+	pool := newPool("shadow", []*Server{{URL: shadowURL, Alive: true}})
+	lb := &LoadBalancer{
+		servers:    []*Server{{URL: primaryURL, Alive: true}},
+		current:    -1,
+		pools:      map[string]*Pool{"shadow": pool},
+		mirror:     newMirror(pool, mirrorSettings{percent: 100, maxBody: 1024, timeout: time.Second, concurrency: 1}),
+		mirrorDiff: newMirrorDiff(diffRules{}),
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/orders/1", strings.NewReader("hello")))
+	if w.Code != http.StatusOK || w.Body.String() != "primary:hello" {
+		t.Errorf("Expected the primary response, got %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case got := <-shadowed:
+		if got != "1 hello" {
+			t.Errorf("Expected the shadow to receive the marked request body, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+
+	// The shadow's 500 is counted as a divergence on the route
+	deadline := time.Now().Add(time.Second)
+	for lb.mirrorDiff.snapshot()["/orders"].Compared == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := lb.mirrorDiff.snapshot()["/orders"]; stats.Compared != 1 || stats.StatusMismatch != 1 {
+		t.Errorf("Expected one status mismatch, got %+v", stats)
+	}
+}
+
+func TestMirrorRequestSkipped(t *testing.T) {
+	shadowURL, _ := url.Parse("http://localhost:9000")
+	pool := newPool("shadow", []*Server{{URL: shadowURL, Alive: true}})
+	lb := &LoadBalancer{mirror: newMirror(pool, mirrorSettings{percent: 100, maxBody: 4, concurrency: 1})}
+
+	if s := lb.mirrorRequest(httptest.NewRequest("POST", "/", strings.NewReader("too large"))); s != nil {
+		t.Errorf("Expected bodies above the limit not to be mirrored")
+	}
+	chunked := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+	chunked.ContentLength = -1
+	if s := lb.mirrorRequest(chunked); s != nil {
+		t.Errorf("Expected bodies of unknown length not to be mirrored")
+	}
+
+	lb.mirror.settings.percent = 0
+	if s := lb.mirrorRequest(httptest.NewRequest("GET", "/", nil)); s != nil {
+		t.Errorf("Expected no request to be mirrored at 0%%")
+	}
+
+	// Methods are safe on requests that are not mirrored
+	var s *shadowRequest
+	s.finish(200, nil)
+	if body := io.NopCloser(strings.NewReader("")); s.capture(body) != body {
+		t.Errorf("Expected the body to be left alone")
+	}
+}
+
+func TestCapturingBody(t *testing.T) {
+	buf := &bytes.Buffer{}
+	body := &capturingBody{ReadCloser: io.NopCloser(strings.NewReader("0123456789")), buf: buf, limit: 4}
+	if got, _ := io.ReadAll(body); string(got) != "0123456789" {
+		t.Errorf("Expected the whole body to be read, got %q", got)
+	}
+	if buf.String() != "0123" {
+		t.Errorf("Expected the first 4 bytes to be captured, got %q", buf.String())
+	}
+}
+
+func TestMirrorRoute(t *testing.T) {
+	for path, want := range map[string]string{"/": "/", "/api": "/api", "/api/users/1": "/api"} {
+		if got := mirrorRoute(path); got != want {
+			t.Errorf("mirrorRoute(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
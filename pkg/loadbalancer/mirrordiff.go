@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mirrorResult is the outcome of sending a request to the primary or shadow backend
+type mirrorResult struct {
+	Status   int
+	Latency  time.Duration
+	BodyHash string
+	Err      error
+}
+
+// diffRules control how primary and shadow responses are compared
+type diffRules struct {
+	compareBody      bool
+	latencyTolerance time.Duration    // Extra shadow latency tolerated, 0 ignores latency
+	ignore           []*regexp.Regexp // Body fragments (timestamps, IDs) removed before hashing
+}
+
+// hashBody normalises a response body with the ignore rules and hashes it
+func (rules diffRules) hashBody(body []byte) string {
+	for _, re := range rules.ignore {
+		body = re.ReplaceAll(body, nil)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// diffStats counts divergences between primary and shadow responses for a route
+type diffStats struct {
+	Compared          int64   `json:"compared"`
+	Diverged          int64   `json:"diverged"`
+	StatusMismatch    int64   `json:"status_mismatch"`
+	BodyMismatch      int64   `json:"body_mismatch"`
+	LatencyRegression int64   `json:"latency_regression"`
+	ShadowErrors      int64   `json:"shadow_errors"`
+	DivergenceRate    float64 `json:"divergence_rate"`
+}
+
+// mirrorDiff compares mirrored responses and tracks divergence per route
+type mirrorDiff struct {
+	rules  diffRules
+	mu     sync.Mutex
+	routes map[string]*diffStats
+}
+
+// newMirrorDiff creates a comparator with the given rules
+func newMirrorDiff(rules diffRules) *mirrorDiff {
+	return &mirrorDiff{
+		rules:  rules,
+		routes: make(map[string]*diffStats),
+	}
+}
+
+// record compares a primary and shadow result for a route
+func (d *mirrorDiff) record(route string, primary, shadow mirrorResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, ok := d.routes[route]
+	if !ok {
+		stats = &diffStats{}
+		d.routes[route] = stats
+	}
+	stats.Compared++
+
+	diverged := false
+	if shadow.Err != nil {
+		stats.ShadowErrors++
+		diverged = primary.Err == nil
+	} else {
+		if shadow.Status != primary.Status {
+			stats.StatusMismatch++
+			diverged = true
+		}
+		if d.rules.compareBody && shadow.BodyHash != primary.BodyHash {
+			stats.BodyMismatch++
+			diverged = true
+		}
+		if d.rules.latencyTolerance > 0 && shadow.Latency > primary.Latency+d.rules.latencyTolerance {
+			stats.LatencyRegression++
+			diverged = true
+		}
+	}
+
+	if diverged {
+		stats.Diverged++
+	}
+	stats.DivergenceRate = float64(stats.Diverged) / float64(stats.Compared)
+}
+
+// snapshot returns a copy of the per-route statistics
+func (d *mirrorDiff) snapshot() map[string]diffStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := make(map[string]diffStats, len(d.routes))
+	for route, stats := range d.routes {
+		snapshot[route] = *stats
+	}
+	return snapshot
+}
+
+// handleMirrorDiff reports divergence rates per route
+func (lb *LoadBalancer) handleMirrorDiff(w http.ResponseWriter, r *http.Request) {
+	snapshot := lb.mirrorDiff.snapshot()
+	routes := make([]string, 0, len(snapshot))
+	for route := range snapshot {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	type routeDiff struct {
+		Route string `json:"route"`
+		diffStats
+	}
+	report := make([]routeDiff, 0, len(routes))
+	for _, route := range routes {
+		report = append(report, routeDiff{Route: route, diffStats: snapshot[route]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
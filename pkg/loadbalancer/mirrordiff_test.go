@@ -0,0 +1,39 @@
+package loadbalancer
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMirrorDiffRecord(t *testing.T) {
+	rules := diffRules{
+		compareBody:      true,
+		latencyTolerance: 50 * time.Millisecond,
+		ignore:           []*regexp.Regexp{regexp.MustCompile(`"ts":\d+`)},
+	}
+	d := newMirrorDiff(rules)
+
+	primary := mirrorResult{Status: 200, Latency: 10 * time.Millisecond, BodyHash: rules.hashBody([]byte(`{"ts":1,"v":1}`))}
+
+	// Identical after normalisation
+	d.record("/api", primary, mirrorResult{Status: 200, Latency: 20 * time.Millisecond, BodyHash: rules.hashBody([]byte(`{"ts":2,"v":1}`))})
+	// Status mismatch
+	d.record("/api", primary, mirrorResult{Status: 500, Latency: 10 * time.Millisecond, BodyHash: primary.BodyHash})
+	// Body mismatch and latency regression
+	d.record("/api", primary, mirrorResult{Status: 200, Latency: 100 * time.Millisecond, BodyHash: rules.hashBody([]byte(`{"ts":1,"v":2}`))})
+	// Shadow error
+	d.record("/api", primary, mirrorResult{Err: errors.New("connection refused")})
+
+	stats := d.snapshot()["/api"]
+	if stats.Compared != 4 || stats.Diverged != 3 {
+		t.Errorf("Expected 4 compared and 3 diverged, got %d and %d", stats.Compared, stats.Diverged)
+	}
+	if stats.StatusMismatch != 1 || stats.BodyMismatch != 1 || stats.LatencyRegression != 1 || stats.ShadowErrors != 1 {
+		t.Errorf("Unexpected divergence breakdown: %+v", stats)
+	}
+	if stats.DivergenceRate != 0.75 {
+		t.Errorf("Expected divergence rate 0.75, got %f", stats.DivergenceRate)
+	}
+}
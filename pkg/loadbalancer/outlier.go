@@ -0,0 +1,205 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Minimum absolute deviations from the peers before a backend counts as an
+// outlier, so tiny differences between healthy backends are ignored
+const (
+	outlierMinErrorRate = 0.05
+	outlierMinLatency   = 10 * time.Millisecond
+)
+
+// outlierSettings configure outlier detection, which ejects backends whose
+// 5xx rate or latency deviates from their peers in the same pool
+type outlierSettings struct {
+	interval      time.Duration // Evaluation window, 0 disables
+	errorFactor   float64       // Eject above this multiple of the peers' 5xx rate
+	latencyFactor float64       // Eject above this multiple of the peers' mean latency
+	minRequests   int           // Requests in a window before a backend is judged
+	cooldown      time.Duration // How long an outlier stays ejected
+	ramp          time.Duration // Time to ramp back to full weight after ejection
+	maxEjected    float64       // Largest share of a pool ejected at once
+}
+
+// enabled reports whether outlier detection is configured
+func (o outlierSettings) enabled() bool {
+	return o.interval > 0
+}
+
+// outlierStats accumulates the outcomes of one backend within a window
+type outlierStats struct {
+	mu       sync.Mutex
+	requests int
+	errors   int
+	latency  time.Duration
+
+	ejectedUntil time.Time
+	weight       int // Target weight restored after ejection
+}
+
+// record counts one request outcome
+func (o *outlierStats) record(failed bool, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests++
+	o.latency += d
+	if failed {
+		o.errors++
+	}
+}
+
+// ejected reports whether the backend is ejected at the given time
+func (o *outlierStats) ejected(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return now.Before(o.ejectedUntil)
+}
+
+// outlierSample is one backend's window, taken when it is evaluated
+type outlierSample struct {
+	server    *Server
+	requests  int
+	errorRate float64
+	latency   time.Duration // Mean time to response headers
+}
+
+// take returns the window's totals and starts a new window
+func (o *outlierStats) take(server *Server) outlierSample {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sample := outlierSample{server: server, requests: o.requests}
+	if o.requests > 0 {
+		sample.errorRate = float64(o.errors) / float64(o.requests)
+		sample.latency = o.latency / time.Duration(o.requests)
+	}
+	o.requests, o.errors, o.latency = 0, 0, 0
+	return sample
+}
+
+// outlierReason explains why the sample deviates from its peers, or returns
+// an empty string when it does not
+func (o outlierSettings) outlierReason(sample outlierSample, peers []outlierSample) string {
+	var requests, errors float64
+	var latency time.Duration
+	for _, peer := range peers {
+		requests += float64(peer.requests)
+		errors += peer.errorRate * float64(peer.requests)
+		latency += peer.latency * time.Duration(peer.requests)
+	}
+	if requests == 0 {
+		return ""
+	}
+	peerRate := errors / requests
+	peerLatency := time.Duration(float64(latency) / requests)
+
+	if o.errorFactor > 0 && sample.errorRate > peerRate*o.errorFactor && sample.errorRate-peerRate >= outlierMinErrorRate {
+		return fmt.Sprintf("5xx rate %.0f%% against %.0f%% for its peers", sample.errorRate*100, peerRate*100)
+	}
+	if o.latencyFactor > 0 && float64(sample.latency) > float64(peerLatency)*o.latencyFactor && sample.latency-peerLatency >= outlierMinLatency {
+		return fmt.Sprintf("mean latency %s against %s for its peers", sample.latency.Round(time.Millisecond), peerLatency.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// outlierGroups returns the default servers and each pool, the groups
+// whose backends are compared with each other
+func (lb *LoadBalancer) outlierGroups() [][]*Server {
+	groups := [][]*Server{lb.servers}
+	names := make([]string, 0, len(lb.pools))
+	for name := range lb.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		groups = append(groups, lb.pools[name].servers())
+	}
+	return groups
+}
+
+// detectOutliers closes the current window: ejected backends whose cooldown
+// has passed are reinstated and new outliers are ejected
+func (lb *LoadBalancer) detectOutliers(now time.Time) {
+	for _, group := range lb.outlierGroups() {
+		ejected := 0
+		var samples []outlierSample
+		for _, server := range group {
+			sample := server.outlier.take(server)
+			if lb.reinstateOutlier(server, now) {
+				continue
+			}
+			if server.outlier.ejected(now) {
+				ejected++
+				continue
+			}
+			if server.IsAlive() && sample.requests >= max(lb.outlier.minRequests, 1) {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) < 2 {
+			continue
+		}
+
+		limit := int(float64(len(group)) * lb.outlier.maxEjected)
+		for i, sample := range samples {
+			if ejected >= limit {
+				break
+			}
+			peers := append(append([]outlierSample(nil), samples[:i]...), samples[i+1:]...)
+			reason := lb.outlier.outlierReason(sample, peers)
+			if reason == "" {
+				continue
+			}
+			lb.ejectOutlier(sample.server, now, reason)
+			ejected++
+		}
+	}
+}
+
+// ejectOutlier takes the server out of rotation for the cooldown
+func (lb *LoadBalancer) ejectOutlier(server *Server, now time.Time, reason string) {
+	server.outlier.mu.Lock()
+	server.outlier.ejectedUntil = now.Add(lb.outlier.cooldown)
+	server.outlier.weight = server.TargetWeight()
+	server.outlier.mu.Unlock()
+	server.SetWeight(0, 0)
+
+	lb.logf("Ejecting outlier %s for %s: %s", server.URL.Host, lb.outlier.cooldown, reason)
+	lb.metrics().IncCounter("lb_outlier_ejections_total", map[string]string{"backend": server.URL.Host})
+	lb.emit(EventOutlierEjected, server.URL.Host, reason)
+}
+
+// reinstateOutlier ramps an ejected server back to its weight once the
+// cooldown has passed and reports whether it did
+func (lb *LoadBalancer) reinstateOutlier(server *Server, now time.Time) bool {
+	server.outlier.mu.Lock()
+	due := !server.outlier.ejectedUntil.IsZero() && !now.Before(server.outlier.ejectedUntil)
+	weight := server.outlier.weight
+	if due {
+		server.outlier.ejectedUntil = time.Time{}
+	}
+	server.outlier.mu.Unlock()
+	if !due {
+		return false
+	}
+
+	server.SetWeight(weight, lb.outlier.ramp)
+	lb.logf("Reinstating outlier %s over %s", server.URL.Host, lb.outlier.ramp)
+	lb.emit(EventOutlierReinstated, server.URL.Host, "outlier cooldown passed")
+	return true
+}
+
+// ScheduleOutlierDetection evaluates the backends at the end of every window
+func (lb *LoadBalancer) ScheduleOutlierDetection() {
+	go func() {
+		ticker := time.NewTicker(lb.outlier.interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			lb.detectOutliers(now)
+		}
+	}()
+}
@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectionAndReinstatement(t *testing.T) {
+	var servers []*Server
+	for _, host := range []string{"a:80", "b:80", "c:80"} {
+		servers = append(servers, &Server{URL: &url.URL{Scheme: "http", Host: host}, Alive: true})
+	}
+	listener := &recordingListener{}
+	lb := &LoadBalancer{
+		servers: servers,
+		outlier: outlierSettings{
+			interval:      time.Second,
+			errorFactor:   3,
+			latencyFactor: 3,
+			minRequests:   10,
+			cooldown:      time.Minute,
+			ramp:          time.Minute,
+			maxEjected:    0.5,
+		},
+	}
+	lb.AddEventListener(listener)
+
+	// b passes health checks but fails a third of its requests
+	for i := 0; i < 30; i++ {
+		lb.observeOutcome(servers[0], 200, nil, 10*time.Millisecond)
+		status := 200
+		if i%3 == 0 {
+			status = 500
+		}
+		lb.observeOutcome(servers[1], status, nil, 10*time.Millisecond)
+		lb.observeOutcome(servers[2], 200, nil, 12*time.Millisecond)
+	}
+
+	now := time.Now()
+	lb.detectOutliers(now)
+	if !servers[1].outlier.ejected(now) || servers[1].available(now) {
+		t.Fatalf("Expected b to be ejected")
+	}
+	if servers[0].outlier.ejected(now) || servers[2].outlier.ejected(now) {
+		t.Errorf("Expected only b to be ejected")
+	}
+	if len(listener.events) != 1 || listener.events[0].Type != EventOutlierEjected {
+		t.Errorf("Expected an outlier_ejected event, got %+v", listener.events)
+	}
+
+	// After the cooldown b ramps back from weight 0
+	later := now.Add(2 * time.Minute)
+	lb.detectOutliers(later)
+	if servers[1].outlier.ejected(later) {
+		t.Fatalf("Expected b to be reinstated after the cooldown")
+	}
+	if w := servers[1].Weight(); w >= 0.5 {
+		t.Errorf("Expected b to start ramping from a low weight, got %g", w)
+	}
+	if servers[1].TargetWeight() != 1 {
+		t.Errorf("Expected b to ramp back to weight 1, got %d", servers[1].TargetWeight())
+	}
+}
+
+func TestOutlierReason(t *testing.T) {
+	settings := outlierSettings{errorFactor: 3, latencyFactor: 3}
+	peers := []outlierSample{{requests: 100, errorRate: 0.01, latency: 20 * time.Millisecond}}
+	for _, tc := range []struct {
+		sample  outlierSample
+		outlier bool
+	}{
+		{outlierSample{requests: 100, errorRate: 0.02, latency: 25 * time.Millisecond}, false},
+		{outlierSample{requests: 100, errorRate: 0.2, latency: 20 * time.Millisecond}, true},
+		{outlierSample{requests: 100, errorRate: 0.01, latency: 100 * time.Millisecond}, true},
+	} {
+		if got := settings.outlierReason(tc.sample, peers) != ""; got != tc.outlier {
+			t.Errorf("outlierReason(%+v) = %v, want %v", tc.sample, got, tc.outlier)
+		}
+	}
+
+	// Fast backends are not outliers just because they differ by a few ms
+	peers = []outlierSample{{requests: 100, latency: time.Millisecond}}
+	if reason := settings.outlierReason(outlierSample{requests: 100, latency: 5 * time.Millisecond}, peers); reason != "" {
+		t.Errorf("Expected no outlier below the minimum latency deviation, got %q", reason)
+	}
+}
+
+func TestOutlierMaxEjected(t *testing.T) {
+	var servers []*Server
+	for _, host := range []string{"a:80", "b:80"} {
+		servers = append(servers, &Server{URL: &url.URL{Scheme: "http", Host: host}, Alive: true})
+	}
+	lb := &LoadBalancer{
+		servers: servers,
+		outlier: outlierSettings{interval: time.Second, errorFactor: 2, minRequests: 1, cooldown: time.Minute, maxEjected: 0.4},
+	}
+	for i := 0; i < 10; i++ {
+		lb.observeOutcome(servers[0], 200, nil, time.Millisecond)
+		lb.observeOutcome(servers[1], 500, nil, time.Millisecond)
+	}
+	now := time.Now()
+	lb.detectOutliers(now)
+	if servers[1].outlier.ejected(now) {
+		t.Errorf("Expected no ejection when the limit rounds down to 0")
+	}
+}
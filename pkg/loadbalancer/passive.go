@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// passiveSettings configure when live traffic takes a backend out of
+// rotation between active health checks
+type passiveSettings struct {
+	failures     int // Consecutive connection failures or timeouts, 0 disables
+	serverErrors int // Consecutive 5xx responses, 0 disables
+}
+
+// passiveHealth counts consecutive failed requests to one backend
+type passiveHealth struct {
+	mu           sync.Mutex
+	failures     int
+	serverErrors int
+}
+
+// record counts an outcome and reports whether a threshold was reached.
+// A successful request resets both counters.
+func (p *passiveHealth) record(settings passiveSettings, status int, err error) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err != nil:
+		p.failures++
+		if settings.failures > 0 && p.failures >= settings.failures {
+			p.failures, p.serverErrors = 0, 0
+			return "consecutive connection failures", true
+		}
+	case status >= 500:
+		p.serverErrors++
+		if settings.serverErrors > 0 && p.serverErrors >= settings.serverErrors {
+			p.failures, p.serverErrors = 0, 0
+			return "consecutive 5xx responses", true
+		}
+	default:
+		p.failures, p.serverErrors = 0, 0
+	}
+	return "", false
+}
+
+// observeOutcome feeds the outcome of a request to the backend's circuit
+// breaker, passive health check, quarantine and outlier statistics. The status is 0
+// when err is set and d is the time until response headers or the error.
+// Requests abandoned by the client say nothing about the backend and only
+// give up their circuit breaker probe.
+func (lb *LoadBalancer) observeOutcome(server *Server, status int, err error, d time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		server.release()
+		return
+	}
+	if q := server.quarantineState(); q != nil {
+		q.record(err != nil || status >= 500, d)
+	}
+	lb.recordOutcome(server, err == nil && status < 500)
+	if lb.outlier.enabled() {
+		server.outlier.record(err != nil || status >= 500, d)
+	}
+	lb.observeCutover(server, err != nil || status >= 500, d)
+
+	if lb.passive.failures == 0 && lb.passive.serverErrors == 0 {
+		return
+	}
+	reason, down := server.passive.record(lb.passive, status, err)
+	if !down || !server.IsAlive() {
+		return
+	}
+	lb.logf("Marking %s down after %s", server.URL.Host, reason)
+	lb.setServerAliveReason(server, false, "backend failed passive health check: "+reason)
+}
@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPassiveHealthConnectionFailures(t *testing.T) {
+	server := &Server{URL: closedServerURL(t), Alive: true}
+	lb := &LoadBalancer{
+		servers: []*Server{server},
+		current: -1,
+		passive: passiveSettings{failures: 2},
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("Expected 502 from a closed backend, got %d", w.Code)
+		}
+	}
+	if server.IsAlive() {
+		t.Errorf("Expected backend to be marked down after 2 failed requests")
+	}
+}
+
+func TestPassiveHealthServerErrors(t *testing.T) {
+	settings := passiveSettings{serverErrors: 3}
+	var p passiveHealth
+
+	p.record(settings, 503, nil)
+	p.record(settings, 503, nil)
+	p.record(settings, 200, nil)
+	if _, down := p.record(settings, 503, nil); down {
+		t.Errorf("Expected a success to reset the 5xx count")
+	}
+	p.record(settings, 500, nil)
+	if _, down := p.record(settings, 502, nil); !down {
+		t.Errorf("Expected 3 consecutive 5xx responses to mark the backend down")
+	}
+
+	// Connection failures are not counted when only 5xx is configured
+	for i := 0; i < 5; i++ {
+		if _, down := p.record(settings, 0, errors.New("refused")); down {
+			t.Errorf("Expected connection failures to be ignored")
+		}
+	}
+}
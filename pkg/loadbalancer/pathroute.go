@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// pathRoute sends requests under a path prefix to a pool, optionally
+// removing the prefix before forwarding. A route gated by a feature flag
+// only applies to requests the flag is on for.
+type pathRoute struct {
+	prefix string
+	pool   string
+	strip  bool
+	flag   string
+}
+
+// parsePathRoutes parses /path/prefix=pool[,strip][,flag=name] definitions
+func parsePathRoutes(defs []string, poolNames map[string]bool) ([]pathRoute, error) {
+	var routes []pathRoute
+	for _, def := range defs {
+		prefix, value, ok := strings.Cut(def, "=")
+		pool, options, _ := strings.Cut(value, ",")
+		if !ok || !strings.HasPrefix(prefix, "/") || pool == "" {
+			return nil, fmt.Errorf("invalid path route %q, expected /path/prefix=pool[,strip][,flag=name]", def)
+		}
+		if !poolNames[pool] {
+			return nil, fmt.Errorf("invalid path route %q: pool %s is not defined", def, pool)
+		}
+		route := pathRoute{prefix: strings.TrimSuffix(prefix, "/"), pool: pool}
+		for _, option := range splitList(options) {
+			flag, isFlag := strings.CutPrefix(option, "flag=")
+			switch {
+			case option == "strip":
+				route.strip = true
+			case isFlag && flag != "":
+				route.flag = flag
+			default:
+				return nil, fmt.Errorf("invalid path route %q, expected /path/prefix=pool[,strip][,flag=name]", def)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// matches reports whether the path is the prefix or below it. /api matches
+// /api and /api/users but not /apis.
+func (route pathRoute) matches(path string) bool {
+	return route.prefix == "" || path == route.prefix || strings.HasPrefix(path, route.prefix+"/")
+}
+
+// cleanRequestPath resolves dot segments and duplicate slashes in the path
+// before any route looks at it, keeping a trailing slash. Otherwise
+// /public/../secure would pass the checks on /public and reach a backend
+// that resolves it to /secure. The cleaned path is also the one forwarded.
+func cleanRequestPath(r *http.Request) *http.Request {
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		return r
+	}
+	cleaned := path.Clean(r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned == r.URL.Path {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path, r.URL.RawPath = cleaned, ""
+	return r
+}
+
+// rewrite removes the prefix from the path when the route strips it
+func (route pathRoute) rewrite(path string) string {
+	if !route.strip {
+		return path
+	}
+	if path = strings.TrimPrefix(path, route.prefix); path == "" {
+		return "/"
+	}
+	return path
+}
+
+// pathRouteFor returns the path route with the longest prefix matching the
+// request path whose feature flag, if any, is on for the request, or nil
+func (lb *LoadBalancer) pathRouteFor(r *http.Request) *pathRoute {
+	var best *pathRoute
+	for i, route := range lb.pathRoutes {
+		if route.matches(r.URL.Path) && (best == nil || len(route.prefix) > len(best.prefix)) && lb.flagEnabled(route.flag, r) {
+			best = &lb.pathRoutes[i]
+		}
+	}
+	return best
+}
+
+// pathPool returns the pool routed to by the request path
+func (lb *LoadBalancer) pathPool(r *http.Request) *Pool {
+	if route := lb.pathRouteFor(r); route != nil {
+		return lb.pools[route.pool]
+	}
+	return nil
+}
+
+// backendPath returns the path forwarded to the server: the result of the
+// first matching rewrite rule, or else the path with the prefix of a
+// stripping path route removed, or the path built by a template route,
+// when the server belongs to the route's pool
+func (lb *LoadBalancer) backendPath(r *http.Request, server *Server) string {
+	if path, ok := lb.rewritePath(r.URL.Path); ok {
+		return path
+	}
+	route := lb.pathRouteFor(r)
+	if route == nil {
+		if path, ok := lb.templatePath(r, server); ok {
+			return path
+		}
+		return r.URL.Path
+	}
+	if !route.strip {
+		return r.URL.Path
+	}
+	if pool := lb.pools[route.pool]; pool == nil || !slices.Contains(pool.servers(), server) {
+		return r.URL.Path
+	}
+	return route.rewrite(r.URL.Path)
+}
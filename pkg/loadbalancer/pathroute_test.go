@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPathRouting(t *testing.T) {
+	echo := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.RequestURI())
+		}))
+	}
+	web, api, static := echo("web"), echo("api"), echo("static")
+	defer web.Close()
+	defer api.Close()
+	defer static.Close()
+	server := func(backend *httptest.Server) *Server {
+		u, _ := url.Parse(backend.URL)
+		return &Server{URL: u, Alive: true}
+	}
+
+	pools := map[string]*Pool{
+		"api":    newPool("api", []*Server{server(api)}),
+		"static": newPool("static", []*Server{server(static)}),
+	}
+	routes, err := parsePathRoutes([]string{"/api/=api", "/static=static,strip"}, map[string]bool{"api": true, "static": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{servers: []*Server{server(web)}, current: -1, pools: pools, pathRoutes: routes}
+
+	for path, want := range map[string]string{
+		"/":                 "web /",
+		"/apis":             "web /apis",
+		"/api":              "api /api",
+		"/api/users?id=1":   "api /api/users?id=1",
+		"/static":           "static /",
+		"/static/css/a.css": "static /css/a.css",
+	} {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Body.String(); got != want {
+			t.Errorf("GET %s: expected %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/api/users":          "/api/users",
+		"/public/../secure/x": "/secure/x",
+		"/a/./b/":             "/a/b/",
+		"//api///users":       "/api/users",
+		"/..":                 "/",
+		"/a%2F..%2Fb":         "/b",
+	} {
+		r := httptest.NewRequest("GET", path+"?q=1", nil)
+		cleaned := cleanRequestPath(r)
+		if cleaned.URL.Path != want || cleaned.URL.RawQuery != "q=1" {
+			t.Errorf("Expected %s to clean to %s, got %s", path, want, cleaned.URL)
+		}
+		if cleaned != r && r.URL.Path == cleaned.URL.Path {
+			t.Errorf("Expected the original request of %s to be left alone", path)
+		}
+	}
+}
+
+func TestPathRouteLongestPrefix(t *testing.T) {
+	lb := &LoadBalancer{pathRoutes: []pathRoute{{prefix: "/api", pool: "v1"}, {prefix: "/api/v2", pool: "v2"}, {prefix: "", pool: "catchall"}}}
+	for path, want := range map[string]string{"/api/v2/users": "v2", "/api/users": "v1", "/other": "catchall"} {
+		if route := lb.pathRouteFor(httptest.NewRequest("GET", path, nil)); route == nil || route.pool != want {
+			t.Errorf("Expected %s to route to %s, got %+v", path, want, route)
+		}
+	}
+}
+
+func TestParsePathRoutes(t *testing.T) {
+	pools := map[string]bool{"api": true}
+	for _, def := range []string{"/api", "api=api", "/api=", "/api=missing", "/api=api,rewrite"} {
+		if _, err := parsePathRoutes([]string{def}, pools); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Functions a plugin script defines to run at each phase
+const (
+	pluginOnRequest  = "on_request"
+	pluginOnResponse = "on_response"
+)
+
+// plugin is a Lua script run for every request. on_request(req) may change
+// the request headers, pick a pool or reject the request, and
+// on_response(req, resp) may change the response headers.
+type plugin struct {
+	path        string
+	proto       *lua.FunctionProto
+	onRequest   bool
+	onResponse  bool
+	memoryLimit int64 // Bytes a call may hold, 0 for no limit
+
+	// Interpreters with the script loaded; one runs a single call at a time
+	states sync.Pool
+}
+
+// loadPlugin compiles the script and checks that it defines a phase function
+func loadPlugin(path string, memoryLimit int64) (*plugin, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(src), path)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	p := &plugin{path: path, proto: proto, memoryLimit: memoryLimit}
+	state, err := p.newState(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	p.onRequest = state.L.GetGlobal(pluginOnRequest).Type() == lua.LTFunction
+	p.onResponse = state.L.GetGlobal(pluginOnResponse).Type() == lua.LTFunction
+	if !p.onRequest && !p.onResponse {
+		return nil, fmt.Errorf("plugin %s defines neither %s nor %s", path, pluginOnRequest, pluginOnResponse)
+	}
+	p.states.Put(state)
+	return p, nil
+}
+
+// loadPlugins loads the scripts in order
+func loadPlugins(paths []string, memoryLimit int64) ([]*plugin, error) {
+	var plugins []*plugin
+	for _, path := range paths {
+		p, err := loadPlugin(path, memoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// newState returns an interpreter that ran the script. Scripts get the
+// base, table, string and math libraries but cannot reach files or the
+// operating system, and their stack and call depth are bounded.
+func (p *plugin) newState(ctx context.Context) (*pluginState, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       pluginCallStackSize,
+		RegistrySize:        pluginRegistrySize,
+		RegistryMaxSize:     pluginRegistryMaxSize,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.GetGlobal(lua.StringLibName).(*lua.LTable).RawSetString("rep", L.NewFunction(luaStringRep))
+	tableLib := L.GetGlobal(lua.TabLibName).(*lua.LTable)
+	tableLib.RawSetString("concat", L.NewFunction(luaTableConcat(tableLib.RawGetString("concat").(*lua.LFunction).GFunction)))
+	state := &pluginState{L: L, libs: make(map[lua.LValue]bool)}
+	L.G.Global.ForEach(func(_, value lua.LValue) {
+		state.libs[value] = true
+		if lib, ok := value.(*lua.LTable); ok {
+			lib.ForEach(func(_, fn lua.LValue) { state.libs[fn] = true })
+		}
+	})
+	delete(state.libs, L.G.Global)
+
+	budget := state.budget(ctx, p.memoryLimit)
+	L.SetContext(budget)
+	L.Push(L.NewFunctionFromProto(p.proto))
+	err := L.PCall(0, 0, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, p.callError(budget, err)
+	}
+	return state, nil
+}
+
+// callError describes a failed call, wrapping the memory limit or the
+// context's error when the call was aborted
+func (p *plugin) callError(budget *pluginBudget, err error) error {
+	if abort := budget.Err(); abort != nil {
+		err = abort
+	}
+	return fmt.Errorf("plugin %s: %w", p.path, err)
+}
+
+// call runs a phase function of the script with the arguments, returning
+// its first two results
+func (p *plugin) call(ctx context.Context, fn string, args ...lua.LValue) (lua.LValue, lua.LValue, error) {
+	state, ok := p.states.Get().(*pluginState)
+	if !ok {
+		var err error
+		if state, err = p.newState(ctx); err != nil {
+			return lua.LNil, lua.LNil, err
+		}
+	}
+	L := state.L
+	budget := state.budget(ctx, p.memoryLimit)
+	L.SetContext(budget)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(fn), NRet: 2, Protect: true}, args...)
+	L.RemoveContext()
+	if err != nil {
+		// An interrupted script may have left the interpreter in any state
+		L.Close()
+		return lua.LNil, lua.LNil, p.callError(budget, err)
+	}
+	first, second := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	p.states.Put(state)
+	return first, second, nil
+}
+
+// headerTable returns the headers as a Lua table of canonical names to
+// their first value
+func headerTable(header http.Header) *lua.LTable {
+	t := &lua.LTable{}
+	for name, values := range header {
+		if len(values) > 0 {
+			t.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+	return t
+}
+
+// applyHeaderTable applies the script's changes to the header table: names
+// it removed are deleted and values it changed replace every value
+func applyHeaderTable(t lua.LValue, header http.Header) {
+	table, ok := t.(*lua.LTable)
+	if !ok {
+		return
+	}
+	for name := range header {
+		if table.RawGetString(name) == lua.LNil {
+			header.Del(name)
+		}
+	}
+	table.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok || value == lua.LNil {
+			return
+		}
+		v := lua.LVAsString(value)
+		if values := header.Values(string(name)); len(values) == 0 || values[0] != v {
+			header.Set(string(name), v)
+		}
+	})
+}
+
+// requestTable describes the request to a script
+func (lb *LoadBalancer) requestTable(r *http.Request) *lua.LTable {
+	t := &lua.LTable{}
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("query", lua.LString(r.URL.RawQuery))
+	t.RawSetString("host", lua.LString(r.Host))
+	t.RawSetString("client_ip", lua.LString(lb.trustedProxies.clientIP(r)))
+	t.RawSetString("headers", headerTable(r.Header))
+	return t
+}
+
+// callPlugin runs a phase function of the plugin for the request within
+// the plugin timeout, recording how long it took and why it failed. The
+// timeout is wall-clock time: a call waiting for the CPU uses it up too.
+func (lb *LoadBalancer) callPlugin(p *plugin, r *http.Request, fn string, args ...lua.LValue) (lua.LValue, lua.LValue, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), lb.pluginTimeout)
+	defer cancel()
+	start := time.Now()
+	first, second, err := p.call(ctx, fn, args...)
+	lb.metrics().ObserveDuration("lb_plugin_duration_seconds", time.Since(start), map[string]string{"plugin": p.path, "phase": fn})
+	if err != nil {
+		reason := "error"
+		switch {
+		case errors.Is(err, errPluginMemory):
+			reason = "memory"
+		case errors.Is(err, context.DeadlineExceeded):
+			reason = "timeout"
+		case errors.Is(err, context.Canceled):
+			reason = "cancelled"
+		}
+		lb.metrics().IncCounter("lb_plugin_aborts_total", map[string]string{"plugin": p.path, "phase": fn, "reason": reason})
+	}
+	return first, second, err
+}
+
+// pluginDecision is the outcome of the request phase
+type pluginDecision struct {
+	status int    // Rejects the request with this status when set
+	body   string // Body of the rejection
+	pool   string // Pool to send the request to, empty to route as usual
+}
+
+// handleRequest runs the script's request phase. The script changes
+// req.headers in place, sets req.pool to pick a pool, and returns a status
+// and body to reject the request.
+func (lb *LoadBalancer) handleRequest(p *plugin, r *http.Request) (pluginDecision, error) {
+	var decision pluginDecision
+	req := lb.requestTable(r)
+	status, body, err := lb.callPlugin(p, r, pluginOnRequest, req)
+	if err != nil {
+		return decision, err
+	}
+	applyHeaderTable(req.RawGetString("headers"), r.Header)
+	if pool, ok := req.RawGetString("pool").(lua.LString); ok {
+		decision.pool = string(pool)
+	}
+	if code, ok := status.(lua.LNumber); ok {
+		decision.status = int(code)
+		decision.body = lua.LVAsString(body)
+		if decision.status < 100 || decision.status > 999 {
+			return decision, fmt.Errorf("plugin %s returned invalid status %d", p.path, decision.status)
+		}
+	}
+	return decision, nil
+}
+
+// handleResponse runs the script's response phase on the response headers
+// about to be sent. The script changes resp.headers in place.
+func (lb *LoadBalancer) handleResponse(p *plugin, r *http.Request, status int, header http.Header) error {
+	resp := &lua.LTable{}
+	resp.RawSetString("status", lua.LNumber(status))
+	resp.RawSetString("headers", headerTable(header))
+	if _, _, err := lb.callPlugin(p, r, pluginOnResponse, lb.requestTable(r), resp); err != nil {
+		return err
+	}
+	applyHeaderTable(resp.RawGetString("headers"), header)
+	return nil
+}
+
+// pluginPoolKey carries the pool a plugin picked for the request
+type pluginPoolKey struct{}
+
+// pluginPool returns the pool a plugin picked for the request
+func (lb *LoadBalancer) pluginPool(r *http.Request) *Pool {
+	name, _ := r.Context().Value(pluginPoolKey{}).(string)
+	if name == "" {
+		return nil
+	}
+	return lb.pools[name]
+}
+
+// runPlugins runs the request phase of every plugin in order, and their
+// response phase just before the response headers are written
+func (lb *LoadBalancer) runPlugins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(lb.plugins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range lb.plugins {
+			if !p.onRequest {
+				continue
+			}
+			decision, err := lb.handleRequest(p, r)
+			if err != nil {
+				lb.writeError(w, errPluginFailed, err.Error())
+				return
+			}
+			if decision.status != 0 {
+				lb.writeError(w, errPluginRejected.withStatus(decision.status), decision.body)
+				return
+			}
+			if decision.pool != "" {
+				if lb.pools[decision.pool] == nil {
+					lb.writeError(w, errPluginFailed, fmt.Sprintf("plugin %s picked unknown pool %s", p.path, decision.pool))
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), pluginPoolKey{}, decision.pool))
+			}
+		}
+		next.ServeHTTP(&pluginResponseWriter{ResponseWriter: w, lb: lb, r: r}, r)
+	})
+}
+
+// pluginResponseWriter runs the plugins' response phase once, before the
+// status line is sent
+type pluginResponseWriter struct {
+	http.ResponseWriter
+	lb          *LoadBalancer
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *pluginResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for _, p := range w.lb.plugins {
+			if !p.onResponse {
+				continue
+			}
+			if err := w.lb.handleResponse(p, w.r, status, w.Header()); err != nil {
+				w.lb.recordError(errPluginFailed, err.Error())
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pluginResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *pluginResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,207 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePlugin writes a Lua script and loads it as a plugin holding at most
+// a megabyte
+func writePlugin(t *testing.T, script string) *plugin {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin.lua")
+	os.WriteFile(path, []byte(script), 0o600)
+	p, err := loadPlugin(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPlugins(t *testing.T) {
+	backend := func(name string) *Server {
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend-Secret", "hide me")
+			io.WriteString(w, name+" "+r.Header.Get("X-Tenant")+" "+r.Header.Get("Cookie"))
+		}))
+		t.Cleanup(b.Close)
+		u, _ := url.Parse(b.URL)
+		return &Server{URL: u, Alive: true}
+	}
+	lb := &LoadBalancer{
+		servers:       []*Server{backend("web")},
+		current:       -1,
+		pools:         map[string]*Pool{"beta": newPool("beta", []*Server{backend("beta")})},
+		pluginTimeout: time.Second,
+	}
+	lb.plugins = []*plugin{writePlugin(t, `
+function on_request(req)
+  if req.path == "/private" then
+    return 403, "private area"
+  end
+  req.headers["X-Tenant"] = "acme"
+  req.headers["Cookie"] = nil
+  if string.sub(req.path, 1, 5) == "/beta" then
+    req.pool = "beta"
+  end
+end
+
+function on_response(req, resp)
+  resp.headers["X-Backend-Secret"] = nil
+  resp.headers["X-Status"] = tostring(resp.status)
+end
+`)}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Cookie", "session=1")
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("/")
+	if rec.Body.String() != "web acme " {
+		t.Errorf("Expected the request headers to be changed, got %q", rec.Body.String())
+	}
+	if rec.Header().Get("X-Backend-Secret") != "" || rec.Header().Get("X-Status") != "200" {
+		t.Errorf("Expected the response headers to be changed, got %v", rec.Header())
+	}
+	if rec := get("/beta/home"); rec.Body.String() != "beta acme " {
+		t.Errorf("Expected the plugin to pick the beta pool, got %q", rec.Body.String())
+	}
+	if rec := get("/private"); rec.Code != http.StatusForbidden || rec.Header().Get(errorCodeHeader) != errPluginRejected.code {
+		t.Errorf("Expected the plugin to reject the request, got %d %v", rec.Code, rec.Header())
+	}
+
+	// Scripts running too long fail the request
+	lb.plugins = []*plugin{writePlugin(t, `function on_request(req) while true do end end`)}
+	lb.pluginTimeout = 20 * time.Millisecond
+	if rec := get("/"); rec.Code != http.StatusInternalServerError || rec.Header().Get(errorCodeHeader) != errPluginFailed.code {
+		t.Errorf("Expected a runaway plugin to fail the request, got %d", rec.Code)
+	}
+}
+
+// pluginMetrics counts plugin calls and their aborts by reason
+type pluginMetrics struct {
+	nopMetrics
+	calls  int
+	aborts map[string]int
+}
+
+func (m *pluginMetrics) IncCounter(name string, labels map[string]string) {
+	if name == "lb_plugin_aborts_total" {
+		m.aborts[labels["reason"]]++
+	}
+}
+
+func (m *pluginMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	if name == "lb_plugin_duration_seconds" {
+		m.calls++
+	}
+}
+
+func TestPluginLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	for _, test := range []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		reason  string
+	}{
+		{"table growth", `function on_request(req)
+  local t = {}
+  while true do t[#t + 1] = "entry " .. #t end
+end`, time.Minute, "memory"},
+		{"string.rep", `function on_request(req) local s = string.rep("x", 1e12) end`, time.Minute, "memory"},
+		{"repeated string.rep", `function on_request(req)
+  local t = {}
+  for i = 1, 1e6 do t[i] = string.rep("x", 1e5) end
+end`, time.Minute, "memory"},
+		{"doubling concatenation", `function on_request(req)
+  local s = "xxxxxxxx"
+  for i = 1, 25 do s = s .. s end
+end`, time.Minute, "memory"},
+		{"global concatenation", `function on_request(req)
+  s = "xxxxxxxx"
+  for i = 1, 25 do s = s .. s .. "!" end
+end`, time.Minute, "memory"},
+		{"table.concat", `function on_request(req)
+  local t = {}
+  for i = 1, 1000 do t[i] = "xxxxxxxx" end
+  local s = ""
+  for i = 1, 200 do s = table.concat(t, s) end
+end`, time.Minute, "memory"},
+		{"recursion", `local function f(n) return 1 + f(n + 1) end
+function on_request(req) return f(1) end`, time.Minute, "error"},
+		{"busy loop", `function on_request(req) while true do end end`, 50 * time.Millisecond, "timeout"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := &pluginMetrics{aborts: make(map[string]int)}
+			lb := &LoadBalancer{
+				servers:       []*Server{{URL: backendURL, Alive: true}},
+				current:       -1,
+				plugins:       []*plugin{writePlugin(t, test.script)},
+				pluginTimeout: test.timeout,
+			}
+			lb.SetMetricsSink(metrics)
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				if rec.Code != http.StatusInternalServerError || rec.Header().Get(errorCodeHeader) != errPluginFailed.code {
+					t.Fatalf("Expected the plugin to fail the request, got %d", rec.Code)
+				}
+			}
+			if metrics.calls != 2 || metrics.aborts[test.reason] != 2 {
+				t.Errorf("Expected 2 calls aborted for %s, got %d calls and aborts %v", test.reason, metrics.calls, metrics.aborts)
+			}
+		})
+	}
+
+	// Scripts within the limits keep their state between calls
+	lb := &LoadBalancer{
+		servers:       []*Server{{URL: backendURL, Alive: true}},
+		current:       -1,
+		pluginTimeout: time.Second,
+		plugins: []*plugin{writePlugin(t, `local seen = {}
+function on_request(req)
+  seen[#seen + 1] = string.rep("x", 1000)
+  req.headers["X-Seen"] = tostring(#seen)
+end`)},
+	}
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the limits to pass, got %d", i+1, rec.Code)
+		}
+	}
+}
+
+func TestLoadPlugin(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"syntax.lua":  "function on_request(req",
+		"nothing.lua": "local x = 1",
+		"files.lua":   "dofile('/etc/passwd')\nfunction on_request(req) end",
+		"os.lua":      "local t = os.time()\nfunction on_request(req) end",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(script), 0o600)
+		if _, err := loadPlugin(path, 1<<20); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+
+	findings := lintArgs(t, "-server", "http://localhost:8080", "-server", "http://localhost:8081", "-plugin", filepath.Join(dir, "nothing.lua"))
+	if !hasFinding(findings, lintError, "defines neither") {
+		t.Error("Expected lint to report a plugin without phase functions")
+	}
+}
@@ -0,0 +1,224 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Interpreter stack bounds: nested calls, and values on the stack
+const (
+	pluginCallStackSize   = 200
+	pluginRegistrySize    = 1024
+	pluginRegistryMaxSize = 16 * 1024
+)
+
+// pluginCheckSteps is how many instructions a plugin runs between
+// estimates of the memory it holds. Larger states are estimated less
+// often, so an estimate costs about one step per value visited.
+const pluginCheckSteps = 1000
+
+// luaValueSize approximates the memory taken by a Lua value or table slot
+const luaValueSize = 16
+
+// errPluginMemory aborts a plugin call holding more than the memory limit
+var errPluginMemory = errors.New("memory limit exceeded")
+
+// pluginState is an interpreter with the script loaded. libs holds the
+// library tables and functions, which memory estimates leave out.
+type pluginState struct {
+	L    *lua.LState
+	libs map[lua.LValue]bool
+}
+
+// pluginBudget is the context of one plugin call. The interpreter asks for
+// Done before every instruction, so it also checks the strings the next
+// instruction may join, and now and then estimates the memory the script
+// holds, ending the call once either is over the limit.
+type pluginBudget struct {
+	context.Context
+	state     *pluginState
+	limit     int64 // Bytes the script may hold, 0 for no limit
+	built     int64 // Bytes of strings built by string.rep during the call
+	steps     int
+	nextCheck int
+	exceeded  chan struct{}
+	err       error
+}
+
+// budget returns the context for a call on the state
+func (s *pluginState) budget(ctx context.Context, limit int64) *pluginBudget {
+	return &pluginBudget{Context: ctx, state: s, limit: limit, nextCheck: pluginCheckSteps, exceeded: make(chan struct{})}
+}
+
+func (b *pluginBudget) Done() <-chan struct{} {
+	if b.err == nil && b.limit > 0 {
+		// The operands of a concatenation wait in the registers of the
+		// running function, so their total bounds the string it builds
+		if b.state.registerBytes() > b.limit {
+			b.exceed()
+		}
+		b.steps++
+		if b.steps >= b.nextCheck {
+			size, visited := b.state.size(b.limit)
+			b.steps, b.nextCheck = 0, max(pluginCheckSteps, visited)
+			if size > b.limit {
+				b.exceed()
+			}
+		}
+	}
+	if b.err != nil {
+		return b.exceeded
+	}
+	return b.Context.Done()
+}
+
+func (b *pluginBudget) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.Context.Err()
+}
+
+// exceed ends the call for holding too much memory
+func (b *pluginBudget) exceed() {
+	if b.err == nil {
+		b.err = fmt.Errorf("%w: holds more than %d bytes", errPluginMemory, b.limit)
+		close(b.exceeded)
+	}
+}
+
+// registerBytes adds up the strings in the registers of the running
+// function, counting a string once per register holding it
+func (s *pluginState) registerBytes() int64 {
+	var size int64
+	for i := s.L.GetTop(); i > 0; i-- {
+		if str, ok := s.L.Get(i).(lua.LString); ok {
+			size += int64(len(str))
+		}
+	}
+	return size
+}
+
+// build accounts for a string about to be built in one go, failing when
+// the strings built during the call would pass the limit
+func (b *pluginBudget) build(size int64) error {
+	if b.limit <= 0 {
+		return nil
+	}
+	if size > b.limit-b.built {
+		b.exceed()
+		return b.err
+	}
+	b.built += size
+	return nil
+}
+
+// size estimates the bytes held by the script: the values reachable from
+// its globals and from the locals of running functions, leaving out the
+// libraries. It stops counting once past limit, and also returns how many
+// values it visited.
+func (s *pluginState) size(limit int64) (int64, int) {
+	sizer := &luaSizer{skip: s.libs, seen: make(map[lua.LValue]bool), limit: limit}
+	sizer.add(s.L.G.Global)
+	for level := 0; ; level++ {
+		frame, ok := s.L.GetStack(level)
+		if !ok {
+			break
+		}
+		for n := 1; ; n++ {
+			name, value := s.L.GetLocal(frame, n)
+			if name == "" {
+				break
+			}
+			sizer.add(value)
+		}
+	}
+	return sizer.size, sizer.visited
+}
+
+// luaSizer adds up the approximate size of Lua values, visiting each table
+// and function once
+type luaSizer struct {
+	skip    map[lua.LValue]bool
+	seen    map[lua.LValue]bool
+	limit   int64
+	size    int64
+	visited int
+}
+
+func (s *luaSizer) add(v lua.LValue) {
+	if s.size > s.limit || s.skip[v] {
+		return
+	}
+	s.visited++
+	s.size += luaValueSize
+	switch v := v.(type) {
+	case lua.LString:
+		s.size += int64(len(v))
+	case *lua.LTable:
+		if s.seen[v] {
+			return
+		}
+		s.seen[v] = true
+		v.ForEach(func(key, value lua.LValue) {
+			s.add(key)
+			s.add(value)
+		})
+	case *lua.LFunction:
+		if s.seen[v] {
+			return
+		}
+		s.seen[v] = true
+		for _, upvalue := range v.Upvalues {
+			s.add(upvalue.Value())
+		}
+	}
+}
+
+// luaStringRep is string.rep, which builds a string of any size in one
+// call and is therefore checked against the memory limit up front
+func luaStringRep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 || str == "" {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	size := int64(math.MaxInt64)
+	if int64(n) <= math.MaxInt64/int64(len(str)) {
+		size = int64(len(str)) * int64(n)
+	}
+	if budget, ok := L.Context().(*pluginBudget); ok {
+		if err := budget.build(size); err != nil {
+			L.RaiseError("%s", err)
+		}
+	}
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// luaTableConcat wraps table.concat, which joins any number of strings in
+// one call, so that the result is checked against the memory limit before
+// it is built
+func luaTableConcat(concat lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		tbl := L.CheckTable(1)
+		sep := L.OptString(2, "")
+		last := min(L.OptInt(4, tbl.Len()), tbl.Len())
+		var size int64
+		for i := max(L.OptInt(3, 1), 1); i <= last; i++ {
+			size += int64(len(lua.LVAsString(tbl.RawGetInt(i))) + len(sep))
+		}
+		if budget, ok := L.Context().(*pluginBudget); ok {
+			if err := budget.build(size); err != nil {
+				L.RaiseError("%s", err)
+			}
+		}
+		return concat(L)
+	}
+}
@@ -0,0 +1,322 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Server selection strategies of a pool
+const (
+	StrategyRoundRobin = "round-robin" // Interleaved weighted round-robin
+	StrategyLeastConn  = "least-conn"  // Fewest requests in flight per unit of weight
+	StrategyRandom     = "random"      // Weighted random choice
+)
+
+// Pool is a named group of backend servers with its own selection strategy
+type Pool struct {
+	name     string
+	members  atomic.Pointer[[]*Server] // Replaced as a whole when discovery changes it
+	strategy string
+	current  int64 // Position in the round-robin schedule, accessed atomically
+
+	// Selections that found a server and that found none
+	selected    atomic.Int64
+	unavailable atomic.Int64
+}
+
+// newPool creates a round-robin pool whose first selection is its first
+// server
+func newPool(name string, servers []*Server) *Pool {
+	p := &Pool{
+		name:     name,
+		strategy: StrategyRoundRobin,
+		current:  -1,
+	}
+	p.setServers(servers)
+	return p
+}
+
+// NewPool creates a pool choosing among the servers with the strategy:
+// StrategyRoundRobin, StrategyLeastConn or StrategyRandom
+func NewPool(name, strategy string, servers []*Server) (*Pool, error) {
+	strategy, err := parseStrategy(strategy)
+	if err != nil {
+		return nil, err
+	}
+	p := newPool(name, servers)
+	p.strategy = strategy
+	return p, nil
+}
+
+// Name returns the name of the pool
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Servers returns the pool's current servers, which change over time when
+// the pool is discovered. The slice must not be modified.
+func (p *Pool) Servers() []*Server {
+	return p.servers()
+}
+
+// servers returns the pool's current servers. The slice must not be
+// modified.
+func (p *Pool) servers() []*Server {
+	return *p.members.Load()
+}
+
+// setServers replaces the pool's servers
+func (p *Pool) setServers(servers []*Server) {
+	p.members.Store(&servers)
+}
+
+// parseStrategy checks a selection strategy name
+func parseStrategy(value string) (string, error) {
+	switch value {
+	case StrategyRoundRobin, StrategyLeastConn, StrategyRandom:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown strategy %q, expected round-robin, least-conn or random", value)
+}
+
+// NextServer returns the next alive server in the pool according to its
+// strategy
+func (p *Pool) NextServer() *Server {
+	var server *Server
+	servers := p.servers()
+	switch p.strategy {
+	case StrategyLeastConn:
+		server = leastConnServer(servers, &p.current)
+	case StrategyRandom:
+		server = randomServer(servers)
+	default:
+		server = nextAliveServer(servers, &p.current)
+	}
+	if server == nil {
+		p.unavailable.Add(1)
+	} else {
+		p.selected.Add(1)
+	}
+	return server
+}
+
+// selectionWeights snapshots the effective weights of the servers, treating
+// dead, quarantined, circuit-broken and saturated servers as weight 0
+func selectionWeights(servers []*Server, now time.Time) []int {
+	weights := make([]int, len(servers))
+	for i, server := range servers {
+		if !server.available(now) || server.quarantineState() != nil || server.saturated() {
+			continue
+		}
+		weights[i] = server.selectionWeight(now)
+	}
+	return weights
+}
+
+// nextAliveServer advances current using interleaved weighted round-robin
+// until it finds an alive server, returning nil when none are alive. With
+// equal weights this is plain round-robin. current is a position in the
+// endless schedule of passes over the servers and is only ever advanced
+// atomically, so concurrent selections never wait for each other.
+func nextAliveServer(servers []*Server, current *int64) *Server {
+	// Check for available servers
+	serverCount := int64(len(servers))
+	if serverCount == 0 {
+		return nil
+	}
+
+	// Quarantined servers only get their small share of traffic
+	now := time.Now()
+	if server := nextQuarantinedServer(servers, now); server != nil {
+		return server
+	}
+
+	weights := selectionWeights(servers, now)
+	maxWeight, divisor := 0, 0
+	for _, weight := range weights {
+		maxWeight = max(maxWeight, weight)
+		divisor = gcd(divisor, weight)
+	}
+
+	// If none are alive (or all are drained to weight 0)
+	if maxWeight == 0 {
+		return nil
+	}
+
+	// Each pass over the servers lowers the weight threshold, so heavier
+	// servers are picked in more passes than lighter ones
+	steps := int64(maxWeight / divisor)
+	for i := int64(0); i < serverCount*(steps+1); i++ {
+		// Move to next server (round-robin)
+		position := atomic.AddInt64(current, 1)
+		index := position % serverCount
+		threshold := maxWeight - int((position/serverCount)%steps)*divisor
+
+		if weights[index] > 0 && weights[index] >= threshold && servers[index].acquire(now) {
+			return servers[index]
+		}
+	}
+
+	return nil
+}
+
+// leastConnServer returns the available server with the fewest requests
+// in flight relative to its weight. Ties are broken in round-robin order
+// so idle servers share the load.
+func leastConnServer(servers []*Server, current *int64) *Server {
+	now := time.Now()
+	if server := nextQuarantinedServer(servers, now); server != nil {
+		return server
+	}
+	weights := selectionWeights(servers, now)
+	var candidates []int
+	start := int(atomic.AddInt64(current, 1) % int64(max(len(servers), 1)))
+	for i := range servers {
+		if index := (start + i) % len(servers); weights[index] > 0 {
+			candidates = append(candidates, index)
+		}
+	}
+	// Compare (inflight+1)/weight by cross-multiplying
+	load := func(i int) int64 { return servers[i].inflight.Load() + 1 }
+	slices.SortStableFunc(candidates, func(a, b int) int {
+		return cmp.Compare(load(a)*int64(weights[b]), load(b)*int64(weights[a]))
+	})
+	for _, index := range candidates {
+		if servers[index].acquire(now) {
+			return servers[index]
+		}
+	}
+	return nil
+}
+
+// randomServer picks an available server at random in proportion to its
+// weight
+func randomServer(servers []*Server) *Server {
+	now := time.Now()
+	if server := nextQuarantinedServer(servers, now); server != nil {
+		return server
+	}
+	weights := selectionWeights(servers, now)
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	for total > 0 {
+		n := rand.IntN(total)
+		for i, weight := range weights {
+			if n -= weight; n >= 0 {
+				continue
+			}
+			if servers[i].acquire(now) {
+				return servers[i]
+			}
+			// A half-open circuit with its probe in flight; skip it
+			total -= weight
+			weights[i] = 0
+			break
+		}
+	}
+	return nil
+}
+
+// poolServerList returns the servers of all pools
+func poolServerList(pools map[string]*Pool) []*Server {
+	var servers []*Server
+	for _, pool := range pools {
+		servers = append(servers, pool.servers()...)
+	}
+	return servers
+}
+
+// poolConfig holds a pool's own strategy and health check settings
+type poolConfig struct {
+	strategy string
+	health   *healthCheck // Applied to servers without their own check
+}
+
+// parsePoolConfigs parses pool settings of the form
+// name?strategy=least-conn&path=/healthz&interval=10s, taking the same
+// health check settings as -backend-health
+func parsePoolConfigs(defs []string, poolNames map[string]bool) (map[string]poolConfig, error) {
+	configs := make(map[string]poolConfig)
+	for _, def := range defs {
+		name, query, _ := strings.Cut(def, "?")
+		values, err := url.ParseQuery(query)
+		if name == "" || err != nil {
+			return nil, fmt.Errorf("invalid pool config %q, expected name?strategy=least-conn&path=/healthz", def)
+		}
+		if !poolNames[name] {
+			return nil, fmt.Errorf("invalid pool config %q: pool %s is not defined", def, name)
+		}
+		if _, exists := configs[name]; exists {
+			return nil, fmt.Errorf("pool %s is configured more than once", name)
+		}
+		config := poolConfig{strategy: StrategyRoundRobin}
+		if values.Has("strategy") {
+			if config.strategy, err = parseStrategy(values.Get("strategy")); err != nil {
+				return nil, fmt.Errorf("invalid pool config %q: %w", def, err)
+			}
+			values.Del("strategy")
+		}
+		if len(values) > 0 {
+			check, err := parseHealthCheck(def, values)
+			if err != nil {
+				return nil, err
+			}
+			config.health = &check
+		}
+		configs[name] = config
+	}
+	return configs, nil
+}
+
+// poolStatus is the JSON view of a pool
+type poolStatus struct {
+	Name        string `json:"name"`
+	Strategy    string `json:"strategy"`
+	Servers     int    `json:"servers"`
+	Alive       int    `json:"alive"`
+	InFlight    int64  `json:"in_flight"`
+	Requests    int64  `json:"requests"`
+	Selected    int64  `json:"selected"`
+	Unavailable int64  `json:"unavailable"`
+}
+
+// status reports the pool's servers and selections
+func (p *Pool) status() poolStatus {
+	servers := p.servers()
+	status := poolStatus{
+		Name:        p.name,
+		Strategy:    p.strategy,
+		Servers:     len(servers),
+		InFlight:    p.inFlight(),
+		Selected:    p.selected.Load(),
+		Unavailable: p.unavailable.Load(),
+	}
+	for _, server := range servers {
+		if server.IsAlive() {
+			status.Alive++
+		}
+		status.Requests += server.requests.Load()
+	}
+	return status
+}
+
+// handlePools reports the strategy, health and traffic of every named pool
+func (lb *LoadBalancer) handlePools(w http.ResponseWriter, r *http.Request) {
+	pools := make([]poolStatus, 0, len(lb.pools))
+	for _, pool := range lb.pools {
+		pools = append(pools, pool.status())
+	}
+	slices.SortFunc(pools, func(a, b poolStatus) int { return cmp.Compare(a.Name, b.Name) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pools)
+}
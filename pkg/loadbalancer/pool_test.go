@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testServers returns alive servers for the hosts
+func testServers(hosts ...string) []*Server {
+	var servers []*Server
+	for _, host := range hosts {
+		servers = append(servers, &Server{URL: &url.URL{Scheme: "http", Host: host}, Alive: true})
+	}
+	return servers
+}
+
+func TestLeastConnPool(t *testing.T) {
+	servers := testServers("a:80", "b:80", "c:80")
+	pool := newPool("api", servers)
+	pool.strategy = StrategyLeastConn
+
+	servers[0].inflight.Store(5)
+	servers[1].inflight.Store(1)
+	servers[2].inflight.Store(3)
+	if s := pool.NextServer(); s != servers[1] {
+		t.Errorf("Expected the server with the fewest requests in flight, got %s", s.URL.Host)
+	}
+
+	// Twice the weight takes twice the load
+	servers[2].SetWeight(2, 0)
+	servers[1].inflight.Store(2)
+	if s := pool.NextServer(); s != servers[2] {
+		t.Errorf("Expected the heavier server, got %s", s.URL.Host)
+	}
+
+	// Idle servers share the load
+	seen := make(map[*Server]bool)
+	for _, server := range servers {
+		server.inflight.Store(0)
+		server.SetWeight(1, 0)
+	}
+	for range servers {
+		seen[pool.NextServer()] = true
+	}
+	if len(seen) != len(servers) {
+		t.Errorf("Expected idle servers to take turns, got %d distinct servers", len(seen))
+	}
+
+	servers[1].SetAlive(false)
+	for range 10 {
+		if s := pool.NextServer(); s == servers[1] {
+			t.Fatal("Expected a dead server never to be picked")
+		}
+	}
+}
+
+func TestRandomPool(t *testing.T) {
+	servers := testServers("a:80", "b:80")
+	pool := newPool("api", servers)
+	pool.strategy = StrategyRandom
+
+	servers[0].SetWeight(3, 0)
+	counts := make(map[*Server]int)
+	for range 4000 {
+		counts[pool.NextServer()]++
+	}
+	if share := float64(counts[servers[0]]) / 4000; share < 0.7 || share > 0.8 {
+		t.Errorf("Expected about 75%% of requests on the heavier server, got %.2f", share)
+	}
+
+	servers[0].SetAlive(false)
+	servers[1].SetAlive(false)
+	if s := pool.NextServer(); s != nil {
+		t.Errorf("Expected no server when all are down, got %s", s.URL.Host)
+	}
+	if status := pool.status(); status.Selected != 4000 || status.Unavailable != 1 || status.Alive != 0 {
+		t.Errorf("Unexpected pool status %+v", status)
+	}
+}
+
+func TestParsePoolConfigs(t *testing.T) {
+	configs, err := parsePoolConfigs([]string{"api?strategy=least-conn&path=/healthz&interval=5s", "static?strategy=random"}, map[string]bool{"api": true, "static": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := configs["api"]
+	if api.strategy != StrategyLeastConn || api.health == nil || api.health.path != "/healthz" || api.health.interval != 5*time.Second {
+		t.Errorf("Unexpected api config %+v", api)
+	}
+	if static := configs["static"]; static.strategy != StrategyRandom || static.health != nil {
+		t.Errorf("Unexpected static config %+v", static)
+	}
+
+	for _, def := range []string{"missing?strategy=random", "api?strategy=fastest", "api?path=healthz", "api?color=blue", "?strategy=random"} {
+		if _, err := parsePoolConfigs([]string{def}, map[string]bool{"api": true}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+	if _, err := parsePoolConfigs([]string{"api", "api?strategy=random"}, map[string]bool{"api": true}); err == nil {
+		t.Errorf("Expected a pool configured twice to be rejected")
+	}
+}
+
+func TestHandlePools(t *testing.T) {
+	servers := testServers("a:80", "b:80")
+	servers[1].SetAlive(false)
+	servers[0].requests.Store(7)
+	lb := &LoadBalancer{pools: map[string]*Pool{
+		"web": newPool("web", servers[1:]),
+		"api": newPool("api", servers[:1]),
+	}}
+
+	w := httptest.NewRecorder()
+	lb.handlePools(w, httptest.NewRequest("GET", "/lb-admin/pools", nil))
+	var pools []poolStatus
+	if err := json.NewDecoder(w.Body).Decode(&pools); err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools[0].Name != "api" || pools[0].Alive != 1 || pools[0].Requests != 7 || pools[1].Alive != 0 {
+		t.Errorf("Unexpected pools %+v", pools)
+	}
+}
@@ -0,0 +1,66 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// isProtocolUpgrade reports whether the request asks to switch protocols,
+// as a WebSocket handshake does. An accepted upgrade holds on to the
+// connection, so these requests are never cached, coalesced, hedged,
+// mirrored or sent over HTTP/3.
+func isProtocolUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// relayUpgrade completes a protocol switch the backend accepted: it sends
+// the 101 response to the client over the hijacked connection, then copies
+// bytes both ways until either side closes. It returns the bytes sent to
+// the client.
+func (lb *LoadBalancer) relayUpgrade(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return 0, errors.New("backend switched protocols without handing over the connection")
+	}
+	defer backend.Close()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return 0, fmt.Errorf("taking over the client connection: %w", err)
+	}
+	defer client.Close()
+	// The server's read and write timeouts no longer apply to the upgraded
+	// connection
+	client.SetDeadline(time.Time{})
+
+	resp.Header = w.Header()
+	resp.Body = nil
+	if err := resp.Write(buf); err != nil {
+		return 0, err
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	// Bytes the client sent right after the handshake may already be
+	// buffered, so the client side is read through the buffer
+	sent := make(chan int64, 1)
+	go func() {
+		n, _ := copyPooled(client, backend)
+		sent <- n
+	}()
+	go func() {
+		copyPooled(backend, buf.Reader)
+		backend.Close()
+	}()
+	return <-sent, nil
+}
@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolUpgrade(t *testing.T) {
+	// The backend accepts the upgrade and echoes lines back
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isProtocolUpgrade(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString("echo " + line)
+			buf.Flush()
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(accessLogSettings{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// A route timeout shorter than the exchange must not cut it short
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, accessLog: l,
+		routeTimeouts: []routeTimeout{{prefix: "/", request: 50 * time.Millisecond}}}
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// The first message follows the handshake without waiting for the
+	// response
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected the backend's 101 response, got %d %v", resp.StatusCode, resp.Header)
+	}
+	for _, message := range []string{"hello", "again"} {
+		if message == "again" {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(conn, "again\n")
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "echo "+message+"\n" {
+			t.Fatalf("Expected %q echoed, got %q, %v", message, line, err)
+		}
+	}
+
+	// Closing the client connection ends the relay and logs the request
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		line, _ := os.ReadFile(path)
+		if strings.Contains(string(line), `"GET /chat HTTP/1.1" 101 `) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the upgrade in the access log, got %q", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProtocolUpgradeBypassesCache(t *testing.T) {
+	r := httptest.NewRequest("GET", "/chat", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if !isProtocolUpgrade(r) {
+		t.Fatal("Expected an upgrade request")
+	}
+	if reason := cacheBypass(r); reason != "upgrade" {
+		t.Errorf("Expected upgrades to bypass the cache and coalescing, got %q", reason)
+	}
+	r.Header.Del("Connection")
+	if isProtocolUpgrade(r) {
+		t.Error("Expected an Upgrade header without Connection: upgrade to be ignored")
+	}
+}
@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newBackendRequest creates the request forwarded to the server
+func (lb *LoadBalancer) newBackendRequest(r *http.Request, server *Server) (*http.Request, error) {
+	// Create the backend URL
+	targetURL := *server.URL
+	targetURL.Path = lb.backendPath(r, server)
+	targetURL.RawQuery = lb.backendQuery(r)
+
+	// Create the request to send to the backend
+	req, err := newBackendRequestTo(r.Context(), r.Method, &targetURL, r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the headers from the original request
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	// Tag the request with the client's device class
+	lb.tagDevice(r, req)
+
+	// Append the client address to X-Forwarded-For
+	if ip := remoteIP(r.RemoteAddr); ip != "" {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	// Forward the verified client certificate identity, never the client's own value
+	if lb.clientCertHeader != "" {
+		req.Header.Del(lb.clientCertHeader)
+		if identity := clientIdentity(r); identity != "" {
+			req.Header.Set(lb.clientCertHeader, identity)
+		}
+	}
+
+	return req, nil
+}
+
+// upstreamClient returns the client shared by all proxied requests, so
+// connections to backends are pooled instead of set up per request
+func (lb *LoadBalancer) upstreamClient() *http.Client {
+	lb.clientOnce.Do(func() {
+		lb.client = &http.Client{Transport: lb.transport}
+	})
+	return lb.client
+}
+
+// attempt sends the request to the server once and feeds the outcome to
+// health tracking. Attempts cancelled through their context, such as the
+// losing copy of a hedged request, are not held against the server.
+func (lb *LoadBalancer) attempt(r *http.Request, server *Server) (*http.Response, error) {
+	req, err := lb.newBackendRequest(r, server)
+	if err != nil {
+		server.release()
+		return nil, err
+	}
+	req = lb.withConnTrace(req, server)
+
+	start := time.Now()
+	_, headerTimeout := lb.timeoutsFor(r.URL.Path)
+	resp, err := lb.sendWithHeaderTimeout(req, headerTimeout)
+	if err == nil {
+		lb.observeOutcome(server, resp.StatusCode, nil, time.Since(start))
+		return resp, nil
+	}
+	// Neither cancelled attempts nor oversized request bodies say anything
+	// about the backend
+	if errors.Is(r.Context().Err(), context.Canceled) || bodyTooLarge(err) {
+		server.release()
+	} else {
+		lb.observeOutcome(server, 0, err, time.Since(start))
+	}
+	return nil, err
+}
+
+// roundTrip sends the request to the server. When the attempt fails in a
+// way the retry policy covers, requests that are safe to repeat are retried
+// on the next healthy backend that has not been tried yet. Requests on
+// hedged routes are hedged instead. It returns the server that produced the
+// response or the last error.
+func (lb *LoadBalancer) roundTrip(r *http.Request, server *Server) (*http.Response, *Server, error) {
+	if route := lb.hedgeRouteFor(r); route != nil {
+		return lb.hedgedRoundTrip(r, server, route)
+	}
+	tried := make(map[*Server]bool)
+	lb.retryBudget.recordRequest(time.Now())
+	policy := lb.retryRules()
+	rewind := func() {}
+	if lb.retries > 0 {
+		var err error
+		if rewind, err = policy.bufferBody(r); err != nil {
+			server.release()
+			return nil, server, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		rewind()
+		resp, err := lb.attempt(r, server)
+		if err != nil {
+			lb.metrics().IncCounter("lb_upstream_errors_total", map[string]string{"backend": server.URL.Host})
+		}
+		tried[server] = true
+		if attempt >= lb.retries || !policy.shouldRetry(r, resp, err) {
+			return resp, server, err
+		}
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+		}
+		if !lb.retryBudget.takeRetry(time.Now()) {
+			lb.errorf("Not retrying %s %s after %s from %s: retry budget exhausted", r.Method, r.URL.Path, reason, server.URL.Host)
+			lb.metrics().IncCounter("lb_retry_budget_exhausted_total", nil)
+			return resp, server, err
+		}
+
+		next := lb.nextUntriedServer(r, tried)
+		if next == nil {
+			return resp, server, err
+		}
+		if !next.startRequest() {
+			next.release()
+			return resp, server, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		server.finishRequest()
+		lb.errorf("Retrying %s %s on %s after %s from %s", r.Method, r.URL.Path, next.URL.Host, reason, server.URL.Host)
+		lb.metrics().IncCounter("lb_retries_total", map[string]string{"backend": next.URL.Host})
+		server = next
+		lb.recordRequest(server)
+	}
+}
+
+// nextUntriedServer returns the next backend for the request that has not
+// been tried yet, or nil when every alive backend has been tried
+func (lb *LoadBalancer) nextUntriedServer(r *http.Request, tried map[*Server]bool) *Server {
+	for i := 0; i <= len(lb.allServers()); i++ {
+		server := lb.nextServerFor(r)
+		if server == nil {
+			return nil
+		}
+		if !tried[server] {
+			return server
+		}
+	}
+	return nil
+}
+
+// idempotentMethods may be safely sent more than once
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closedServerURL returns the URL of a port with nothing listening on it
+func closedServerURL(t *testing.T) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return &url.URL{Scheme: "http", Host: addr}
+}
+
+func TestRetryOnConnectionRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	dead := &Server{URL: closedServerURL(t), Alive: true}
+	live := &Server{URL: backendURL, Alive: true}
+	lb := &LoadBalancer{
+		servers: []*Server{dead, live},
+		current: -1,
+		retries: 2,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("Expected GET to be retried on the live backend, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Requests with a body are not replayed
+	lb.current = -1
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected POST not to be retried, got %d", w.Code)
+	}
+
+	// Retries can be disabled
+	lb.current = -1
+	lb.retries = 0
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 with retries disabled, got %d", w.Code)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "too late")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	timeouts := proxyTimeouts{dial: time.Second, responseHeader: 50 * time.Millisecond}
+	lb := &LoadBalancer{
+		servers:   []*Server{{URL: backendURL, Alive: true}},
+		current:   -1,
+		transport: newUpstreamTransport(nil, timeouts),
+		timeouts:  timeouts,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 from a wedged backend, got %d", w.Code)
+	}
+}
+
+func TestBackendConnectionsAreReused(t *testing.T) {
+	var dials atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	transport := newUpstreamTransport(nil, proxyTimeouts{})
+	connPoolSettings{maxIdlePerHost: 4, idleTimeout: time.Minute}.apply(transport)
+	transports := newBackendTransports(transport)
+	lb := &LoadBalancer{
+		servers:   []*Server{{URL: backendURL, Alive: true}},
+		current:   -1,
+		transport: transports,
+	}
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+	transports.CloseIdleConnections()
+	if n := dials.Load(); n != 1 {
+		t.Errorf("Expected sequential requests to share one connection, got %d", n)
+	}
+	if transports.forHost(backendURL.Host) == transports.forHost("other:80") {
+		t.Errorf("Expected every backend to get its own transport")
+	}
+}
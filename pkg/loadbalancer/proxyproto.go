@@ -0,0 +1,190 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts connections that start with an HAProxy PROXY
+// protocol v1 or v2 header and reports the client address it carries
+type proxyProtoListener struct {
+	net.Listener
+	trusted trustedProxies // When non-empty, only these peers may send a header
+}
+
+// Accept wraps the next connection. The header itself is parsed lazily on
+// first use so a slow client cannot block the accept loop.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(conn)
+}
+
+// wrap expects a PROXY header on connections from trusted peers
+func (l *proxyProtoListener) wrap(conn net.Conn) (net.Conn, error) {
+	if len(l.trusted) > 0 {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !l.trusted.contains(addr.IP) {
+			return conn, nil
+		}
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn is a connection whose PROXY header is parsed on first use
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+// init reads the PROXY header once
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, falling
+// back to the peer address for LOCAL or UNKNOWN headers
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader parses a v1 or v2 PROXY header. A nil address means the
+// header did not carry a client address (LOCAL or UNKNOWN).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) < 6 {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("connection did not start with a PROXY header")
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY v1 address: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 parses the binary v2 header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	// LOCAL commands (health checks from the upstream balancer) carry no client
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// listen opens a TCP listener on the address, expecting PROXY headers when enabled
+func listen(addr string, proxyProtocol bool, trusted trustedProxies) (net.Listener, error) {
+	ln, err := net.Listen(listenNetwork(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	return withProxyProtocol(ln, proxyProtocol, trusted), nil
+}
+
+// withProxyProtocol makes the listener expect PROXY headers when enabled
+func withProxyProtocol(ln net.Listener, proxyProtocol bool, trusted trustedProxies) net.Listener {
+	if proxyProtocol {
+		return &proxyProtoListener{Listener: ln, trusted: trusted}
+	}
+	return ln
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyConnWith returns the load balancer side of a connection whose client
+// sends the given bytes
+func proxyConnWith(data []byte) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	ln := &proxyProtoListener{}
+	conn, _ := ln.wrap(server)
+	return conn
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	conn := proxyConnWith([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\nGET / HTTP/1.1\r\n"))
+	if addr := conn.RemoteAddr().String(); addr != "203.0.113.7:51234" {
+		t.Errorf("Expected client address from header, got %s", addr)
+	}
+	rest, _ := io.ReadAll(conn)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("Expected payload after header, got %q", rest)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11) // v2 PROXY, TCP over IPv4
+	header = binary.BigEndian.AppendUint16(header, 12)
+	header = append(header, 198, 51, 100, 9, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, 40000)
+	header = binary.BigEndian.AppendUint16(header, 443)
+
+	conn := proxyConnWith(append(header, []byte("hello")...))
+	if addr := conn.RemoteAddr().String(); addr != "198.51.100.9:40000" {
+		t.Errorf("Expected client address from header, got %s", addr)
+	}
+	rest, _ := io.ReadAll(conn)
+	if string(rest) != "hello" {
+		t.Errorf("Expected payload after header, got %q", rest)
+	}
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	conn := proxyConnWith([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := conn.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Expected an error for a connection without a PROXY header")
+	}
+}
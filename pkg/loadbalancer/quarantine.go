@@ -0,0 +1,160 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quarantine tracks a suspect backend that only receives a small share of
+// traffic until it is reinstated
+type quarantine struct {
+	share float64 // Percentage of requests sent to the backend
+	since time.Time
+
+	mu       sync.Mutex
+	requests int64
+	failures int64 // Connection errors, timeouts and 5xx responses
+	latency  *histogram
+}
+
+// quarantineReport describes a quarantined backend for the admin API
+type quarantineReport struct {
+	Backend  string         `json:"backend"`
+	Share    float64        `json:"share"`
+	Since    time.Time      `json:"since"`
+	Requests int64          `json:"requests"`
+	Failures int64          `json:"failures"`
+	Latency  latencySummary `json:"latency"`
+}
+
+// Quarantine limits the server to a share (0-100) of traffic and starts
+// tracking its outcomes separately
+func (s *Server) Quarantine(share float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.quarantine = &quarantine{share: share, since: time.Now(), latency: newHistogram()}
+}
+
+// Reinstate returns a quarantined server to full rotation
+func (s *Server) Reinstate() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.quarantine = nil
+}
+
+// quarantineState returns the server's quarantine, nil when not quarantined
+func (s *Server) quarantineState() *quarantine {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.quarantine
+}
+
+// record counts the outcome of a request sent to the quarantined server
+func (q *quarantine) record(failed bool, d time.Duration) {
+	q.mu.Lock()
+	q.requests++
+	if failed {
+		q.failures++
+	}
+	q.mu.Unlock()
+	q.latency.observe(d)
+}
+
+// nextQuarantinedServer gives each available quarantined server its share
+// of selections, returning nil when none of them is picked
+func nextQuarantinedServer(servers []*Server, now time.Time) *Server {
+	for _, server := range servers {
+		q := server.quarantineState()
+		if q == nil || !server.available(now) || server.saturated() {
+			continue
+		}
+		if rand.Float64()*100 < q.share && server.acquire(now) {
+			return server
+		}
+	}
+	return nil
+}
+
+// findServers returns the backends, across all pools, with the given host
+func (lb *LoadBalancer) findServers(host string) []*Server {
+	var found []*Server
+	for _, server := range lb.allServers() {
+		if server.URL.Host == host {
+			found = append(found, server)
+		}
+	}
+	return found
+}
+
+// handleQuarantine lists quarantined backends with their outcomes
+func (lb *LoadBalancer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	report := []quarantineReport{}
+	for _, server := range lb.allServers() {
+		q := server.quarantineState()
+		if q == nil {
+			continue
+		}
+		q.mu.Lock()
+		requests, failures := q.requests, q.failures
+		q.mu.Unlock()
+		report = append(report, quarantineReport{
+			Backend:  server.URL.Host,
+			Share:    q.share,
+			Since:    q.since,
+			Requests: requests,
+			Failures: failures,
+			Latency:  q.latency.summary(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleSetQuarantine quarantines a backend, e.g.
+// POST /lb-admin/backends/localhost:8080/quarantine?share=0.5
+func (lb *LoadBalancer) handleSetQuarantine(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	share := lb.quarantineShare
+	if value := r.URL.Query().Get("share"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 100 {
+			http.Error(w, "invalid share value", http.StatusBadRequest)
+			return
+		}
+		share = parsed
+	}
+
+	servers := lb.findServers(host)
+	if len(servers) == 0 {
+		http.Error(w, "unknown backend", http.StatusNotFound)
+		return
+	}
+	for _, server := range servers {
+		server.Quarantine(share)
+	}
+
+	lb.logf("Quarantined %s with %.2f%% of traffic", host, share)
+	lb.emit(EventBackendQuarantined, host, "backend quarantined")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReinstate returns a quarantined backend to full rotation
+func (lb *LoadBalancer) handleReinstate(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	servers := lb.findServers(host)
+	if len(servers) == 0 {
+		http.Error(w, "unknown backend", http.StatusNotFound)
+		return
+	}
+	for _, server := range servers {
+		server.Reinstate()
+	}
+
+	lb.logf("Reinstated %s", host)
+	lb.emit(EventBackendReinstated, host, "backend reinstated")
+	w.WriteHeader(http.StatusNoContent)
+}
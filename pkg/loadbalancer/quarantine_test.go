@@ -0,0 +1,69 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestQuarantinedServerGetsShare(t *testing.T) {
+	var servers []*Server
+	for i := 1; i <= 2; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://localhost:808%d", i))
+		servers = append(servers, &Server{URL: u, Alive: true})
+	}
+	lb := &LoadBalancer{servers: servers, current: -1}
+
+	// A share of 0 keeps the server out of rotation entirely
+	servers[1].Quarantine(0)
+	for i := 0; i < 100; i++ {
+		if lb.NextServer() != servers[0] {
+			t.Fatalf("Expected quarantined server with no share to be skipped")
+		}
+	}
+
+	servers[1].Quarantine(10)
+	picked := 0
+	for i := 0; i < 10000; i++ {
+		if lb.NextServer() == servers[1] {
+			picked++
+		}
+	}
+	if picked < 700 || picked > 1300 {
+		t.Errorf("Expected about 10%% of traffic to the quarantined server, got %d of 10000", picked)
+	}
+
+	servers[1].Reinstate()
+	if lb.NextServer() == lb.NextServer() {
+		t.Errorf("Expected round-robin after reinstating")
+	}
+}
+
+func TestQuarantineAdmin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{adminLocal: true, servers: []*Server{{URL: backendURL, Alive: true}}, current: -1}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/backends/"+backendURL.Host+"/quarantine?share=100", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", w.Code)
+	}
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	q := lb.servers[0].quarantineState()
+	if q.requests != 1 || q.failures != 1 {
+		t.Errorf("Expected 1 failed quarantined request, got %d/%d", q.failures, q.requests)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/lb-admin/backends/unknown:1/quarantine", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown backend, got %d", w.Code)
+	}
+}
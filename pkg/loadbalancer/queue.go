@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// queuePoll is how often a queued request looks for a free backend even
+// without being woken, covering slots freed outside the request path
+const queuePoll = 20 * time.Millisecond
+
+// requestQueue holds requests while every backend is at its concurrency
+// cap. Requests wait in arrival order for a slot to free, up to the queue
+// timeout or their own deadline, and are turned away when the queue is
+// full.
+type requestQueue struct {
+	depth   int64         // Requests that may wait at once
+	timeout time.Duration // Longest wait for a slot
+
+	waiting atomic.Int64
+	wake    chan struct{}
+}
+
+// newRequestQueue creates a queue, returning nil when depth or timeout is 0
+func newRequestQueue(depth int, timeout time.Duration) *requestQueue {
+	if depth <= 0 || timeout <= 0 {
+		return nil
+	}
+	return &requestQueue{depth: int64(depth), timeout: timeout, wake: make(chan struct{})}
+}
+
+// enter takes a place in the queue, failing when it is full
+func (q *requestQueue) enter() bool {
+	if q.waiting.Add(1) > q.depth {
+		q.waiting.Add(-1)
+		return false
+	}
+	return true
+}
+
+// leave gives up a place in the queue
+func (q *requestQueue) leave() {
+	q.waiting.Add(-1)
+}
+
+// release wakes the longest waiting request after a slot was freed
+func (q *requestQueue) release() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryAfter is the Retry-After sent with rejected requests, in seconds
+func (q *requestQueue) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(q.timeout.Seconds()))))
+}
+
+// reserveServer picks a backend for the request and takes one of its request
+// slots. Backends at their cap are skipped; when every available backend of
+// the request's route is at its cap the request is queued until a slot frees. It answers the
+// request itself and returns false when no backend can take it.
+func (lb *LoadBalancer) reserveServer(w http.ResponseWriter, r *http.Request) (*Server, bool) {
+	var deadline <-chan time.Time
+	queued := false
+	defer func() {
+		if queued {
+			lb.queue.leave()
+			lb.metrics().SetGauge("lb_queue_depth", float64(lb.queue.waiting.Load()), nil)
+		}
+	}()
+
+	for {
+		server := lb.nextServerFor(r)
+		if server != nil {
+			if server.startRequest() {
+				return server, true
+			}
+			// Another request took the last slot, pick again
+			server.release()
+			continue
+		}
+		if !lb.routeSaturated(r) {
+			lb.writeUnavailable(w, r)
+			return nil, false
+		}
+		if lb.queue == nil {
+			lb.writeError(w, errUpstreamSaturated, "All servers are at capacity")
+			return nil, false
+		}
+
+		if !queued {
+			if !lb.queue.enter() {
+				w.Header().Set("Retry-After", lb.queue.retryAfter())
+				lb.writeError(w, errQueueFull, "Request queue is full")
+				return nil, false
+			}
+			queued = true
+			lb.metrics().IncCounter("lb_queued_total", nil)
+			lb.metrics().SetGauge("lb_queue_depth", float64(lb.queue.waiting.Load()), nil)
+			timer := time.NewTimer(lb.queue.timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-lb.queue.wake:
+		case <-time.After(queuePoll):
+		case <-deadline:
+			w.Header().Set("Retry-After", lb.queue.retryAfter())
+			lb.writeError(w, errUpstreamSaturated, "Timed out waiting for a server")
+			return nil, false
+		case <-r.Context().Done():
+			lb.writeError(w, errDeadlineExceeded, "Deadline passed while queued")
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// blockingBackend answers a request each time release is signalled
+func blockingBackend(t *testing.T) (*Server, chan struct{}) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, _ := url.Parse(backend.URL)
+	server := &Server{URL: backendURL, Alive: true}
+	server.SetMaxConcurrent(1)
+	return server, release
+}
+
+// serveAsync sends a request through the load balancer in the background
+func serveAsync(lb *LoadBalancer) chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		done <- w
+	}()
+	return done
+}
+
+func TestRequestQueue(t *testing.T) {
+	server, release := blockingBackend(t)
+	lb := &LoadBalancer{servers: []*Server{server}, current: -1, queue: newRequestQueue(1, 5*time.Second)}
+
+	first := serveAsync(lb)
+	for server.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued := serveAsync(lb)
+	for lb.queue.waiting.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue holds one request, the next one is turned away
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(errorCodeHeader) != "queue_full" || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected 503 queue_full with Retry-After 5, got %d %q %q", w.Code, w.Header().Get(errorCodeHeader), w.Header().Get("Retry-After"))
+	}
+
+	// The queued request takes the slot as soon as it frees
+	release <- struct{}{}
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got %d", w.Code)
+	}
+	release <- struct{}{}
+	if w := <-queued; w.Code != http.StatusOK {
+		t.Errorf("Expected the queued request to succeed, got %d", w.Code)
+	}
+	if server.inflight.Load() != 0 || lb.queue.waiting.Load() != 0 {
+		t.Errorf("Expected all slots and queue places to be returned")
+	}
+}
+
+func TestRequestQueueTimeout(t *testing.T) {
+	server, release := blockingBackend(t)
+	lb := &LoadBalancer{servers: []*Server{server}, current: -1, queue: newRequestQueue(10, 50*time.Millisecond)}
+
+	first := serveAsync(lb)
+	for server.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(errorCodeHeader) != "upstream_saturated" || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 upstream_saturated with Retry-After 1, got %d %q %q", w.Code, w.Header().Get(errorCodeHeader), w.Header().Get("Retry-After"))
+	}
+
+	// Without a queue requests are turned away at once
+	lb.queue = nil
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get(errorCodeHeader) != "upstream_saturated" {
+		t.Errorf("Expected upstream_saturated without a queue, got %q", w.Header().Get(errorCodeHeader))
+	}
+
+	release <- struct{}{}
+	<-first
+}
+
+func TestReserveServerWithoutBackends(t *testing.T) {
+	lb := &LoadBalancer{current: -1, queue: newRequestQueue(10, time.Second)}
+	start := time.Now()
+	w := httptest.NewRecorder()
+	if _, ok := lb.reserveServer(w, httptest.NewRequest("GET", "/", nil)); ok || w.Header().Get(errorCodeHeader) != "no_healthy_upstream" {
+		t.Errorf("Expected no_healthy_upstream, got %q", w.Header().Get(errorCodeHeader))
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Expected no queueing when no backend is saturated")
+	}
+}
+
+func TestReserveServerOnlyWaitsForItsRoute(t *testing.T) {
+	server, release := blockingBackend(t)
+	down, _ := url.Parse("http://127.0.0.1:1")
+	lb := &LoadBalancer{
+		servers:    []*Server{server},
+		current:    -1,
+		pools:      map[string]*Pool{"api": newPool("api", []*Server{{URL: down}})},
+		pathRoutes: []pathRoute{{prefix: "/api", pool: "api"}},
+		queue:      newRequestQueue(10, time.Second),
+	}
+
+	first := serveAsync(lb)
+	for server.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The default pool is saturated, but the api route has no live backend
+	start := time.Now()
+	w := httptest.NewRecorder()
+	if _, ok := lb.reserveServer(w, httptest.NewRequest("GET", "/api/users", nil)); ok || w.Header().Get(errorCodeHeader) != "no_healthy_upstream" {
+		t.Errorf("Expected no_healthy_upstream, got %q", w.Header().Get(errorCodeHeader))
+	}
+	if time.Since(start) > 100*time.Millisecond || lb.queue.waiting.Load() != 0 {
+		t.Errorf("Expected no queueing when the route's backends are down")
+	}
+
+	release <- struct{}{}
+	<-first
+}
@@ -0,0 +1,319 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate requests per second on average with bursts of up
+// to burst requests. With a shared store the requests are counted there
+// instead, see takeStored.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	store Store // Shared store, nil to keep the tokens in memory
+	key   string
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := bucketBurst(rate, burst)
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// bucketBurst returns the burst of a bucket. A burst below 1 defaults to
+// the rate rounded up.
+func bucketBurst(rate float64, burst int) float64 {
+	if burst < 1 {
+		return math.Max(1, math.Ceil(rate))
+	}
+	return float64(burst)
+}
+
+// sharedStore returns the store for rate limits shared between instances,
+// or nil when it is the in-process memory store, which the token buckets
+// track more precisely themselves
+func sharedStore(store Store) Store {
+	if _, ok := store.(*memoryStore); ok {
+		return nil
+	}
+	return store
+}
+
+// rateQuota is the state of a rate limit after a request, as reported in
+// the RateLimit response headers
+type rateQuota struct {
+	allowed   bool
+	wait      time.Duration // Until the next token arrives, when not allowed
+	limit     int           // Requests allowed in a burst, 0 when unlimited
+	remaining int           // Requests left in the current burst
+	reset     time.Duration // Until the full burst is available again
+	window    time.Duration // Time in which a full burst is refilled
+	err       error         // Store failure, the request is let through
+}
+
+// tighter reports whether the quota has less of its burst left than other
+func (q rateQuota) tighter(other rateQuota) bool {
+	return q.limit > 0 && (other.limit == 0 || q.remaining*other.limit < other.remaining*q.limit)
+}
+
+// take removes a token when one is available. Otherwise it returns false
+// and how long until the next token arrives.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	q := b.takeQuota(context.Background(), now)
+	return q.allowed, q.wait
+}
+
+// takeQuota removes a token when one is available and reports the
+// remaining quota
+func (b *tokenBucket) takeQuota(ctx context.Context, now time.Time) rateQuota {
+	if b.store != nil {
+		return takeStored(ctx, b.store, b.key, b.rate, b.burst, now)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	q := rateQuota{limit: int(b.burst), window: b.refill(b.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		q.allowed = true
+	} else {
+		q.wait = b.refill(1 - b.tokens)
+	}
+	q.remaining = int(b.tokens)
+	q.reset = b.refill(b.burst - b.tokens)
+	return q
+}
+
+// refill returns how long it takes to earn the tokens
+func (b *tokenBucket) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
+
+// takeStored counts a request against a limit kept in a shared store, so
+// every instance using the store enforces it together. The store only
+// offers atomic increments, so rather than a token bucket the limit is a
+// fixed window as long as refilling the burst would take, admitting a
+// full burst per window. Store failures let the request through.
+func takeStored(ctx context.Context, store Store, key string, rate, burst float64, now time.Time) rateQuota {
+	window := max(time.Duration(burst/rate*float64(time.Second)), time.Millisecond)
+	start := now.Truncate(window)
+	// Keys outlive their window so instances with slightly different
+	// clocks still agree on the count
+	n, err := store.Incr(ctx, key+":"+strconv.FormatInt(start.UnixMilli(), 10), 1, window)
+	if err != nil {
+		return rateQuota{allowed: true, err: err}
+	}
+	limit := int(burst)
+	q := rateQuota{
+		allowed:   n <= int64(limit),
+		limit:     limit,
+		remaining: max(limit-int(n), 0),
+		reset:     start.Add(window).Sub(now),
+		window:    window,
+	}
+	if !q.allowed {
+		q.wait = q.reset
+	}
+	return q
+}
+
+// clientRateOverride is a rate limit applying to clients in a network
+type clientRateOverride struct {
+	network *net.IPNet
+	rate    float64
+}
+
+// parseClientRateOverrides parses cidr=rate definitions. A bare IP is
+// treated as a single-address network.
+func parseClientRateOverrides(defs []string) ([]clientRateOverride, error) {
+	var overrides []clientRateOverride
+	for _, def := range defs {
+		cidr, value, ok := strings.Cut(def, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid client rate override %q, expected cidr=rate", def)
+		}
+		networks, err := parseTrustedProxies([]string{cidr})
+		if err != nil {
+			return nil, fmt.Errorf("invalid client rate override %q, expected cidr=rate", def)
+		}
+		overrides = append(overrides, clientRateOverride{network: networks[0], rate: rate})
+	}
+	return overrides, nil
+}
+
+// clientLimiter keeps a token bucket per client IP. Only the most recently
+// seen clients are tracked; the least recently seen one is forgotten when
+// the limit is reached, starting over with a full bucket if it returns.
+// With a shared store the clients are counted there instead.
+type clientLimiter struct {
+	rate       float64
+	burst      int
+	overrides  []clientRateOverride // First matching network wins
+	maxClients int
+	store      Store // Shared store, nil to keep the buckets in memory
+
+	mu      sync.Mutex
+	order   *list.List // Client IPs, most recently seen first
+	buckets map[string]*list.Element
+}
+
+// clientBucket is an entry of the limiter's LRU list
+type clientBucket struct {
+	ip     string
+	bucket *tokenBucket
+}
+
+// newClientLimiter creates a limiter tracking up to maxClients clients
+func newClientLimiter(rate float64, burst int, overrides []clientRateOverride, maxClients int) *clientLimiter {
+	return &clientLimiter{
+		rate:       rate,
+		burst:      burst,
+		overrides:  overrides,
+		maxClients: max(maxClients, 1),
+		order:      list.New(),
+		buckets:    make(map[string]*list.Element),
+	}
+}
+
+// rateFor returns the rate limit of a client
+func (l *clientLimiter) rateFor(ip string) float64 {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, override := range l.overrides {
+			if override.network.Contains(parsed) {
+				return override.rate
+			}
+		}
+	}
+	return l.rate
+}
+
+// take removes a token from the client's bucket, see tokenBucket.take
+func (l *clientLimiter) take(ip string, now time.Time) (bool, time.Duration) {
+	q := l.takeQuota(context.Background(), ip, now)
+	return q.allowed, q.wait
+}
+
+// burstFor returns the burst of a client with the given rate. Overridden
+// networks get a burst of their rate.
+func (l *clientLimiter) burstFor(rate float64) int {
+	if rate != l.rate {
+		return 0
+	}
+	return l.burst
+}
+
+// takeQuota removes a token from the client's bucket and reports the
+// client's remaining quota
+func (l *clientLimiter) takeQuota(ctx context.Context, ip string, now time.Time) rateQuota {
+	if l.store != nil {
+		rate := l.rateFor(ip)
+		if rate <= 0 {
+			return rateQuota{allowed: true}
+		}
+		return takeStored(ctx, l.store, storeKey("ratelimit", "client", ip), rate, bucketBurst(rate, l.burstFor(rate)), now)
+	}
+	l.mu.Lock()
+	elem, ok := l.buckets[ip]
+	if ok {
+		l.order.MoveToFront(elem)
+	} else {
+		rate := l.rateFor(ip)
+		if rate <= 0 {
+			// Only overridden networks are limited
+			l.mu.Unlock()
+			return rateQuota{allowed: true}
+		}
+		if l.order.Len() >= l.maxClients {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*clientBucket).ip)
+		}
+		elem = l.order.PushFront(&clientBucket{ip: ip, bucket: newTokenBucket(rate, l.burstFor(rate), now)})
+		l.buckets[ip] = elem
+	}
+	bucket := elem.Value.(*clientBucket).bucket
+	l.mu.Unlock()
+	return bucket.takeQuota(ctx, now)
+}
+
+// rateLimited answers the request with 429 when the client's or the global
+// rate limit is exceeded. The client limit is checked first so an abusive
+// client does not use up the global budget. Requests that are let through
+// with little of the tighter quota left carry the RateLimit headers too.
+func (lb *LoadBalancer) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	now := time.Now()
+	var tightest rateQuota
+	if lb.clientRateLimit != nil {
+		q := lb.clientRateLimit.takeQuota(r.Context(), lb.trustedProxies.clientIP(r), now)
+		lb.rateLimitStoreFailed(q.err, "client")
+		if !q.allowed {
+			lb.rejectRateLimited(w, q, "client")
+			return true
+		}
+		tightest = q
+	}
+	if lb.rateLimit != nil {
+		q := lb.rateLimit.takeQuota(r.Context(), now)
+		lb.rateLimitStoreFailed(q.err, "global")
+		if !q.allowed {
+			lb.rejectRateLimited(w, q, "global")
+			return true
+		}
+		if q.tighter(tightest) {
+			tightest = q
+		}
+	}
+	if tightest.limit > 0 && float64(tightest.remaining) < lb.rateLimitWarn*float64(tightest.limit) {
+		setRateLimitHeaders(w.Header(), tightest)
+	}
+	return false
+}
+
+// rateLimitStoreFailed logs a store failure of a rate limit, which lets the
+// request through rather than failing it
+func (lb *LoadBalancer) rateLimitStoreFailed(err error, scope string) {
+	if err == nil {
+		return
+	}
+	lb.metrics().IncCounter("lb_rate_limit_store_errors_total", map[string]string{"scope": scope})
+	lb.errorf("Error checking the %s rate limit in the store, letting the request through: %s", scope, err)
+}
+
+// rejectRateLimited answers with 429 and a Retry-After in whole seconds
+func (lb *LoadBalancer) rejectRateLimited(w http.ResponseWriter, q rateQuota, scope string) {
+	setRateLimitHeaders(w.Header(), q)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(q.wait)))
+	lb.metrics().IncCounter("lb_rate_limited_total", map[string]string{"scope": scope})
+	lb.writeError(w, errRateLimited, "Rate limit exceeded")
+}
+
+// setRateLimitHeaders describes the quota with the RateLimit header fields
+// of the IETF draft, so clients can slow down before they are throttled
+func setRateLimitHeaders(header http.Header, q rateQuota) {
+	header.Set("RateLimit-Limit", strconv.Itoa(q.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(q.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(q.reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", q.limit, ceilSeconds(q.window)))
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,254 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("Expected the burst of 3 to be allowed, request %d rejected", i+1)
+		}
+	}
+	ok, wait := bucket.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Expected a rejection with a 500ms wait, got %v %s", ok, wait)
+	}
+	if ok, _ := bucket.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("Expected a token after 500ms at 2 per second")
+	}
+
+	// Refills are capped at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		bucket.take(later)
+	}
+	if ok, _ := bucket.take(later); ok {
+		t.Errorf("Expected the bucket to hold no more than the burst")
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	lb := &LoadBalancer{rateLimit: newTokenBucket(0.5, 1, time.Now())}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the first request through to the (empty) backends, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w.Header().Get(errorCodeHeader) != "rate_limited" {
+		t.Errorf("Expected the rate_limited error code, got %q", w.Header().Get(errorCodeHeader))
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	now := time.Now()
+	overrides, err := parseClientRateOverrides([]string{"10.0.0.0/8=10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newClientLimiter(1, 1, overrides, 2)
+
+	if ok, _ := limiter.take("192.0.2.1", now); !ok {
+		t.Fatalf("Expected the first request of a client to be allowed")
+	}
+	if ok, wait := limiter.take("192.0.2.1", now); ok || wait != time.Second {
+		t.Fatalf("Expected the second request to wait 1s, got %v %s", ok, wait)
+	}
+	if ok, _ := limiter.take("192.0.2.2", now); !ok {
+		t.Errorf("Expected another client to have its own bucket")
+	}
+
+	// Overridden networks get their own rate and a burst of it
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.take("10.1.2.3", now); !ok {
+			t.Fatalf("Expected 10 requests from an overridden network, request %d rejected", i+1)
+		}
+	}
+
+	// The least recently seen client was forgotten and starts over
+	if len(limiter.buckets) != 2 {
+		t.Errorf("Expected 2 tracked clients, got %d", len(limiter.buckets))
+	}
+	if ok, _ := limiter.take("192.0.2.1", now); !ok {
+		t.Errorf("Expected a forgotten client to start with a full bucket")
+	}
+}
+
+func TestClientRateLimitHonoursTrustedProxies(t *testing.T) {
+	proxies, _ := parseTrustedProxies([]string{"127.0.0.1"})
+	lb := &LoadBalancer{trustedProxies: proxies, clientRateLimit: newClientLimiter(0.5, 1, nil, 100)}
+
+	request := func(forwardedFor string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	request("198.51.100.1")
+	if w := request("198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second request of a client to be limited, got %d", w.Code)
+	}
+	if w := request("198.51.100.2"); w.Code == http.StatusTooManyRequests {
+		t.Errorf("Expected a different client behind the same proxy not to be limited")
+	}
+}
+
+func TestParseClientRateOverrides(t *testing.T) {
+	for _, def := range []string{"10.0.0.0/8", "10.0.0.0/8=0", "nonsense=5", "10.0.0.0/8=fast"} {
+		if _, err := parseClientRateOverrides([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+	overrides, err := parseClientRateOverrides([]string{"192.0.2.7=3"})
+	if err != nil || len(overrides) != 1 || overrides[0].rate != 3 || !overrides[0].network.Contains(net.ParseIP("192.0.2.7")) {
+		t.Errorf("Unexpected overrides %+v, %v", overrides, err)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	lb := &LoadBalancer{rateLimit: newTokenBucket(1, 5, time.Now()), rateLimitWarn: 0.5}
+
+	remaining := func(w *httptest.ResponseRecorder) string { return w.Header().Get("RateLimit-Remaining") }
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if remaining(w) != "" {
+			t.Errorf("Expected no RateLimit headers with most of the quota left, got %q", remaining(w))
+		}
+	}
+
+	// Below half of the burst, allowed responses carry the headers
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("RateLimit-Limit") != "5" || remaining(w) != "2" || w.Header().Get("RateLimit-Policy") != "5;w=5" {
+		t.Errorf("Expected limit 5 and 2 remaining, got %v", w.Header())
+	}
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || remaining(w) != "0" || w.Header().Get("RateLimit-Reset") != "5" {
+		t.Errorf("Expected a throttled response with 0 remaining and a reset of 5s, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateQuotaTighter(t *testing.T) {
+	client := rateQuota{limit: 10, remaining: 5}
+	global := rateQuota{limit: 1000, remaining: 100}
+	if !global.tighter(client) || client.tighter(global) {
+		t.Errorf("Expected the quota with the smaller share left to be tighter")
+	}
+	if (rateQuota{}).tighter(client) || !client.tighter(rateQuota{}) {
+		t.Errorf("Expected an unlimited quota never to be tighter")
+	}
+}
+
+// testStoredRateLimit checks that limiters keeping their state in the same
+// store, as load balancer instances sharing it do, enforce one limit
+func testStoredRateLimit(t *testing.T, store Store) {
+	defer store.Close()
+	now := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+
+	// At 1 per second with a burst of 2 each window lasts 2 seconds
+	first := newTokenBucket(1, 2, now)
+	second := newTokenBucket(1, 2, now)
+	for _, bucket := range []*tokenBucket{first, second} {
+		bucket.store, bucket.key = store, storeKey("ratelimit", "global")
+	}
+	if ok, _ := first.take(now); !ok {
+		t.Fatalf("Expected the first request to be allowed")
+	}
+	if ok, _ := second.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatalf("Expected the second request of the burst to be allowed")
+	}
+	ok, wait := first.take(now.Add(500 * time.Millisecond))
+	if ok || wait != 1500*time.Millisecond {
+		t.Fatalf("Expected the burst to be used up across instances with a 1.5s wait, got %v %s", ok, wait)
+	}
+	if ok, _ := second.take(now.Add(2 * time.Second)); !ok {
+		t.Errorf("Expected a new burst in the next window")
+	}
+
+	// Clients are never forgotten, however many there are
+	limiters := []*clientLimiter{newClientLimiter(1, 1, nil, 1), newClientLimiter(1, 1, nil, 1)}
+	for _, limiter := range limiters {
+		limiter.store = store
+	}
+	if ok, _ := limiters[0].take("192.0.2.1", now); !ok {
+		t.Fatalf("Expected the first request of a client to be allowed")
+	}
+	if ok, _ := limiters[1].take("192.0.2.2", now); !ok {
+		t.Errorf("Expected another client to have its own limit")
+	}
+	if ok, _ := limiters[1].take("192.0.2.1", now); ok {
+		t.Errorf("Expected the client's limit to be shared by the instances")
+	}
+	q := limiters[0].takeQuota(context.Background(), "192.0.2.1", now.Add(200*time.Millisecond))
+	if q.allowed || q.limit != 1 || q.remaining != 0 || q.reset != 800*time.Millisecond {
+		t.Errorf("Unexpected quota %+v", q)
+	}
+}
+
+func TestStoredRateLimitMemory(t *testing.T) {
+	testStoredRateLimit(t, newMemoryStore())
+}
+
+func TestStoredRateLimitBolt(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "lb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %s", err)
+	}
+	testStoredRateLimit(t, store)
+}
+
+func TestStoredRateLimitStoreFailure(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "lb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %s", err)
+	}
+	store.Close()
+	lb := &LoadBalancer{rateLimit: newTokenBucket(0.5, 1, time.Now())}
+	lb.rateLimit.store, lb.rateLimit.key = store, storeKey("ratelimit", "global")
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("Expected requests to be let through when the store fails, request %d was limited", i+1)
+		}
+	}
+}
+
+func TestSharedStore(t *testing.T) {
+	if sharedStore(newMemoryStore()) != nil {
+		t.Errorf("Expected rate limits to stay in token buckets with the memory store")
+	}
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "lb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %s", err)
+	}
+	defer store.Close()
+	if sharedStore(store) != store {
+		t.Errorf("Expected rate limits to be kept in the bolt store")
+	}
+}
@@ -0,0 +1,550 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheStatusHeader tells clients whether a response came from the cache
+const cacheStatusHeader = "X-Cache"
+
+// cacheTTL overrides the freshness lifetime of responses under a prefix
+type cacheTTL struct {
+	prefix string
+	ttl    time.Duration
+}
+
+// parseCacheTTLs parses /path/prefix=duration overrides
+func parseCacheTTLs(defs []string) ([]cacheTTL, error) {
+	var ttls []cacheTTL
+	for _, def := range defs {
+		prefix, value, ok := strings.Cut(def, "=")
+		ttl, err := time.ParseDuration(value)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid cache TTL %q, expected /path/prefix=duration", def)
+		}
+		ttls = append(ttls, cacheTTL{prefix: strings.TrimSuffix(prefix, "/"), ttl: ttl})
+	}
+	return ttls, nil
+}
+
+// cachedResponse is a stored GET response
+type cachedResponse struct {
+	key     string
+	path    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	vary    map[string]string // Request header values the response varies on
+
+	staleWhileRevalidate time.Duration // How long it may be served stale while being refreshed
+	staleIfError         time.Duration // How long it may be served stale when the backend fails
+	revalidating         bool          // A refresh is running; guarded by the cache's mu
+}
+
+// retainUntil returns when the entry can no longer be served, not even stale
+func (e *cachedResponse) retainUntil() time.Time {
+	return e.expires.Add(max(e.staleWhileRevalidate, e.staleIfError))
+}
+
+// size approximates the memory held by the entry
+func (e *cachedResponse) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		n += int64(len(name))
+		for _, value := range values {
+			n += int64(len(value))
+		}
+	}
+	return n
+}
+
+// matches reports whether the request has the header values the response
+// was stored for
+func (e *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// responseCache keeps GET responses in memory, evicting the least recently
+// used ones when it exceeds its size
+type responseCache struct {
+	maxSize   int64 // Total bytes of stored responses
+	maxObject int64 // Largest body that is stored
+	ttls      []cacheTTL
+
+	// Stale windows of responses whose Cache-Control sets none
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // Front is most recently used
+	size      int64
+	hits      int64
+	misses    int64
+	stale     int64 // Stale responses served, while refreshing or on errors
+	evictions int64
+}
+
+// newResponseCache creates an empty cache holding up to maxSize bytes
+func newResponseCache(maxSize, maxObject int64, ttls []cacheTTL) *responseCache {
+	return &responseCache{
+		maxSize:   maxSize,
+		maxObject: maxObject,
+		ttls:      ttls,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// ttlFor returns the TTL override with the longest prefix matching the
+// path, or 0
+func (c *responseCache) ttlFor(path string) time.Duration {
+	var best *cacheTTL
+	for i, t := range c.ttls {
+		if (pathRoute{prefix: t.prefix}).matches(path) && (best == nil || len(t.prefix) > len(best.prefix)) {
+			best = &c.ttls[i]
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.ttl
+}
+
+// cacheBypass reports why a request must not be answered from the cache,
+// or an empty string when it may be
+func cacheBypass(r *http.Request) string {
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return "method"
+	case r.Header.Get("Authorization") != "":
+		return "authorization"
+	case r.Header.Get("Range") != "":
+		return "range"
+	case isProtocolUpgrade(r):
+		return "upgrade"
+	}
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok || directives["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache" {
+		return "no-cache"
+	}
+	if _, ok := directives["no-store"]; ok {
+		return "no-store"
+	}
+	return ""
+}
+
+// lookup returns the response stored for the request while it can still
+// be served, fresh or stale, or nil. Must hold c.mu.
+func (c *responseCache) lookup(r *http.Request, now time.Time) *cachedResponse {
+	elem, ok := c.entries[cacheKey(r)]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cachedResponse)
+	if !now.Before(entry.retainUntil()) {
+		c.remove(elem)
+		return nil
+	}
+	if !entry.matches(r) {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+// get returns the response stored for the request when it is fresh, or
+// stale within its stale-while-revalidate window, in which case revalidate
+// is true. It returns nil otherwise.
+func (c *responseCache) get(r *http.Request, now time.Time) (entry *cachedResponse, revalidate bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry = c.lookup(r, now)
+	switch {
+	case entry != nil && now.Before(entry.expires):
+		c.hits++
+		return entry, false
+	case entry != nil && now.Before(entry.expires.Add(entry.staleWhileRevalidate)):
+		c.stale++
+		return entry, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// getIfError returns the stale response that may replace a failed one for
+// the request, or nil
+func (c *responseCache) getIfError(r *http.Request, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.lookup(r, now)
+	if entry == nil || !now.Before(entry.expires.Add(entry.staleIfError)) {
+		return nil
+	}
+	return entry
+}
+
+// startRevalidation marks the entry as being refreshed, reporting false
+// when a refresh is already running
+func (c *responseCache) startRevalidation(entry *cachedResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.revalidating {
+		return false
+	}
+	entry.revalidating = true
+	return true
+}
+
+// finishRevalidation lets the entry be refreshed again, should the refresh
+// have failed to replace it
+func (c *responseCache) finishRevalidation(entry *cachedResponse) {
+	c.mu.Lock()
+	entry.revalidating = false
+	c.mu.Unlock()
+}
+
+// lifetime returns how long the response may be served from the cache,
+// or 0 when it must not be stored. A route's TTL override replaces the
+// response's own freshness, but never makes a private response shared.
+func (c *responseCache) lifetime(r *http.Request, resp *http.Response, now time.Time) time.Duration {
+	if r.Method != http.MethodGet || resp.StatusCode == http.StatusPartialContent {
+		return 0
+	}
+	lifetime, reason := freshnessLifetime(r, resp, now)
+	if ttl := c.ttlFor(r.URL.Path); ttl > 0 && (reason == "" || reason == "no-freshness" || reason == "expired") {
+		return ttl
+	}
+	if reason != "" {
+		return 0
+	}
+	return lifetime
+}
+
+// put stores a response, evicting the least recently used ones to make
+// room
+func (c *responseCache) put(r *http.Request, resp *http.Response, body []byte, lifetime time.Duration, now time.Time) {
+	entry := &cachedResponse{
+		key:     cacheKey(r),
+		path:    r.URL.Path,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		stored:  now,
+		expires: now.Add(lifetime),
+	}
+	entry.staleWhileRevalidate, entry.staleIfError = c.staleWindows(resp)
+	for _, name := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if entry.vary == nil {
+				entry.vary = make(map[string]string)
+			}
+			entry.vary[name] = r.Header.Get(name)
+		}
+	}
+	if entry.size() > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// staleWindows returns how long past its freshness the response may be
+// served while being refreshed and when the backend fails, per RFC 5861.
+// Responses that must be revalidated are never served stale.
+func (c *responseCache) staleWindows(resp *http.Response) (whileRevalidate, ifError time.Duration) {
+	directives := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, name := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return 0, 0
+		}
+	}
+	window := func(name string, fallback time.Duration) time.Duration {
+		value, ok := directives[name]
+		if !ok {
+			return fallback
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return window("stale-while-revalidate", c.staleWhileRevalidate), window("stale-if-error", c.staleIfError)
+}
+
+// remove drops an entry. Must hold c.mu.
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// purge drops the entries whose path is under the prefix, or every entry
+// when the prefix is empty, returning how many were dropped
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	route := pathRoute{prefix: strings.TrimSuffix(prefix, "/")}
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if route.matches(elem.Value.(*cachedResponse).path) {
+			c.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	return purged
+}
+
+// revalidationKey marks the background request refreshing a stale response
+type revalidationKey struct{}
+
+// isRevalidation reports whether the request refreshes a stale response,
+// which must reach a backend
+func isRevalidation(r *http.Request) bool {
+	return r.Context().Value(revalidationKey{}) != nil
+}
+
+// serveCached answers the request from the cache when a fresh response is
+// stored, or a stale one that may be served while it is refreshed in the
+// background, reporting whether it did
+func (lb *LoadBalancer) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	if lb.cache == nil || isRevalidation(r) || !lb.featureEnabled(gateCache, r) {
+		return false
+	}
+	if reason := cacheBypass(r); reason != "" {
+		lb.metrics().IncCounter("lb_response_cache_total", map[string]string{"result": "bypass"})
+		return false
+	}
+	now := time.Now()
+	entry, revalidate := lb.cache.get(r, now)
+	if entry == nil {
+		lb.metrics().IncCounter("lb_response_cache_total", map[string]string{"result": "miss"})
+		return false
+	}
+	if revalidate {
+		lb.metrics().IncCounter("lb_response_cache_total", map[string]string{"result": "stale"})
+		lb.revalidate(r, entry)
+		lb.writeCached(w, r, entry, now, "STALE")
+		return true
+	}
+	lb.metrics().IncCounter("lb_response_cache_total", map[string]string{"result": "hit"})
+	lb.writeCached(w, r, entry, now, "HIT")
+	return true
+}
+
+// writeCached answers the request with a stored response
+func (lb *LoadBalancer) writeCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse, now time.Time, status string) {
+	for name, values := range entry.header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(entry.stored).Seconds())))
+	w.Header().Set(cacheStatusHeader, status)
+	if etag := entry.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	lb.rewriteResponseHeaders(r, w.Header())
+	resp := &http.Response{StatusCode: entry.status, ContentLength: int64(len(entry.body))}
+	out, finishBody := lb.compressResponse(w, r, resp)
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		out.Write(entry.body)
+	}
+	finishBody()
+}
+
+// revalidate refreshes a stale response in the background, unless another
+// request already does
+func (lb *LoadBalancer) revalidate(r *http.Request, entry *cachedResponse) {
+	if !lb.cache.startRevalidation(entry) {
+		return
+	}
+	// The refresh outlives the client's request, so it is detached from its
+	// cancellation but keeps the pool the request was routed to
+	req := r.Clone(context.WithValue(context.WithoutCancel(r.Context()), revalidationKey{}, true))
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	go func() {
+		defer lb.cache.finishRevalidation(entry)
+		lb.logf("Revalidating stale response for %s", r.URL.RequestURI())
+		lb.proxy(&discardingWriter{header: make(http.Header)}, req)
+	}()
+}
+
+// discardingWriter receives the response of a background request
+type discardingWriter struct {
+	header http.Header
+}
+
+func (w *discardingWriter) Header() http.Header         { return w.header }
+func (w *discardingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardingWriter) WriteHeader(int)             {}
+
+// staleIfError wraps the writer so that a 5xx response, from the backend or
+// the load balancer, is replaced by the stale cached response when one may
+// be served on errors
+func (lb *LoadBalancer) staleIfError(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if lb.cache == nil || isRevalidation(r) || cacheBypass(r) != "" || !lb.featureEnabled(gateCache, r) {
+		return w
+	}
+	entry := lb.cache.getIfError(r, time.Now())
+	if entry == nil {
+		return w
+	}
+	return &staleIfErrorWriter{ResponseWriter: w, header: make(http.Header), lb: lb, r: r, entry: entry}
+}
+
+// staleIfErrorWriter holds back the response headers until the status is
+// known, so a failed response can be replaced by a stale one
+type staleIfErrorWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	lb          *LoadBalancer
+	r           *http.Request
+	entry       *cachedResponse
+	wroteHeader bool
+	replaced    bool // The failed response is dropped
+}
+
+func (w *staleIfErrorWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *staleIfErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	if status >= 500 {
+		w.replaced = true
+		w.lb.cache.mu.Lock()
+		w.lb.cache.stale++
+		w.lb.cache.mu.Unlock()
+		w.lb.metrics().IncCounter("lb_response_cache_total", map[string]string{"result": "stale-if-error"})
+		w.lb.logf("Serving stale response for %s after %d", w.r.URL.RequestURI(), status)
+		w.lb.writeCached(w.ResponseWriter, w.r, w.entry, time.Now(), "STALE")
+		return
+	}
+	for name, values := range w.header {
+		w.ResponseWriter.Header()[name] = values
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *staleIfErrorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *staleIfErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheResponse prepares to store the response once its body has been
+// copied to the client. The returned function stores it unless the body
+// was larger than the object limit.
+func (lb *LoadBalancer) cacheResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) func() {
+	noop := func() {}
+	if lb.cache == nil || cacheBypass(r) == "no-store" || !lb.featureEnabled(gateCache, r) {
+		return noop
+	}
+	now := time.Now()
+	lifetime := lb.cache.lifetime(r, resp, now)
+	if lifetime <= 0 || resp.ContentLength > lb.cache.maxObject {
+		return noop
+	}
+	w.Header().Set(cacheStatusHeader, "MISS")
+	body := &capturingBody{ReadCloser: resp.Body, buf: &bytes.Buffer{}, limit: lb.cache.maxObject + 1}
+	resp.Body = body
+	return func() {
+		if int64(body.buf.Len()) > lb.cache.maxObject {
+			return
+		}
+		lb.cache.put(r, resp, body.buf.Bytes(), lifetime, now)
+	}
+}
+
+// cacheStatus is the JSON view of the response cache
+type cacheStatus struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Stale     int64 `json:"stale"`
+	Evictions int64 `json:"evictions"`
+}
+
+// handleCache reports the size and hit counts of the response cache
+func (lb *LoadBalancer) handleCache(w http.ResponseWriter, r *http.Request) {
+	c := lb.cache
+	c.mu.Lock()
+	status := cacheStatus{
+		Entries:   len(c.entries),
+		Bytes:     c.size,
+		MaxBytes:  c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Stale:     c.stale,
+		Evictions: c.evictions,
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handlePurgeCache drops cached responses, e.g.
+// DELETE /lb-admin/cache?prefix=/static, or all of them without a prefix
+func (lb *LoadBalancer) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		http.Error(w, "prefix must start with /", http.StatusBadRequest)
+		return
+	}
+	purged := lb.cache.purge(prefix)
+	lb.logf("Purged %d cached responses under %q", purged, prefix)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
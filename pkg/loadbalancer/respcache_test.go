@@ -0,0 +1,266 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/static/app.js":
+			// No freshness information; the route's TTL applies
+		case "/big":
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, strings.Repeat("x", 100))
+		}
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{
+		servers: []*Server{{URL: backendURL, Alive: true}},
+		current: -1,
+		cache:   newResponseCache(1<<20, 64, []cacheTTL{{prefix: "/static", ttl: time.Minute}}),
+	}
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	first, second := get("/fresh"), get("/fresh")
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected a miss then a hit, got %q and %q", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if second.Body.String() != "response 1" || second.Header().Get("Age") == "" {
+		t.Errorf("Expected the stored response with an Age, got %q and %v", second.Body.String(), second.Header())
+	}
+	if w := get("/fresh", "If-None-Match", `"v1"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", w.Code)
+	}
+	if w := get("/fresh", "Cache-Control", "no-cache"); w.Body.String() != "response 2" {
+		t.Errorf("Expected no-cache to reach the backend, got %q", w.Body.String())
+	}
+	if w := get("/fresh", "Authorization", "Bearer x"); w.Body.String() != "response 3" {
+		t.Errorf("Expected authorized requests to reach the backend, got %q", w.Body.String())
+	}
+
+	get("/private")
+	if w := get("/private"); w.Header().Get("X-Cache") == "HIT" {
+		t.Error("Expected private responses not to be cached")
+	}
+
+	get("/static/app.js")
+	if w := get("/static/app.js"); w.Header().Get("X-Cache") != "HIT" {
+		t.Error("Expected the route TTL to make the response cacheable")
+	}
+
+	get("/big")
+	if w := get("/big"); w.Header().Get("X-Cache") == "HIT" {
+		t.Error("Expected bodies above the object limit not to be cached")
+	}
+
+	if purged := lb.cache.purge("/static"); purged != 1 {
+		t.Errorf("Expected 1 purged response, got %d", purged)
+	}
+	if w := get("/static/app.js"); w.Header().Get("X-Cache") == "HIT" {
+		t.Error("Expected the purged response to be fetched again")
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{
+		servers: []*Server{{URL: backendURL, Alive: true}},
+		current: -1,
+		cache:   newResponseCache(1<<20, 1<<10, nil),
+	}
+	get := func(language string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	get("en")
+	if body := get("de"); body != "de" {
+		t.Errorf("Expected a different Accept-Language to miss the cache, got %q", body)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(300, 1<<10, nil)
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		r := httptest.NewRequest("GET", path, nil)
+		c.put(r, resp, []byte(strings.Repeat("x", 100)), time.Minute, now)
+		if path == "/b" {
+			// Touch /a so /b is the least recently used
+			c.get(httptest.NewRequest("GET", "/a", nil), now)
+		}
+	}
+	if entry, _ := c.get(httptest.NewRequest("GET", "/b", nil), now); entry != nil {
+		t.Error("Expected the least recently used response to be evicted")
+	}
+	if entry, _ := c.get(httptest.NewRequest("GET", "/a", nil), now); entry == nil || c.evictions != 1 {
+		t.Errorf("Expected /a to be kept and one eviction, got %d", c.evictions)
+	}
+	if entry, _ := c.get(httptest.NewRequest("GET", "/c", nil), now.Add(time.Minute)); entry != nil {
+		t.Error("Expected an expired response not to be served")
+	}
+}
+
+func TestParseCacheTTLs(t *testing.T) {
+	ttls, err := parseCacheTTLs([]string{"/static/=1h", "/api=30s"})
+	if err != nil || len(ttls) != 2 || ttls[0].prefix != "/static" || ttls[1].ttl != 30*time.Second {
+		t.Errorf("Unexpected TTLs %+v, %v", ttls, err)
+	}
+	for _, def := range []string{"static=1h", "/static", "/static=soon", "/static=-1s"} {
+		if _, err := parseCacheTTLs([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
+
+func TestStaleResponses(t *testing.T) {
+	var hits atomic.Int32
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		n := hits.Add(1)
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	lb := &LoadBalancer{
+		servers: []*Server{{URL: backendURL, Alive: true}},
+		current: -1,
+		cache:   newResponseCache(1<<20, 1<<10, nil),
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	expireAll := func() {
+		lb.cache.mu.Lock()
+		for _, elem := range lb.cache.entries {
+			entry := elem.Value.(*cachedResponse)
+			entry.expires = time.Now().Add(-time.Second)
+			entry.stored = entry.expires.Add(-time.Second)
+		}
+		lb.cache.mu.Unlock()
+	}
+
+	// Stale while revalidate serves the old response and refreshes it
+	swr := "/swr?cc=max-age=1,stale-while-revalidate=60"
+	get(swr)
+	expireAll()
+	if w := get(swr); w.Body.String() != "response 1" || w.Header().Get(cacheStatusHeader) != "STALE" {
+		t.Errorf("Expected the stale response while revalidating, got %q %q", w.Body.String(), w.Header().Get(cacheStatusHeader))
+	}
+	for deadline := time.Now().Add(time.Second); hits.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if w := get(swr); w.Body.String() != "response 2" || w.Header().Get(cacheStatusHeader) != "HIT" {
+		t.Errorf("Expected the refreshed response, got %q %q", w.Body.String(), w.Header().Get(cacheStatusHeader))
+	}
+
+	// Stale if error replaces failed responses
+	sie := "/sie?cc=max-age=1,stale-if-error=60"
+	get(sie)
+	expireAll()
+	failing.Store(true)
+	if w := get(sie); w.Code != http.StatusOK || w.Body.String() != "response 3" || w.Header().Get(cacheStatusHeader) != "STALE" {
+		t.Errorf("Expected the stale response on a backend error, got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/other"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected errors without a stale response to pass, got %d", w.Code)
+	}
+
+	// Responses that must be revalidated are never served stale
+	failing.Store(false)
+	strict := "/strict?cc=max-age=1,stale-if-error=60,must-revalidate"
+	get(strict)
+	expireAll()
+	failing.Store(true)
+	if w := get(strict); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected must-revalidate to forbid stale responses, got %d", w.Code)
+	}
+}
+
+func TestRevalidationKeepsPluginPool(t *testing.T) {
+	var hits [2]atomic.Int32
+	backend := func(i int) *Server {
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := hits[i].Add(1)
+			w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+			fmt.Fprintf(w, "backend %d response %d", i, n)
+		}))
+		t.Cleanup(b.Close)
+		u, _ := url.Parse(b.URL)
+		return &Server{URL: u, Alive: true}
+	}
+	lb := &LoadBalancer{
+		servers:       []*Server{backend(0)},
+		current:       -1,
+		pools:         map[string]*Pool{"beta": newPool("beta", []*Server{backend(1)})},
+		pluginTimeout: time.Second,
+		cache:         newResponseCache(1<<20, 1<<10, nil),
+	}
+	lb.plugins = []*plugin{writePlugin(t, `function on_request(req) req.pool = "beta" end`)}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+		return w
+	}
+
+	get()
+	lb.cache.mu.Lock()
+	for _, elem := range lb.cache.entries {
+		entry := elem.Value.(*cachedResponse)
+		entry.expires = time.Now().Add(-time.Second)
+		entry.stored = entry.expires.Add(-time.Second)
+	}
+	lb.cache.mu.Unlock()
+	if w := get(); w.Header().Get(cacheStatusHeader) != "STALE" {
+		t.Fatalf("Expected the stale response while revalidating, got %q", w.Header().Get(cacheStatusHeader))
+	}
+	for deadline := time.Now().Add(time.Second); hits[0].Load()+hits[1].Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if hits[0].Load() != 0 || hits[1].Load() != 2 {
+		t.Errorf("Expected the revalidation to go to the pool the plugin picked, got %d default and %d beta requests", hits[0].Load(), hits[1].Load())
+	}
+}
@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Response header operations
+const (
+	headerSet = "set" // Replace the header's values with one value
+	headerAdd = "add" // Append a value to the header
+	headerDel = "del" // Remove the header
+)
+
+// responseHeaderRule changes a header of responses to requests under a
+// path prefix
+type responseHeaderRule struct {
+	prefix string
+	op     string
+	name   string
+	value  string
+}
+
+// parseResponseHeaders parses /prefix=op:Name[: value] rules, e.g.
+// /=del:Server or /static=set:Cache-Control: public, max-age=3600
+func parseResponseHeaders(defs []string) ([]responseHeaderRule, error) {
+	var rules []responseHeaderRule
+	for _, def := range defs {
+		prefix, action, _ := strings.Cut(def, "=")
+		op, header, _ := strings.Cut(action, ":")
+		name, value, hasValue := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		valid := strings.HasPrefix(prefix, "/") && name != "" && !strings.ContainsAny(name, " \t")
+		switch op {
+		case headerSet, headerAdd:
+			valid = valid && hasValue
+		case headerDel:
+			valid = valid && !hasValue
+		default:
+			valid = false
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid response header rule %q, expected /prefix=set:Name: value, /prefix=add:Name: value or /prefix=del:Name", def)
+		}
+		rules = append(rules, responseHeaderRule{
+			prefix: strings.TrimSuffix(prefix, "/"),
+			op:     op,
+			name:   http.CanonicalHeaderKey(name),
+			value:  value,
+		})
+	}
+	return rules, nil
+}
+
+// rewriteResponseHeaders applies the response header rules matching the
+// request path, in order, to the headers about to be sent
+func (lb *LoadBalancer) rewriteResponseHeaders(r *http.Request, header http.Header) {
+	for _, rule := range lb.responseHeaders {
+		if !(pathRoute{prefix: rule.prefix}).matches(r.URL.Path) {
+			continue
+		}
+		switch rule.op {
+		case headerSet:
+			header.Set(rule.name, rule.value)
+		case headerAdd:
+			header.Add(rule.name, rule.value)
+		case headerDel:
+			header.Del(rule.name)
+		}
+	}
+}
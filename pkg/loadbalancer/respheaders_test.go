@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestResponseHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Powered-By", "PHP")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	rules, err := parseResponseHeaders([]string{
+		"/=del:server",
+		"/=add:X-Frame-Options: DENY",
+		"/static=set:Cache-Control: public, max-age=3600",
+		"/static=del:X-Powered-By",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, responseHeaders: rules}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/static/app.js", nil))
+	h := w.Header()
+	if h.Get("Server") != "" || h.Get("X-Powered-By") != "" {
+		t.Errorf("Expected Server and X-Powered-By to be removed, got %v", h)
+	}
+	if h.Get("Cache-Control") != "public, max-age=3600" || h.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Expected Cache-Control to be replaced and X-Frame-Options added, got %v", h)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+	if h := w.Header(); h.Get("Cache-Control") != "no-cache" || h.Get("X-Powered-By") != "PHP" || h.Get("Server") != "" {
+		t.Errorf("Expected only the rules for / to apply outside /static, got %v", h)
+	}
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	for _, def := range []string{"del:Server", "/=drop:Server", "/=set:Cache-Control", "/=del:Server: x", "/=add:: x", "/=set:Bad Name: x"} {
+		if _, err := parseResponseHeaders([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryBudgetBuckets is how many buckets the sliding window is split into
+const retryBudgetBuckets = 10
+
+// retryBudgetSettings cap the share of requests that may be retries
+type retryBudgetSettings struct {
+	ratio  float64       // Largest share of requests in the window that may be retries, 0 disables
+	min    int           // Retries always allowed within the window, for low traffic
+	window time.Duration // Length of the sliding window
+}
+
+// retryBucket counts the requests and retries of one slice of the window
+type retryBucket struct {
+	start    time.Time
+	requests int64
+	retries  int64
+}
+
+// retryBudget keeps retries from amplifying an outage: once retries make up
+// the budgeted share of recent requests, failed requests are not retried
+// until the share drops again. Requests are counted in buckets so old
+// traffic leaves the window gradually.
+type retryBudget struct {
+	settings retryBudgetSettings
+
+	mu        sync.Mutex
+	buckets   [retryBudgetBuckets]retryBucket
+	exhausted int64 // Retries refused because the budget was used up
+}
+
+// newRetryBudget creates a retry budget, or returns nil when disabled
+func newRetryBudget(settings retryBudgetSettings) *retryBudget {
+	if settings.ratio <= 0 || settings.window <= 0 {
+		return nil
+	}
+	return &retryBudget{settings: settings}
+}
+
+// bucket returns the bucket of the moment, clearing it when it last held an
+// older slice of the window. Must hold b.mu.
+func (b *retryBudget) bucket(now time.Time) *retryBucket {
+	width := b.settings.window / retryBudgetBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%retryBudgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = retryBucket{start: start}
+	}
+	return bucket
+}
+
+// totals sums the requests and retries within the window. Must hold b.mu.
+func (b *retryBudget) totals(now time.Time) (requests, retries int64) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.settings.window {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+// recordRequest counts a proxied request towards the budget
+func (b *retryBudget) recordRequest(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(now).requests++
+}
+
+// takeRetry reserves a retry, reporting false when the budget is used up
+func (b *retryBudget) takeRetry(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket := b.bucket(now)
+	requests, retries := b.totals(now)
+	if retries >= int64(b.settings.min) && float64(retries+1) > b.settings.ratio*float64(requests) {
+		b.exhausted++
+		return false
+	}
+	bucket.retries++
+	return true
+}
+
+// retryBudgetStatus is the JSON view of the retry budget
+type retryBudgetStatus struct {
+	Window    string  `json:"window"`
+	Budget    float64 `json:"budget"`
+	Requests  int64   `json:"requests"`
+	Retries   int64   `json:"retries"`
+	RetryRate float64 `json:"retry_rate"`
+	Exhausted int64   `json:"exhausted_total"`
+}
+
+// handleRetryBudget reports the requests and retries within the window and
+// how many retries the budget refused
+func (lb *LoadBalancer) handleRetryBudget(w http.ResponseWriter, r *http.Request) {
+	b := lb.retryBudget
+	b.mu.Lock()
+	requests, retries := b.totals(time.Now())
+	status := retryBudgetStatus{
+		Window:    b.settings.window.String(),
+		Budget:    b.settings.ratio,
+		Requests:  requests,
+		Retries:   retries,
+		Exhausted: b.exhausted,
+	}
+	b.mu.Unlock()
+	if requests > 0 {
+		status.RetryRate = float64(retries) / float64(requests)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
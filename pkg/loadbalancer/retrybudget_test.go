@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := newRetryBudget(retryBudgetSettings{ratio: 0.2, min: 2, window: 10 * time.Second})
+
+	// The minimum is available before any traffic
+	if !b.takeRetry(now) || !b.takeRetry(now) {
+		t.Error("Expected the minimum retries to be allowed without traffic")
+	}
+	if b.takeRetry(now) {
+		t.Error("Expected retries beyond the minimum to need traffic")
+	}
+	for range 20 {
+		b.recordRequest(now)
+	}
+	if !b.takeRetry(now) || !b.takeRetry(now) {
+		t.Error("Expected 20% of 20 requests to allow 4 retries")
+	}
+	if b.takeRetry(now) {
+		t.Error("Expected the budget to be used up")
+	}
+	if b.exhausted != 2 {
+		t.Errorf("Expected 2 refused retries, got %d", b.exhausted)
+	}
+
+	// Old traffic leaves the window bucket by bucket
+	later := now.Add(5 * time.Second)
+	if b.takeRetry(later) {
+		t.Error("Expected retries within the window to still count")
+	}
+	later = now.Add(11 * time.Second)
+	if !b.takeRetry(later) {
+		t.Error("Expected the budget to recover once the window has passed")
+	}
+
+	if newRetryBudget(retryBudgetSettings{window: time.Second}) != nil {
+		t.Error("Expected a zero budget to disable it")
+	}
+	var disabled *retryBudget
+	disabled.recordRequest(now)
+	if !disabled.takeRetry(now) {
+		t.Error("Expected a disabled budget to allow every retry")
+	}
+}
+
+func TestRetryBudgetLimitsRetries(t *testing.T) {
+	var servers []*Server
+	for range 3 {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		u, _ := url.Parse(backend.URL)
+		backend.Close()
+		servers = append(servers, &Server{URL: u, Alive: true})
+	}
+	lb := &LoadBalancer{
+		servers:     servers,
+		current:     -1,
+		retries:     2,
+		retryBudget: newRetryBudget(retryBudgetSettings{ratio: 0.1, min: 1, window: time.Minute}),
+	}
+	for range 5 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	w := httptest.NewRecorder()
+	lb.handleRetryBudget(w, httptest.NewRequest("GET", "/lb-admin/retry-budget", nil))
+	if lb.retryBudget.exhausted == 0 {
+		t.Errorf("Expected the budget to refuse retries against dead backends, got %s", w.Body.String())
+	}
+	requests, retries := lb.retryBudget.totals(time.Now())
+	if requests != 5 || retries != 1 {
+		t.Errorf("Expected 5 requests and the minimum of 1 retry, got %d and %d", requests, retries)
+	}
+}
@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Failures that -retry-on can name besides status codes
+const (
+	retryOnConnectError = "connect-error"
+	retryOnTimeout      = "timeout"
+	retryOn5xx          = "5xx"
+)
+
+// retryPolicy decides which failed requests are sent to another backend.
+// Only requests that are safe to repeat are retried: those with a retried
+// method, or carrying an idempotency key, and a body small enough to replay.
+type retryPolicy struct {
+	methods        map[string]bool
+	connectErrors  bool         // Connection refused or failed
+	timeouts       bool         // Dial, response header and request timeouts
+	statuses       map[int]bool // Response statuses retried
+	idempotencyKey string       // Header making a request of any method retryable, empty to disable
+	maxBody        int64        // Largest request body buffered for replay, 0 retries only bodiless requests
+}
+
+// defaultRetryPolicy retries idempotent requests after connection failures
+// and timeouts, matching the flag defaults
+var defaultRetryPolicy = &retryPolicy{
+	methods:        idempotentMethods,
+	connectErrors:  true,
+	timeouts:       true,
+	idempotencyKey: "Idempotency-Key",
+	maxBody:        64 << 10,
+}
+
+// parseRetryPolicy parses the comma separated methods and failures to retry
+func parseRetryPolicy(methods, on, idempotencyKey string, maxBody int64) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		methods:        make(map[string]bool),
+		statuses:       make(map[int]bool),
+		idempotencyKey: http.CanonicalHeaderKey(idempotencyKey),
+		maxBody:        maxBody,
+	}
+	if maxBody < 0 {
+		return nil, fmt.Errorf("retry body limit must not be negative, got %d", maxBody)
+	}
+	for _, method := range splitList(strings.ToUpper(methods)) {
+		policy.methods[method] = true
+	}
+	for _, failure := range splitList(strings.ToLower(on)) {
+		switch failure {
+		case retryOnConnectError:
+			policy.connectErrors = true
+		case retryOnTimeout:
+			policy.timeouts = true
+		case retryOn5xx:
+			for status := 500; status < 600; status++ {
+				policy.statuses[status] = true
+			}
+		default:
+			status, err := strconv.Atoi(failure)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid retry condition %q, expected %s, %s, %s or a status code", failure, retryOnConnectError, retryOnTimeout, retryOn5xx)
+			}
+			policy.statuses[status] = true
+		}
+	}
+	return policy, nil
+}
+
+// retryRules returns the retry policy in use
+func (lb *LoadBalancer) retryRules() *retryPolicy {
+	if lb.retryPolicy == nil {
+		return defaultRetryPolicy
+	}
+	return lb.retryPolicy
+}
+
+// repeatable reports whether the request is safe to send more than once:
+// its method is retried or it carries an idempotency key
+func (p *retryPolicy) repeatable(r *http.Request) bool {
+	return p.methods[r.Method] || (p.idempotencyKey != "" && r.Header.Get(p.idempotencyKey) != "")
+}
+
+// allows reports whether the request may be retried: it is repeatable and
+// has no body or one that can be buffered for replay
+func (p *retryPolicy) allows(r *http.Request) bool {
+	if !p.repeatable(r) {
+		return false
+	}
+	return r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody || (r.ContentLength > 0 && r.ContentLength <= p.maxBody)
+}
+
+// retriesError reports whether the policy retries the error
+func (p *retryPolicy) retriesError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.connectErrors
+	}
+	return p.timeouts && isTimeout(err)
+}
+
+// shouldRetry reports whether the outcome of an attempt, a response or an
+// error, is retried for the request
+func (p *retryPolicy) shouldRetry(r *http.Request, resp *http.Response, err error) bool {
+	if !p.allows(r) {
+		return false
+	}
+
+	// The overall request deadline has passed or the client went away
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return p.retriesError(err)
+	}
+	return p.statuses[resp.StatusCode]
+}
+
+// bufferBody reads a replayable request body into memory. The returned
+// function rewinds the body before each attempt.
+func (p *retryPolicy) bufferBody(r *http.Request) (func(), error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength <= 0 || !p.allows(r) {
+		return func() {}, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() { r.Body = io.NopCloser(bytes.NewReader(body)) }, nil
+}
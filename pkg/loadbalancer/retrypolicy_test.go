@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+	unavailableURL, _ := url.Parse(unavailable.URL)
+	echoURL, _ := url.Parse(echo.URL)
+
+	policy, err := parseRetryPolicy("get,head", "connect-error,503", "Idempotency-Key", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers:     []*Server{{URL: unavailableURL, Alive: true}, {URL: echoURL, Alive: true}},
+		current:     -1,
+		retries:     1,
+		retryPolicy: policy,
+	}
+	send := func(method, body, key string) *httptest.ResponseRecorder {
+		lb.current = -1
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("GET", "", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected GET to be retried after a 503, got %d", w.Code)
+	}
+	if w := send("POST", "order", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected POST without an idempotency key not to be retried, got %d", w.Code)
+	}
+	if w := send("POST", "order", "abc"); w.Code != http.StatusOK || w.Body.String() != "order" {
+		t.Errorf("Expected POST with an idempotency key to be retried with its body, got %d %q", w.Code, w.Body.String())
+	}
+	if w := send("POST", strings.Repeat("x", 17), "abc"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a body over the replay limit not to be retried, got %d", w.Code)
+	}
+
+	// Connection failures are only retried when the policy names them
+	lb.servers[0].URL = closedServerURL(t)
+	if w := send("HEAD", "", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected HEAD to be retried after a connection failure, got %d", w.Code)
+	}
+	lb.retryPolicy, _ = parseRetryPolicy("GET", "503", "", 0)
+	if w := send("GET", "", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected connection failures not to be retried, got %d", w.Code)
+	}
+}
+
+func TestParseRetryPolicy(t *testing.T) {
+	policy, err := parseRetryPolicy("GET", "5xx,timeout", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.statuses[500] || !policy.statuses[599] || policy.statuses[429] || !policy.timeouts || policy.connectErrors {
+		t.Errorf("Expected 5xx and timeouts to be retried, got %+v", policy)
+	}
+	for _, on := range []string{"refused", "99", "600"} {
+		if _, err := parseRetryPolicy("GET", on, "", 0); err == nil {
+			t.Errorf("Expected %q to be rejected", on)
+		}
+	}
+	if _, err := parseRetryPolicy("GET", "", "", -1); err == nil {
+		t.Error("Expected a negative body limit to be rejected")
+	}
+}
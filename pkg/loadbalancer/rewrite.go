@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule replaces the path forwarded to backends. A prefix rule
+// replaces a leading path prefix; a pattern rule replaces what a regular
+// expression matches, with $1 or ${name} expanding capture groups.
+type rewriteRule struct {
+	prefix      string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseRewrites parses /prefix=/replacement and ~regex=/replacement rules
+func parseRewrites(defs []string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	for _, def := range defs {
+		// The replacement starts with /, which tells the separator apart from
+		// an = in a regular expression
+		from, to, ok := strings.Cut(def, "=/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rewrite %q, expected /prefix=/replacement or ~regex=/replacement", def)
+		}
+		rule := rewriteRule{replacement: "/" + to}
+		switch {
+		case strings.HasPrefix(from, "~"):
+			pattern, err := regexp.Compile(from[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite %q: %w", def, err)
+			}
+			rule.pattern = pattern
+		case strings.HasPrefix(from, "/"):
+			rule.prefix = strings.TrimSuffix(from, "/")
+		default:
+			return nil, fmt.Errorf("invalid rewrite %q, expected /prefix=/replacement or ~regex=/replacement", def)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply rewrites the path, reporting whether the rule matched
+func (rule rewriteRule) apply(path string) (string, bool) {
+	if rule.pattern != nil {
+		if !rule.pattern.MatchString(path) {
+			return path, false
+		}
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return path, true
+	}
+	if !(pathRoute{prefix: rule.prefix}).matches(path) {
+		return path, false
+	}
+	rest := strings.TrimPrefix(path, rule.prefix)
+	if rest == "" {
+		return rule.replacement, true
+	}
+	return strings.TrimSuffix(rule.replacement, "/") + rest, true
+}
+
+// rewritePath applies the first rewrite rule matching the request path
+func (lb *LoadBalancer) rewritePath(path string) (string, bool) {
+	for _, rule := range lb.rewrites {
+		if rewritten, ok := rule.apply(path); ok {
+			return rewritten, true
+		}
+	}
+	return path, false
+}
+
+// Query rewrite operations
+const (
+	queryDel    = "del"    // Remove a parameter
+	queryRename = "rename" // Rename a parameter, keeping its values
+	querySet    = "set"    // Replace a parameter's values with one value
+	queryAdd    = "add"    // Append a value to a parameter
+)
+
+// queryAction is one change to the query string
+type queryAction struct {
+	op    string
+	name  string
+	value string // Value for set and add, new name for rename
+}
+
+// queryRewrite changes the query string of requests under a path prefix
+type queryRewrite struct {
+	prefix  string
+	actions []queryAction
+}
+
+// parseQueryRewrites parses /prefix=op:name[=value],... rules, e.g.
+// /api=del:debug,set:version=2,rename:q=search
+func parseQueryRewrites(defs []string) ([]queryRewrite, error) {
+	var rules []queryRewrite
+	for _, def := range defs {
+		prefix, list, ok := strings.Cut(def, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || list == "" {
+			return nil, fmt.Errorf("invalid query rewrite %q, expected /prefix=op:name[=value],...", def)
+		}
+		rule := queryRewrite{prefix: strings.TrimSuffix(prefix, "/")}
+		for _, item := range strings.Split(list, ",") {
+			op, arg, _ := strings.Cut(item, ":")
+			name, value, hasValue := strings.Cut(arg, "=")
+			valid := name != ""
+			switch op {
+			case queryDel:
+				valid = valid && !hasValue
+			case querySet, queryAdd:
+				valid = valid && hasValue
+			case queryRename:
+				valid = valid && value != ""
+			default:
+				valid = false
+			}
+			if !valid {
+				return nil, fmt.Errorf("invalid query rewrite %q: bad action %q, expected del:name, set:name=value, add:name=value or rename:old=new", def, item)
+			}
+			rule.actions = append(rule.actions, queryAction{op: op, name: name, value: value})
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply makes the rule's changes to the query parameters
+func (rule queryRewrite) apply(query url.Values) {
+	for _, action := range rule.actions {
+		switch action.op {
+		case queryDel:
+			query.Del(action.name)
+		case queryRename:
+			if values, ok := query[action.name]; ok {
+				query.Del(action.name)
+				query[action.value] = values
+			}
+		case querySet:
+			query.Set(action.name, action.value)
+		case queryAdd:
+			query.Add(action.name, action.value)
+		}
+	}
+}
+
+// backendQuery returns the query string forwarded to backends, with the
+// query rewrites matching the request path applied in order. Without a
+// matching rule the query is forwarded untouched.
+func (lb *LoadBalancer) backendQuery(r *http.Request) string {
+	var query url.Values
+	for _, rule := range lb.queryRewrites {
+		if !(pathRoute{prefix: rule.prefix}).matches(r.URL.Path) {
+			continue
+		}
+		if query == nil {
+			query = r.URL.Query()
+		}
+		rule.apply(query)
+	}
+	if query == nil {
+		return r.URL.RawQuery
+	}
+	return query.Encode()
+}
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	rules, err := parseRewrites([]string{
+		`/old=/new`,
+		`/legacy/=/`,
+		`~^/users/(\d+)/posts/(?P<post>\d+)$=/api/posts/${post}/by/$1`,
+		`~\.php$=/index`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{rewrites: rules}
+	for path, want := range map[string]string{
+		"/old":              "/new",
+		"/old/a/b":          "/new/a/b",
+		"/older":            "/older",
+		"/legacy/orders":    "/orders",
+		"/legacy":           "/",
+		"/users/7/posts/42": "/api/posts/42/by/7",
+		"/users/7/posts":    "/users/7/posts",
+		"/blog/feed.php":    "/blog/feed/index",
+	} {
+		if got, _ := lb.rewritePath(path); got != want {
+			t.Errorf("rewritePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	for _, def := range []string{"/old", "old=/new", "/old=new", "~([=/x"} {
+		if _, err := parseRewrites([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
+
+func TestQueryRewrites(t *testing.T) {
+	rules, err := parseQueryRewrites([]string{"/api=del:debug,rename:q=search,set:version=2", "/api/v1=add:compat=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{queryRewrites: rules}
+	for target, want := range map[string]string{
+		"/api/items?q=shoes&debug=1&version=1": "search=shoes&version=2",
+		"/api/v1/items?tag=a":                  "compat=1&tag=a&version=2",
+		"/web?debug=1&b=2&a=1":                 "debug=1&b=2&a=1",
+	} {
+		if got := lb.backendQuery(httptest.NewRequest("GET", target, nil)); got != want {
+			t.Errorf("backendQuery(%q) = %q, want %q", target, got, want)
+		}
+	}
+
+	for _, def := range []string{"/api", "api=del:x", "/api=", "/api=del:x=1", "/api=set:x", "/api=rename:x", "/api=drop:x"} {
+		if _, err := parseQueryRewrites([]string{def}); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
+
+func TestRewriteForwarded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	rules, _ := parseRewrites([]string{"/shop=/store"})
+	queryRules, _ := parseQueryRewrites([]string{"/shop=set:channel=web"})
+	lb := &LoadBalancer{servers: []*Server{{URL: backendURL, Alive: true}}, current: -1, rewrites: rules, queryRewrites: queryRules}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/shop/cart?id=3", nil))
+	if got := w.Body.String(); got != "/store/cart?channel=web&id=3" {
+		t.Errorf("Expected the rewritten URL to be forwarded, got %q", got)
+	}
+}
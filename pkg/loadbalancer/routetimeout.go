@@ -0,0 +1,81 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// routeTimeout replaces the proxy timeouts of requests under a path prefix
+type routeTimeout struct {
+	prefix         string
+	request        time.Duration // The whole exchange, 0 for no limit
+	responseHeader time.Duration // Waiting for response headers, 0 for no limit
+}
+
+// parseRouteTimeouts parses /path/prefix=duration[,header=duration]
+// timeouts. Without header= the route's response header timeout is its
+// request timeout, or the global one for a route without a request timeout.
+func parseRouteTimeouts(defs []string, global proxyTimeouts) ([]routeTimeout, error) {
+	var timeouts []routeTimeout
+	for _, def := range defs {
+		prefix, value, ok := strings.Cut(def, "=")
+		request, header, hasHeader := strings.Cut(value, ",header=")
+		route := routeTimeout{prefix: strings.TrimSuffix(prefix, "/")}
+		var err error
+		if route.request, err = time.ParseDuration(request); err != nil || !ok || !strings.HasPrefix(prefix, "/") || route.request < 0 {
+			return nil, fmt.Errorf("invalid route timeout %q, expected /path/prefix=duration[,header=duration]", def)
+		}
+		switch {
+		case hasHeader:
+			if route.responseHeader, err = time.ParseDuration(header); err != nil || route.responseHeader < 0 {
+				return nil, fmt.Errorf("invalid response header timeout in %q", def)
+			}
+		case route.request > 0:
+			route.responseHeader = route.request
+		default:
+			route.responseHeader = global.responseHeader
+		}
+		timeouts = append(timeouts, route)
+	}
+	return timeouts, nil
+}
+
+// timeoutsFor returns the request and response header timeouts of the
+// request path: those of the longest matching route, or the global ones
+func (lb *LoadBalancer) timeoutsFor(path string) (request, responseHeader time.Duration) {
+	request, responseHeader = lb.timeouts.request, lb.timeouts.responseHeader
+	longest := -1
+	for _, route := range lb.routeTimeouts {
+		if (pathRoute{prefix: route.prefix}).matches(path) && len(route.prefix) > longest {
+			request, responseHeader, longest = route.request, route.responseHeader, len(route.prefix)
+		}
+	}
+	return request, responseHeader
+}
+
+// errResponseHeaderTimeout fails an attempt whose backend did not send
+// response headers in time
+var errResponseHeaderTimeout = fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)
+
+// sendWithHeaderTimeout sends the request, failing it when the response
+// headers do not arrive within timeout. The timeout is enforced here rather
+// than by the transport so that routes can override it.
+func (lb *LoadBalancer) sendWithHeaderTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return lb.upstreamClient().Do(req)
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errResponseHeaderTimeout) })
+	resp, err := lb.upstreamClient().Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired, cancelling the response body as well
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errResponseHeaderTimeout
+	}
+	return resp, err
+}
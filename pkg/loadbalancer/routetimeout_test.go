@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		time.Sleep(delay)
+		fmt.Fprint(w, "done")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	timeouts := proxyTimeouts{responseHeader: 50 * time.Millisecond, request: 50 * time.Millisecond}
+	routes, err := parseRouteTimeouts([]string{"/export=1s", "/export/fast=20ms", "/stream=0,header=50ms"}, timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{
+		servers:       []*Server{{URL: backendURL, Alive: true}},
+		current:       -1,
+		timeouts:      timeouts,
+		routeTimeouts: routes,
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if code := get("/api?delay=200ms"); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the global timeout to apply, got %d", code)
+	}
+	if code := get("/export/report?delay=200ms"); code != http.StatusOK {
+		t.Errorf("Expected the route timeout to lift the global one, got %d", code)
+	}
+	if code := get("/export/fast?delay=40ms"); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the longest route prefix to win, got %d", code)
+	}
+	if code := get("/stream?delay=200ms"); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the route's response header timeout to apply, got %d", code)
+	}
+	if request, header := lb.timeoutsFor("/stream/events"); request != 0 || header != 50*time.Millisecond {
+		t.Errorf("Expected no request timeout and a 50ms header timeout, got %s and %s", request, header)
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	global := proxyTimeouts{responseHeader: 30 * time.Second}
+	routes, err := parseRouteTimeouts([]string{"/export/=2m", "/events=0"}, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].prefix != "/export" || routes[0].request != 2*time.Minute || routes[0].responseHeader != 2*time.Minute {
+		t.Errorf("Expected the route timeout to cover response headers, got %+v", routes[0])
+	}
+	if routes[1].request != 0 || routes[1].responseHeader != 30*time.Second {
+		t.Errorf("Expected a route without request timeout to keep the global header timeout, got %+v", routes[1])
+	}
+	for _, def := range []string{"export=1s", "/export", "/export=soon", "/export=-1s", "/export=1s,header=x"} {
+		if _, err := parseRouteTimeouts([]string{def}, global); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
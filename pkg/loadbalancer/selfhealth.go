@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Paths of the load balancer's own health endpoints, enabled with -self-health
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// serveSelfHealth answers the liveness and readiness probes of the load
+// balancer itself, reporting whether the request was one of them. The
+// probes need no admin credentials so orchestrators can reach them.
+func (lb *LoadBalancer) serveSelfHealth(w http.ResponseWriter, r *http.Request) bool {
+	if !lb.selfHealth || (r.URL.Path != livenessPath && r.URL.Path != readinessPath) {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Path == readinessPath {
+		if err := lb.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return true
+		}
+	}
+	io.WriteString(w, "ok\n")
+	return true
+}
+
+// ready returns why the load balancer cannot serve traffic yet, or nil once
+// every backend known at startup has been health checked and at least one
+// backend is healthy
+func (lb *LoadBalancer) ready() error {
+	if !lb.initialChecksDone() {
+		return errors.New("initial health checks pending")
+	}
+	for _, server := range lb.allServers() {
+		if server.IsAlive() {
+			return nil
+		}
+	}
+	return errors.New("no healthy backend")
+}
+
+// initialChecksDone reports whether every backend scheduled for health
+// checks at startup has completed its first check. Once done it stays done,
+// so backends discovered later do not flip readiness.
+func (lb *LoadBalancer) initialChecksDone() bool {
+	if lb.initialChecked.Load() {
+		return true
+	}
+	for _, server := range lb.initialServers {
+		if !server.health.checked() {
+			return false
+		}
+	}
+	lb.initialChecked.Store(true)
+	return true
+}
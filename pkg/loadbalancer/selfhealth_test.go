@@ -0,0 +1,50 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSelfHealth(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	server := &Server{URL: u, Alive: true}
+	lb := &LoadBalancer{servers: []*Server{server}, current: -1, selfHealth: true}
+	lb.initialServers = lb.allServers()
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		if !lb.serveSelfHealth(rec, httptest.NewRequest(http.MethodGet, path, nil)) {
+			t.Fatalf("Expected %s to be answered", path)
+		}
+		return rec
+	}
+	if rec := probe("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the liveness probe to pass, got %d", rec.Code)
+	}
+	if rec := probe("/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to wait for the first health check, got %d", rec.Code)
+	}
+
+	lb.recordHealthCheck(server, false)
+	if rec := probe("/readyz"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "no healthy backend\n" {
+		t.Errorf("Expected readiness to fail without a healthy backend, got %d %q", rec.Code, rec.Body.String())
+	}
+	lb.recordHealthCheck(server, true)
+	if rec := probe("/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected readiness once a backend is healthy, got %d", rec.Code)
+	}
+
+	// Backends discovered later do not hold readiness back
+	late, _ := url.Parse("http://127.0.0.1:2")
+	lb.initialServers = append(lb.initialServers, &Server{URL: late})
+	if err := lb.ready(); err != nil {
+		t.Errorf("Expected readiness to stay once reached, got %s", err)
+	}
+
+	lb.selfHealth = false
+	if lb.serveSelfHealth(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil)) {
+		t.Error("Expected the probes to be off without -self-health")
+	}
+}
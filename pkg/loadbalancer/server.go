@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Server represents a backend server
+type Server struct {
+	URL          *url.URL
+	Alive        bool
+	mux          sync.RWMutex
+	ReverseProxy http.Handler
+
+	// Weight for weighted round-robin, nil means the default weight of 1
+	weight *weightRamp
+
+	// Circuit breaker, nil when disabled
+	breaker *circuitBreaker
+
+	// Quarantine limiting the server to a trickle of traffic, nil when
+	// the server is in full rotation
+	quarantine *quarantine
+
+	// Consecutive active health check results
+	health healthState
+
+	// Consecutive failures seen by live traffic
+	passive passiveHealth
+
+	// Outcomes in the current outlier detection window
+	outlier outlierStats
+
+	// Compatibility probe result, admitting the server to rotation
+	compat compatState
+
+	// Requests and connections handled, for the stats page
+	requests atomic.Int64
+
+	// Requests in flight and their cap, 0 for no cap
+	inflight      atomic.Int64
+	maxConcurrent atomic.Int64
+}
+
+// NewServer returns a backend server for the URL, alive until a health
+// check finds otherwise
+func NewServer(u *url.URL) *Server {
+	return &Server{URL: u, Alive: true}
+}
+
+// SetAlive updates the alive status of the backend server
+func (s *Server) SetAlive(alive bool) {
+	s.mux.Lock()
+	s.Alive = alive
+	s.mux.Unlock()
+}
+
+// IsAlive returns true when the backend server is alive
+func (s *Server) IsAlive() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Alive
+}
@@ -0,0 +1,36 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// sniRoutes maps TLS server names to pool names. A pattern may be an exact
+// hostname or a wildcard such as "*.example.com" matching one label.
+type sniRoutes map[string]string
+
+// match returns the pool name for the server name
+func (routes sniRoutes) match(serverName string) (string, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if pool, ok := routes[serverName]; ok {
+		return pool, true
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		if pool, ok := routes["*"+serverName[i:]]; ok {
+			return pool, true
+		}
+	}
+	return "", false
+}
+
+// sniPool returns the pool routed to by the SNI name of a TLS request
+func (lb *LoadBalancer) sniPool(r *http.Request) *Pool {
+	if r.TLS == nil || r.TLS.ServerName == "" || len(lb.sniRoutes) == 0 {
+		return nil
+	}
+	name, ok := lb.sniRoutes.match(r.TLS.ServerName)
+	if !ok {
+		return nil
+	}
+	return lb.pools[name]
+}
@@ -0,0 +1,61 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSNIRoutesMatch(t *testing.T) {
+	routes := sniRoutes{
+		"api.example.com": "api",
+		"*.example.com":   "web",
+	}
+
+	tests := []struct {
+		serverName string
+		pool       string
+		ok         bool
+	}{
+		{"api.example.com", "api", true},
+		{"API.example.com.", "api", true},
+		{"www.example.com", "web", true},
+		{"example.com", "", false},
+		{"a.b.example.com", "", false},
+		{"other.org", "", false},
+	}
+
+	for _, tt := range tests {
+		pool, ok := routes.match(tt.serverName)
+		if pool != tt.pool || ok != tt.ok {
+			t.Errorf("%s: expected (%q, %t), got (%q, %t)", tt.serverName, tt.pool, tt.ok, pool, ok)
+		}
+	}
+}
+
+func TestNextServerForSNI(t *testing.T) {
+	defaultServer := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	apiServer := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:9000"}, Alive: true}
+
+	lb := &LoadBalancer{
+		servers:   []*Server{defaultServer},
+		pools:     map[string]*Pool{"api": newPool("api", []*Server{apiServer})},
+		sniRoutes: sniRoutes{"api.example.com": "api"},
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	if s := lb.nextServerFor(r); s != defaultServer {
+		t.Errorf("Expected plain HTTP request to use the default servers")
+	}
+
+	r.TLS = &tls.ConnectionState{ServerName: "api.example.com"}
+	if s := lb.nextServerFor(r); s != apiServer {
+		t.Errorf("Expected api.example.com to be routed to the api pool")
+	}
+
+	r.TLS = &tls.ConnectionState{ServerName: "other.example.com"}
+	if s := lb.nextServerFor(r); s != defaultServer {
+		t.Errorf("Expected unrouted server name to use the default servers")
+	}
+}
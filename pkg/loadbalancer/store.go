@@ -0,0 +1,245 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is the key/value state backend shared by stateful subsystems such
+// as rate limiting, sticky sessions, idempotency caching and quotas. A TTL
+// of zero means the key does not expire.
+type Store interface {
+	// Get returns the value of a key and whether it exists
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores a value, replacing any existing one
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Incr adds delta to an integer key and returns the new value. The TTL
+	// is applied only when the key is created, giving fixed windows.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Delete removes a key
+	Delete(ctx context.Context, key string) error
+	// Watch delivers the new value of a key whenever it changes (nil when
+	// deleted) until the context is cancelled
+	Watch(ctx context.Context, key string) (<-chan []byte, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// newStore creates a store from a URL: "memory", "bolt:///path/to/lb.db"
+// or "redis://host:6379/0"
+func newStore(rawURL string) (Store, error) {
+	if rawURL == "" || rawURL == "memory" {
+		return newSweptMemoryStore(), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL: %w", err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return newSweptMemoryStore(), nil
+	case "bolt":
+		return newBoltStore(u.Path)
+	case "redis", "rediss":
+		return newRedisStore(rawURL)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", u.Scheme)
+	}
+}
+
+// storeWatchers fans out key changes to in-process watchers
+type storeWatchers struct {
+	mu       sync.Mutex
+	watchers map[string][]chan []byte
+}
+
+// add registers a watcher for a key that is removed when ctx is done
+func (w *storeWatchers) add(ctx context.Context, key string) <-chan []byte {
+	ch := make(chan []byte, 16)
+	w.mu.Lock()
+	if w.watchers == nil {
+		w.watchers = make(map[string][]chan []byte)
+	}
+	w.watchers[key] = append(w.watchers[key], ch)
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		list := w.watchers[key]
+		for i, c := range list {
+			if c == ch {
+				w.watchers[key] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(w.watchers[key]) == 0 {
+			delete(w.watchers, key)
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// notify delivers a new value to the key's watchers, dropping it for
+// watchers that are not keeping up
+func (w *storeWatchers) notify(key string, value []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.watchers[key] {
+		select {
+		case ch <- value:
+		default:
+		}
+	}
+}
+
+// memoryEntry is a value with an optional expiry
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// expired reports whether the entry has passed its expiry
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// memoryStore is an in-process Store
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	storeWatchers
+	now  func() time.Time
+	done chan struct{}
+}
+
+// newMemoryStore creates an empty in-memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string]memoryEntry),
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+}
+
+// newSweptMemoryStore creates a memory store that periodically drops
+// expired keys until it is closed
+func newSweptMemoryStore() *memoryStore {
+	s := newMemoryStore()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// expiry returns the absolute expiry for a TTL
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// lookup returns a live entry, dropping it when expired. Must hold s.mu.
+func (s *memoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if ok && entry.expired(s.now()) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	return entry.value, ok, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	s.entries[key] = memoryEntry{value: value, expires: expiry(s.now(), ttl)}
+	s.mu.Unlock()
+	s.notify(key, value)
+	return nil
+}
+
+func (s *memoryStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	entry, ok := s.lookup(key)
+	var n int64
+	if ok {
+		current, err := strconv.ParseInt(string(entry.value), 10, 64)
+		if err != nil {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("value of %s is not an integer", key)
+		}
+		n = current
+	} else {
+		entry.expires = expiry(s.now(), ttl)
+	}
+	n += delta
+	entry.value = []byte(strconv.FormatInt(n, 10))
+	s.entries[key] = entry
+	s.mu.Unlock()
+
+	s.notify(key, entry.value)
+	return n, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	s.notify(key, nil)
+	return nil
+}
+
+func (s *memoryStore) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	return s.add(ctx, key), nil
+}
+
+// sweep removes expired entries
+func (s *memoryStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+// storeKey namespaces keys used by a subsystem, e.g. storeKey("ratelimit", ip)
+func storeKey(parts ...string) string {
+	return "lb:" + strings.Join(parts, ":")
+}
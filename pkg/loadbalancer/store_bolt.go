@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds all load balancer keys
+var boltBucket = []byte("lb")
+
+// boltStore is a Store persisted to a local Bolt database, for single
+// instance deployments that need state to survive restarts. Expired keys
+// are removed every minute.
+type boltStore struct {
+	db *bolt.DB
+	storeWatchers
+	done chan struct{}
+}
+
+// newBoltStore opens or creates the database file
+func newBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt store requires a file path")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &boltStore{db: db, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// encodeBoltValue prefixes the value with its expiry in unix nanoseconds
+func encodeBoltValue(value []byte, expires time.Time) []byte {
+	var nanos int64
+	if !expires.IsZero() {
+		nanos = expires.UnixNano()
+	}
+	buf := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(buf, uint64(nanos))
+	return append(buf, value...)
+}
+
+// decodeBoltValue splits a stored value, reporting false when it has expired
+func decodeBoltValue(data []byte) ([]byte, time.Time, bool) {
+	if len(data) < 8 {
+		return nil, time.Time{}, false
+	}
+	var expires time.Time
+	if nanos := int64(binary.BigEndian.Uint64(data[:8])); nanos != 0 {
+		expires = time.Unix(0, nanos)
+		if !time.Now().Before(expires) {
+			return nil, expires, false
+		}
+	}
+	return append([]byte(nil), data[8:]...), expires, true
+}
+
+func (s *boltStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var value []byte
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value, _, ok = decodeBoltValue(tx.Bucket(boltBucket).Get([]byte(key)))
+		return nil
+	})
+	return value, ok, err
+}
+
+func (s *boltStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), encodeBoltValue(value, expiry(time.Now(), ttl)))
+	})
+	if err == nil {
+		s.notify(key, value)
+	}
+	return err
+}
+
+func (s *boltStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	var n int64
+	var value []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		current, expires, ok := decodeBoltValue(bucket.Get([]byte(key)))
+		if ok {
+			parsed, err := strconv.ParseInt(string(current), 10, 64)
+			if err != nil {
+				return fmt.Errorf("value of %s is not an integer", key)
+			}
+			n = parsed
+		} else {
+			expires = expiry(time.Now(), ttl)
+		}
+		n += delta
+		value = []byte(strconv.FormatInt(n, 10))
+		return bucket.Put([]byte(key), encodeBoltValue(value, expires))
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.notify(key, value)
+	return n, nil
+}
+
+func (s *boltStore) Delete(ctx context.Context, key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+	if err == nil {
+		s.notify(key, nil)
+	}
+	return err
+}
+
+func (s *boltStore) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	return s.add(ctx, key), nil
+}
+
+// sweep removes expired keys
+func (s *boltStore) sweep() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		// Deleting while iterating makes the cursor skip keys
+		var expired [][]byte
+		bucket.ForEach(func(key, data []byte) error {
+			if _, _, ok := decodeBoltValue(data); !ok {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
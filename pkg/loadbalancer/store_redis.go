@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisIncrScript increments a key and sets its expiry only on creation
+var redisIncrScript = redis.NewScript(`
+local n = redis.call("INCRBY", KEYS[1], ARGV[1])
+if n == tonumber(ARGV[1]) and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return n
+`)
+
+// redisStore is a Store backed by Redis, sharing state between load
+// balancer instances. Changes are published on a per-key channel so every
+// instance's watchers see them.
+type redisStore struct {
+	client *redis.Client
+}
+
+// newRedisStore connects using a redis:// URL
+func newRedisStore(rawURL string) (*redisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis store URL: %w", err)
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+// watchChannel is the pub/sub channel announcing changes to a key
+func watchChannel(key string) string {
+	return "lb-watch:" + key
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return err
+	}
+	return s.client.Publish(ctx, watchChannel(key), value).Err()
+}
+
+func (s *redisStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	n, err := redisIncrScript.Run(ctx, s.client, []string{key}, delta, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	s.client.Publish(ctx, watchChannel(key), n)
+	return n, nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, key).Err(); err != nil {
+		return err
+	}
+	return s.client.Publish(ctx, watchChannel(key), "").Err()
+}
+
+func (s *redisStore) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	sub := s.client.Subscribe(ctx, watchChannel(key))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	ch := make(chan []byte, 16)
+	go func() {
+		defer close(ch)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var value []byte
+				if msg.Payload != "" {
+					value = []byte(msg.Payload)
+				}
+				select {
+				case ch <- value:
+				default:
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
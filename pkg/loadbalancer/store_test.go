@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testStore runs the behaviour shared by every Store implementation
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	defer store.Close()
+
+	if _, ok, _ := store.Get(ctx, "missing"); ok {
+		t.Errorf("Expected missing key to not exist")
+	}
+
+	store.Set(ctx, "greeting", []byte("hello"), 0)
+	if value, ok, _ := store.Get(ctx, "greeting"); !ok || string(value) != "hello" {
+		t.Errorf("Expected hello, got %q (%t)", value, ok)
+	}
+
+	n, _ := store.Incr(ctx, "counter", 2, time.Hour)
+	n, _ = store.Incr(ctx, "counter", 3, time.Hour)
+	if n != 5 {
+		t.Errorf("Expected counter to be 5, got %d", n)
+	}
+
+	// Keys expire after their TTL
+	store.Set(ctx, "short", []byte("x"), 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, _ := store.Get(ctx, "short"); ok {
+		t.Errorf("Expected key to expire")
+	}
+
+	// Watchers see changes until cancelled
+	watchCtx, cancel := context.WithCancel(ctx)
+	changes, err := store.Watch(watchCtx, "watched")
+	if err != nil {
+		t.Fatalf("Watch failed: %s", err)
+	}
+	store.Set(ctx, "watched", []byte("v1"), 0)
+	store.Delete(ctx, "watched")
+	if value := <-changes; string(value) != "v1" {
+		t.Errorf("Expected watcher to see v1, got %q", value)
+	}
+	if value := <-changes; value != nil {
+		t.Errorf("Expected watcher to see deletion, got %q", value)
+	}
+	cancel()
+	for range changes {
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "lb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %s", err)
+	}
+	testStore(t, store)
+}
+
+func TestBoltStoreSweep(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "lb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %s", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	store.Set(ctx, "kept", []byte("x"), 0)
+	for _, key := range []string{"a", "b", "c"} {
+		store.Incr(ctx, key, 1, 10*time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := store.sweep(); err != nil {
+		t.Fatalf("Sweep failed: %s", err)
+	}
+	var keys []string
+	store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "kept" {
+		t.Errorf("Expected only the key without a TTL to be kept, got %q", keys)
+	}
+}
+
+func TestNewStoreUnknownType(t *testing.T) {
+	if _, err := newStore("etcd://localhost"); err == nil {
+		t.Errorf("Expected an error for an unknown store type")
+	}
+}
@@ -0,0 +1,196 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syntheticCheck is a user-defined request sent through the full proxy
+// path at a fixed interval, e.g.
+//
+//	{"name": "login", "method": "POST", "path": "/api/login", "body": "{}",
+//	 "interval": "30s", "expect_status": 200, "expect_body": "token",
+//	 "max_latency": "500ms"}
+type syntheticCheck struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Host         string            `json:"host"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	Interval     string            `json:"interval"`
+	ExpectStatus int               `json:"expect_status"`
+	ExpectBody   string            `json:"expect_body"`
+	MaxLatency   string            `json:"max_latency"`
+
+	interval   time.Duration
+	maxLatency time.Duration
+}
+
+// syntheticResult is the outcome of the latest run of a synthetic check
+type syntheticResult struct {
+	Name    string    `json:"name"`
+	OK      bool      `json:"ok"`
+	Status  int       `json:"status"`
+	Latency float64   `json:"latency_ms"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// synthetics runs synthetic checks and keeps their latest results
+type synthetics struct {
+	checks []*syntheticCheck
+
+	mu      sync.Mutex
+	results map[string]syntheticResult
+}
+
+// loadSynthetics reads synthetic check definitions from a JSON file
+// holding {"checks": [...]}
+func loadSynthetics(path string) (*synthetics, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Checks []*syntheticCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid synthetic checks file: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, check := range doc.Checks {
+		if err := check.validate(); err != nil {
+			return nil, err
+		}
+		if seen[check.Name] {
+			return nil, fmt.Errorf("synthetic check %s is defined more than once", check.Name)
+		}
+		seen[check.Name] = true
+	}
+	return &synthetics{checks: doc.Checks, results: make(map[string]syntheticResult)}, nil
+}
+
+// validate checks a definition and fills in defaults
+func (c *syntheticCheck) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("synthetic check without a name")
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("synthetic check %s: path must start with /", c.Name)
+	}
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+	if c.ExpectStatus == 0 {
+		c.ExpectStatus = http.StatusOK
+	}
+
+	c.interval = time.Minute
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("synthetic check %s: invalid interval %q", c.Name, c.Interval)
+		}
+		c.interval = d
+	}
+	if c.MaxLatency != "" {
+		d, err := time.ParseDuration(c.MaxLatency)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("synthetic check %s: invalid max_latency %q", c.Name, c.MaxLatency)
+		}
+		c.maxLatency = d
+	}
+	return nil
+}
+
+// runSynthetic sends the check's request through the proxy path in process
+// and validates the response
+func (lb *LoadBalancer) runSynthetic(check *syntheticCheck) syntheticResult {
+	req := httptest.NewRequest(check.Method, check.Path, strings.NewReader(check.Body))
+	req.RemoteAddr = "127.0.0.1:0"
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+	for name, value := range check.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, req)
+	latency := time.Since(start)
+
+	result := syntheticResult{Name: check.Name, Status: w.Code, Latency: durationMs(latency), Time: start}
+	switch {
+	case w.Code != check.ExpectStatus:
+		result.Error = fmt.Sprintf("status %d, expected %d", w.Code, check.ExpectStatus)
+	case check.ExpectBody != "" && !strings.Contains(w.Body.String(), check.ExpectBody):
+		result.Error = fmt.Sprintf("body does not contain %q", check.ExpectBody)
+	case check.maxLatency > 0 && latency > check.maxLatency:
+		result.Error = fmt.Sprintf("latency %s exceeds %s", latency.Round(time.Millisecond), check.maxLatency)
+	default:
+		result.OK = true
+	}
+
+	outcome := "pass"
+	if !result.OK {
+		outcome = "fail"
+	}
+	lb.metrics().IncCounter("lb_synthetic_checks_total", map[string]string{"check": check.Name, "result": outcome})
+	lb.metrics().ObserveDuration("lb_synthetic_duration_seconds", latency, map[string]string{"check": check.Name})
+	return result
+}
+
+// recordSynthetic stores a result, emitting an event when a check starts or
+// stops failing
+func (lb *LoadBalancer) recordSynthetic(result syntheticResult) {
+	lb.synthetics.mu.Lock()
+	previous, seen := lb.synthetics.results[result.Name]
+	lb.synthetics.results[result.Name] = result
+	lb.synthetics.mu.Unlock()
+
+	if !result.OK && (!seen || previous.OK) {
+		lb.logf("Synthetic check %s failed: %s", result.Name, result.Error)
+		lb.emit(EventSyntheticFailed, "", fmt.Sprintf("synthetic check %s failed: %s", result.Name, result.Error))
+	} else if result.OK && seen && !previous.OK {
+		lb.logf("Synthetic check %s recovered", result.Name)
+		lb.emit(EventSyntheticRecovered, "", fmt.Sprintf("synthetic check %s recovered", result.Name))
+	}
+}
+
+// ScheduleSynthetics runs every synthetic check at its interval
+func (lb *LoadBalancer) ScheduleSynthetics() {
+	for _, check := range lb.synthetics.checks {
+		go func() {
+			ticker := time.NewTicker(check.interval)
+			defer ticker.Stop()
+			for {
+				lb.recordSynthetic(lb.runSynthetic(check))
+				<-ticker.C
+			}
+		}()
+	}
+}
+
+// handleSynthetics reports the latest result of every synthetic check
+func (lb *LoadBalancer) handleSynthetics(w http.ResponseWriter, r *http.Request) {
+	lb.synthetics.mu.Lock()
+	results := make([]syntheticResult, 0, len(lb.synthetics.checks))
+	for _, check := range lb.synthetics.checks {
+		if result, ok := lb.synthetics.results[check.Name]; ok {
+			results = append(results, result)
+		}
+	}
+	lb.synthetics.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
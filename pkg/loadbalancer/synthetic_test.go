@@ -0,0 +1,74 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSynthetics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checks.json")
+	os.WriteFile(path, []byte(`{"checks": [{"name": "home", "path": "/", "interval": "10s"}]}`), 0o644)
+	s, err := loadSynthetics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := s.checks[0]
+	if check.Method != "GET" || check.ExpectStatus != 200 || check.interval.Seconds() != 10 {
+		t.Errorf("Expected defaults to be filled in, got %+v", check)
+	}
+
+	for _, doc := range []string{
+		`{"checks": [{"path": "/"}]}`,
+		`{"checks": [{"name": "a", "path": "api"}]}`,
+		`{"checks": [{"name": "a", "path": "/", "interval": "often"}]}`,
+		`{"checks": [{"name": "a", "path": "/"}, {"name": "a", "path": "/b"}]}`,
+	} {
+		os.WriteFile(path, []byte(doc), 0o644)
+		if _, err := loadSynthetics(path); err == nil {
+			t.Errorf("Expected error for %s", doc)
+		}
+	}
+}
+
+func TestSyntheticCheck(t *testing.T) {
+	body := "all good"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	check := &syntheticCheck{Name: "home", Path: "/status", ExpectBody: "good"}
+	check.validate()
+	lb := &LoadBalancer{
+		servers:    []*Server{{URL: backendURL, Alive: true}},
+		current:    -1,
+		synthetics: &synthetics{checks: []*syntheticCheck{check}, results: make(map[string]syntheticResult)},
+	}
+	listener := &recordingListener{}
+	lb.AddEventListener(listener)
+
+	lb.recordSynthetic(lb.runSynthetic(check))
+	if result := lb.synthetics.results["home"]; !result.OK {
+		t.Fatalf("Expected check to pass, got %+v", result)
+	}
+
+	body = "degraded"
+	lb.recordSynthetic(lb.runSynthetic(check))
+	lb.recordSynthetic(lb.runSynthetic(check))
+	if result := lb.synthetics.results["home"]; result.OK {
+		t.Errorf("Expected check to fail on an unexpected body")
+	}
+	body = "good again"
+	lb.recordSynthetic(lb.runSynthetic(check))
+
+	// Only state changes are reported
+	if len(listener.events) != 2 || listener.events[0].Type != EventSyntheticFailed || listener.events[1].Type != EventSyntheticRecovered {
+		t.Errorf("Expected failed and recovered events, got %+v", listener.events)
+	}
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// syslogLocal names the local syslog daemon as a -syslog address
+const syslogLocal = "local"
+
+// syslogFacilities are the facility codes of RFC 5424 by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter sends messages to a syslog endpoint, Write with the
+// informational severity. *syslog.Writer satisfies it.
+type syslogWriter interface {
+	io.Writer
+	Info(msg string) error
+	Err(msg string) error
+	Close() error
+}
+
+// syslogEndpoint is where syslog messages are sent: network and address as
+// taken by log/syslog, both empty for the local daemon
+type syslogEndpoint struct {
+	network string
+	addr    string
+}
+
+// parseSyslogAddress parses local, udp://host[:port], tcp://host[:port] or
+// unix:///path. Remote endpoints default to port 514.
+func parseSyslogAddress(address string) (syslogEndpoint, error) {
+	if address == syslogLocal {
+		return syslogEndpoint{}, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return syslogEndpoint{}, fmt.Errorf("invalid syslog address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Hostname() == "" {
+			return syslogEndpoint{}, fmt.Errorf("invalid syslog address %q, expected a host", address)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "514"
+		}
+		return syslogEndpoint{network: u.Scheme, addr: net.JoinHostPort(u.Hostname(), port)}, nil
+	case "unix":
+		if u.Path == "" {
+			return syslogEndpoint{}, fmt.Errorf("invalid syslog address %q, expected a socket path", address)
+		}
+		return syslogEndpoint{network: "unix", addr: u.Path}, nil
+	}
+	return syslogEndpoint{}, fmt.Errorf("invalid syslog address %q, expected %s, udp://host:port, tcp://host:port or unix:///path", address, syslogLocal)
+}
+
+// parseSyslogFacility returns the code of a facility name such as local0
+func parseSyslogFacility(name string) (int, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q, expected kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp or local0 to local7", name)
+	}
+	return facility, nil
+}
+
+// openSyslog connects to the syslog endpoint, tagging messages with tag
+func openSyslog(address, facilityName, tag string) (syslogWriter, error) {
+	endpoint, err := parseSyslogAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	facility, err := parseSyslogFacility(facilityName)
+	if err != nil {
+		return nil, err
+	}
+	return dialSyslog(endpoint, facility, tag)
+}
+
+// syslogAccessLog sends access log lines to syslog with the informational
+// severity
+type syslogAccessLog struct {
+	syslog syslogWriter
+}
+
+func (l syslogAccessLog) Write(line []byte) (int, error) {
+	if err := l.syslog.Info(strings.TrimSuffix(string(line), "\n")); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// logErrorf logs an error message, with the error severity when logging to
+// syslog
+func (lb *LoadBalancer) logErrorf(format string, v ...any) {
+	if lb.syslog == nil {
+		lb.logf(format, v...)
+		return
+	}
+	lb.syslog.Err(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package loadbalancer
+
+import "errors"
+
+// dialSyslog reports that syslog is not supported, log/syslog being
+// unavailable on this platform
+func dialSyslog(endpoint syslogEndpoint, facility int, tag string) (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,122 @@
+package loadbalancer
+
+import (
+	"flag"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    syslogEndpoint
+	}{
+		{"local", syslogEndpoint{}},
+		{"udp://logs.internal", syslogEndpoint{network: "udp", addr: "logs.internal:514"}},
+		{"tcp://10.0.0.5:6514", syslogEndpoint{network: "tcp", addr: "10.0.0.5:6514"}},
+		{"unix:///dev/log", syslogEndpoint{network: "unix", addr: "/dev/log"}},
+	}
+	for _, tt := range tests {
+		got, err := parseSyslogAddress(tt.address)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSyslogAddress(%q) = %+v, %v, want %+v", tt.address, got, err, tt.want)
+		}
+	}
+	for _, address := range []string{"logs.internal:514", "udp://", "unix://", "http://logs"} {
+		if _, err := parseSyslogAddress(address); err == nil {
+			t.Errorf("Expected an error for syslog address %q", address)
+		}
+	}
+
+	if facility, err := parseSyslogFacility("LOCAL3"); err != nil || facility != 19 {
+		t.Errorf("Expected local3 to be facility 19, got %d, %v", facility, err)
+	}
+	if _, err := parseSyslogFacility("local8"); err == nil {
+		t.Error("Expected an error for an unknown facility")
+	}
+}
+
+func TestSyslogOutput(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("syslog is not supported on " + runtime.GOOS)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := openSyslog("udp://"+conn.LocalAddr().String(), "local3", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	lb := &LoadBalancer{syslog: w}
+
+	// Access log lines are informational, errors have the error severity
+	syslogAccessLog{syslog: w}.Write([]byte("GET / 200\n"))
+	lb.errorf("Error connecting to %s", "backend:80")
+
+	for _, want := range []string{"<158>", "<155>"} {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, want) || !strings.Contains(msg, " lb[") {
+			t.Errorf("Expected a message with priority %s tagged lb, got %q", want, msg)
+		}
+	}
+}
+
+func TestRunSyslogLeavesStandardLogger(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("syslog is not supported on " + runtime.GOOS)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The listener's unknown pool stops Run after the servers are logged
+	cfg, err := ParseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-server", "http://a", "-syslog", "udp://" + conn.LocalAddr().String(), "-listen", "127.0.0.1:0?pool=missing",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, flags := log.Writer(), log.Flags()
+	if err := Run(cfg); err == nil || !strings.Contains(err.Error(), "unknown pool") {
+		t.Fatalf("Expected Run to fail on the unknown pool, got %v", err)
+	}
+	if log.Writer() != output || log.Flags() != flags {
+		t.Error("Expected the standard logger to be left to the program")
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasSuffix(strings.TrimSpace(msg), "Added backend server: http://a") {
+		t.Errorf("Expected the startup log in syslog, got %q", msg)
+	}
+}
+
+func TestLintSyslog(t *testing.T) {
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-access-log", "syslog"), lintError, "requires -syslog") {
+		t.Error("Expected an error for a syslog access log without -syslog")
+	}
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-syslog", "local", "-syslog-facility", "nope"), lintError, "unknown syslog facility") {
+		t.Error("Expected an error for an unknown syslog facility")
+	}
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-syslog", "logs:514"), lintError, "invalid syslog address") {
+		t.Error("Expected an error for a syslog address without a scheme")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// dialSyslog connects to the endpoint. A unix socket is tried as a datagram
+// socket first, which is what syslog daemons usually listen on.
+func dialSyslog(endpoint syslogEndpoint, facility int, tag string) (syslogWriter, error) {
+	priority := syslog.Priority(facility<<3) | syslog.LOG_INFO
+	network := endpoint.network
+	if network == "unix" {
+		network = "unixgram"
+	}
+	w, err := syslog.Dial(network, endpoint.addr, priority, tag)
+	if err != nil && endpoint.network == "unix" {
+		w, err = syslog.Dial("unix", endpoint.addr, priority, tag)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return w, nil
+}
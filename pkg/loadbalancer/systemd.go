@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes sockets on
+const systemdFirstFD = 3
+
+// activatedSockets are the listening sockets passed by systemd socket
+// activation, taking the places of the listeners the load balancer would
+// otherwise open itself
+type activatedSockets struct {
+	plain []net.Listener // Serve plain HTTP, or TCP in tcp mode
+	tls   []net.Listener // Serve HTTPS
+}
+
+// systemdSockets returns the sockets systemd passed to this process, if
+// any. Sockets named https or tls with FileDescriptorName=, or listening
+// on the TLS port, serve HTTPS; every other socket serves plain HTTP.
+func systemdSockets(tlsPort int) (activatedSockets, error) {
+	files, err := systemdFiles(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid(), systemdFirstFD)
+	// The sockets are meant for this process only, not its children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return activatedSockets{}, err
+	}
+	return activateSockets(files, tlsPort)
+}
+
+// systemdFiles returns the descriptors described by the LISTEN_* variables,
+// named after LISTEN_FDNAMES. The descriptors belong to another process
+// when LISTEN_PID is not pid, and there are none when it is unset.
+func systemdFiles(listenPID, listenFDs, fdNames string, pid, firstFD int) ([]*os.File, error) {
+	if listenPID == "" || listenPID != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	files := make([]*os.File, 0, count)
+	for i := range count {
+		fd := firstFD + i
+		name := fmt.Sprintf("fd %d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files, nil
+}
+
+// activateSockets turns the files into listeners, closing the files
+func activateSockets(files []*os.File, tlsPort int) (activatedSockets, error) {
+	var sockets activatedSockets
+	for _, file := range files {
+		ln, err := net.FileListener(file)
+		// FileListener works on a duplicate, so the original can go
+		file.Close()
+		if err != nil {
+			return sockets, fmt.Errorf("socket %s from systemd is not a listening socket: %w", file.Name(), err)
+		}
+		if activatedTLS(file.Name(), ln.Addr(), tlsPort) {
+			sockets.tls = append(sockets.tls, ln)
+		} else {
+			sockets.plain = append(sockets.plain, ln)
+		}
+	}
+	return sockets, nil
+}
+
+// activatedTLS reports whether a socket from systemd serves HTTPS: when it
+// is named https or tls, or listens on the TLS port
+func activatedTLS(name string, addr net.Addr, tlsPort int) bool {
+	if name == "https" || name == "tls" {
+		return true
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port == strconv.Itoa(tlsPort)
+}
+
+// empty reports whether systemd passed no sockets
+func (s activatedSockets) empty() bool {
+	return len(s.plain) == 0 && len(s.tls) == 0
+}
@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdFiles(t *testing.T) {
+	pid := os.Getpid()
+	files, err := systemdFiles(strconv.Itoa(pid), "2", "web:https", pid, 1<<20)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected two files, got %v, %v", files, err)
+	}
+	if files[0].Name() != "web" || files[1].Name() != "https" {
+		t.Errorf("Expected the files to be named after LISTEN_FDNAMES, got %s and %s", files[0].Name(), files[1].Name())
+	}
+	files, _ = systemdFiles(strconv.Itoa(pid), "1", "", pid, 1<<20)
+	if len(files) != 1 || files[0].Name() != "fd 1048576" {
+		t.Errorf("Expected an unnamed file to be named after its descriptor, got %v", files)
+	}
+
+	// The sockets belong to another process, or there are none
+	for _, listenPID := range []string{"", strconv.Itoa(pid + 1)} {
+		if files, err := systemdFiles(listenPID, "2", "", pid, 1<<20); err != nil || files != nil {
+			t.Errorf("Expected no files for LISTEN_PID %q, got %v, %v", listenPID, files, err)
+		}
+	}
+	for _, listenFDs := range []string{"", "two", "-1"} {
+		if _, err := systemdFiles(strconv.Itoa(pid), listenFDs, "", pid, 1<<20); err == nil {
+			t.Errorf("Expected LISTEN_FDS %q to be rejected", listenFDs)
+		}
+	}
+}
+
+func TestActivateSockets(t *testing.T) {
+	listenFile := func() (*os.File, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file, ln.Addr().String()
+	}
+	plainFile, plainAddr := listenFile()
+	tlsFile, tlsAddr := listenFile()
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	port, _ := strconv.Atoi(tlsPort)
+
+	sockets, err := activateSockets([]*os.File{plainFile, tlsFile}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets.plain) != 1 || len(sockets.tls) != 1 {
+		t.Fatalf("Expected one plain and one TLS socket, got %+v", sockets)
+	}
+	var upgrades *upgrader
+	ln, err := upgrades.listen("plain", sockets.plain, []string{"127.0.0.1:1"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer sockets.tls[0].Close()
+	conn, err := net.Dial("tcp", plainAddr)
+	if err != nil {
+		t.Fatalf("Expected the activated socket to keep listening, got %s", err)
+	}
+	conn.Close()
+	if _, err := ln.Accept(); err != nil {
+		t.Errorf("Expected a connection on the activated socket, got %s", err)
+	}
+
+	if !activatedTLS("https", sockets.plain[0].Addr(), port) || activatedTLS("http", sockets.plain[0].Addr(), port) {
+		t.Error("Expected sockets named https to serve TLS")
+	}
+	if !(activatedSockets{}).empty() || sockets.empty() {
+		t.Error("Expected empty to report whether systemd passed sockets")
+	}
+}
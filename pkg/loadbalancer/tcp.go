@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Proxy modes
+const (
+	modeHTTP = "http"
+	modeTCP  = "tcp"
+)
+
+// defaultTCPDialTimeout bounds connecting to a TCP backend when no dial timeout is configured
+const defaultTCPDialTimeout = 10 * time.Second
+
+// tcpDialTimeout returns the timeout for connecting to TCP backends
+func (lb *LoadBalancer) tcpDialTimeout() time.Duration {
+	if lb.timeouts.dial > 0 {
+		return lb.timeouts.dial
+	}
+	return defaultTCPDialTimeout
+}
+
+// ServeTCP accepts connections on the listener and proxies each one to the
+// next available backend until the listener is closed
+func (lb *LoadBalancer) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				lb.errorf("Accept error: %s", err)
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		lb.tcpConns.Add(1)
+		go func() {
+			defer lb.tcpConns.Done()
+			lb.handleTCPConn(conn)
+		}()
+	}
+}
+
+// waitTCPConns waits until the proxied connections close or ctx is done
+func (lb *LoadBalancer) waitTCPConns(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		lb.tcpConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleTCPConn forwards bytes between a client connection and a backend
+func (lb *LoadBalancer) handleTCPConn(client net.Conn) {
+	defer client.Close()
+
+	server := lb.NextServer()
+	if server == nil {
+		lb.logf("No available servers for connection from %s", client.RemoteAddr())
+		return
+	}
+	lb.recordRequest(server)
+
+	labels := map[string]string{"backend": server.URL.Host}
+	start := time.Now()
+	backend, err := net.DialTimeout("tcp", server.URL.Host, lb.tcpDialTimeout())
+	if err != nil {
+		lb.observeOutcome(server, 0, err, time.Since(start))
+		lb.metrics().IncCounter("lb_upstream_errors_total", labels)
+		lb.errorf("Failed to connect to %s: %s", server.URL.Host, err)
+		return
+	}
+	defer backend.Close()
+	lb.observeOutcome(server, 0, nil, time.Since(start))
+	lb.logf("Proxying connection from %s to %s", client.RemoteAddr(), server.URL.Host)
+
+	// Copy in both directions, propagating half-closes so protocols that
+	// signal end of input by closing their write side keep working
+	done := make(chan struct{})
+	go func() {
+		copyPooled(backend, client)
+		closeWrite(backend)
+		close(done)
+	}()
+	copyPooled(client, backend)
+	closeWrite(client)
+	<-done
+
+	lb.metrics().IncCounter("lb_connections_total", labels)
+	lb.metrics().ObserveDuration("lb_connection_duration_seconds", time.Since(start), labels)
+}
+
+// closeWrite half-closes a connection when supported
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+}
+
+// checkTCP reports whether a connection to the address can be established
+func checkTCP(network, address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
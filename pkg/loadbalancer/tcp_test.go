@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestServeTCP(t *testing.T) {
+	// Start an echo backend
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start backend: %s", err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server := &Server{URL: &url.URL{Scheme: "tcp", Host: backendLn.Addr().String()}, Alive: true}
+	lb := &LoadBalancer{
+		servers: []*Server{server},
+		current: -1,
+		mode:    modeTCP,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start listener: %s", err)
+	}
+	defer ln.Close()
+	go lb.ServeTCP(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to load balancer: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("PING\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "PING\n" {
+		t.Errorf("Expected echoed PING, got %q (%v)", line, err)
+	}
+
+	// TCP health checks dial the backend
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Errorf("Expected reachable TCP backend to be alive")
+	}
+	backendLn.Close()
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Errorf("Expected closed TCP backend to be down")
+	}
+}
@@ -0,0 +1,147 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// templateVar matches a {name} placeholder in a route template
+var templateVar = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// templateRoute builds the pool and backend path of a request from
+// variables captured from its path, e.g. /{tenant}/api/{rest...} routed to
+// pool {tenant} with path /api/{rest}
+type templateRoute struct {
+	segments []string // Literal segments or {name} captures
+	rest     string   // Name of the trailing {name...} capture, if any
+	pool     string   // Pool name template
+	path     string   // Backend path template, empty to keep the path
+}
+
+// templateMatch is a request matched by a template route
+type templateMatch struct {
+	pool string
+	path string
+}
+
+// parseTemplateRoutes parses /pattern=pool-template[,path-template]
+// definitions. Patterns capture one segment with {name} and the rest of the
+// path with a trailing {name...}; {host} is the request host.
+func parseTemplateRoutes(defs []string, poolNames map[string]bool) ([]templateRoute, error) {
+	var routes []templateRoute
+	for _, def := range defs {
+		pattern, value, ok := strings.Cut(def, "=")
+		pool, path, _ := strings.Cut(value, ",")
+		if !ok || !strings.HasPrefix(pattern, "/") || pool == "" || (path != "" && !strings.HasPrefix(path, "/")) {
+			return nil, fmt.Errorf("invalid template route %q, expected /pattern=pool[,/path]", def)
+		}
+		route := templateRoute{pool: pool, path: path}
+		vars := map[string]bool{"host": true}
+		parts := strings.Split(strings.Trim(pattern, "/"), "/")
+		for i, part := range parts {
+			if name, ok := strings.CutSuffix(strings.TrimPrefix(part, "{"), "...}"); ok && strings.HasPrefix(part, "{") {
+				if i != len(parts)-1 {
+					return nil, fmt.Errorf("invalid template route %q: {%s...} must be the last segment", def, name)
+				}
+				route.rest, vars[name] = name, true
+				continue
+			}
+			if m := templateVar.FindStringSubmatch(part); m != nil {
+				if m[0] != part {
+					return nil, fmt.Errorf("invalid template route %q: %s must capture a whole segment", def, part)
+				}
+				vars[m[1]] = true
+			}
+			route.segments = append(route.segments, part)
+		}
+		for _, m := range templateVar.FindAllStringSubmatch(pool+path, -1) {
+			if !vars[m[1]] {
+				return nil, fmt.Errorf("invalid template route %q: {%s} is not captured", def, m[1])
+			}
+		}
+		if !templateVar.MatchString(pool) && !poolNames[pool] {
+			return nil, fmt.Errorf("invalid template route %q: pool %s is not defined", def, pool)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// match captures the variables of the request path, returning nil when the
+// pattern does not match
+func (route *templateRoute) match(r *http.Request) map[string]string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) < len(route.segments) || (route.rest == "" && len(parts) != len(route.segments)) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	vars := map[string]string{"host": host}
+	for i, segment := range route.segments {
+		if m := templateVar.FindStringSubmatch(segment); m != nil {
+			if parts[i] == "" {
+				return nil
+			}
+			vars[m[1]] = parts[i]
+		} else if parts[i] != segment {
+			return nil
+		}
+	}
+	if route.rest != "" {
+		vars[route.rest] = strings.Join(parts[len(route.segments):], "/")
+	}
+	return vars
+}
+
+// expandTemplate replaces the {name} placeholders of a template
+func expandTemplate(template string, vars map[string]string) string {
+	return templateVar.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return vars[placeholder[1:len(placeholder)-1]]
+	})
+}
+
+// templateMatchFor returns the first template route matching the request
+// whose pool exists, or nil
+func (lb *LoadBalancer) templateMatchFor(r *http.Request) *templateMatch {
+	for i := range lb.templateRoutes {
+		route := &lb.templateRoutes[i]
+		vars := route.match(r)
+		if vars == nil {
+			continue
+		}
+		pool := expandTemplate(route.pool, vars)
+		if lb.pools[pool] == nil {
+			continue
+		}
+		match := &templateMatch{pool: pool}
+		if route.path != "" {
+			match.path = expandTemplate(route.path, vars)
+		}
+		return match
+	}
+	return nil
+}
+
+// templatePool returns the pool a template route builds for the request
+func (lb *LoadBalancer) templatePool(r *http.Request) *Pool {
+	if match := lb.templateMatchFor(r); match != nil {
+		return lb.pools[match.pool]
+	}
+	return nil
+}
+
+// templatePath returns the backend path a template route builds for the
+// request when the server belongs to the route's pool
+func (lb *LoadBalancer) templatePath(r *http.Request, server *Server) (string, bool) {
+	match := lb.templateMatchFor(r)
+	if match == nil || match.path == "" || !slices.Contains(lb.pools[match.pool].servers(), server) {
+		return "", false
+	}
+	return match.path, true
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTemplateRouting(t *testing.T) {
+	echo := func(name string) *Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.RequestURI())
+		}))
+		t.Cleanup(backend.Close)
+		u, _ := url.Parse(backend.URL)
+		return &Server{URL: u, Alive: true}
+	}
+
+	pools := map[string]*Pool{
+		"acme":    newPool("acme", []*Server{echo("acme")}),
+		"globex":  newPool("globex", []*Server{echo("globex")}),
+		"reports": newPool("reports", []*Server{echo("reports")}),
+	}
+	poolNames := map[string]bool{"acme": true, "globex": true, "reports": true}
+	routes, err := parseTemplateRoutes([]string{"/{tenant}/api/{rest...}={tenant},/api/{rest}", "/reports/{id}=reports,/v2/report/{id}"}, poolNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{servers: []*Server{echo("web")}, current: -1, pools: pools, templateRoutes: routes}
+
+	for path, want := range map[string]string{
+		"/acme/api/users?id=1": "acme /api/users?id=1",
+		"/globex/api":          "globex /api/",
+		"/initech/api/users":   "web /initech/api/users",
+		"/acme/web/users":      "web /acme/web/users",
+		"/reports/42":          "reports /v2/report/42",
+		"/reports/42/pdf":      "web /reports/42/pdf",
+	} {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Body.String(); got != want {
+			t.Errorf("GET %s: expected %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestTemplateRouteHost(t *testing.T) {
+	routes, err := parseTemplateRoutes([]string{"/{rest...}={host}"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{pools: map[string]*Pool{"acme.example.com": newPool("acme.example.com", nil)}, templateRoutes: routes}
+	r := httptest.NewRequest("GET", "/anything", nil)
+	r.Host = "acme.example.com:8443"
+	if match := lb.templateMatchFor(r); match == nil || match.pool != "acme.example.com" || match.path != "" {
+		t.Errorf("Expected the host to select the pool and the path to be kept, got %+v", match)
+	}
+}
+
+func TestParseTemplateRoutes(t *testing.T) {
+	pools := map[string]bool{"api": true}
+	for _, def := range []string{
+		"/{tenant}/api",
+		"{tenant}/api={tenant}",
+		"/{tenant}=",
+		"/{tenant}={tenant},api",
+		"/{rest...}/api=api",
+		"/x{tenant}={tenant}",
+		"/{tenant}={region}",
+		"/static=missing",
+	} {
+		if _, err := parseTemplateRoutes([]string{def}, pools); err == nil {
+			t.Errorf("Expected %q to be rejected", def)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTiming records how long each phase of an upstream request took.
+// Only the last attempt is kept when a request is retried.
+type requestTiming struct {
+	mu sync.Mutex
+	timingPhases
+}
+
+// timingPhases holds the timestamps and durations of one attempt
+type timingPhases struct {
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	gotConn      time.Time
+	firstByte    time.Time
+
+	dns      time.Duration
+	connect  time.Duration
+	tls      time.Duration
+	ttfb     time.Duration // From acquiring a connection to the first response byte
+	transfer time.Duration // Copying the response body to the client
+	reused   bool
+}
+
+// withTiming attaches a trace to the context that fills in the timing.
+// Traces compose, so the connection statistics trace still fires. A dial
+// started for the request keeps running when an idle connection frees up
+// first, so its events are ignored once a connection was obtained.
+func (t *requestTiming) withTiming(ctx context.Context) context.Context {
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timingPhases = timingPhases{}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.gotConn.IsZero() {
+				t.dns = time.Since(t.dnsStart)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// Parallel dials report several starts, keep the first
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.gotConn.IsZero() {
+				t.connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.gotConn.IsZero() {
+				t.tls = time.Since(t.tlsStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = time.Now()
+			t.reused = info.Reused
+			if info.Reused {
+				// Phases of a dial that lost to the idle connection
+				t.dns, t.connect, t.tls = 0, 0, 0
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+			t.ttfb = t.firstByte.Sub(t.gotConn)
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// finish records the end of the response body transfer
+func (t *requestTiming) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.firstByte.IsZero() {
+		t.transfer = time.Since(t.firstByte)
+	}
+}
+
+// String formats the phases for logging
+func (t *requestTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("dns=%s connect=%s tls=%s ttfb=%s transfer=%s reused=%v",
+		t.dns, t.connect, t.tls, t.ttfb, t.transfer, t.reused)
+}
+
+// serverTiming formats the phases known once response headers arrive as a
+// Server-Timing header value
+func (t *requestTiming) serverTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.dns},
+		{"connect", t.connect},
+		{"tls", t.tls},
+		{"ttfb", t.ttfb},
+	}
+	var metrics []string
+	for _, phase := range phases {
+		if phase.d > 0 {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phase.name, durationMs(phase.d)))
+		}
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// observeTiming reports the phases as metrics
+func (lb *LoadBalancer) observeTiming(t *requestTiming, server *Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	labels := map[string]string{"backend": server.URL.Host}
+	if t.dns > 0 {
+		lb.metrics().ObserveDuration("lb_upstream_dns_seconds", t.dns, labels)
+	}
+	lb.metrics().ObserveDuration("lb_upstream_ttfb_seconds", t.ttfb, labels)
+	lb.metrics().ObserveDuration("lb_upstream_transfer_seconds", t.transfer, labels)
+}
+
+// addServerTiming sets the Server-Timing header when enabled
+func (lb *LoadBalancer) addServerTiming(w http.ResponseWriter, t *requestTiming) {
+	if !lb.serverTiming {
+		return
+	}
+	if value := t.serverTiming(); value != "" {
+		w.Header().Add("Server-Timing", value)
+	}
+}
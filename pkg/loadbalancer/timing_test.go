@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimingHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	lb := &LoadBalancer{
+		servers:      []*Server{{URL: backendURL, Alive: true}},
+		current:      -1,
+		serverTiming: true,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	header := w.Header().Get("Server-Timing")
+	if !strings.Contains(header, "connect;dur=") || !strings.Contains(header, "ttfb;dur=") {
+		t.Errorf("Expected connect and ttfb phases in Server-Timing, got %q", header)
+	}
+}
+
+func TestRequestTimingReusedConnection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	client := backend.Client()
+	get := func() *requestTiming {
+		timing := &requestTiming{}
+		req, _ := http.NewRequestWithContext(timing.withTiming(context.Background()), "GET", backend.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The connection only returns to the pool once the body is read
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return timing
+	}
+
+	first := get()
+	if first.reused || first.connect <= 0 {
+		t.Errorf("Expected a new connection with connect time, got %s", first)
+	}
+	second := get()
+	if !second.reused || second.connect != 0 {
+		t.Errorf("Expected a reused connection without connect time, got %s", second)
+	}
+}
+
+func TestRequestTimingIgnoresLateDial(t *testing.T) {
+	timing := &requestTiming{}
+	trace := httptrace.ContextClientTrace(timing.withTiming(context.Background()))
+	trace.GetConn("backend:80")
+	trace.ConnectStart("tcp", "192.0.2.1:80")
+	trace.DNSStart(httptrace.DNSStartInfo{Host: "backend"})
+	trace.DNSDone(httptrace.DNSDoneInfo{})
+
+	// An idle connection is handed over before the dial completes
+	trace.GotConn(httptrace.GotConnInfo{Reused: true})
+	trace.ConnectDone("tcp", "192.0.2.1:80", nil)
+	trace.TLSHandshakeStart()
+	trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
+	if timing.dns != 0 || timing.connect != 0 || timing.tls != 0 {
+		t.Errorf("Expected no dial phases on a reused connection, got %s", timing)
+	}
+}
@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Client certificate authentication modes
+const (
+	clientAuthNone    = "none"
+	clientAuthRequest = "request"
+	clientAuthRequire = "require"
+)
+
+// tlsOptions holds the settings for the TLS listener
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	acme         *autocert.Manager
+	clientCAFile string
+	clientAuth   string
+}
+
+// newACMEManager creates an autocert manager that obtains and renews
+// certificates from Let's Encrypt for the given domains
+func newACMEManager(domains []string, cacheDir, email string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
+
+// buildTLSConfig creates the listener TLS configuration, using either the
+// ACME manager or a static certificate, and optionally verifying client
+// certificates against a CA bundle
+func buildTLSConfig(opts tlsOptions) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if opts.acme != nil {
+		tlsConfig = opts.acme.TLSConfig()
+	} else {
+		cert, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	switch opts.clientAuth {
+	case "", clientAuthNone:
+		return tlsConfig, nil
+	case clientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode: %s", opts.clientAuth)
+	}
+
+	if opts.clientCAFile == "" {
+		return nil, fmt.Errorf("client auth mode %q requires a client CA bundle", opts.clientAuth)
+	}
+	pool, err := loadCertPool(opts.clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM encoded CA bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// clientIdentity returns the subject of the verified client certificate,
+// or an empty string when the client did not present one
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// serveTLS serves HTTPS on the listener
+func serveTLS(ln net.Listener, server *http.Server, tlsConfig *tls.Config, logger *log.Logger) {
+	server.TLSConfig = tlsConfig
+	logger.Printf("TLS listener starting on %s", ln.Addr())
+	if err := server.ServeTLS(ln, "", ""); !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal(err)
+	}
+}
+
+// backendTLSOptions holds the settings for TLS connections to https:// backends
+type backendTLSOptions struct {
+	caFile     string
+	serverName string
+	certFile   string
+	keyFile    string
+	insecure   bool
+	resumption bool // Cache sessions so reconnects use abbreviated handshakes
+}
+
+// buildBackendTLSConfig creates the TLS configuration used when dialing backends
+func buildBackendTLSConfig(opts backendTLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.serverName,
+		InsecureSkipVerify: opts.insecure,
+	}
+
+	if opts.caFile != "" {
+		pool, err := loadCertPool(opts.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.certFile != "" || opts.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading backend client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Session resumption skips the full handshake (and certificate
+	// exchange) when reconnecting to a backend. crypto/tls does not offer
+	// 0-RTT early data, so resumption is the fastest reconnect available.
+	if opts.resumption {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(256)
+	}
+
+	return tlsConfig, nil
+}
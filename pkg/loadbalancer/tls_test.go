@@ -0,0 +1,295 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM bundle holding the CA certificate
+}
+
+// newTestCA creates a certificate authority and writes its bundle
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate signed by the CA and its key. Server
+// certificates are valid for the DNS names and 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, client bool, dnsNames ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else if len(dnsNames) == 0 {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// serveTLSTest serves the handler with the TLS configuration and returns
+// its address
+func serveTLSTest(t *testing.T, tlsConfig *tls.Config, handler http.HandlerFunc) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+// tlsGet requests / with the client TLS configuration and returns the body
+func tlsGet(addr string, tlsConfig *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// clientCertificate loads a key pair for a client TLS configuration
+func clientCertificate(t *testing.T, certFile, keyFile string) []tls.Certificate {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []tls.Certificate{cert}
+}
+
+func TestBuildTLSConfigClientAuth(t *testing.T) {
+	ca := newTestCA(t, "Clients CA")
+	serverCert, serverKey := ca.issue(t, pkix.Name{CommonName: "lb"}, false)
+	aliceCert, aliceKey := ca.issue(t, pkix.Name{CommonName: "alice", Organization: []string{"Example"}}, true)
+	stranger := newTestCA(t, "Other CA")
+	malloryCert, malloryKey := stranger.issue(t, pkix.Name{CommonName: "mallory"}, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	identity := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, clientIdentity(r))
+	}
+
+	tests := []struct {
+		mode         string
+		certificates []tls.Certificate
+		want         string
+		fails        bool
+	}{
+		{clientAuthRequire, clientCertificate(t, aliceCert, aliceKey), "CN=alice,O=Example", false},
+		{clientAuthRequire, nil, "", true},
+		{clientAuthRequire, clientCertificate(t, malloryCert, malloryKey), "", true},
+		{clientAuthRequest, nil, "", false},
+		{clientAuthRequest, clientCertificate(t, aliceCert, aliceKey), "CN=alice,O=Example", false},
+		{clientAuthRequest, clientCertificate(t, malloryCert, malloryKey), "", true},
+		{clientAuthNone, clientCertificate(t, aliceCert, aliceKey), "", false},
+	}
+	for _, tt := range tests {
+		tlsConfig, err := buildTLSConfig(tlsOptions{certFile: serverCert, keyFile: serverKey, clientCAFile: ca.file, clientAuth: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := serveTLSTest(t, tlsConfig, identity)
+		clientConfig := &tls.Config{RootCAs: roots}
+		if tt.certificates != nil {
+			// Present the certificate even when the server does not list its
+			// issuer among the acceptable CAs
+			clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tt.certificates[0], nil
+			}
+		}
+		got, err := tlsGet(addr, clientConfig)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s with %d certificates: expected the handshake to fail", tt.mode, len(tt.certificates))
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s with %d certificates: expected identity %q, got %q, %v", tt.mode, len(tt.certificates), tt.want, got, err)
+		}
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	ca := newTestCA(t, "Clients CA")
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "lb"}, false)
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+
+	tests := []tlsOptions{
+		{certFile: certFile, keyFile: keyFile, clientAuth: clientAuthRequire},
+		{certFile: certFile, keyFile: keyFile, clientAuth: "optional", clientCAFile: ca.file},
+		{certFile: certFile, keyFile: keyFile, clientAuth: clientAuthRequire, clientCAFile: notPEM},
+		{certFile: certFile, keyFile: keyFile, clientAuth: clientAuthRequire, clientCAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{certFile: certFile, keyFile: ca.file},
+	}
+	for _, opts := range tests {
+		if _, err := buildTLSConfig(opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+
+	tlsConfig, err := buildTLSConfig(tlsOptions{certFile: certFile, keyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected TLS 1.2 or later without client certificates, got %+v", tlsConfig)
+	}
+}
+
+func TestClientIdentityWithoutTLS(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://lb/", nil)
+	if got := clientIdentity(r); got != "" {
+		t.Errorf("Expected no identity over plain HTTP, got %q", got)
+	}
+	// A certificate that was presented but not verified is no identity
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+	if got := clientIdentity(r); got != "" {
+		t.Errorf("Expected no identity without a verified chain, got %q", got)
+	}
+}
+
+func TestBuildBackendTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "Backends CA")
+	backendCert, backendKey := ca.issue(t, pkix.Name{CommonName: "backend"}, false, "backend.internal")
+	lbCert, lbKey := ca.issue(t, pkix.Name{CommonName: "lb"}, true)
+
+	// The backend only accepts clients with a certificate from the CA
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	backendConfig := &tls.Config{
+		Certificates: clientCertificate(t, backendCert, backendKey),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	addr := serveTLSTest(t, backendConfig, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+
+	tests := []struct {
+		name  string
+		opts  backendTLSOptions
+		fails bool
+	}{
+		{"trusted CA, server name and client certificate", backendTLSOptions{caFile: ca.file, serverName: "backend.internal", certFile: lbCert, keyFile: lbKey}, false},
+		{"system roots", backendTLSOptions{serverName: "backend.internal", certFile: lbCert, keyFile: lbKey}, true},
+		{"name not in the certificate", backendTLSOptions{caFile: ca.file, certFile: lbCert, keyFile: lbKey}, true},
+		{"no client certificate", backendTLSOptions{caFile: ca.file, serverName: "backend.internal"}, true},
+		{"verification disabled", backendTLSOptions{insecure: true, certFile: lbCert, keyFile: lbKey}, false},
+	}
+	for _, tt := range tests {
+		tlsConfig, err := buildBackendTLSConfig(tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got, err := tlsGet(addr, tlsConfig)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: expected the handshake to fail", tt.name)
+			}
+			continue
+		}
+		if err != nil || got != "lb" {
+			t.Errorf("%s: expected the backend to see client lb, got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestBuildBackendTLSConfigOptions(t *testing.T) {
+	ca := newTestCA(t, "Backends CA")
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "lb"}, true)
+
+	tlsConfig, err := buildBackendTLSConfig(backendTLSOptions{caFile: ca.file, serverName: "backend.internal", resumption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ServerName != "backend.internal" || tlsConfig.RootCAs == nil || tlsConfig.ClientSessionCache == nil || tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected the server name, CA pool and session cache to be set, got %+v", tlsConfig)
+	}
+	tlsConfig, err = buildBackendTLSConfig(backendTLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs != nil || tlsConfig.ClientSessionCache != nil || len(tlsConfig.Certificates) != 0 || tlsConfig.InsecureSkipVerify {
+		t.Errorf("Expected system roots, no session cache and no client certificate by default, got %+v", tlsConfig)
+	}
+
+	for _, opts := range []backendTLSOptions{
+		{caFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{certFile: certFile},
+		{keyFile: keyFile},
+		{certFile: certFile, keyFile: ca.file},
+	} {
+		if _, err := buildBackendTLSConfig(opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
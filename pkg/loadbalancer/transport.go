@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// proxyTimeouts bound each phase of a proxied request. Zero disables a timeout.
+type proxyTimeouts struct {
+	dial           time.Duration // Establishing the TCP connection
+	tlsHandshake   time.Duration // Completing the TLS handshake with https:// backends
+	responseHeader time.Duration // Waiting for response headers after the request is sent
+	request        time.Duration // The whole exchange including the response body
+}
+
+// newUpstreamTransport creates the transport used to reach backends
+func newUpstreamTransport(tlsConfig *tls.Config, timeouts proxyTimeouts) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{
+		Timeout:   timeouts.dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = timeouts.tlsHandshake
+	transport.ResponseHeaderTimeout = timeouts.responseHeader
+	return transport
+}
+
+// connPoolSettings tune the idle connections kept to each backend
+type connPoolSettings struct {
+	maxIdlePerHost    int           // Idle connections kept per backend
+	idleTimeout       time.Duration // How long an idle connection is kept, 0 for no limit
+	disableKeepAlives bool          // Use a new connection for every request
+}
+
+// apply configures the transport's connection pool
+func (p connPoolSettings) apply(transport *http.Transport) {
+	transport.MaxIdleConns = p.maxIdlePerHost
+	transport.MaxIdleConnsPerHost = p.maxIdlePerHost
+	transport.IdleConnTimeout = p.idleTimeout
+	transport.DisableKeepAlives = p.disableKeepAlives
+}
+
+// backendTransports gives every backend its own transport, cloned from a
+// template on first use, so each backend has a connection pool of its own
+type backendTransports struct {
+	template *http.Transport
+
+	mu     sync.Mutex
+	byHost map[string]*http.Transport
+}
+
+// newBackendTransports creates per-backend transports cloned from template
+func newBackendTransports(template *http.Transport) *backendTransports {
+	return &backendTransports{template: template, byHost: make(map[string]*http.Transport)}
+}
+
+// forHost returns the transport for a backend, creating it on first use
+func (b *backendTransports) forHost(host string) *http.Transport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	transport, ok := b.byHost[host]
+	if !ok {
+		transport = b.template.Clone()
+		if isUnixSocket(host) {
+			dialUnix(transport, host)
+		}
+		b.byHost[host] = transport
+	}
+	return transport
+}
+
+// RoundTrip sends the request over the backend's own transport
+func (b *backendTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == unixScheme {
+		return b.forHost(req.URL.Host).RoundTrip(unixRequest(req))
+	}
+	return b.forHost(req.URL.Host).RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of every backend
+func (b *backendTransports) CloseIdleConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, transport := range b.byHost {
+		transport.CloseIdleConnections()
+	}
+}
+
+// isTimeout reports whether a proxy error was caused by a timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
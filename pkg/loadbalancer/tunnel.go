@@ -0,0 +1,347 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelScheme is the URL scheme of backends reached over reverse tunnels,
+// e.g. tunnel://edge-1
+const tunnelScheme = "tunnel"
+
+// tunnelHandshakeTimeout bounds the registration of a new tunnel connection
+const tunnelHandshakeTimeout = 10 * time.Second
+
+// tunnelIdleLimit caps the idle connections kept per tunnel name
+const tunnelIdleLimit = 64
+
+// tunnelRegistry holds idle connections opened by backends behind NAT.
+// Each connection carries one proxied HTTP connection.
+type tunnelRegistry struct {
+	token  string
+	errorf func(format string, v ...any) // Logs rejected tunnels
+
+	mu   sync.Mutex
+	idle map[string]chan net.Conn
+}
+
+// newTunnelRegistry creates a registry accepting tunnels with the token
+func newTunnelRegistry(token string, errorf func(format string, v ...any)) *tunnelRegistry {
+	return &tunnelRegistry{token: token, errorf: errorf, idle: make(map[string]chan net.Conn)}
+}
+
+// conns returns the idle connection queue of a tunnel name
+func (t *tunnelRegistry) conns(name string) chan net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch, ok := t.idle[name]
+	if !ok {
+		ch = make(chan net.Conn, tunnelIdleLimit)
+		t.idle[name] = ch
+	}
+	return ch
+}
+
+// Serve accepts tunnel connections from backends
+func (t *tunnelRegistry) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go t.register(conn)
+	}
+}
+
+// Close closes the idle tunnel connections, so that the agents open new
+// ones to whichever process now holds the tunnel listener. Connections
+// carrying requests are left to finish.
+func (t *tunnelRegistry) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.idle {
+		for len(ch) > 0 {
+			select {
+			case conn := <-ch:
+				conn.Close()
+			default:
+			}
+		}
+	}
+}
+
+// register reads the "TUNNEL name token" greeting and queues the
+// connection for use by the proxy. Over TLS with client certificates, the
+// certificate must be issued for the tunnel name.
+func (t *tunnelRegistry) register(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			t.errorf("Rejected tunnel from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	line, err := bufio.NewReader(io.LimitReader(conn, 512)).ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) < 2 || fields[0] != "TUNNEL" {
+		t.errorf("Rejected tunnel from %s: bad greeting", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	name, token := fields[1], ""
+	if len(fields) > 2 {
+		token = fields[2]
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) != 1 {
+		t.errorf("Rejected tunnel %s from %s: bad token", name, conn.RemoteAddr())
+		fmt.Fprint(conn, "DENIED\n")
+		conn.Close()
+		return
+	}
+	if !tunnelCertAllows(conn, name) {
+		t.errorf("Rejected tunnel %s from %s: client certificate not issued for it", name, conn.RemoteAddr())
+		fmt.Fprint(conn, "DENIED\n")
+		conn.Close()
+		return
+	}
+	if _, err := fmt.Fprint(conn, "OK\n"); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	ch := t.conns(name)
+	select {
+	case ch <- conn:
+		return
+	default:
+	}
+	// Make room by dropping connections the agents have closed
+	pruneTunnelConns(ch)
+	select {
+	case ch <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// tunnelCertAllows reports whether the verified client certificate of a
+// tunnel connection, if any, was issued for the tunnel name as its common
+// name or one of its DNS names
+func tunnelCertAllows(conn net.Conn, name string) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return true
+	}
+	cert := chains[0][0]
+	return cert.Subject.CommonName == name || slices.Contains(cert.DNSNames, name)
+}
+
+// tunnelConnOpen reports whether an idle tunnel connection is still open.
+// Agents send nothing until the load balancer does, so anything but a read
+// timeout means the agent closed the connection or broke the protocol.
+func tunnelConnOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// pruneTunnelConns closes the idle connections of a queue that are no
+// longer open, keeping the others
+func pruneTunnelConns(ch chan net.Conn) {
+	for i := len(ch); i > 0; i-- {
+		var conn net.Conn
+		select {
+		case conn = <-ch:
+		default:
+			return
+		}
+		if !tunnelConnOpen(conn) {
+			conn.Close()
+			continue
+		}
+		select {
+		case ch <- conn:
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// dial takes an idle tunnel connection for the backend address, waiting
+// until the context expires for the backend to open one. Connections the
+// agent has closed meanwhile are discarded.
+func (t *tunnelRegistry) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	name, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		name = addr
+	}
+	for {
+		select {
+		case conn := <-t.conns(name):
+			if !tunnelConnOpen(conn) {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no tunnel connection from %s: %w", name, ctx.Err())
+		}
+	}
+}
+
+// tunnelTransport sends requests for tunnel:// backends over the tunnels
+type tunnelTransport struct {
+	transport *http.Transport
+}
+
+// newTunnelTransport creates a transport dialing through the registry with
+// the timeouts of the upstream transport. The dial timeout bounds the wait
+// for an idle tunnel connection.
+func newTunnelTransport(registry *tunnelRegistry, upstream *http.Transport, dialTimeout time.Duration) *tunnelTransport {
+	transport := upstream.Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+		}
+		return registry.dial(ctx, network, addr)
+	}
+	return &tunnelTransport{transport: transport}
+}
+
+// RoundTrip sends the request as plain HTTP over a tunnel connection
+func (t *tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	return t.transport.RoundTrip(out)
+}
+
+// hasTunnelBackends reports whether any backend is reached over a tunnel
+func hasTunnelBackends(servers []*Server) bool {
+	for _, server := range servers {
+		if server.URL.Scheme == tunnelScheme {
+			return true
+		}
+	}
+	return false
+}
+
+// RunTunnelAgent implements "lb tunnel [flags]", run next to a backend that
+// the load balancer cannot dial. It keeps a number of idle connections open
+// to the load balancer's tunnel port and bridges each one to the backend
+// once the load balancer starts using it.
+func RunTunnelAgent(args []string) error {
+	fs := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	server := fs.String("server", "", "Tunnel address of the load balancer as host:port")
+	name := fs.String("name", "", "Tunnel name, matching a tunnel://name backend on the load balancer")
+	target := fs.String("target", "localhost:8080", "Local backend address to forward to")
+	token := fs.String("token", "", "Shared token expected by the load balancer")
+	conns := fs.Int("conns", 4, "Idle connections to keep open")
+	useTLS := fs.Bool("tls", false, "Connect to the load balancer's tunnel port over TLS")
+	caFile := fs.String("ca", "", "CA bundle verifying the tunnel listener's certificate (implies -tls)")
+	serverName := fs.String("server-name", "", "Server name verified in the tunnel listener's certificate (default: the host of -server)")
+	certFile := fs.String("cert", "", "Client certificate presented to the load balancer, issued for the tunnel name (implies -tls)")
+	keyFile := fs.String("key", "", "Private key of the client certificate")
+	fs.Parse(args)
+
+	if *server == "" || *name == "" {
+		return errors.New("tunnel agent requires -server and -name")
+	}
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" {
+		var err error
+		tlsConfig, err = buildBackendTLSConfig(backendTLSOptions{caFile: *caFile, serverName: *serverName, certFile: *certFile, keyFile: *keyFile})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Tunnel %s: forwarding %s to %s with %d connections", *name, *server, *target, *conns)
+	var wg sync.WaitGroup
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := runTunnelConn(*server, *name, *token, *target, tlsConfig); err != nil {
+					log.Printf("Tunnel %s: %s", *name, err)
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// runTunnelConn opens one tunnel connection, over TLS when tlsConfig is
+// set, waits for the load balancer to send a request over it and bridges
+// it to the target until either side closes
+func runTunnelConn(server, name, token, target string, tlsConfig *tls.Config) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: tunnelHandshakeTimeout}
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	if _, err := fmt.Fprintf(conn, "TUNNEL %s %s\n", name, token); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("load balancer refused tunnel: %s", strings.TrimSpace(reply))
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Block until the load balancer uses the connection
+	if _, err := reader.Peek(1); err != nil {
+		return nil
+	}
+
+	backend, err := net.DialTimeout("tcp", target, tunnelHandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	go func() {
+		copyPooled(backend, reader)
+		closeWrite(backend)
+	}()
+	copyPooled(conn, backend)
+	return nil
+}
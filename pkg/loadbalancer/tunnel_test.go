@@ -0,0 +1,250 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "via tunnel %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	registry := newTunnelRegistry("secret", t.Logf)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go registry.Serve(ln)
+
+	// A bad token is refused
+	if err := runTunnelConn(ln.Addr().String(), "edge-1", "wrong", backend.Listener.Addr().String(), nil); err == nil {
+		t.Errorf("Expected tunnel with a bad token to be refused")
+	}
+
+	go runTunnelConn(ln.Addr().String(), "edge-1", "secret", backend.Listener.Addr().String(), nil)
+
+	transport := newUpstreamTransport(nil, proxyTimeouts{})
+	transport.RegisterProtocol(tunnelScheme, newTunnelTransport(registry, transport, 2*time.Second))
+	serverURL, _ := url.Parse("tunnel://edge-1")
+	lb := &LoadBalancer{
+		servers:   []*Server{{URL: serverURL, Alive: true}},
+		current:   -1,
+		transport: transport,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+	body, _ := io.ReadAll(w.Body)
+	if w.Code != http.StatusOK || string(body) != "via tunnel /hello" {
+		t.Errorf("Expected response through the tunnel, got %d %q", w.Code, body)
+	}
+}
+
+func TestTunnelListenerHandover(t *testing.T) {
+	u, err := newUpgrader(time.Second, "", t.Logf, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := u.listen("tunnel", nil, []string{"127.0.0.1:0"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.sockets) != 1 || u.sockets[0].name != "tunnel" {
+		t.Errorf("Expected the tunnel socket to be handed over on upgrade, got %+v", u.sockets)
+	}
+	registry := newTunnelRegistry("secret", t.Logf)
+	served := make(chan error, 1)
+	go func() { served <- registry.Serve(ln) }()
+
+	agent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	fmt.Fprint(agent, "TUNNEL edge-1 secret\n")
+	reader := bufio.NewReader(agent)
+	if line, err := reader.ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("Expected the tunnel to be accepted, got %q, %v", line, err)
+	}
+	for deadline := time.Now().Add(time.Second); len(registry.conns("edge-1")) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Draining stops accepting tunnels and sends the agents elsewhere
+	ln.Close()
+	registry.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected Serve to end with the closed listener, got %v", err)
+	}
+	agent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the idle tunnel connection to be closed, got %v", err)
+	}
+}
+
+func TestTunnelDialTimeout(t *testing.T) {
+	registry := newTunnelRegistry("", t.Logf)
+	transport := newUpstreamTransport(nil, proxyTimeouts{})
+	transport.RegisterProtocol(tunnelScheme, newTunnelTransport(registry, transport, 50*time.Millisecond))
+	serverURL, _ := url.Parse("tunnel://offline")
+	lb := &LoadBalancer{
+		servers:   []*Server{{URL: serverURL, Alive: true}},
+		current:   -1,
+		transport: transport,
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 without an open tunnel, got %d", w.Code)
+	}
+}
+
+// tunnelLB returns a load balancer with a single tunnel backend
+func tunnelLB(registry *tunnelRegistry, name string) *LoadBalancer {
+	transport := newUpstreamTransport(nil, proxyTimeouts{})
+	transport.RegisterProtocol(tunnelScheme, newTunnelTransport(registry, transport, 2*time.Second))
+	serverURL, _ := url.Parse("tunnel://" + name)
+	return &LoadBalancer{
+		servers:   []*Server{{URL: serverURL, Alive: true}},
+		current:   -1,
+		transport: transport,
+	}
+}
+
+// waitIdleTunnels waits until the registry holds n idle connections for
+// the tunnel name
+func waitIdleTunnels(t *testing.T, registry *tunnelRegistry, name string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(registry.conns(name)) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d idle tunnel connections, got %d", n, len(registry.conns(name)))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTunnelClientCertificate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "via tls tunnel")
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t, "Tunnel CA")
+	serverCert, serverKey := ca.issue(t, pkix.Name{CommonName: "lb"}, false)
+	agentCert, agentKey := ca.issue(t, pkix.Name{CommonName: "edge-1"}, true)
+	tlsConfig, err := buildTLSConfig(tlsOptions{certFile: serverCert, keyFile: serverKey, clientCAFile: ca.file, clientAuth: clientAuthRequire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	registry := newTunnelRegistry("", t.Logf)
+	go registry.Serve(ln)
+
+	agentTLS, err := buildBackendTLSConfig(backendTLSOptions{caFile: ca.file, certFile: agentCert, keyFile: agentKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := backend.Listener.Addr().String()
+
+	// The certificate only allows its own tunnel name
+	if err := runTunnelConn(ln.Addr().String(), "edge-2", "", target, agentTLS); err == nil {
+		t.Errorf("Expected a tunnel for another name to be refused")
+	}
+	// Agents without a certificate are refused during the handshake
+	noCert, _ := buildBackendTLSConfig(backendTLSOptions{caFile: ca.file})
+	if err := runTunnelConn(ln.Addr().String(), "edge-1", "", target, noCert); err == nil {
+		t.Errorf("Expected a tunnel without a client certificate to be refused")
+	}
+
+	go runTunnelConn(ln.Addr().String(), "edge-1", "", target, agentTLS)
+	w := httptest.NewRecorder()
+	tunnelLB(registry, "edge-1").ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "via tls tunnel" {
+		t.Errorf("Expected a response through the TLS tunnel, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestTunnelDiscardsClosedConnections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	registry := newTunnelRegistry("secret", t.Logf)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go registry.Serve(ln)
+
+	// An agent registers a connection and goes away
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "TUNNEL edge-1 secret\n")
+	if reply, _ := bufio.NewReader(conn).ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("Expected the tunnel to be accepted, got %q", reply)
+	}
+	waitIdleTunnels(t, registry, "edge-1", 1)
+	conn.Close()
+
+	go runTunnelConn(ln.Addr().String(), "edge-1", "secret", backend.Listener.Addr().String(), nil)
+	waitIdleTunnels(t, registry, "edge-1", 2)
+
+	w := httptest.NewRecorder()
+	tunnelLB(registry, "edge-1").ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("Expected the closed connection to be skipped, got %d %q", w.Code, w.Body.String())
+	}
+	if n := len(registry.conns("edge-1")); n != 0 {
+		t.Errorf("Expected the closed connection to be discarded, %d left", n)
+	}
+}
+
+func TestTunnelPrunesClosedConnectionsWhenFull(t *testing.T) {
+	ch := make(chan net.Conn, 2)
+	open, openPeer := net.Pipe()
+	closed, closedPeer := net.Pipe()
+	defer open.Close()
+	defer openPeer.Close()
+	closedPeer.Close()
+	ch <- closed
+	ch <- open
+
+	pruneTunnelConns(ch)
+	if len(ch) != 1 || <-ch != open {
+		t.Errorf("Expected only the open connection to be kept")
+	}
+}
+
+func TestLintTunnel(t *testing.T) {
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-tunnel-port", "7000"), lintError, "-tunnel-token or -tunnel-client-ca") {
+		t.Error("Expected an error for a tunnel listener without authentication")
+	}
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-tunnel-port", "7000", "-tunnel-token", "secret"), lintWarning, "plain text") {
+		t.Error("Expected a warning for a tunnel token sent without TLS")
+	}
+	if !hasFinding(lintArgs(t, "-server", "http://a", "-tunnel-port", "7000", "-tunnel-client-ca", "ca.pem"), lintError, "requires -tunnel-tls-cert") {
+		t.Error("Expected an error for tunnel client certificates without a TLS listener")
+	}
+}
@@ -0,0 +1,117 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// defaultRoute names the route of the default servers
+const defaultRoute = "default"
+
+// unavailableResponse is a custom body answered when no backend can take a
+// request
+type unavailableResponse struct {
+	body        []byte
+	contentType string
+}
+
+// loadUnavailableResponse reads a custom response body, returning nil when
+// path is empty. The content type follows the file extension.
+func loadUnavailableResponse(path string) (*unavailableResponse, error) {
+	if path == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response file: %w", err)
+	}
+	return &unavailableResponse{body: body, contentType: fileContentType(path, body)}, nil
+}
+
+// fileContentType returns the content type of a response file from its
+// extension, sniffing the body when the extension is unknown
+func fileContentType(path string, body []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(body)
+}
+
+// routeFor returns the pool a request is routed to by its listener, or by
+// upload, SNI, path, device, cutover, canary or blue/green routes, or nil
+// for the default servers
+func (lb *LoadBalancer) routeFor(r *http.Request) *Pool {
+	if pool := lb.listenerPool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.pluginPool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.uploadPool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.sniPool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.pathPool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.templatePool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.devicePool(r); pool != nil {
+		return pool
+	}
+	if pool := lb.cutoverPool(); pool != nil {
+		return pool
+	}
+	if pool := lb.canaryPool(); pool != nil {
+		return pool
+	}
+	return lb.blueGreenPool()
+}
+
+// unavailableBody is the default structured body of an unavailable route
+type unavailableBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Route   string `json:"route,omitempty"`
+}
+
+// writeUnavailable answers a request no backend can take. When only pools
+// are configured and no route matches, it is a 404 route_not_found; a route
+// whose backends are all missing or down gets a 503 no_healthy_upstream. Either body can be
+// replaced with a custom response or an error page.
+func (lb *LoadBalancer) writeUnavailable(w http.ResponseWriter, r *http.Request) {
+	e, custom := errNoHealthyUpstream, lb.noBackendResponse
+	route, message := defaultRoute, "No healthy backend for the route"
+	if pool := lb.routeFor(r); pool != nil {
+		route = pool.name
+	} else if len(lb.servers) == 0 && len(lb.pools) > 0 {
+		e, custom = errRouteNotFound, lb.noRouteResponse
+		route, message = "", "No route matches the request"
+	}
+
+	lb.recordError(e, fmt.Sprintf("%s: %s %s", message, r.Method, r.URL.Path))
+	if route != "" {
+		lb.metrics().IncCounter("lb_route_unavailable_total", map[string]string{"route": route})
+	}
+	w.Header().Set(errorCodeHeader, e.code)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if custom != nil {
+		w.Header().Set("Content-Type", custom.contentType)
+		w.WriteHeader(e.status)
+		w.Write(custom.body)
+		return
+	}
+	if lb.writeErrorPage(w, e, message) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(unavailableBody{Error: e.code, Message: message, Route: route})
+}
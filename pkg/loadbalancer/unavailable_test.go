@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnavailableRoutes(t *testing.T) {
+	mobile := &Server{URL: closedServerURL(t)}
+	lb := &LoadBalancer{
+		pools:        map[string]*Pool{"mobile": newPool("mobile", []*Server{mobile})},
+		deviceRoutes: map[string]string{deviceMobile: "mobile"},
+		current:      -1,
+	}
+
+	// The route matches but its only backend is down
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Sec-CH-UA-Mobile", "?1")
+	lb.ServeHTTP(w, r)
+	var body unavailableBody
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusServiceUnavailable || body.Error != "no_healthy_upstream" || body.Route != "mobile" {
+		t.Errorf("Expected 503 no_healthy_upstream for the mobile route, got %d %+v", w.Code, body)
+	}
+
+	// Without default servers, desktop requests match no route
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body = unavailableBody{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusNotFound || w.Header().Get(errorCodeHeader) != "route_not_found" || body.Route != "" {
+		t.Errorf("Expected 404 route_not_found, got %d %+v", w.Code, body)
+	}
+
+	// With default servers, the default route is matched
+	lb.servers = []*Server{{URL: closedServerURL(t)}}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body = unavailableBody{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusServiceUnavailable || body.Route != defaultRoute {
+		t.Errorf("Expected 503 for the default route, got %d %+v", w.Code, body)
+	}
+}
+
+func TestCustomUnavailableResponse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.html")
+	os.WriteFile(path, []byte("<h1>Back soon</h1>"), 0o644)
+	custom, err := loadUnavailableResponse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{servers: []*Server{{URL: closedServerURL(t)}}, current: -1, noBackendResponse: custom}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("Expected the custom body with 503, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Expected an HTML content type, got %q", got)
+	}
+
+	if custom, err := loadUnavailableResponse(""); custom != nil || err != nil {
+		t.Errorf("Expected no custom response without a file")
+	}
+	if _, err := loadUnavailableResponse(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Errorf("Expected a missing file to be rejected")
+	}
+}
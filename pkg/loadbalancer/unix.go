@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixScheme is the URL scheme of backends listening on a unix domain
+// socket, e.g. unix:///var/run/app.sock
+const unixScheme = "unix"
+
+// unixHostHeader is the Host header sent to socket backends in place of the
+// socket path, unless the request sets a Host of its own
+const unixHostHeader = "localhost"
+
+// normalizeUnixURL moves the socket path of a unix:// URL into its host,
+// so the socket identifies the backend in stats, metrics and flags such as
+// -weight the way host:port does for TCP backends
+func normalizeUnixURL(u *url.URL) error {
+	if u.Scheme != unixScheme {
+		return nil
+	}
+	if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid unix socket backend %s, expected unix:///path/to/socket", u)
+	}
+	u.Host, u.Path = u.Path, ""
+	return nil
+}
+
+// isUnixSocket reports whether a backend host is a socket path
+func isUnixSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+// backendNetwork returns the network a backend is dialed on
+func backendNetwork(u *url.URL) string {
+	if u.Scheme == unixScheme {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// dialUnix makes the transport dial the socket for every connection,
+// keeping the dial timeout and connection tracking of its dialer
+func dialUnix(transport *http.Transport, socket string) {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", socket)
+	}
+}
+
+// unixRequest rewrites a request to a socket backend as plain HTTP for the
+// socket's transport
+func unixRequest(req *http.Request) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	if out.Host == "" || out.Host == req.URL.Host {
+		out.Host = unixHostHeader
+	}
+	return out
+}
+
+// newBackendRequestTo creates a request to a backend URL. The URL is set
+// directly rather than going through its string form, which cannot carry
+// the socket path of unix:// backends.
+func newBackendRequestTo(ctx context.Context, method string, target *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = target
+	req.Host = target.Host
+	return req, nil
+}
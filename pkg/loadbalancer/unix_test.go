@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// unixBackend serves the handler on a socket in a temporary directory
+func unixBackend(t *testing.T, handler http.HandlerFunc) (string, func()) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err)
+	}
+	backend := &http.Server{Handler: handler}
+	go backend.Serve(ln)
+	return socket, func() { backend.Close() }
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	socket, stop := unixBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		io.WriteString(w, r.URL.RequestURI())
+	})
+	defer stop()
+	cfg := &Config{Servers: []string{"unix://" + socket}}
+	urls, err := cfg.parseServerURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls[0].Host != socket || urls[0].Path != "" {
+		t.Fatalf("Expected the socket path as host, got %q %q", urls[0].Host, urls[0].Path)
+	}
+
+	server := &Server{URL: urls[0], Alive: true}
+	healthTransport := newHealthTransport(nil, 0)
+	healthTransport.RegisterProtocol(unixScheme, newBackendTransports(healthTransport))
+	lb := &LoadBalancer{
+		servers:      []*Server{server},
+		current:      -1,
+		transport:    newBackendTransports(newUpstreamTransport(nil, proxyTimeouts{})),
+		healthCheck:  "/healthz",
+		healthClient: &http.Client{Transport: healthTransport},
+	}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/users?page=2", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "/api/users?page=2" {
+		t.Fatalf("Expected the request to reach the socket, got %d %q", w.Code, w.Body.String())
+	}
+	if host := w.Header().Get("X-Host"); host != unixHostHeader {
+		t.Errorf("Expected Host %s in place of the socket path, got %q", unixHostHeader, host)
+	}
+
+	server.SetAlive(false)
+	lb.HealthCheck()
+	if !server.IsAlive() {
+		t.Error("Expected the HTTP health check to reach the socket")
+	}
+	lb.healthType = healthTCP
+	stop()
+	lb.HealthCheck()
+	if server.IsAlive() {
+		t.Error("Expected the TCP health check to fail once the socket is closed")
+	}
+}
+
+func TestUnixRequestHost(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	target := &url.URL{Scheme: unixScheme, Host: "/run/app.sock"}
+	out, err := newBackendRequestTo(req.Context(), "GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unix := unixRequest(out); unix.Host != unixHostHeader || unix.URL.Scheme != "http" || unix.URL.Host != "/run/app.sock" {
+		t.Errorf("Expected a plain HTTP request with Host %s, got %q %s %s", unixHostHeader, unix.Host, unix.URL.Scheme, unix.URL.Host)
+	}
+	for _, raw := range []string{"unix://app.sock", "unix://"} {
+		cfg := &Config{Servers: []string{raw}}
+		if _, err := cfg.parseServerURLs(); err == nil {
+			t.Errorf("Expected %s to be rejected", raw)
+		}
+	}
+}
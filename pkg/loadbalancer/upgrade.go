@@ -0,0 +1,311 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeEnv names the sockets a process hands to its successor, one name
+// per descriptor following the readiness pipe
+const upgradeEnv = "LB_UPGRADE_FDNAMES"
+
+// upgradeReadyFD is the descriptor of the readiness pipe in the new process,
+// followed by the handed over sockets
+const upgradeReadyFD = 3
+
+// upgradeStartTimeout bounds how long the new process may take to start
+// serving before the upgrade is abandoned
+const upgradeStartTimeout = time.Minute
+
+// http3SocketName is the name of the UDP socket of the HTTP/3 listener
+const http3SocketName = "h3"
+
+// namedSocket is a socket the process serves on, handed to its successor
+// under the name so the successor uses it for the same listener
+type namedSocket struct {
+	name string
+	file interface{ File() (*os.File, error) }
+}
+
+// upgrader hands the listening sockets to a new process so the binary can
+// be replaced without refusing connections. The new process serves on the
+// same sockets, and the old one drains its connections once the new one
+// reports it is ready.
+type upgrader struct {
+	timeout time.Duration // How long the old process drains its connections
+	pidFile string
+	logf    func(format string, v ...any)
+	errorf  func(format string, v ...any)
+
+	mu        sync.Mutex
+	inherited map[string][]net.Listener // From the previous process, by name
+	packets   map[string]net.PacketConn
+	sockets   []namedSocket
+	drains    []func(context.Context) error
+	readyPipe *os.File // Tells the previous process this one serves, nil when not upgraded
+	drained   chan struct{}
+}
+
+// newUpgrader takes over the sockets handed over by a previous process, if
+// this process was started by an upgrade
+func newUpgrader(timeout time.Duration, pidFile string, logf, errorf func(format string, v ...any)) (*upgrader, error) {
+	u := &upgrader{
+		timeout:   timeout,
+		pidFile:   pidFile,
+		logf:      logf,
+		errorf:    errorf,
+		inherited: make(map[string][]net.Listener),
+		packets:   make(map[string]net.PacketConn),
+		drained:   make(chan struct{}),
+	}
+	names, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return u, nil
+	}
+	// The sockets are meant for this process only, not its children
+	os.Unsetenv(upgradeEnv)
+	u.readyPipe = os.NewFile(upgradeReadyFD, "upgrade ready pipe")
+	if names == "" {
+		return u, nil
+	}
+	for i, name := range strings.Split(names, ":") {
+		if err := u.inherit(name, os.NewFile(uintptr(upgradeReadyFD+1+i), name)); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// inherit takes over a socket of the previous process, closing the file
+func (u *upgrader) inherit(name string, file *os.File) error {
+	defer file.Close()
+	if name == http3SocketName {
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			return fmt.Errorf("inherited socket %s is not a UDP socket: %w", name, err)
+		}
+		u.packets[name] = conn
+		return nil
+	}
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return fmt.Errorf("inherited socket %s is not a listening socket: %w", name, err)
+	}
+	u.inherited[name] = append(u.inherited[name], ln)
+	return nil
+}
+
+// listen returns a listener for the named socket: the one inherited from
+// the previous process, else the sockets from systemd, else new sockets on
+// the addresses. A nil upgrader always opens new sockets.
+func (u *upgrader) listen(name string, activated []net.Listener, addrs []string, proxyProtocol bool, trusted trustedProxies) (net.Listener, error) {
+	sockets := activated
+	if u != nil {
+		u.mu.Lock()
+		if inherited, ok := u.inherited[name]; ok {
+			sockets = inherited
+			delete(u.inherited, name)
+		}
+		u.mu.Unlock()
+	}
+	if len(sockets) == 0 {
+		var err error
+		if sockets, err = listenAll(addrs); err != nil {
+			return nil, err
+		}
+	}
+	if u != nil {
+		u.mu.Lock()
+		for _, ln := range sockets {
+			if file, ok := ln.(interface{ File() (*os.File, error) }); ok {
+				u.sockets = append(u.sockets, namedSocket{name: name, file: file})
+			}
+		}
+		u.mu.Unlock()
+	}
+	return withProxyProtocol(mergeListeners(sockets), proxyProtocol, trusted), nil
+}
+
+// listenPacket returns the UDP socket of the HTTP/3 listener, inherited from
+// the previous process when there is one
+func (u *upgrader) listenPacket(addr string) (net.PacketConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conn, ok := u.packets[http3SocketName]
+	if ok {
+		delete(u.packets, http3SocketName)
+	} else {
+		var err error
+		if conn, err = net.ListenPacket("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if file, ok := conn.(interface{ File() (*os.File, error) }); ok {
+		u.sockets = append(u.sockets, namedSocket{name: http3SocketName, file: file})
+	}
+	return conn, nil
+}
+
+// drainOnUpgrade registers how a server finishes once a new process has
+// taken over its sockets
+func (u *upgrader) drainOnUpgrade(drain func(context.Context) error) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.drains = append(u.drains, drain)
+}
+
+// ready is called once every listener serves. It writes the PID file, tells
+// the previous process to drain, and closes inherited sockets no listener
+// uses any more.
+func (u *upgrader) ready() {
+	if u == nil {
+		return
+	}
+	if u.pidFile != "" {
+		if err := os.WriteFile(u.pidFile, fmt.Appendf(nil, "%d\n", os.Getpid()), 0o644); err != nil {
+			u.errorf("Error writing PID file: %s", err)
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, listeners := range u.inherited {
+		u.logf("Closing inherited socket %s, which is no longer configured", name)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for _, conn := range u.packets {
+		conn.Close()
+	}
+	clear(u.inherited)
+	clear(u.packets)
+	if u.readyPipe != nil {
+		u.readyPipe.Write([]byte{1})
+		u.readyPipe.Close()
+		u.readyPipe = nil
+	}
+}
+
+// upgrade starts the executable again with the same arguments, handing it
+// the sockets, and waits until it serves
+func (u *upgrader) upgrade() (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	files := []*os.File{readyW}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	u.mu.Lock()
+	names := make([]string, 0, len(u.sockets))
+	for _, socket := range u.sockets {
+		file, err := socket.file.File()
+		if err != nil {
+			u.mu.Unlock()
+			return nil, fmt.Errorf("handing over socket %s: %w", socket.name, err)
+		}
+		files = append(files, file)
+		names = append(names, socket.name)
+	}
+	u.mu.Unlock()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ":"))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go cmd.Wait()
+
+	// The new process writes a byte once it serves; the pipe reaches EOF
+	// without one when it exits first
+	readyR.SetReadDeadline(time.Now().Add(upgradeStartTimeout))
+	files[0].Close()
+	files = files[1:]
+	buf := make([]byte, 1)
+	if n, err := readyR.Read(buf); n == 0 {
+		cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process %d did not start serving within %s", cmd.Process.Pid, upgradeStartTimeout)
+		}
+		return nil, fmt.Errorf("new process %d exited before serving", cmd.Process.Pid)
+	}
+	return cmd.Process, nil
+}
+
+// drain stops the servers from accepting and lets their connections finish
+// within the timeout
+func (u *upgrader) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	u.mu.Lock()
+	drains := u.drains
+	u.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, drain := range drains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := drain(ctx); err != nil {
+				u.errorf("Error draining connections: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(u.drained)
+}
+
+// watch upgrades when the process receives the upgrade signal. Once a new
+// process serves, this one drains and wait returns.
+func (u *upgrader) watch() {
+	signals := make(chan os.Signal, 1)
+	if !notifyUpgrade(signals) {
+		return
+	}
+	go func() {
+		for range signals {
+			u.logf("Upgrading: starting a new process")
+			process, err := u.upgrade()
+			if err != nil {
+				u.errorf("Upgrade failed, still serving: %s", err)
+				continue
+			}
+			u.logf("Process %d took over the sockets, draining connections", process.Pid)
+			u.drain()
+			return
+		}
+	}()
+}
+
+// wait blocks once a server has been shut down by an upgrade, until the
+// connections have drained. Any other error from serving is returned.
+func (u *upgrader) wait(err error) error {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if u != nil {
+		<-u.drained
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package loadbalancer
+
+import "os"
+
+// notifyUpgrade reports that upgrades are not supported, having no signal
+// to ask for one
+func notifyUpgrade(signals chan<- os.Signal) bool {
+	return false
+}
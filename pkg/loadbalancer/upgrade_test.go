@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgraderInheritsSockets(t *testing.T) {
+	// The previous process listens and hands over a copy of its socket
+	previous, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := previous.Addr().String()
+	file, err := previous.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.Close()
+	unused, _ := net.Listen("tcp", "127.0.0.1:0")
+	unusedFile, _ := unused.(*net.TCPListener).File()
+	unused.Close()
+
+	pidFile := filepath.Join(t.TempDir(), "lb.pid")
+	u, err := newUpgrader(time.Second, pidFile, t.Logf, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.inherit("plain", file); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.inherit("admin", unusedFile); err != nil {
+		t.Fatal(err)
+	}
+	readyR, readyW, _ := os.Pipe()
+	defer readyR.Close()
+	u.readyPipe = readyW
+
+	ln, err := u.listen("plain", nil, []string{"127.0.0.1:1"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != addr {
+		t.Errorf("Expected the inherited socket on %s, got %s", addr, ln.Addr())
+	}
+	if len(u.sockets) != 1 || u.sockets[0].name != "plain" {
+		t.Errorf("Expected the socket to be handed over on the next upgrade, got %+v", u.sockets)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected the inherited socket to accept connections, got %s", err)
+	}
+	conn.Close()
+
+	u.ready()
+	buf := make([]byte, 1)
+	if n, _ := readyR.Read(buf); n != 1 {
+		t.Error("Expected the previous process to be told the new one serves")
+	}
+	if pid, _ := os.ReadFile(pidFile); strings.TrimSpace(string(pid)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected the PID file to hold %d, got %q", os.Getpid(), pid)
+	}
+	if len(u.inherited) != 0 {
+		t.Errorf("Expected unused inherited sockets to be closed, got %v", u.inherited)
+	}
+	if err := u.inherit("h3", readyR); err == nil {
+		t.Error("Expected a pipe to be rejected as a UDP socket")
+	}
+}
+
+func TestUpgraderDrain(t *testing.T) {
+	u, err := newUpgrader(time.Second, "", t.Logf, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := u.listen("plain", nil, []string{"127.0.0.1:0"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	u.drainOnUpgrade(server.Shutdown)
+	var drained bool
+	u.drainOnUpgrade(func(context.Context) error {
+		drained = true
+		return nil
+	})
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	u.drain()
+	select {
+	case err := <-served:
+		if err := u.wait(err); err != nil {
+			t.Errorf("Expected a drained server to stop cleanly, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the server to stop once drained")
+	}
+	if !drained {
+		t.Error("Expected every registered server to drain")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade relays SIGUSR2, which asks for an upgrade, to the channel
+func notifyUpgrade(signals chan<- os.Signal) bool {
+	signal.Notify(signals, syscall.SIGUSR2)
+	return true
+}
@@ -0,0 +1,42 @@
+package loadbalancer
+
+import (
+	"mime"
+	"net/http"
+)
+
+// uploadRoute sends large request bodies to a dedicated pool
+type uploadRoute struct {
+	pool         string
+	minSize      int64    // Content-Length at or above which a request is an upload
+	contentTypes []string // Media types that are always uploads, e.g. multipart/form-data
+}
+
+// isUpload reports whether the request body should go to the upload pool.
+// Bodies of unknown length (chunked) are treated as large.
+func (u *uploadRoute) isUpload(r *http.Request) bool {
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	if r.ContentLength < 0 || u.minSize > 0 && r.ContentLength >= u.minSize {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range u.contentTypes {
+		if mediaType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPool returns the upload pool when the request is a large upload
+func (lb *LoadBalancer) uploadPool(r *http.Request) *Pool {
+	if lb.upload == nil || !lb.upload.isUpload(r) {
+		return nil
+	}
+	return lb.pools[lb.upload.pool]
+}
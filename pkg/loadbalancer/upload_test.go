@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsUpload(t *testing.T) {
+	route := &uploadRoute{pool: "uploads", minSize: 1024, contentTypes: []string{"multipart/form-data"}}
+
+	small := httptest.NewRequest("POST", "/api", strings.NewReader("{}"))
+	if route.isUpload(small) {
+		t.Errorf("Expected a small body to stay on the default pool")
+	}
+
+	large := httptest.NewRequest("POST", "/api", strings.NewReader(strings.Repeat("x", 2048)))
+	if !route.isUpload(large) {
+		t.Errorf("Expected a body above the threshold to be an upload")
+	}
+
+	form := httptest.NewRequest("POST", "/upload", strings.NewReader("--b--"))
+	form.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+	if !route.isUpload(form) {
+		t.Errorf("Expected multipart bodies to be uploads regardless of size")
+	}
+
+	chunked := httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+	chunked.ContentLength = -1
+	if !route.isUpload(chunked) {
+		t.Errorf("Expected bodies of unknown length to be uploads")
+	}
+
+	if route.isUpload(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("Expected requests without a body to stay on the default pool")
+	}
+}
+
+func TestUploadPoolRouting(t *testing.T) {
+	api := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	uploads := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:9000"}, Alive: true}
+	lb := &LoadBalancer{
+		servers: []*Server{api},
+		current: -1,
+		pools:   map[string]*Pool{"uploads": newPool("uploads", []*Server{uploads})},
+		upload:  &uploadRoute{pool: "uploads", minSize: 10},
+	}
+
+	if got := lb.nextServerFor(httptest.NewRequest("POST", "/", strings.NewReader("a large upload"))); got != uploads {
+		t.Errorf("Expected the upload pool, got %s", got.URL.Host)
+	}
+	if got := lb.nextServerFor(httptest.NewRequest("POST", "/", strings.NewReader("small"))); got != api {
+		t.Errorf("Expected the default pool, got %s", got.URL.Host)
+	}
+}
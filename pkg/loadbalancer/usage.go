@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// anonymousTenant is used for requests without a tenant header
+const anonymousTenant = "anonymous"
+
+// otherTenant collects the usage of tenants beyond the per-period limit
+const otherTenant = "other"
+
+// usageRecord accumulates the usage of one tenant within a period
+type usageRecord struct {
+	Tenant     string `json:"tenant"`
+	Requests   int64  `json:"requests"`
+	Errors     int64  `json:"errors"`
+	BytesIn    int64  `json:"bytes_in"`
+	BytesOut   int64  `json:"bytes_out"`
+	UpstreamMs int64  `json:"upstream_ms"`
+}
+
+// usagePeriod holds the usage of all tenants for one reporting period
+type usagePeriod struct {
+	Start   time.Time
+	End     time.Time
+	tenants map[string]*usageRecord
+}
+
+// usageSample is the usage of a single proxied request
+type usageSample struct {
+	bytesIn  int64
+	bytesOut int64
+	upstream time.Duration
+	failed   bool
+}
+
+// usageTracker attributes request counts, bytes and upstream time to
+// tenants identified by a request header, rolling over every period
+type usageTracker struct {
+	header     string
+	period     time.Duration
+	retain     int // Number of closed periods kept for reporting
+	maxTenants int // Tenants tracked per period before the rest count as other, 0 for no limit
+
+	mu      sync.Mutex
+	current *usagePeriod
+	history []*usagePeriod
+	now     func() time.Time
+}
+
+// newUsageTracker creates a tracker keyed on the given header. The header
+// is set by clients, so at most maxTenants are tracked per period.
+func newUsageTracker(header string, period time.Duration, retain, maxTenants int) *usageTracker {
+	u := &usageTracker{
+		header:     header,
+		period:     period,
+		retain:     retain,
+		maxTenants: maxTenants,
+		now:        time.Now,
+	}
+	u.current = u.newPeriod(u.now())
+	return u
+}
+
+// newPeriod starts a period aligned to the period length
+func (u *usageTracker) newPeriod(now time.Time) *usagePeriod {
+	start := now.Truncate(u.period)
+	return &usagePeriod{
+		Start:   start,
+		End:     start.Add(u.period),
+		tenants: make(map[string]*usageRecord),
+	}
+}
+
+// rotate closes the current period when it has ended. Must hold u.mu.
+func (u *usageTracker) rotate() {
+	now := u.now()
+	if now.Before(u.current.End) {
+		return
+	}
+	u.history = append(u.history, u.current)
+	if len(u.history) > u.retain {
+		u.history = u.history[len(u.history)-u.retain:]
+	}
+	u.current = u.newPeriod(now)
+}
+
+// record attributes a request's usage to its tenant
+func (u *usageTracker) record(r *http.Request, sample usageSample) {
+	tenant := r.Header.Get(u.header)
+	if tenant == "" {
+		tenant = anonymousTenant
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rotate()
+
+	rec, ok := u.current.tenants[tenant]
+	if !ok && u.maxTenants > 0 && len(u.current.tenants) >= u.maxTenants {
+		tenant = otherTenant
+		rec, ok = u.current.tenants[tenant]
+	}
+	if !ok {
+		rec = &usageRecord{Tenant: tenant}
+		u.current.tenants[tenant] = rec
+	}
+	rec.Requests++
+	if sample.failed {
+		rec.Errors++
+	}
+	rec.BytesIn += sample.bytesIn
+	rec.BytesOut += sample.bytesOut
+	rec.UpstreamMs += sample.upstream.Milliseconds()
+}
+
+// usageReport is a snapshot of one period for reporting
+type usageReport struct {
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Tenants []usageRecord `json:"tenants"`
+}
+
+// reports returns snapshots of the closed periods followed by the current one
+func (u *usageTracker) reports() []usageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rotate()
+
+	periods := append(append([]*usagePeriod(nil), u.history...), u.current)
+	reports := make([]usageReport, 0, len(periods))
+	for _, p := range periods {
+		report := usageReport{Start: p.Start, End: p.End, Tenants: make([]usageRecord, 0, len(p.tenants))}
+		for _, rec := range p.tenants {
+			report.Tenants = append(report.Tenants, *rec)
+		}
+		sort.Slice(report.Tenants, func(i, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// handleUsage serves usage reports as JSON, or CSV with ?format=csv
+func (lb *LoadBalancer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	reports := lb.usage.reports()
+
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	out := csv.NewWriter(w)
+	out.Write([]string{"period_start", "period_end", "tenant", "requests", "errors", "bytes_in", "bytes_out", "upstream_ms"})
+	for _, report := range reports {
+		for _, rec := range report.Tenants {
+			out.Write([]string{
+				report.Start.UTC().Format(time.RFC3339),
+				report.End.UTC().Format(time.RFC3339),
+				rec.Tenant,
+				strconv.FormatInt(rec.Requests, 10),
+				strconv.FormatInt(rec.Errors, 10),
+				strconv.FormatInt(rec.BytesIn, 10),
+				strconv.FormatInt(rec.BytesOut, 10),
+				strconv.FormatInt(rec.UpstreamMs, 10),
+			})
+		}
+	}
+	out.Flush()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
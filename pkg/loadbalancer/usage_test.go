@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageTracker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)
+	u := newUsageTracker("X-API-Key", time.Hour, 2, 0)
+	u.now = func() time.Time { return now }
+	u.current = u.newPeriod(now)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "team-a")
+	u.record(r, usageSample{bytesIn: 10, bytesOut: 100, upstream: 20 * time.Millisecond})
+	u.record(r, usageSample{bytesIn: 5, bytesOut: 50, upstream: 10 * time.Millisecond, failed: true})
+
+	anonymous, _ := http.NewRequest("GET", "/", nil)
+	u.record(anonymous, usageSample{bytesOut: 1})
+
+	// Move into the next period
+	now = now.Add(time.Hour)
+	u.record(r, usageSample{bytesOut: 7})
+
+	reports := u.reports()
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 periods, got %d", len(reports))
+	}
+
+	first := reports[0]
+	if !first.Start.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected period to be aligned to the hour, got %s", first.Start)
+	}
+	if len(first.Tenants) != 2 || first.Tenants[0].Tenant != anonymousTenant {
+		t.Fatalf("Expected anonymous and team-a tenants, got %+v", first.Tenants)
+	}
+	teamA := first.Tenants[1]
+	if teamA.Requests != 2 || teamA.Errors != 1 || teamA.BytesIn != 15 || teamA.BytesOut != 150 || teamA.UpstreamMs != 30 {
+		t.Errorf("Unexpected usage for team-a: %+v", teamA)
+	}
+	if reports[1].Tenants[0].BytesOut != 7 {
+		t.Errorf("Expected the current period to hold the latest request")
+	}
+
+	lb := &LoadBalancer{usage: u}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/lb-admin/usage?format=csv", nil))
+	if !strings.Contains(w.Body.String(), "2024-01-01T10:00:00Z,2024-01-01T11:00:00Z,team-a,2,1,15,150,30") {
+		t.Errorf("Unexpected CSV report:\n%s", w.Body.String())
+	}
+}
+
+func TestUsageTenantLimit(t *testing.T) {
+	u := newUsageTracker("X-API-Key", time.Hour, 2, 2)
+	for _, key := range []string{"a", "b", "c", "d", "a"} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-API-Key", key)
+		u.record(r, usageSample{})
+	}
+	tenants := u.reports()[0].Tenants
+	if len(tenants) != 3 || tenants[0].Tenant != "a" || tenants[0].Requests != 2 || tenants[2].Tenant != otherTenant || tenants[2].Requests != 2 {
+		t.Errorf("Expected a, b and the rest counted as other, got %+v", tenants)
+	}
+}
+
+func TestUsageRecordsRejectedRequests(t *testing.T) {
+	u := newUsageTracker("X-API-Key", time.Hour, 2, 0)
+	backend, _ := url.Parse("http://backend")
+	lb := &LoadBalancer{servers: []*Server{{URL: backend, Alive: false}}, current: -1, usage: u}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "team-a")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without a backend, got %d", w.Code)
+	}
+	tenants := u.reports()[0].Tenants
+	if len(tenants) != 1 || tenants[0].Requests != 1 || tenants[0].Errors != 1 {
+		t.Errorf("Expected the rejected request to count as an error, got %+v", tenants)
+	}
+}
@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weightScale gives ramping weights fractional resolution during selection
+const weightScale = 100
+
+// weightRamp moves a server's weight linearly from one value to another
+type weightRamp struct {
+	from     int
+	to       int
+	start    time.Time
+	duration time.Duration
+}
+
+// at returns the scaled weight at the given time
+func (w *weightRamp) at(now time.Time) int {
+	if w.duration <= 0 || !now.Before(w.start.Add(w.duration)) {
+		return w.to * weightScale
+	}
+	progress := float64(now.Sub(w.start)) / float64(w.duration)
+	return int(math.Round((float64(w.from) + float64(w.to-w.from)*progress) * weightScale))
+}
+
+// selectionWeight returns the scaled effective weight used for selection
+func (s *Server) selectionWeight(now time.Time) int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.weight == nil {
+		return weightScale
+	}
+	return s.weight.at(now)
+}
+
+// Weight returns the server's current effective weight, which lags behind
+// the target weight while a ramp is in progress
+func (s *Server) Weight() float64 {
+	return float64(s.selectionWeight(time.Now())) / weightScale
+}
+
+// TargetWeight returns the weight the server is ramping towards
+func (s *Server) TargetWeight() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.weight == nil {
+		return 1
+	}
+	return s.weight.to
+}
+
+// SetWeight changes the server's weight, moving traffic to the new weight
+// gradually over the ramp duration instead of in one step
+func (s *Server) SetWeight(weight int, ramp time.Duration) {
+	now := time.Now()
+	from := float64(s.selectionWeight(now)) / weightScale
+
+	s.mux.Lock()
+	s.weight = &weightRamp{
+		from:     int(math.Round(from)),
+		to:       weight,
+		start:    now,
+		duration: ramp,
+	}
+	s.mux.Unlock()
+}
+
+// gcd returns the greatest common divisor of two weights
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// parseWeights parses host=weight definitions
+func parseWeights(defs []string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, def := range defs {
+		host, value, ok := strings.Cut(def, "=")
+		weight, err := strconv.Atoi(value)
+		if !ok || host == "" || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q, expected host:port=weight", def)
+		}
+		weights[host] = weight
+	}
+	return weights, nil
+}
+
+// backendStatus describes a backend for the admin API
+type backendStatus struct {
+	URL          string  `json:"url"`
+	Alive        bool    `json:"alive"`
+	Weight       float64 `json:"weight"`
+	TargetWeight int     `json:"target_weight"`
+	Circuit      string  `json:"circuit"`
+	InFlight     int64   `json:"in_flight"`
+}
+
+// handleBackends lists all backends with their health and weights
+func (lb *LoadBalancer) handleBackends(w http.ResponseWriter, r *http.Request) {
+	var backends []backendStatus
+	for _, server := range lb.allServers() {
+		backends = append(backends, backendStatus{
+			URL:          server.URL.String(),
+			Alive:        server.IsAlive(),
+			Weight:       server.Weight(),
+			TargetWeight: server.TargetWeight(),
+			Circuit:      server.CircuitState(),
+			InFlight:     server.inflight.Load(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backends)
+}
+
+// handleSetWeight changes a backend's weight, e.g.
+// POST /lb-admin/backends/localhost:8080/weight?weight=5&ramp=60
+func (lb *LoadBalancer) handleSetWeight(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+	if err != nil || weight < 0 {
+		http.Error(w, "invalid weight value", http.StatusBadRequest)
+		return
+	}
+	ramp := lb.weightRamp
+	if value := r.URL.Query().Get("ramp"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid ramp value", http.StatusBadRequest)
+			return
+		}
+		ramp = time.Duration(seconds) * time.Second
+	}
+
+	found := false
+	for _, server := range lb.allServers() {
+		if server.URL.Host == host {
+			previous := server.TargetWeight()
+			server.SetWeight(weight, ramp)
+			go lb.notifyDrain(server, previous, weight, ramp)
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "unknown backend", http.StatusNotFound)
+		return
+	}
+
+	lb.logf("Weight of %s set to %d over %s", host, weight, ramp)
+	w.WriteHeader(http.StatusNoContent)
+}
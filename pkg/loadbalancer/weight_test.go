@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	heavy := &Server{URL: &url.URL{Scheme: "http", Host: "heavy:80"}, Alive: true}
+	light := &Server{URL: &url.URL{Scheme: "http", Host: "light:80"}, Alive: true}
+	heavy.SetWeight(3, 0)
+
+	pool := newPool("weighted", []*Server{heavy, light})
+	counts := make(map[*Server]int)
+	for i := 0; i < 400; i++ {
+		counts[pool.NextServer()]++
+	}
+	if counts[heavy] != 300 || counts[light] != 100 {
+		t.Errorf("Expected a 3:1 split, got %d:%d", counts[heavy], counts[light])
+	}
+
+	// A weight of zero drains the server
+	light.SetWeight(0, 0)
+	for i := 0; i < 10; i++ {
+		if pool.NextServer() != heavy {
+			t.Fatalf("Expected drained server to receive no traffic")
+		}
+	}
+}
+
+func TestWeightRamp(t *testing.T) {
+	start := time.Now()
+	ramp := &weightRamp{from: 1, to: 5, start: start, duration: 10 * time.Second}
+
+	if w := ramp.at(start); w != 1*weightScale {
+		t.Errorf("Expected ramp to start at weight 1, got %d", w)
+	}
+	if w := ramp.at(start.Add(5 * time.Second)); w != 3*weightScale {
+		t.Errorf("Expected weight 3 half way through the ramp, got %d", w)
+	}
+	if w := ramp.at(start.Add(20 * time.Second)); w != 5*weightScale {
+		t.Errorf("Expected ramp to end at weight 5, got %d", w)
+	}
+
+	server := &Server{URL: &url.URL{Scheme: "http", Host: "localhost:8080"}, Alive: true}
+	server.SetWeight(4, time.Hour)
+	if server.Weight() > 1.01 || server.TargetWeight() != 4 {
+		t.Errorf("Expected weight to ramp from 1 towards 4, got %.2f -> %d", server.Weight(), server.TargetWeight())
+	}
+}